@@ -0,0 +1,196 @@
+package btree
+
+import (
+	"bytes"
+	"slices"
+	"sort"
+)
+
+// Inserts or updates every pair of the batch, the last one wins for a key
+// given more than once. The batch is sorted and every node on the way is
+// rewritten once for all the keys landing in it, instead of once per key.
+// Fails like `Insert`, writing none of the batch.
+func (tree *BTree) PutMany(kvs []KV) (err error) {
+	for _, kv := range kvs {
+		if err := tree.checkKV(kv.Key, kv.Val); err != nil {
+			return err
+		}
+	}
+	if len(kvs) == 0 {
+		return nil
+	}
+
+	// nodes are written as the batch goes, they are freed if it stops at a
+	// damaged page
+	var written []uint64
+	newPage := tree.new
+	tree.new = func(page []byte) uint64 {
+		ptr := newPage(page)
+		written = append(written, ptr)
+		return ptr
+	}
+	defer func() {
+		tree.new = newPage
+		if err != nil {
+			for _, ptr := range written {
+				tree.del(ptr)
+			}
+		}
+	}()
+	defer recoverWrite(&err)
+
+	batch := slices.Clone(kvs)
+	slices.SortStableFunc(batch, func(a, b KV) int { return tree.compare(a.Key, b.Key) })
+
+	// keep the last of every run of equal keys
+	n := 0
+	for i := range batch {
+		if i+1 < len(batch) && tree.compare(batch[i].Key, batch[i+1].Key) == 0 {
+			continue
+		}
+		batch[n] = batch[i]
+		n++
+	}
+	batch = batch[:n]
+
+	// the old pages are freed once every page on the way was read
+	var old []uint64
+	var links []rangeKid
+	if tree.root == 0 {
+		links = putManyLeaf(tree, nil, batch, &old)
+	} else {
+		links = putMany(tree, tree.get(tree.root), batch, &old)
+		old = append(old, tree.root)
+	}
+
+	// add levels until there's a single root
+	for len(links) > 1 {
+		entries := make([]bulkKV, len(links))
+		for i, link := range links {
+			entries[i] = bulkKV{ptr: link.ptr, key: link.key, val: link.count}
+		}
+		links = packNodes(tree, BNODE_NODE, entries)
+	}
+
+	tree.root = links[0].ptr
+	for _, ptr := range old {
+		tree.del(ptr)
+	}
+	return nil
+}
+
+// Copies every pair of `src` into `dst` with a single `PutMany`, so that the
+// nodes of `dst` are rewritten once however many keys land in them. A key in
+// both trees gets the value `onConflict` returns given the one in `dst` and
+// the one in `src`, a nil `onConflict` keeps the one in `src`. Fails like
+// `PutMany`, merging nothing.
+func MergeTrees(dst, src *BTree, onConflict func(key, a, b []byte) []byte) (err error) {
+	defer recoverWrite(&err) // from reading either tree
+
+	var batch []KV
+	for key, val := range src.Scan(nil) {
+		if onConflict != nil {
+			if old, ok := dst.Get(key); ok {
+				val = onConflict(key, old, val)
+			}
+		}
+		batch = append(batch, KV{Key: bytes.Clone(key), Val: val})
+	}
+
+	return dst.PutMany(batch)
+}
+
+// Applies the sorted batch to the subtree, returns the links to the nodes
+// that replace it. The pages replaced below the node are added to `old`.
+func putMany(tree *BTree, node BNode, batch []KV, old *[]uint64) []rangeKid {
+	if node.btype() == BNODE_LEAF {
+		return putManyLeaf(tree, node, batch, old)
+	}
+
+	nkeys := node.nkeys()
+	entries := make([]bulkKV, 0, nkeys)
+
+	for i := uint16(0); i < nkeys; i++ {
+		// the keys for this kid are the ones below the next link
+		n := len(batch)
+		if i+1 < nkeys {
+			next := node.getKey(i + 1)
+			n = sort.Search(len(batch), func(j int) bool { return tree.compare(batch[j].Key, next) >= 0 })
+		}
+		kids := batch[:n]
+		batch = batch[n:]
+
+		ptr, key := node.getPtr(i), bytes.Clone(node.getKey(i))
+		if len(kids) == 0 {
+			entries = append(entries, bulkKV{ptr: ptr, key: key, val: node.getVal(i)})
+			continue
+		}
+
+		links := putMany(tree, tree.get(ptr), kids, old)
+		*old = append(*old, ptr)
+
+		// the old link still works for the first node unless it got a smaller key
+		if tree.compare(key, links[0].key) <= 0 {
+			links[0].key = key
+		}
+		for _, link := range links {
+			entries = append(entries, bulkKV{ptr: link.ptr, key: link.key, val: link.count})
+		}
+	}
+
+	return packNodes(tree, BNODE_NODE, entries)
+}
+
+// Merges the sorted batch into a leaf, which might be nil.
+func putManyLeaf(tree *BTree, node BNode, batch []KV, old *[]uint64) []rangeKid {
+	var nkeys uint16
+	if node != nil {
+		nkeys = node.nkeys()
+	}
+
+	entries := make([]bulkKV, 0, int(nkeys)+len(batch))
+	kept := func(i uint16) bulkKV {
+		return bulkKV{ptr: node.getPtr(i), key: bytes.Clone(node.getKey(i)), val: node.getVal(i)}
+	}
+
+	i := uint16(0)
+	for _, kv := range batch {
+		for ; i < nkeys && tree.compare(node.getKey(i), kv.Key) < 0; i++ {
+			entries = append(entries, kept(i))
+		}
+		if i < nkeys && tree.compare(node.getKey(i), kv.Key) == 0 {
+			*old = append(*old, overflowChain(tree, node.getPtr(i))...) // replaced
+			i++
+		}
+
+		ptr, val := tree.storeVal(kv.Key, kv.Val)
+		entries = append(entries, bulkKV{ptr: ptr, key: kv.Key, val: val})
+	}
+	for ; i < nkeys; i++ {
+		entries = append(entries, kept(i))
+	}
+
+	return packNodes(tree, BNODE_LEAF, entries)
+}
+
+// Writes the entries into as few nodes as they fit, evenly filled, and
+// returns the links to them.
+func packNodes(tree *BTree, btype uint16, entries []bulkKV) []rangeKid {
+	total, largest := 0, 0
+	for _, e := range entries {
+		total += kvSize(e.key, e.val)
+		largest = max(largest, kvSize(e.key, e.val))
+	}
+
+	// aim for the fewest nodes of even size, each one takes its share and up
+	// to one more entry
+	space := int(tree.pageSize) - HEADER
+	n := (total + space - 1) / space
+	lb := newLevelBuilder(tree, btype, HEADER+(total+n-1)/n+largest)
+	for _, e := range entries {
+		lb.add(e.ptr, e.key, e.val)
+	}
+
+	lb.flush()
+	return lb.links
+}
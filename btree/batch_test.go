@@ -0,0 +1,130 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+func TestPutMany(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	want := map[string]string{}
+	rng := rand.New(rand.NewPCG(1, 2))
+
+	tree.PutMany(nil)
+	checkTree(t, tree, mem, want)
+
+	for round := range 20 {
+		// runs of adjacent keys, some repeated in the batch or already there
+		var batch []KV
+		for range 1 + rng.IntN(5) {
+			start, n := rng.IntN(20000), rng.IntN(2000)
+			for i := start; i < start+n; i++ {
+				key := fmt.Sprintf("key%05d", i)
+				val := strings.Repeat(string(rune('a'+round)), rng.IntN(100))
+				if rng.IntN(500) == 0 {
+					val = strings.Repeat("o", 2*BTREE_MAX_VAL_SIZE)
+				}
+				batch = append(batch, KV{[]byte(key), []byte(val)})
+				want[key] = val
+			}
+		}
+
+		tree.PutMany(batch)
+		checkTree(t, tree, mem, want)
+		if err := tree.Verify(); err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+	}
+}
+
+// The nodes on the way are rewritten once per batch instead of once per key.
+func TestPutManyPages(t *testing.T) {
+	var batch []KV
+	for i := range 5000 {
+		batch = append(batch, KV{fmt.Appendf(nil, "key%05d", 2*i), []byte("val")})
+	}
+
+	one, mem1 := newTestTree(t, Config{})
+	many, mem2 := newTestTree(t, Config{})
+	one.PutMany(batch)
+	many.PutMany(batch)
+
+	// the odd keys go in between the even ones
+	for i := range batch {
+		batch[i].Key = fmt.Appendf(nil, "key%05d", 2*i+1)
+	}
+	before1, before2 := mem1.next, mem2.next
+	for _, kv := range batch {
+		one.Insert(kv.Key, kv.Val)
+	}
+	many.PutMany(batch)
+
+	written1, written2 := mem1.next-before1, mem2.next-before2
+	if written2*50 > written1 {
+		t.Fatalf("%d pages written by PutMany, %d by Insert", written2, written1)
+	}
+	if l1, l2 := len(one.LeafPages()), len(many.LeafPages()); l2 > l1 {
+		t.Fatalf("%d leaves after PutMany, %d after Insert", l2, l1)
+	}
+}
+
+func TestMergeTrees(t *testing.T) {
+	dst, mem := newTestTree(t, Config{})
+	src, srcMem := newTestTree(t, Config{})
+	want, srcWant := map[string]string{}, map[string]string{}
+	for i := range 6000 {
+		key := fmt.Sprintf("key%05d", i)
+		if i%2 == 0 {
+			dst.Insert([]byte(key), []byte("dst"))
+			want[key] = "dst"
+		}
+		if i%3 == 0 {
+			src.Insert([]byte(key), []byte("src"))
+			srcWant[key] = "src"
+		}
+	}
+
+	// into an empty tree
+	empty, emptyMem := newTestTree(t, Config{})
+	if err := MergeTrees(empty, src, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, empty, emptyMem, srcWant)
+
+	// the conflicts are resolved by the callback
+	concat := func(key, a, b []byte) []byte {
+		return append(append([]byte(nil), a...), b...)
+	}
+	if err := MergeTrees(dst, src, concat); err != nil {
+		t.Fatal(err)
+	}
+	for key, val := range srcWant {
+		if _, ok := want[key]; ok {
+			val = want[key] + val
+		}
+		want[key] = val
+	}
+	checkTree(t, dst, mem, want)
+	checkTree(t, src, srcMem, srcWant)
+
+	// and the source wins without one
+	if err := MergeTrees(dst, src, nil); err != nil {
+		t.Fatal(err)
+	}
+	for key, val := range srcWant {
+		want[key] = val
+	}
+	checkTree(t, dst, mem, want)
+	if err := dst.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty source changes nothing
+	none, _ := newTestTree(t, Config{})
+	if err := MergeTrees(dst, none, concat); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, dst, mem, want)
+}
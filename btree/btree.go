@@ -3,66 +3,645 @@ package btree
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 )
 
-const HEADER = 4
+const HEADER = 16
 
+// default page size
 const BTREE_PAGE_SIZE = 4096
+
+// A page must fit a KV of the max size and 2 pages must be addressable with
+// the 2B offsets used by the scratch nodes.
+const BTREE_MIN_PAGE_SIZE = 4096
+const BTREE_MAX_PAGE_SIZE = 16384
+
+// most bytes a page can leave to the store, see `Config.Reserved`
+const BTREE_MAX_RESERVED = 64
 const BTREE_MAX_KEY_SIZE = 1000
 const BTREE_MAX_VAL_SIZE = 3000
 
+// largest key with `Config.LongKeys`, on pages of at least
+// `BTREE_MIN_LONG_KEY_PAGE_SIZE`, see `overflows`
+const BTREE_MAX_LONG_KEY_SIZE = BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE - 8
+const BTREE_MIN_LONG_KEY_PAGE_SIZE = 8192
+
 type BTree struct {
 	// root pointer (a nonzero page number)
 	root uint64
 
-	// callbacks for managing on-disk pages
-	get func(uint64) []byte // read data from a page number
-	new func([]byte) uint64 // allocate a new page number with data
-	del func(uint64)        // deallocate a page number
+	// bytes of every page the nodes are laid out in, see `Config.Reserved`
+	pageSize uint16
+
+	// key order
+	compare func(a, b []byte) int
+
+	// every value is empty
+	keysOnly bool
+
+	// largest key, see `Config.LongKeys`
+	maxKey int
+
+	// insertions merge the under-filled kids, see `Config.RepairOnWrite`
+	repairOnWrite bool
+
+	// scratch nodes of 3 pages to build updates in, see `Config.Scratch`
+	scratch  *ScratchPool
+	held     map[*byte]bool // taken by the update running
+	reserved int            // by the update running, 0 for no limit
+
+	// copies sharing the pages, see `Clone`
+	readOnly bool
+	snapID   uint64 // the copy's id, for a read-only tree
+	snaps    *snapshots
+
+	// callbacks for managing on-disk pages, `get` and `new` check and set
+	// the page checksums and `new` compresses the nodes
+	get  func(uint64) []byte // read data from a page number
+	new  func([]byte) uint64 // allocate a new page number with data
+	del  func(uint64)        // deallocate a page number
+	read func(uint64) []byte // `Config.Get`, without checking the checksum
+
+	prefetch func([]uint64) // `Config.Prefetch`, can be nil
+	commit   func() uint64  // `Config.Commit`, can be nil
 }
 
-func treeInsert(tree *BTree, node BNode, key, val []byte) BNode {
+// Configures a new tree.
+type Config struct {
+	// page size in bytes, a power of 2 in [BTREE_MIN_PAGE_SIZE, BTREE_MAX_PAGE_SIZE],
+	// 0 means BTREE_PAGE_SIZE
+	PageSize int
+
+	// bytes at the end of every page left to the store, at most
+	// BTREE_MAX_RESERVED, for a cipher's nonce and tag: the nodes are laid out
+	// in the rest, the pages given to `New` are padded with zeros and the
+	// ones from `Get` are cut
+	Reserved int
+
+	// key order, 0 means the keys are equal, defaults to `bytes.Compare`
+	Compare func(a, b []byte) int
+
+	// makes a set for secondary indexes and membership: every value must be
+	// empty, so that the nodes leave out the value sizes
+	KeysOnly bool
+
+	// allows keys of up to `BTREE_MAX_LONG_KEY_SIZE` rather than
+	// `BTREE_MAX_KEY_SIZE`, with pages of at least
+	// `BTREE_MIN_LONG_KEY_PAGE_SIZE`, see `overflows`
+	LongKeys bool
+
+	// makes the insertions merge the nodes on their path that hold a quarter
+	// of a page or less into a sibling, like the deletions do, to recover from
+	// a tree written without merging, see `Underfilled`
+	RepairOnWrite bool
+
+	// pool of the scratch nodes the updates are built in, which can be shared
+	// by trees to bound the ones they have at once, see `NewScratchPool`. Nil
+	// gives the tree a pool of its own, without a limit.
+	Scratch *ScratchPool
+
+	// root page of an existing tree written with the same config, 0 for an
+	// empty one
+	Root uint64
+
+	// callbacks for managing on-disk pages, reading a damaged page panics with
+	// an error wrapping `ErrCorrupt`, or `ErrVersion` for a page of an unknown
+	// format, unless the method returns errors. The data given to `New` isn't
+	// touched by the tree afterwards, it can be kept without a copy.
+	Get func(uint64) []byte // read data from a page number
+	New func([]byte) uint64 // allocate a new page number with data
+	Del func(uint64)        // deallocate a page number
+
+	// optional hint that the pages are about to be read, by a cursor going
+	// through consecutive leaves, see `READ_AHEAD_LEAVES`
+	Prefetch func([]uint64)
+
+	// optional number of the update being made, stamped into the pages it
+	// writes, never less than the one before, 0 if nil
+	Commit func() uint64
+}
+
+var (
+	ErrPageSize    = errors.New("btree: bad page size")
+	ErrKeyTooLarge = errors.New("btree: key too large")
+	ErrKeysOnly    = errors.New("btree: value in a keys-only tree")
+	ErrVersion     = errors.New("btree: unknown node format version")
+)
+
+// Creates an empty tree.
+func New(cfg Config) (*BTree, error) {
+	if cfg.PageSize == 0 {
+		cfg.PageSize = BTREE_PAGE_SIZE
+	}
+
+	if cfg.Compare == nil {
+		cfg.Compare = bytes.Compare
+	}
+
+	size := cfg.PageSize
+	if size < BTREE_MIN_PAGE_SIZE || size > BTREE_MAX_PAGE_SIZE || size&(size-1) != 0 {
+		return nil, fmt.Errorf("%w: %d is not a power of 2 in [%d, %d]", ErrPageSize, size, BTREE_MIN_PAGE_SIZE, BTREE_MAX_PAGE_SIZE)
+	}
+	if cfg.LongKeys && size < BTREE_MIN_LONG_KEY_PAGE_SIZE {
+		return nil, fmt.Errorf("%w: %d bytes, long keys take at least %d", ErrPageSize, size, BTREE_MIN_LONG_KEY_PAGE_SIZE)
+	}
+	if cfg.Reserved < 0 || cfg.Reserved > BTREE_MAX_RESERVED {
+		return nil, fmt.Errorf("%w: %d bytes reserved, at most %d", ErrPageSize, cfg.Reserved, BTREE_MAX_RESERVED)
+	}
+
+	read := cfg.Get
+	if cfg.Reserved > 0 {
+		read = func(ptr uint64) []byte {
+			page := cfg.Get(ptr)
+			if len(page) == size {
+				page = page[:size-cfg.Reserved]
+			}
+			return page
+		}
+	}
+
+	if cfg.Scratch == nil {
+		cfg.Scratch = NewScratchPool(0)
+	}
+
+	tree := &BTree{
+		scratch:       cfg.Scratch,
+		held:          map[*byte]bool{},
+		root:          cfg.Root,
+		pageSize:      uint16(size - cfg.Reserved),
+		compare:       cfg.Compare,
+		keysOnly:      cfg.KeysOnly,
+		maxKey:        BTREE_MAX_KEY_SIZE,
+		repairOnWrite: cfg.RepairOnWrite,
+		del:           cfg.Del,
+		read:          read,
+		prefetch:      cfg.Prefetch,
+		commit:        cfg.Commit,
+	}
+
+	if cfg.LongKeys {
+		tree.maxKey = BTREE_MAX_LONG_KEY_SIZE
+	}
+
+	tree.get = func(ptr uint64) []byte {
+		page := read(ptr)
+		if err := tree.checkRead(ptr, page); err != nil {
+			panic(err)
+		}
+		return page
+	}
+	tree.new = func(page []byte) uint64 {
+		if t := BNode(page).btype(); t == BNODE_NODE || t == BNODE_LEAF {
+			page = encodeNode(page, tree.pageSize)
+			if BTREE_DEBUG {
+				if err := checkNodeSize(0, page, int(tree.pageSize)); err != nil {
+					panic(fmt.Sprint("btree: writing an untrimmed node: ", err))
+				}
+			}
+		}
+		if tree.commit != nil {
+			BNode(page).setCommit(tree.commit())
+		}
+		BNode(page).setChecksum()
+		if cfg.Reserved > 0 {
+			page = append(page[:len(page):len(page)], make([]byte, cfg.Reserved)...)
+		}
+		return cfg.New(page)
+	}
+
+	return tree, nil
+}
+
+// Returns the bytes of a page the nodes are laid out in, `Config.PageSize`
+// less `Config.Reserved`.
+func (tree *BTree) PageSize() int {
+	return int(tree.pageSize)
+}
+
+// Returns the root page, 0 for an empty tree. Stored along with the pages, it
+// opens the tree again through `Config.Root`.
+func (tree *BTree) Root() uint64 {
+	return tree.root
+}
+
+// Returns the value of a key and whether it was found. Unless it's stored in
+// overflow pages, the value points into the page, it must not be modified and
+// it's only valid until the next update.
+func (tree *BTree) Get(key []byte) ([]byte, bool) {
+	if tree.root == 0 {
+		return nil, false
+	}
+
+	node := BNode(tree.get(tree.root))
+
+	// the root's first key is the smallest in the tree
+	if tree.compare(key, node.getKey(0)) < 0 {
+		return nil, false
+	}
+
+	for node.btype() == BNODE_NODE {
+		node = tree.get(node.getPtr(nodeLookupLE(node, key, tree.compare)))
+	}
+
+	idx := nodeLookupLE(node, key, tree.compare)
+	if tree.compare(key, node.getKey(idx)) != 0 {
+		return nil, false
+	}
+
+	return tree.leafVal(node, idx), true
+}
+
+// Inserts a new key or updates an existing one. Values larger than
+// `BTREE_MAX_VAL_SIZE` are moved out of the leaf into overflow pages. Fails
+// with `ErrReadOnly` for a copy made by `Clone`, with `ErrKeyTooLarge`, with
+// `ErrKeysOnly` for a value in a keys-only tree or, leaving the tree as it
+// was, with an error wrapping `ErrCorrupt` if a page on the way is damaged or
+// `ErrVersion` if it's of an unknown format.
+func (tree *BTree) Insert(key, val []byte) error {
+	return tree.upsert(key, val, nil)
+}
+
+// Sets the key to the value `fn` returns given its current one, in a single
+// descent. `old` is only valid during the call and must not be modified. Fails
+// like `Insert`.
+func (tree *BTree) Merge(key []byte, fn func(old []byte, exists bool) []byte) error {
+	return tree.upsert(key, nil, fn)
+}
+
+// Inserts a new key or updates an existing one, the value is `val` unless
+// `merge` is given.
+func (tree *BTree) upsert(key, val []byte, merge func([]byte, bool) []byte) (err error) {
+	if err := tree.checkKV(key, val); err != nil {
+		return err
+	}
+	defer recoverWrite(&err)
+
+	if merge != nil && tree.keysOnly {
+		fn := merge
+		merge = func(old []byte, exists bool) []byte {
+			val := fn(old, exists)
+			if err := tree.checkKV(key, val); err != nil {
+				panic(err) // nothing was written yet
+			}
+			return val
+		}
+	}
+
+	if tree.root == 0 {
+		if merge != nil {
+			val = merge(nil, false)
+		}
+		ptr, val := tree.storeVal(key, val)
+
+		// create the first node
+		root := BNode(make([]byte, tree.pageSize))
+		root.setHeader(BNODE_LEAF, 1)
+		nodeAppendKV(root, 0, ptr, key, val)
+		tree.root = tree.new(root)
+		return nil
+	}
+
+	if err := tree.reserveScratch(); err != nil {
+		return err
+	}
+	defer tree.releaseScratch()
+
+	update := func() {
+		node := treeInsert(tree, tree.get(tree.root), key, val, merge)
+		tree.del(tree.root)
+		if node.btype() == BNODE_NODE && node.nkeys() == 1 {
+			tree.root = node.getPtr(0) // the last 2 kids were merged, remove a level
+		} else {
+			tree.setRoot(node)
+		}
+		tree.freeScratch(node)
+	}
+	if tree.repairOnWrite {
+		tree.undoable(update) // merging reads the siblings after pages were freed
+	} else {
+		update()
+	}
+	return nil
+}
+
+// Sets the key to `val` only if its current value equals `expected`, or if the
+// key is absent when `expected` is nil. Returns whether it was written, fails
+// like `Insert`.
+func (tree *BTree) PutIf(key, val, expected []byte) (swapped bool, err error) {
+	if err := tree.checkKV(key, val); err != nil {
+		return false, err
+	}
+	defer recoverWrite(&err)
+
+	old, ok := tree.Get(key)
+	if !matches(old, ok, expected) {
+		return false, nil
+	}
+
+	return true, tree.Insert(key, val)
+}
+
+// Fails with `ErrReadOnly` for a copy made by `Clone`, or like `checkSize`.
+func (tree *BTree) checkKV(key, val []byte) error {
+	if tree.readOnly {
+		return ErrReadOnly
+	}
+	return tree.checkSize(key, val)
+}
+
+// Fails with `ErrKeyTooLarge` if the key can't be stored, or with
+// `ErrKeysOnly` if the tree can't store the value.
+func (tree *BTree) checkSize(key, val []byte) error {
+	if len(key) > tree.maxKey {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrKeyTooLarge, len(key), tree.maxKey)
+	}
+	if tree.keysOnly && len(val) > 0 {
+		return fmt.Errorf("%w: %d bytes for %q", ErrKeysOnly, len(val), key)
+	}
+	return nil
+}
+
+// Turns a panic caused by an unreadable page or a merged value the tree can't
+// store back into an error, must be deferred. Both happen before the tree is
+// updated, or in an update `undoable` takes back, so it's left as it was.
+func recoverWrite(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	if e, ok := r.(error); ok && (errors.Is(e, ErrCorrupt) || errors.Is(e, ErrVersion) || errors.Is(e, ErrKeysOnly)) {
+		*err = e
+		return
+	}
+	panic(r)
+}
+
+// Allocates a new root, adding levels while it has to be split.
+func (tree *BTree) setRoot(node BNode) {
+	split := nodeSplit(tree, node)
+	if len(split) > 1 {
+		// the root was split, add a new level
+		root := tree.newScratch()
+		root.setHeader(BNODE_NODE, uint16(len(split)))
+		for i, knode := range split {
+			key := knode.getKey(0)
+			if i > 0 {
+				key = tree.linkKey(split[i-1], knode)
+			}
+			nodeAppendKV(root, uint16(i), tree.new(knode), key, countVal(knode))
+		}
+		tree.setRoot(root)
+		tree.freeScratch(root)
+		tree.freeScratch(split...)
+	} else {
+		tree.root = tree.new(split[0])
+	}
+}
+
+// Removes a key, returns whether it was in the tree. Fails with
+// `ErrReadOnly` for a copy made by `Clone` or, leaving the tree as it was,
+// with an error wrapping `ErrCorrupt` or `ErrVersion` for a damaged page.
+func (tree *BTree) Delete(key []byte) (deleted bool, err error) {
+	if tree.readOnly {
+		return false, ErrReadOnly
+	}
+	if tree.root == 0 {
+		return false, nil
+	}
+	defer recoverWrite(&err)
+	if err := tree.reserveScratch(); err != nil {
+		return false, err
+	}
+	defer tree.releaseScratch()
+
+	tree.undoable(func() {
+		updated := treeDelete(tree, tree.get(tree.root), key)
+		if len(updated) == 0 {
+			return // not found
+		}
+
+		tree.del(tree.root)
+		switch {
+		case updated.nkeys() == 0:
+			tree.root = 0 // the last key is gone
+		case updated.btype() == BNODE_NODE && updated.nkeys() == 1:
+			tree.root = updated.getPtr(0) // remove a level
+		default:
+			tree.setRoot(updated)
+		}
+		tree.freeScratch(updated)
+		deleted = true
+	})
+	return deleted, nil
+}
+
+// Runs an update that reads pages after it freed or allocated others, the
+// siblings it merges with: the pages it frees are only freed once it's done,
+// and if it panics the ones it allocated are freed instead and the root is
+// left as it was.
+func (tree *BTree) undoable(update func()) {
+	root, del, alloc := tree.root, tree.del, tree.new
+	var freed, allocated []uint64
+	tree.del = func(ptr uint64) {
+		freed = append(freed, ptr)
+	}
+	tree.new = func(page []byte) uint64 {
+		ptr := alloc(page)
+		allocated = append(allocated, ptr)
+		return ptr
+	}
+	defer func() {
+		tree.del, tree.new = del, alloc
+		if r := recover(); r != nil {
+			tree.root = root
+			for _, ptr := range allocated {
+				del(ptr)
+			}
+			panic(r)
+		}
+		for _, ptr := range freed {
+			del(ptr)
+		}
+	}()
+
+	update()
+}
+
+// Inserts the key into the subtree, the value is `val` unless `merge` is
+// given. Large values are moved to overflow pages once they reach the leaf.
+func treeInsert(tree *BTree, node BNode, key, val []byte, merge func([]byte, bool) []byte) BNode {
 	// The extra size allows it to exceed 1 page temporarily.
-	newNode := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
+	newNode := tree.newScratch()
 
 	// where to insert the key?
-	idx := nodeLookupLE(node, key) // node.getKey(idx) <= key
+	idx := nodeLookupLE(node, key, tree.compare) // node.getKey(idx) <= key
 
 	switch node.btype() {
 	case BNODE_LEAF:
-		if bytes.Equal(key, node.getKey(idx)) {
-			leafUpdate(newNode, node, idx, key, val) // found, update it
+		cmp := tree.compare(key, node.getKey(idx))
+		if merge != nil {
+			var old []byte
+			if cmp == 0 {
+				old = tree.leafVal(node, idx)
+			}
+			val = merge(old, cmp == 0)
+		}
+
+		if cmp == 0 {
+			tree.freeLeafVal(node, idx) // before anything is written
+		}
+		ptr, val := tree.storeVal(key, val)
+		if cmp == 0 {
+			leafUpdate(newNode, node, idx, ptr, key, val) // found, update it
+		} else if cmp < 0 {
+			leafInsert(newNode, node, idx, ptr, key, val) // smaller than every key
 		} else {
-			leafInsert(newNode, node, idx+1, key, val) // not found, insert
+			leafInsert(newNode, node, idx+1, ptr, key, val) // not found, insert
 		}
 	case BNODE_NODE:
 		// recusive insertion to the kid node
 		kptr := node.getPtr(idx)
-		knode := treeInsert(tree, tree.get(kptr), key, val)
+		knode := treeInsert(tree, tree.get(kptr), key, val, merge)
 
 		// after insertion, split the result
-		nsplit, split := nodeSplit3(knode)
+		split := nodeSplit(tree, knode)
 
 		// deallocate the old kid node
 		tree.del(kptr)
 
-		// update the kid links
-		nodeReplaceKidN(tree, newNode, node, idx, split[:nsplit]...)
+		// update the kid links, which copies the kids out of the scratch nodes
+		if len(split) > 1 || !tree.repairOnWrite || !mergeKid(tree, newNode, node, idx, knode) {
+			nodeReplaceKidN(tree, newNode, node, idx, split...)
+		}
+		if len(split) > 1 {
+			tree.freeScratch(split...)
+		}
+		tree.freeScratch(knode)
 	}
 
 	return newNode
 }
 
+// Returns the page numbers of every leaf in key order, so that a full scan can
+// be split into disjoint runs of leaves and handed out to parallel workers, see
+// `ScanLeaves`.
+func (tree *BTree) LeafPages() []uint64 {
+	if tree.root == 0 {
+		return nil
+	}
+
+	var pages []uint64
+	var walk func(ptr uint64)
+	walk = func(ptr uint64) {
+		node := BNode(tree.get(ptr))
+		if node.btype() == BNODE_LEAF {
+			pages = append(pages, ptr)
+			return
+		}
+
+		for i := uint16(0); i < node.nkeys(); i++ {
+			walk(node.getPtr(i))
+		}
+	}
+
+	walk(tree.root)
+	return pages
+}
+
+// Returns every page of the tree, its nodes and the overflow pages of its
+// values.
+func (tree *BTree) Pages() []uint64 {
+	if tree.root == 0 {
+		return nil
+	}
+
+	var pages []uint64
+	var walk func(ptr uint64)
+	walk = func(ptr uint64) {
+		pages = append(pages, ptr)
+		node := BNode(tree.get(ptr))
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if node.btype() == BNODE_NODE {
+				walk(node.getPtr(i))
+			} else if ptr := node.getPtr(i); ptr != 0 {
+				pages = append(pages, overflowChain(tree, ptr)...)
+			}
+		}
+	}
+
+	walk(tree.root)
+	return pages
+}
+
+// Returns the pages of the tree written by the updates after commit `since`,
+// see `Config.Commit`, its nodes and the overflow pages of its values. Only
+// the nodes on the way to them are read.
+func (tree *BTree) PagesSince(since uint64) []uint64 {
+	if tree.root == 0 {
+		return nil
+	}
+
+	var pages []uint64
+	var walk func(ptr uint64)
+	walk = func(ptr uint64) {
+		node := BNode(tree.get(ptr))
+		if node.commit() <= since {
+			return
+		}
+		pages = append(pages, ptr)
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if node.btype() == BNODE_NODE {
+				walk(node.getPtr(i))
+				continue
+			}
+			// a chain is written at once, with or after its first page
+			if ptr := node.getPtr(i); ptr != 0 && BNode(tree.get(ptr)).commit() > since {
+				pages = append(pages, overflowChain(tree, ptr)...)
+			}
+		}
+	}
+
+	walk(tree.root)
+	return pages
+}
+
 /*
 # Node:
 
-	| type | nkeys |  pointers  |   offsets  | key-values | unused |
-	|  2B  |   2B  | nkeys * 8B | nkeys * 2B |     ...    |        |
+	| type | flags | nkeys | checksum | commit |  pointers  |   offsets  | key-values | unused |
+	|  1B  |   1B  |   2B  |    4B    |   8B   | nkeys * 8B | nkeys * 2B |     ...    |        |
+
+The high 4 bits of the type byte hold the format version of the page. Pages
+are written with `BNODE_VERSION` and only read back if they have it, a page of
+any other version fails with `ErrVersion` rather than being misread. That
+includes the pages of the layouts before the version field, such as the 8B
+header of the flags byte: files written by them are no longer readable, and
+have to be exported with the version that wrote them and imported anew.
+
+The checksum is a CRC32 of the whole page but itself, set when the page is
+allocated and checked every time it's read.
+
+`commit` is the number of the update that wrote the page, from
+`Config.Commit`. Pages are never written over, so a node is as new as any
+page under it: the ones written since a commit are found from the root
+without reading the subtrees of older nodes, see `PagesSince`.
 
 # Key-Value:
 
 	| klen | vlen | key | val |
 	|  2B  |  2B  | ... | ... |
+
+The value of a link in an internal node is the number of keys under the kid,
+as a uvarint.
+
+Nodes without values are written with `BNODE_FLAG_NO_VALS` set and the vlen
+field left out:
+
+	| klen | key |
+	|  2B  | ... |
 */
 type BNode []byte // can be dumped to the disk
 
@@ -71,11 +650,31 @@ const (
 	BNODE_LEAF = 2 // leaf nodes with values
 )
 
+// Format version of the pages written, bumped on every change to the layout.
+const BNODE_VERSION = 2
+
+// Node flags, in the byte after the type. The bits not defined are reserved:
+// pages are written with them clear and `Verify` refuses one that has any set.
+const (
+	BNODE_FLAGS_NONE     = 0
+	BNODE_FLAGS_RESERVED = 0xfc // every bit but `BNODE_FLAG_PREFIX` and `BNODE_FLAG_NO_VALS`
+)
+
 // getters
 
 // Returns the type of node this is, it can either be a `BNODE_NODE` or a `BNODE_LEAF`.
 func (node BNode) btype() uint16 {
-	return binary.LittleEndian.Uint16(node[0:2])
+	return uint16(node[0] & 0x0f)
+}
+
+// Returns the format version of the node.
+func (node BNode) version() uint8 {
+	return node[0] >> 4
+}
+
+// Returns the node flags.
+func (node BNode) flags() uint8 {
+	return node[1]
 }
 
 // Returns the amount of keys this node has or the number of childs it has.
@@ -83,12 +682,79 @@ func (node BNode) nkeys() uint16 {
 	return binary.LittleEndian.Uint16(node[2:4])
 }
 
-// Sets the the node type and amount of keys for this node.
+// Sets the the node type and amount of keys for this node, clearing its flags.
+// The node gets the current format version.
 func (node BNode) setHeader(btype, nkeys uint16) {
-	binary.LittleEndian.PutUint16(node[0:2], btype)
+	node[0] = BNODE_VERSION<<4 | byte(btype)
+	node[1] = BNODE_FLAGS_NONE
 	binary.LittleEndian.PutUint16(node[2:4], nkeys)
 }
 
+// Sets the node flags, must be called after `setHeader`.
+func (node BNode) setFlags(flags uint8) {
+	node[1] = flags
+}
+
+// Returns the checksum stored in the header.
+func (node BNode) checksum() uint32 {
+	return binary.LittleEndian.Uint32(node[4:8])
+}
+
+// Computes the checksum of the node, the header field itself is left out.
+func (node BNode) computeChecksum() uint32 {
+	crc := crc32.ChecksumIEEE(node[:4])
+	return crc32.Update(crc, crc32.IEEETable, node[8:])
+}
+
+// Returns the number of the update that wrote the page.
+func (node BNode) commit() uint64 {
+	return binary.LittleEndian.Uint64(node[8:16])
+}
+
+func (node BNode) setCommit(commit uint64) {
+	binary.LittleEndian.PutUint64(node[8:16], commit)
+}
+
+// Stores the checksum of the node, must be called after it's complete.
+func (node BNode) setChecksum() {
+	binary.LittleEndian.PutUint32(node[4:8], node.computeChecksum())
+}
+
+// Returns a `*ChecksumError` if the checksum of the page doesn't match its
+// contents, or `ErrVersion` if it can't be decoded.
+func checkPage(ptr uint64, page BNode) error {
+	if len(page) < HEADER {
+		return corruptf(ptr, "%d bytes long", len(page))
+	}
+	if sum := page.computeChecksum(); sum != page.checksum() {
+		return &ChecksumError{Page: ptr, Stored: page.checksum(), Computed: sum}
+	}
+	if v := page.version(); v != BNODE_VERSION {
+		return fmt.Errorf("%w: page %d: version %d, expected %d", ErrVersion, ptr, v, BNODE_VERSION)
+	}
+	return nil
+}
+
+// Checks a page as it's read: its checksum and that what its header says fits
+// the page, so that decoding it stays in bounds.
+func (tree *BTree) checkRead(ptr uint64, page BNode) error {
+	if err := checkPage(ptr, page); err != nil {
+		return err
+	}
+
+	switch page.btype() {
+	case BNODE_NODE, BNODE_LEAF:
+		return checkLayout(ptr, page, int(tree.pageSize))
+	case BNODE_OVERFLOW:
+		if len(page) != int(tree.pageSize) || int(page.nkeys()) > len(page)-OVERFLOW_HEADER {
+			return corruptf(ptr, "overflow page holds %dB", page.nkeys())
+		}
+		return nil
+	default:
+		return corruptf(ptr, "bad node type %d", page.btype())
+	}
+}
+
 // Read the nth child pointer.
 func (node BNode) getPtr(idx uint16) uint64 {
 	pos := HEADER + 8*idx
@@ -133,44 +799,74 @@ func (node BNode) setOffset(idx, val uint16) {
 // Returns the position of the nth KV pair relative to the whole node.
 func (node BNode) kvPos(idx uint16) uint16 {
 	keys := node.nkeys()
-	return HEADER + 8*keys + 2*keys + node.getOffset(idx)
+	return HEADER + 8*keys + 2*keys + node.prefixSize() + node.getOffset(idx)
 }
 
-// Returns the nth key.
+// Returns the nth key. Unless the node has a prefix, it points into the node.
 func (node BNode) getKey(idx uint16) []byte {
+	suffix := node.getSuffix(idx)
+	if node.flags()&BNODE_FLAG_PREFIX == 0 {
+		return suffix
+	}
+
+	prefix := node.prefix()
+	return append(prefix[:len(prefix):len(prefix)], suffix...)
+}
+
+// Appends the nth key to `dst`.
+func (node BNode) appendKey(dst []byte, idx uint16) []byte {
+	return append(append(dst, node.prefix()...), node.getSuffix(idx)...)
+}
+
+// Returns the nth key as it's stored, without the prefix of the node.
+func (node BNode) getSuffix(idx uint16) []byte {
 	pos := node.kvPos(idx)
 	klen := binary.LittleEndian.Uint16(node[pos:])
-	return node[pos+4:][:klen]
+	return node[pos+node.kvHeaderSize():][:klen]
 }
 
 func (node BNode) getVal(idx uint16) []byte {
 	pos := node.kvPos(idx)
 	klen := binary.LittleEndian.Uint16(node[pos:])
+	if node.flags()&BNODE_FLAG_NO_VALS != 0 {
+		return node[pos+2+klen:][:0]
+	}
+
 	vlen := binary.LittleEndian.Uint16(node[pos+2:])
 	return node[pos+4+klen:][:vlen]
 }
 
+// Bytes taken by the sizes in front of every KV.
+func (node BNode) kvHeaderSize() uint16 {
+	if node.flags()&BNODE_FLAG_NO_VALS != 0 {
+		return 2
+	}
+	return 4
+}
+
 // node size in bytes
 func (node BNode) nbytes() uint16 {
 	return node.kvPos(node.nkeys())
 }
 
-// find the last position that is less than or equal to the key.
-func nodeLookupLE(node BNode, key []byte) uint16 {
-	nkeys := node.nkeys()
-	var i uint16
-
-	for i = uint16(1); i < nkeys; i++ {
-		cmp := bytes.Compare(node.getKey(i), key)
-		if cmp <= 0 {
-			return i
-		}
-		if cmp >= 0 {
-			return i - 1
+// find the last position that is less than or equal to the key, if every key
+// is greater than it, the first position is returned.
+func nodeLookupLE(node BNode, key []byte, compare func(a, b []byte) int) uint16 {
+	// binary search for the first key greater than `key`, the first key is
+	// never checked since it's the answer either way
+	lo, hi := uint16(1), node.nkeys()
+	var buf []byte // the keys are decompressed into it
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		buf = node.appendKey(buf[:0], mid)
+		if compare(buf, key) <= 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
 		}
 	}
 
-	return i - 1
+	return lo - 1
 }
 
 func nodeAppendKV(node BNode, idx uint16, ptr uint64, key, val []byte) {
@@ -193,54 +889,85 @@ func nodeAppendKV(node BNode, idx uint16, ptr uint64, key, val []byte) {
 }
 
 func nodeAppendRange(newNode, oldNode BNode, dstNew, srcOld, n uint16) {
+	var key []byte // the keys are decompressed into it
 	for i := uint16(0); i < n; i++ {
 		dst, src := dstNew+i, srcOld+i
-		nodeAppendKV(newNode, dst, oldNode.getPtr(src), oldNode.getKey(src), oldNode.getVal(src))
+		key = oldNode.appendKey(key[:0], src)
+		nodeAppendKV(newNode, dst, oldNode.getPtr(src), key, oldNode.getVal(src))
 	}
 }
 
-func leafInsert(newNode, oldNode BNode, idx uint16, key, val []byte) {
+func leafInsert(newNode, oldNode BNode, idx uint16, ptr uint64, key, val []byte) {
 	newNode.setHeader(BNODE_LEAF, oldNode.nkeys()+1)
 	nodeAppendRange(newNode, oldNode, 0, 0, idx)                       // copy the keys before `idx`
-	nodeAppendKV(newNode, idx, 0, key, val)                            // the new key
+	nodeAppendKV(newNode, idx, ptr, key, val)                          // the new key
 	nodeAppendRange(newNode, oldNode, idx+1, idx, oldNode.nkeys()-idx) // keys from `idx`
 }
 
-func leafUpdate(newNode, oldNode BNode, idx uint16, key, val []byte) {
+func leafUpdate(newNode, oldNode BNode, idx uint16, ptr uint64, key, val []byte) {
 	newNode.setHeader(BNODE_LEAF, oldNode.nkeys())
 	nodeAppendRange(newNode, oldNode, 0, 0, idx)
-	nodeAppendKV(newNode, idx, 0, key, val)
+	nodeAppendKV(newNode, idx, ptr, key, val)
 	nodeAppendRange(newNode, oldNode, idx+1, idx+1, oldNode.nkeys()-(idx+1))
 }
 
-// Split an oversized node into 2 nodes. The 2nd node always fits.
-func nodeSplit2(left, right, old BNode) {
-	// the initial guess
-	nleft := old.nkeys() / 2
+// Splits an oversized node into pieces that fit a page each, returns the
+// node itself if it already fits. The pieces are uncompressed scratch nodes.
+func nodeSplit(tree *BTree, old BNode) []BNode {
+	var split []BNode
+	for _, r := range splitRange(old, 0, old.nkeys(), tree.pageSize) {
+		start, end := r[0], r[1]
+		if start == 0 && end == old.nkeys() {
+			return []BNode{old}
+		}
 
-	// try to fit the left half
-	left_bytes := func() uint16 {
-		return HEADER + 8*nleft + 2*nleft + old.getOffset(nleft)
+		node := tree.newScratch()
+		node.setHeader(old.btype(), end-start)
+		nodeAppendRange(node, old, 0, start, end-start)
+		split = append(split, node)
 	}
-	for left_bytes() > BTREE_PAGE_SIZE {
-		nleft--
+	return split
+}
+
+// Splits the KVs in [start, end) into ranges that fit a page.
+func splitRange(old BNode, start, end, pageSize uint16) [][2]uint16 {
+	if rangeFits(old, start, end, pageSize) {
+		return [][2]uint16{{start, end}}
 	}
 
-	// try to fit the right half
-	right_bytes := func() uint16 {
-		return old.nbytes() - left_bytes() + HEADER
+	// the initial guess
+	mid := start + (end-start)/2
+
+	// try to fit the left half
+	for mid > start+1 && !rangeFits(old, start, mid, pageSize) {
+		mid--
 	}
-	for right_bytes() > BTREE_PAGE_SIZE {
-		nleft++
+
+	// the right half always fits in the end, a single KV does
+	for !rangeFits(old, mid, end, pageSize) {
+		mid++
 	}
 
-	nright := old.nkeys() - nleft
+	return append(splitRange(old, start, mid, pageSize), [2]uint16{mid, end})
+}
+
+// Returns the key that links `right` in its parent, `left` being its left
+// sibling. Leaves are linked by the shortest prefix of their first key that
+// sorts after every key of their sibling, internal nodes by their first link,
+// which already separates them.
+func (tree *BTree) linkKey(left, right BNode) []byte {
+	first := right.getKey(0)
+	if right.btype() == BNODE_NODE {
+		return first
+	}
 
-	// new nodes
-	left.setHeader(old.btype(), nleft)
-	right.setHeader(old.btype(), nright)
-	nodeAppendRange(left, old, 0, 0, nleft)
-	nodeAppendRange(right, old, 0, nleft, nright)
+	last := left.getKey(left.nkeys() - 1)
+	for n := commonPrefix(last, first) + 1; n < len(first); n++ {
+		if tree.compare(last, first[:n]) < 0 && tree.compare(first[:n], first) <= 0 {
+			return first[:n]
+		}
+	}
+	return first
 }
 
 // replace a link with multiple links
@@ -249,31 +976,137 @@ func nodeReplaceKidN(tree *BTree, newNode, oldNode BNode, idx uint16, kids ...BN
 	newNode.setHeader(BNODE_NODE, oldNode.nkeys()+inc-1)
 	nodeAppendRange(newNode, oldNode, 0, 0, idx)
 
+	// the old link still works for the first kid unless it got a smaller key
+	key := oldNode.getKey(idx)
 	for i, node := range kids {
-		nodeAppendKV(newNode, idx+uint16(i), tree.new(node), node.getKey(0), nil)
+		if i > 0 {
+			key = tree.linkKey(kids[i-1], node)
+		} else if tree.compare(key, node.getKey(0)) > 0 {
+			key = node.getKey(0)
+		}
+		nodeAppendKV(newNode, idx+uint16(i), tree.new(node), key, countVal(node))
 	}
 
 	nodeAppendRange(newNode, oldNode, idx+inc, idx+1, oldNode.nkeys()-(idx+1))
 }
 
-// Split a node if it's too big. The results are 1~3 nodes.
-func nodeSplit3(old BNode) (uint16, [3]BNode) {
-	if old.nbytes() <= BTREE_PAGE_SIZE {
-		old = old[:BTREE_PAGE_SIZE]
-		return 1, [3]BNode{old} // not split
+// deletion
+
+// Removes a key from the subtree, returns an empty node if it wasn't found.
+// Like insertion, the result can exceed 1 page when a separator key is replaced
+// by a longer one, so it might have to be split by the caller.
+func treeDelete(tree *BTree, node BNode, key []byte) BNode {
+	// where to find the key?
+	idx := nodeLookupLE(node, key, tree.compare)
+
+	switch node.btype() {
+	case BNODE_LEAF:
+		if tree.compare(key, node.getKey(idx)) != 0 {
+			return BNode{} // not found
+		}
+
+		tree.freeLeafVal(node, idx)
+		newNode := tree.newScratch()
+		leafDelete(newNode, node, idx)
+		return newNode
+	case BNODE_NODE:
+		return nodeDelete(tree, node, idx, key)
+	default:
+		panic("bad node!")
+	}
+}
+
+// Deletes the key from the `idx` kid and merges it with a sibling if it got too small.
+func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
+	// recurse into the kid
+	kptr := node.getPtr(idx)
+	updated := treeDelete(tree, tree.get(kptr), key)
+	if len(updated) == 0 {
+		return BNode{} // not found
+	}
+	tree.del(kptr)
+
+	// The extra size allows it to exceed 1 page temporarily.
+	newNode := tree.newScratch()
+
+	// check for merging
+	switch {
+	case mergeKid(tree, newNode, node, idx, updated):
+	case updated.nkeys() == 0:
+		// the only kid is empty and has no sibling, the parent becomes empty too
+		newNode.setHeader(BNODE_NODE, 0)
+	default:
+		split := nodeSplit(tree, updated)
+		nodeReplaceKidN(tree, newNode, node, idx, split...)
+		if len(split) > 1 {
+			tree.freeScratch(split...)
+		}
+	}
+	tree.freeScratch(updated)
+
+	return newNode
+}
+
+// Decides whether the updated kid should be merged with its left (-1) or
+// right (+1) sibling and returns the merged node, returns 0 if it's big
+// enough or nothing fits.
+func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode) {
+	if size, _, _ := nodeSizeRange(updated, 0, updated.nkeys()); size > int(tree.pageSize)/4 {
+		return 0, BNode{}
 	}
 
-	left := BNode(make([]byte, 2*BTREE_PAGE_SIZE)) // might be split later
-	right := BNode(make([]byte, BTREE_PAGE_SIZE))
-	nodeSplit2(left, right, old)
+	if idx > 0 {
+		sibling := BNode(tree.get(node.getPtr(idx - 1)))
+		if merged, ok := tryMerge(tree, sibling, updated); ok {
+			return -1, merged
+		}
+	}
+
+	if idx+1 < node.nkeys() {
+		sibling := BNode(tree.get(node.getPtr(idx + 1)))
+		if merged, ok := tryMerge(tree, updated, sibling); ok {
+			return +1, merged
+		}
+	}
+
+	return 0, BNode{}
+}
+
+// Concatenates 2 sibling nodes into a scratch node if the result fits a page,
+// which the caller gives back.
+func tryMerge(tree *BTree, left, right BNode) (BNode, bool) {
+	raw := left.rawBytes() + right.rawBytes() - HEADER
+	if raw > 2*int(tree.pageSize) {
+		return BNode{}, false
+	}
 
-	if left.nbytes() <= BTREE_PAGE_SIZE {
-		left = left[:BTREE_PAGE_SIZE]
-		return 2, [3]BNode{left, right} // 2 nodes
+	merged := tree.newScratch()
+	nodeMerge(merged, left, right)
+	if !nodeFits(merged, tree.pageSize) {
+		tree.freeScratch(merged)
+		return BNode{}, false
 	}
+	return merged, true
+}
+
+// Removes the nth key from a leaf.
+func leafDelete(newNode, oldNode BNode, idx uint16) {
+	newNode.setHeader(BNODE_LEAF, oldNode.nkeys()-1)
+	nodeAppendRange(newNode, oldNode, 0, 0, idx)
+	nodeAppendRange(newNode, oldNode, idx, idx+1, oldNode.nkeys()-(idx+1))
+}
+
+// Concatenates 2 sibling nodes into one.
+func nodeMerge(newNode, left, right BNode) {
+	newNode.setHeader(left.btype(), left.nkeys()+right.nkeys())
+	nodeAppendRange(newNode, left, 0, 0, left.nkeys())
+	nodeAppendRange(newNode, right, left.nkeys(), 0, right.nkeys())
+}
 
-	leftleft := BNode(make([]byte, BTREE_PAGE_SIZE))
-	middle := BNode(make([]byte, BTREE_PAGE_SIZE))
-	nodeSplit2(leftleft, middle, left)
-	return 3, [3]BNode{leftleft, middle, right} // 3 nodes
+// Replaces the 2 adjacent links at `idx` and `idx+1` with a single one.
+func nodeReplace2Kid(newNode, oldNode BNode, idx uint16, ptr uint64, key, count []byte) {
+	newNode.setHeader(BNODE_NODE, oldNode.nkeys()-1)
+	nodeAppendRange(newNode, oldNode, 0, 0, idx)
+	nodeAppendKV(newNode, idx, ptr, key, count)
+	nodeAppendRange(newNode, oldNode, idx+1, idx+2, oldNode.nkeys()-(idx+2))
 }
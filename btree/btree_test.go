@@ -0,0 +1,1207 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Pages of a test tree, kept in memory. Copies of the tree can read them
+// while it's updated.
+type memPages struct {
+	mu    sync.RWMutex
+	pages map[uint64][]byte
+	next  uint64
+}
+
+// Returns `cfg` with its pages kept in `mem`.
+func (mem *memPages) config(cfg Config) Config {
+	cfg.Get = func(ptr uint64) []byte {
+		mem.mu.RLock()
+		defer mem.mu.RUnlock()
+		page, ok := mem.pages[ptr]
+		if !ok {
+			panic(fmt.Sprintf("read of page %d, which isn't allocated", ptr))
+		}
+		return page
+	}
+	cfg.New = func(page []byte) uint64 {
+		mem.mu.Lock()
+		defer mem.mu.Unlock()
+		ptr := mem.next
+		mem.next++
+		mem.pages[ptr] = bytes.Clone(page)
+		return ptr
+	}
+	cfg.Del = func(ptr uint64) {
+		mem.mu.Lock()
+		defer mem.mu.Unlock()
+		if _, ok := mem.pages[ptr]; !ok {
+			panic(fmt.Sprintf("page %d freed twice", ptr))
+		}
+		delete(mem.pages, ptr)
+	}
+	return cfg
+}
+
+// Returns an empty tree on pages in memory, `cfg` gives the rest of the
+// config.
+func newTestTree(t testing.TB, cfg Config) (*BTree, *memPages) {
+	t.Helper()
+	mem := &memPages{pages: map[uint64][]byte{}, next: 1}
+	tree, err := New(mem.config(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree, mem
+}
+
+// Adds a level of nodes of type `btype` to the tree, `fanout` of the entries
+// in each one, and returns the entries of the new level.
+func buildLevel(tree *BTree, btype uint16, kvs [][2][]byte, ptrs []uint64, fanout int) ([][2][]byte, []uint64) {
+	var upKVs [][2][]byte
+	var upPtrs []uint64
+	for len(kvs) > 0 {
+		n := min(fanout, len(kvs))
+		node := BNode(make([]byte, BTREE_PAGE_SIZE))
+		node.setHeader(btype, uint16(n))
+		for i := range n {
+			var ptr uint64
+			if ptrs != nil {
+				ptr = ptrs[i]
+			}
+			nodeAppendKV(node, uint16(i), ptr, kvs[i][0], kvs[i][1])
+		}
+		upKVs = append(upKVs, [2][]byte{kvs[0][0], countVal(node)})
+		upPtrs = append(upPtrs, tree.new(node))
+		kvs = kvs[n:]
+		if ptrs != nil {
+			ptrs = ptrs[n:]
+		}
+	}
+	return upKVs, upPtrs
+}
+
+// Makes `tree` a tree of 3 levels holding the sorted pairs `kvs`, built by
+// hand.
+func buildTree(tree *BTree, kvs [][2][]byte) {
+	kvs, ptrs := buildLevel(tree, BNODE_LEAF, kvs, nil, 50)
+	kvs, ptrs = buildLevel(tree, BNODE_NODE, kvs, ptrs, 10)
+	_, ptrs = buildLevel(tree, BNODE_NODE, kvs, ptrs, len(kvs))
+	tree.root = ptrs[0]
+}
+
+// The fields of the 16B header are where the layout puts them, the flags
+// don't leak into the type or the version, and a page of the layout before
+// versions is refused rather than misread.
+func TestNodeFlags(t *testing.T) {
+	node := BNode(make([]byte, BTREE_PAGE_SIZE))
+	node.setHeader(BNODE_LEAF, 2)
+	node.setFlags(0xa4)
+	node.setCommit(7)
+	nodeAppendKV(node, 0, 0, nil, nil)
+	nodeAppendKV(node, 1, 0, []byte("key"), []byte("val"))
+	node.setChecksum()
+
+	if node[0] != BNODE_VERSION<<4|BNODE_LEAF || node[1] != 0xa4 || binary.LittleEndian.Uint16(node[2:4]) != 2 {
+		t.Fatalf("header % x", node[:4])
+	}
+	if node.btype() != BNODE_LEAF || node.version() != BNODE_VERSION || node.flags() != 0xa4 || node.nkeys() != 2 {
+		t.Fatalf("type %d, version %d, flags %#x, %d keys", node.btype(), node.version(), node.flags(), node.nkeys())
+	}
+	if binary.LittleEndian.Uint32(node[4:8]) != node.computeChecksum() || binary.LittleEndian.Uint64(node[8:16]) != 7 {
+		t.Fatalf("checksum and commit % x", node[4:16])
+	}
+	if node.kvPos(0) != HEADER+8*2+2*2 || string(node.getKey(1)) != "key" || string(node.getVal(1)) != "val" {
+		t.Fatalf("pairs from %d: %q = %q", node.kvPos(0), node.getKey(1), node.getVal(1))
+	}
+	if err := checkPage(1, node); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new header clears the reserved flags
+	node.setHeader(BNODE_NODE, 1)
+	if node.btype() != BNODE_NODE || node.version() != BNODE_VERSION || node.flags() != BNODE_FLAGS_NONE {
+		t.Fatalf("after setHeader: type %d, version %d, flags %#x", node.btype(), node.version(), node.flags())
+	}
+
+	// a leaf of the 8B header: a 2B type, nkeys and the checksum, no version
+	old := BNode(make([]byte, BTREE_PAGE_SIZE))
+	binary.LittleEndian.PutUint16(old[0:2], BNODE_LEAF)
+	binary.LittleEndian.PutUint16(old[2:4], 1)
+	binary.LittleEndian.PutUint16(old[8+8:], 4+3+3)
+	copy(old[8+8+2:], "\x03\x00\x03\x00keyval")
+	old.setChecksum()
+	if err := checkPage(1, old); !errors.Is(err, ErrVersion) {
+		t.Fatalf("old leaf: %v", err)
+	}
+}
+
+// Workers scanning disjoint runs of the leaves listed, in parallel, yield
+// together exactly what a serial scan does, values on overflow pages too.
+func TestScanLeaves(t *testing.T) {
+	var prefetched sync.Map
+	cfg := Config{Prefetch: func(ptrs []uint64) {
+		for _, ptr := range ptrs {
+			prefetched.Store(ptr, true)
+		}
+	}}
+	tree, _ := newTestTree(t, cfg)
+	if pages := tree.LeafPages(); pages != nil {
+		t.Fatalf("empty tree: %v", pages)
+	}
+	for range tree.ScanLeaves(nil) {
+		t.Fatal("a pair from no leaves")
+	}
+
+	for i := range 5000 {
+		val := fmt.Appendf(nil, "val%d", i)
+		if i%500 == 0 {
+			val = bytes.Repeat(val, BTREE_MAX_VAL_SIZE)
+		}
+		if err := tree.Insert(fmt.Appendf(nil, "key%05d", (i*7919)%5000), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var want [][2]string
+	for key, val := range tree.Scan(nil) {
+		want = append(want, [2]string{string(key), string(val)})
+	}
+	if len(want) != 5000 {
+		t.Fatalf("%d pairs scanned", len(want))
+	}
+
+	pages := tree.LeafPages()
+	for _, workers := range []int{1, 3, 8, len(pages)} {
+		results := make([][][2]string, workers)
+		var wg sync.WaitGroup
+		for w := range workers {
+			run := pages[w*len(pages)/workers : (w+1)*len(pages)/workers]
+			wg.Go(func() {
+				for key, val := range tree.ScanLeaves(run) {
+					results[w] = append(results[w], [2]string{string(key), string(val)})
+				}
+			})
+		}
+		wg.Wait()
+
+		got := slices.Concat(results...)
+		if !slices.Equal(got, want) {
+			t.Fatalf("%d workers: %d pairs, the serial scan %d", workers, len(got), len(want))
+		}
+	}
+	for _, ptr := range pages {
+		if _, ok := prefetched.Load(ptr); !ok {
+			t.Fatalf("leaf %d not prefetched", ptr)
+		}
+	}
+
+	// stops when the loop does
+	n := 0
+	for range tree.ScanLeaves(pages) {
+		if n++; n == 10 {
+			break
+		}
+	}
+
+	// a page that isn't a leaf, like one of a list taken before an update
+	defer func() {
+		if err, _ := recover().(error); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("scan of the root: %v", err)
+		}
+	}()
+	for range tree.ScanLeaves([]uint64{tree.root}) {
+		t.Fatal("a pair from the root")
+	}
+}
+
+// The pages stamped with a commit after the one asked for are the ones found,
+// and `Verify` fails a page newer than its parent.
+func TestPagesSince(t *testing.T) {
+	var commit uint64
+	tree, mem := newTestTree(t, Config{Commit: func() uint64 { return commit }})
+	if pages := tree.PagesSince(0); pages != nil {
+		t.Fatalf("empty tree: %v", pages)
+	}
+
+	for commit = 1; commit <= 30; commit++ {
+		for i := range 100 {
+			key := fmt.Appendf(nil, "key%05d", (int(commit)*7919+i*31)%5000)
+			val := []byte("val")
+			if i == 0 {
+				val = bytes.Repeat([]byte("o"), 2*BTREE_MAX_VAL_SIZE)
+			}
+			if err := tree.Insert(key, val); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, since := range []uint64{0, 1, 10, 29, 30} {
+		want := map[uint64]bool{}
+		for _, ptr := range tree.Pages() {
+			if BNode(mem.pages[ptr]).commit() > since {
+				want[ptr] = true
+			}
+		}
+		got := tree.PagesSince(since)
+		if len(got) != len(want) {
+			t.Fatalf("since %d: %d pages, want %d", since, len(got), len(want))
+		}
+		for _, ptr := range got {
+			if !want[ptr] {
+				t.Fatalf("since %d: page %d of commit %d", since, ptr, BNode(mem.pages[ptr]).commit())
+			}
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	leaf := BNode(mem.pages[tree.LeafPages()[3]])
+	leaf.setCommit(commit + 1)
+	leaf.setChecksum()
+	if err := tree.Verify(); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("verify a leaf newer than its parent: %v", err)
+	}
+}
+
+// With pairs of the same size, the estimate is the number of pairs that fit
+// the target of a page, level by level.
+func TestEstimatePages(t *testing.T) {
+	pairs := make([]KV, 10000)
+	for i := range pairs {
+		pairs[i] = KV{fmt.Appendf(nil, "key%05d", i), make([]byte, 86)}
+	}
+
+	tests := []struct {
+		n     int
+		ratio float64
+		// a leaf takes 108B per pair, an internal node 23B per kid with a
+		// 1B key count, after the 16B header
+		leaves, internal uint64
+	}{
+		{0, 1, 0, 0},
+		{1, 1, 1, 0},
+		{37, 1, 1, 0},
+		{38, 1, 2, 1},
+		{1000, 1, 28, 1},                 // 37 pairs a leaf
+		{1000, 0.5, 56, 1},               // 18 pairs a leaf
+		{1000, 0, 28, 1},                 // the ratio is 1
+		{10000, 1, 271, 2 + 1},           // 177 kids a node
+		{10000, 0.1, 3334, 197 + 12 + 1}, // 3 pairs a leaf, 17 kids a node
+	}
+	for _, test := range tests {
+		leaves, internal, total := EstimatePages(pairs[:test.n], BTREE_PAGE_SIZE, test.ratio)
+		if leaves != test.leaves || internal != test.internal || total != leaves+internal {
+			t.Errorf("%d pairs at %v: %d leaves, %d internal, %d in total, want %d leaves, %d internal",
+				test.n, test.ratio, leaves, internal, total, test.leaves, test.internal)
+		}
+	}
+}
+
+// The size of a range is estimated from the leaves at its ends alone: it's
+// exact within a leaf, and disjoint ranges covering every key add up to about
+// the whole tree.
+func TestRangeSize(t *testing.T) {
+	tree, _ := newTestTree(t, Config{})
+	if size := tree.RangeSize(nil, nil); size != 0 {
+		t.Fatalf("empty tree: %d", size)
+	}
+
+	const n = 5000
+	var kvs [][2][]byte
+	exact := uint64(0)
+	for i := range n {
+		key, val := fmt.Appendf(nil, "key%05d", i), bytes.Repeat([]byte("v"), 20+i%50)
+		kvs = append(kvs, [2][]byte{key, val})
+		exact += uint64(kvSize(key, val))
+	}
+	buildTree(tree, kvs)
+
+	reads := 0
+	get := tree.get
+	tree.get = func(ptr uint64) []byte {
+		reads++
+		return get(ptr)
+	}
+	near := func(got, want uint64) bool {
+		return got >= want*95/100 && got <= want*105/100
+	}
+
+	levels := height(tree)
+	reads = 0
+	whole := tree.RangeSize(nil, nil)
+	if !near(whole, exact) {
+		t.Fatalf("the whole tree takes %d bytes, got %d", exact, whole)
+	}
+	if reads > 2*levels {
+		t.Fatalf("%d pages read for %d levels", reads, levels)
+	}
+
+	bounds := [][]byte{nil}
+	for i := 250; i < n; i += 250 {
+		bounds = append(bounds, fmt.Appendf(nil, "key%05d", i))
+	}
+	bounds = append(bounds, nil)
+	sum := uint64(0)
+	for i := range len(bounds) - 1 {
+		sum += tree.RangeSize(bounds[i], bounds[i+1])
+	}
+	if !near(sum, whole) {
+		t.Fatalf("the ranges add up to %d bytes, the whole tree %d", sum, whole)
+	}
+
+	// exact within a leaf, the first one holds 50 keys
+	want := uint64(0)
+	for _, kv := range kvs[10:20] {
+		want += uint64(kvSize(kv[0], kv[1]))
+	}
+	if size := tree.RangeSize(kvs[10][0], kvs[20][0]); size != want {
+		t.Fatalf("a range in a leaf: %d bytes, want %d", size, want)
+	}
+
+	if size := tree.RangeSize([]byte("key02000"), []byte("key01000")); size != 0 {
+		t.Fatalf("a range ending before its start: %d", size)
+	}
+	if size := tree.RangeSize([]byte("zzz"), nil); size != 0 {
+		t.Fatalf("a range past the keys: %d", size)
+	}
+	if size := tree.RangeSize(nil, []byte("a")); size != 0 {
+		t.Fatalf("a range before the keys: %d", size)
+	}
+}
+
+// Checks that the tree holds exactly `want`: the keys are in the tree's order in the
+// leaves, no link's key is greater than the first key of its kid, no node but
+// the root is empty and every page in `mem` is in the tree or in an overflow
+// chain.
+func checkTree(t *testing.T, tree *BTree, mem *memPages, want map[string]string) {
+	t.Helper()
+	if tree.root == 0 {
+		if len(want) != 0 || len(mem.pages) != 0 {
+			t.Fatalf("empty tree: %d keys wanted, %d pages left", len(want), len(mem.pages))
+		}
+		return
+	}
+
+	var keys []string
+	pages := 0
+	// returns the number of keys under the page
+	var walk func(ptr uint64, first []byte) uint64
+	walk = func(ptr uint64, first []byte) uint64 {
+		pages++
+		node := BNode(tree.get(ptr))
+		if node.nkeys() == 0 && ptr != tree.root {
+			t.Fatalf("page %d is empty", ptr)
+		}
+		if first != nil && tree.compare(node.getKey(0), first) < 0 {
+			t.Fatalf("page %d starts at %q, its link at %q", ptr, node.getKey(0), first)
+		}
+		var count uint64
+		for i := range node.nkeys() {
+			if node.btype() == BNODE_NODE {
+				n := walk(node.getPtr(i), node.getKey(i))
+				if n != node.getCount(i) {
+					t.Fatalf("page %d holds %d keys, its link says %d", node.getPtr(i), n, node.getCount(i))
+				}
+				count += n
+				continue
+			}
+			key, val := string(node.getKey(i)), string(tree.leafVal(node, i))
+			for ptr := node.getPtr(i); ptr != 0; pages++ {
+				ptr = binary.LittleEndian.Uint64(tree.get(ptr)[HEADER:])
+			}
+			if len(keys) > 0 && tree.compare([]byte(keys[len(keys)-1]), []byte(key)) >= 0 {
+				t.Fatalf("key %q after %q", key, keys[len(keys)-1])
+			}
+			if got, ok := want[key]; !ok || got != val {
+				t.Fatalf("%q = %q, want %q (%v)", key, val, got, ok)
+			}
+			keys = append(keys, key)
+			count++
+		}
+		return count
+	}
+	walk(tree.root, nil)
+
+	if len(keys) != len(want) {
+		t.Fatalf("%d keys, want %d", len(keys), len(want))
+	}
+	if pages != len(mem.pages) {
+		t.Fatalf("%d pages in the tree, %d allocated", pages, len(mem.pages))
+	}
+
+	for key, val := range want {
+		if got, ok := tree.Get([]byte(key)); !ok || string(got) != val {
+			t.Fatalf("get %q: %q, %v", key, got, ok)
+		}
+	}
+}
+
+// Returns the number of levels of the tree.
+func height(tree *BTree) int {
+	if tree.root == 0 {
+		return 0
+	}
+	h := 1
+	for node := BNode(tree.get(tree.root)); node.btype() == BNODE_NODE; h++ {
+		node = tree.get(node.getPtr(0))
+	}
+	return h
+}
+
+func TestDelete(t *testing.T) {
+	key := func(i int) string { return fmt.Sprintf("key%05d", i) }
+	val := func(i int) string { return strings.Repeat("v", i%100) }
+
+	tests := []struct {
+		name   string
+		n      int
+		delete func(i int) bool // deletes the keys in [0, n) it's true for
+		order  func(i, n int) int
+	}{
+		{"empty tree", 0, func(int) bool { return true }, nil},
+		{"single key", 1, func(int) bool { return true }, nil},
+		{"missing keys", 100, func(int) bool { return false }, nil},
+		{"first half", 3000, func(i int) bool { return i < 1500 }, nil},
+		{"last half", 3000, func(i int) bool { return i >= 1500 }, nil},
+		{"every other", 3000, func(i int) bool { return i%2 == 0 }, nil},
+		{"all but one", 3000, func(i int) bool { return i != 1234 }, nil},
+		{"all ascending", 3000, func(int) bool { return true }, nil},
+		{"all descending", 3000, func(int) bool { return true }, func(i, n int) int { return n - 1 - i }},
+		{"all shuffled", 3000, func(int) bool { return true }, func(i, n int) int { return i * 7919 % n }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tree, mem := newTestTree(t, Config{})
+			want := map[string]string{}
+			for i := range test.n {
+				tree.Insert([]byte(key(i)), []byte(val(i)))
+				want[key(i)] = val(i)
+			}
+			checkTree(t, tree, mem, want)
+			before := height(tree)
+
+			for j := range test.n {
+				i := j
+				if test.order != nil {
+					i = test.order(j, test.n)
+				}
+				if !test.delete(i) {
+					continue
+				}
+				if deleted, err := tree.Delete([]byte(key(i))); err != nil || !deleted {
+					t.Fatalf("delete %q: %v, %v", key(i), deleted, err)
+				}
+				delete(want, key(i))
+				if j%97 == 0 {
+					checkTree(t, tree, mem, want)
+				}
+			}
+			checkTree(t, tree, mem, want)
+
+			// deleting again finds nothing
+			for i := range test.n + 1 {
+				if _, ok := want[key(i)]; ok {
+					continue
+				}
+				if deleted, err := tree.Delete([]byte(key(i))); err != nil || deleted {
+					t.Fatalf("delete %q: %v, %v after it was deleted", key(i), deleted, err)
+				}
+			}
+			if len(want) <= 1 && height(tree) > 1 {
+				t.Fatalf("%d keys left in %d levels", len(want), height(tree))
+			}
+			if after := height(tree); after > before {
+				t.Fatalf("the tree grew from %d to %d levels", before, after)
+			}
+
+			// the tree takes new keys once emptied
+			tree.Insert([]byte("again"), []byte("1"))
+			want["again"] = "1"
+			checkTree(t, tree, mem, want)
+		})
+	}
+}
+
+// Merging with a sibling keeps the nodes packed: after deleting most keys the
+// leaves hold far fewer pages than before.
+func TestDeleteMerges(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	want := map[string]string{}
+	for i := range 5000 {
+		key := fmt.Sprintf("key%05d", i)
+		tree.Insert([]byte(key), []byte(strings.Repeat("v", 50)))
+		want[key] = strings.Repeat("v", 50)
+	}
+	before := len(tree.LeafPages())
+
+	for i := range 5000 {
+		if i%10 != 0 {
+			key := fmt.Sprintf("key%05d", i)
+			tree.Delete([]byte(key))
+			delete(want, key)
+		}
+	}
+	checkTree(t, tree, mem, want)
+	if after := len(tree.LeafPages()); after > before/4 {
+		t.Fatalf("%d leaves for a tenth of the keys, %d before", after, before)
+	}
+}
+
+func TestGet(t *testing.T) {
+	tree, _ := newTestTree(t, Config{})
+	if val, ok := tree.Get([]byte("key")); ok {
+		t.Fatalf("empty tree: found %q", val)
+	}
+
+	for i := range 3000 {
+		tree.Insert(fmt.Appendf(nil, "key%05d", 2*i), fmt.Appendf(nil, "val%d", i))
+	}
+	for i := range 3000 {
+		key := fmt.Appendf(nil, "key%05d", 2*i)
+		if val, ok := tree.Get(key); !ok || string(val) != fmt.Sprintf("val%d", i) {
+			t.Fatalf("get %q: %q, %v", key, val, ok)
+		}
+		if val, ok := tree.Get(fmt.Appendf(nil, "key%05d", 2*i+1)); ok {
+			t.Fatalf("get between the keys: found %q", val)
+		}
+	}
+
+	for _, key := range []string{"", "a", "key", "key00000\x00", "zzz"} {
+		if val, ok := tree.Get([]byte(key)); ok {
+			t.Fatalf("get %q: found %q", key, val)
+		}
+	}
+
+	// an update is seen by the next lookup, an empty key is a key too
+	tree.Insert([]byte("key00002"), []byte("updated"))
+	tree.Insert([]byte(""), []byte("empty"))
+	for key, want := range map[string]string{"key00002": "updated", "": "empty", "key00004": "val2"} {
+		if val, ok := tree.Get([]byte(key)); !ok || string(val) != want {
+			t.Fatalf("get %q: %q, %v", key, val, ok)
+		}
+	}
+}
+
+func TestNodeLookupLE(t *testing.T) {
+	for n := 1; n <= 200; n++ {
+		node := BNode(make([]byte, BTREE_PAGE_SIZE))
+		node.setHeader(BNODE_LEAF, uint16(n))
+		var keys [][]byte
+		for i := range n {
+			// odd numbers, the even ones fall in between
+			key := fmt.Appendf(nil, "%04d", 2*i+1)
+			nodeAppendKV(node, uint16(i), 0, key, nil)
+			keys = append(keys, key)
+		}
+
+		for q := range 2*n + 2 {
+			key := fmt.Appendf(nil, "%04d", q)
+			want := 0 // every key is greater, the first position
+			for i, k := range keys {
+				if bytes.Compare(k, key) <= 0 {
+					want = i
+				}
+			}
+			if got := nodeLookupLE(node, key, bytes.Compare); int(got) != want {
+				t.Fatalf("%d keys: lookup of %q is %d, want %d", n, key, got, want)
+			}
+		}
+	}
+}
+
+func TestPageSize(t *testing.T) {
+	for _, size := range []int{-1, 1, 2048, 4095, 6144, 32768} {
+		if _, err := New(Config{PageSize: size}); !errors.Is(err, ErrPageSize) {
+			t.Fatalf("page size %d: %v", size, err)
+		}
+	}
+
+	leaves := map[int]int{}
+	for _, size := range []int{0, 4096, 8192, 16384} {
+		tree, mem := newTestTree(t, Config{PageSize: size})
+		if size == 0 {
+			size = BTREE_PAGE_SIZE
+		}
+		if tree.PageSize() != size {
+			t.Fatalf("page size %d, want %d", tree.PageSize(), size)
+		}
+
+		want := map[string]string{}
+		for i := range 3000 {
+			key, val := fmt.Sprintf("key%05d", i*7919%3000), strings.Repeat("v", i%200)
+			if i%500 == 0 {
+				val = strings.Repeat("o", 3*size) // in overflow pages
+			}
+			tree.Insert([]byte(key), []byte(val))
+			want[key] = val
+		}
+		checkTree(t, tree, mem, want)
+		for ptr, page := range mem.pages {
+			if len(page) != size {
+				t.Fatalf("page size %d: page %d has %d bytes", size, ptr, len(page))
+			}
+		}
+		leaves[size] = len(tree.LeafPages())
+
+		for i := range 3000 {
+			if i%3 != 0 {
+				key := fmt.Sprintf("key%05d", i)
+				tree.Delete([]byte(key))
+				delete(want, key)
+			}
+		}
+		checkTree(t, tree, mem, want)
+	}
+
+	// larger pages take fewer leaves
+	if leaves[4096] <= leaves[8192] || leaves[8192] <= leaves[16384] {
+		t.Fatalf("leaves by page size: %v", leaves)
+	}
+}
+
+// The bytes reserved at the end of the pages are left as zeros by the tree,
+// whatever the store writes there, and the largest pairs still fit.
+func TestReserved(t *testing.T) {
+	for _, reserved := range []int{-1, BTREE_MAX_RESERVED + 1} {
+		if _, err := New(Config{Reserved: reserved}); !errors.Is(err, ErrPageSize) {
+			t.Fatalf("%d bytes reserved: %v", reserved, err)
+		}
+	}
+
+	tree, mem := newTestTree(t, Config{Reserved: BTREE_MAX_RESERVED})
+	if tree.PageSize() != BTREE_PAGE_SIZE-BTREE_MAX_RESERVED {
+		t.Fatalf("page size %d", tree.PageSize())
+	}
+	want := map[string]string{}
+	for i := range 3000 {
+		key, val := fmt.Sprintf("key%05d", i*7919%3000), strings.Repeat("v", i%200)
+		switch i % 500 {
+		case 0:
+			val = strings.Repeat("o", 3*BTREE_PAGE_SIZE)
+		case 1:
+			key, val = strings.Repeat(key, BTREE_MAX_KEY_SIZE/len(key)), strings.Repeat("v", BTREE_MAX_VAL_SIZE)
+		}
+		if err := tree.Insert([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = val
+	}
+	for ptr, page := range mem.pages {
+		if len(page) != BTREE_PAGE_SIZE || !bytes.Equal(page[tree.PageSize():], make([]byte, BTREE_MAX_RESERVED)) {
+			t.Fatalf("page %d: %d bytes, ending with %x", ptr, len(page), page[tree.PageSize():])
+		}
+		// the store's own data, a nonce and a tag
+		copy(page[tree.PageSize():], bytes.Repeat([]byte{0xa5}, BTREE_MAX_RESERVED))
+	}
+	checkTree(t, tree, mem, want)
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A flipped bit anywhere in a page, the checksum included, is caught when the
+// page is read and by `Verify`.
+func TestChecksum(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	for i := range 3000 {
+		tree.Insert(fmt.Appendf(nil, "key%05d", i), []byte("val"))
+	}
+	tree.Insert([]byte("big"), bytes.Repeat([]byte("o"), 2*BTREE_MAX_VAL_SIZE))
+
+	for ptr, page := range mem.pages {
+		if BNode(page).checksum() != BNode(page).computeChecksum() {
+			t.Fatalf("page %d was stored without its checksum", ptr)
+		}
+	}
+
+	leaf := tree.LeafPages()[3]
+	for _, pos := range []int{0, 5, HEADER, BTREE_PAGE_SIZE - 1} {
+		mem.pages[leaf][pos] ^= 0x10
+		var cerr *ChecksumError
+		if err := tree.Verify(); !errors.As(err, &cerr) || cerr.Page != leaf || !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("byte %d flipped: verify: %v", pos, err)
+		}
+
+		func() {
+			defer func() {
+				if err, _ := recover().(error); !errors.As(err, &cerr) || cerr.Page != leaf {
+					t.Fatalf("byte %d flipped: read: %v", pos, err)
+				}
+			}()
+			tree.get(leaf)
+		}()
+
+		mem.pages[leaf][pos] ^= 0x10
+		if err := tree.Verify(); err != nil {
+			t.Fatalf("byte %d restored: %v", pos, err)
+		}
+	}
+
+	// so is one in an overflow page
+	ptr := BNode(tree.get(tree.LeafPages()[0])).getPtr(0)
+	if ptr == 0 {
+		t.Fatal("the first key has no overflow pages")
+	}
+	mem.pages[ptr][OVERFLOW_HEADER] ^= 1
+	if err := tree.Verify(); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("overflow page: %v", err)
+	}
+}
+
+// Every page is written with the current format version, and a page of
+// another one is refused instead of being decoded.
+func TestNodeVersion(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	want := map[string]string{}
+	for i := range 3000 {
+		key := fmt.Sprintf("key%05d", i)
+		tree.Insert([]byte(key), []byte("val"))
+		want[key] = "val"
+	}
+	tree.Insert([]byte("big"), bytes.Repeat([]byte("o"), 2*BTREE_MAX_VAL_SIZE))
+	want["big"] = strings.Repeat("o", 2*BTREE_MAX_VAL_SIZE)
+
+	for ptr, page := range mem.pages {
+		if v := BNode(page).version(); v != BNODE_VERSION {
+			t.Fatalf("page %d: version %d", ptr, v)
+		}
+	}
+
+	leaf := tree.LeafPages()[5]
+	key := BNode(tree.get(leaf)).getKey(0)
+	for _, v := range []uint8{0, BNODE_VERSION + 1} {
+		page := BNode(mem.pages[leaf])
+		page[0] = v<<4 | byte(page.btype())
+		page.setChecksum()
+
+		if err := tree.Verify(); !errors.Is(err, ErrVersion) {
+			t.Fatalf("version %d: verify: %v", v, err)
+		}
+		if err := tree.Insert(key, []byte("new")); !errors.Is(err, ErrVersion) {
+			t.Fatalf("version %d: insert: %v", v, err)
+		}
+		func() {
+			defer func() {
+				if err, _ := recover().(error); !errors.Is(err, ErrVersion) {
+					t.Fatalf("version %d: get: %v", v, err)
+				}
+			}()
+			tree.Get(key)
+		}()
+	}
+
+	page := BNode(mem.pages[leaf])
+	page[0] = BNODE_VERSION<<4 | byte(page.btype())
+	page.setChecksum()
+	checkTree(t, tree, mem, want)
+}
+
+// Keys too large to store are refused by every write, and nothing is written.
+func TestKeyTooLarge(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	big := bytes.Repeat([]byte("k"), BTREE_MAX_KEY_SIZE+1)
+	keep := func([]byte, bool) []byte { return []byte("val") }
+
+	if err := tree.BulkLoad(seqKVs([]KV{{Key: []byte("a")}, {Key: big}}), 1); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("bulk load: %v", err)
+	}
+	checkTree(t, tree, mem, nil)
+
+	tree.Insert([]byte("key"), []byte("val"))
+	want := map[string]string{"key": "val"}
+	if err := tree.Insert(big, nil); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("insert: %v", err)
+	}
+	if err := tree.Merge(big, keep); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("merge: %v", err)
+	}
+	if ok, err := tree.PutIf(big, nil, nil); ok || !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("put if: %v, %v", ok, err)
+	}
+	if err := tree.PutMany([]KV{{Key: []byte("a")}, {Key: big}}); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("put many: %v", err)
+	}
+	checkTree(t, tree, mem, want)
+
+	if err := tree.Insert(big[1:], []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	want[string(big[1:])] = "val"
+	checkTree(t, tree, mem, want)
+}
+
+// A write reaching a damaged page fails with `ErrCorrupt` and leaves the tree
+// as it was, whether the page fails its checksum or only says more than it
+// holds.
+func TestCorruptWrite(t *testing.T) {
+	damages := map[string]func(node BNode){
+		"checksum": func(node BNode) { node[HEADER] ^= 1 },
+		"keys": func(node BNode) {
+			node.setHeader(node.btype(), 0xffff)
+			node.setChecksum()
+		},
+		"offset": func(node BNode) {
+			binary.LittleEndian.PutUint16(node[HEADER+8*node.nkeys()+2:], 0xfff0)
+			node.setChecksum()
+		},
+	}
+	for name, damage := range damages {
+		tree, mem := newTestTree(t, Config{})
+		want := map[string]string{}
+		for i := range 3000 {
+			key := fmt.Sprintf("key%05d", i)
+			tree.Insert([]byte(key), []byte("val"))
+			want[key] = "val"
+		}
+
+		leaf := tree.LeafPages()[10]
+		key := BNode(tree.get(leaf)).getKey(0)
+		page := bytes.Clone(mem.pages[leaf])
+		damage(mem.pages[leaf])
+
+		before := map[uint64]string{}
+		for ptr, page := range mem.pages {
+			before[ptr] = string(page)
+		}
+		root := tree.root
+
+		writes := map[string]func() error{
+			"insert": func() error { return tree.Insert(key, []byte("new")) },
+			"merge":  func() error { return tree.Merge(key, func([]byte, bool) []byte { return nil }) },
+			"put if": func() error {
+				_, err := tree.PutIf(key, []byte("new"), []byte("val"))
+				return err
+			},
+			"put many": func() error { return tree.PutMany([]KV{{Key: []byte("a")}, {Key: key}}) },
+			"apply": func() error {
+				_, err := tree.Apply([]Op{{Kind: OP_PUT, Key: []byte("a")}, {Kind: OP_DELETE, Key: key}})
+				return err
+			},
+		}
+		for write, fn := range writes {
+			if err := fn(); !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("%s: %s: %v", name, write, err)
+			}
+			if tree.root != root || len(mem.pages) != len(before) {
+				t.Fatalf("%s: %s: the tree changed", name, write)
+			}
+			for ptr, page := range mem.pages {
+				if string(page) != before[ptr] {
+					t.Fatalf("%s: %s: page %d changed", name, write, ptr)
+				}
+			}
+		}
+
+		mem.pages[leaf] = page
+		checkTree(t, tree, mem, want)
+	}
+}
+
+// A deletion that reaches a damaged page after it freed others, merging with
+// a damaged sibling or dropping the kids before it, fails with `ErrCorrupt`
+// and frees nothing, and so does a batch of ops that wrote before it.
+func TestCorruptDelete(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	want := map[string]string{}
+	for i := range 3000 {
+		key := fmt.Sprintf("key%05d", i)
+		if err := tree.Insert([]byte(key), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = "val"
+	}
+
+	leaves := tree.LeafPages()
+	damaged := leaves[10]
+	page := bytes.Clone(mem.pages[damaged])
+	mem.pages[damaged][HEADER] ^= 1
+
+	// fails unless `write` fails with `ErrCorrupt` leaving every page as it
+	// was, returns whether it failed
+	checkFailed := func(name string, write func() error) bool {
+		t.Helper()
+		before := map[uint64]string{}
+		for ptr, page := range mem.pages {
+			before[ptr] = string(page)
+		}
+		root := tree.root
+		err := write()
+		if err == nil {
+			return false
+		}
+		if !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if tree.root != root || len(mem.pages) != len(before) {
+			t.Fatalf("%s: the tree changed", name)
+		}
+		for ptr, page := range mem.pages {
+			if string(page) != before[ptr] {
+				t.Fatalf("%s: page %d changed", name, ptr)
+			}
+		}
+		return true
+	}
+
+	// the keys of the next leaf go until it's merged with the damaged one
+	var keys [][]byte
+	for i, node := uint16(0), BNode(tree.get(leaves[11])); i < node.nkeys(); i++ {
+		keys = append(keys, node.getKey(i))
+	}
+	// a batch writes before it gets there
+	batch := []Op{{Kind: OP_PUT, Key: []byte("a"), Val: []byte("val")}}
+	for _, key := range keys {
+		batch = append(batch, Op{Kind: OP_DELETE, Key: key})
+	}
+	if !checkFailed("apply", func() error {
+		_, err := tree.Apply(batch)
+		return err
+	}) {
+		t.Fatal("applied a batch merging with the damaged leaf")
+	}
+
+	merged := false
+	for _, key := range keys {
+		merged = checkFailed("delete", func() error {
+			_, err := tree.Delete(key)
+			return err
+		})
+		if merged {
+			break
+		}
+		delete(want, string(key))
+	}
+	if !merged {
+		t.Fatal("the leaf wasn't merged with the damaged one")
+	}
+
+	lo, hi := BNode(tree.get(leaves[8])).getKey(1), BNode(tree.get(leaves[12])).getKey(0)
+	if !checkFailed("delete range", func() error {
+		_, err := tree.DeleteRange(lo, hi)
+		return err
+	}) {
+		t.Fatal("deleted a range over the damaged leaf")
+	}
+
+	mem.pages[damaged] = page
+	checkTree(t, tree, mem, want)
+}
+
+// A keys-only tree refuses values and leaves the value sizes out of its
+// leaves, fitting more keys in each one than a tree of 1B values.
+func TestKeysOnly(t *testing.T) {
+	leaves := map[bool]int{}
+	for _, keysOnly := range []bool{true, false} {
+		tree, mem := newTestTree(t, Config{KeysOnly: keysOnly})
+		want := map[string]string{}
+		val := ""
+		if !keysOnly {
+			val = "v"
+		}
+		for i := range 20000 {
+			key := fmt.Sprintf("%08x", i*7919)
+			tree.Insert([]byte(key), []byte(val))
+			want[key] = val
+		}
+		checkTree(t, tree, mem, want)
+		if err := tree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		leaves[keysOnly] = len(tree.LeafPages())
+
+		// internal nodes hold the key counts of their kids
+		for _, page := range mem.pages {
+			node := BNode(page)
+			if noVals := node.flags()&BNODE_FLAG_NO_VALS != 0; noVals != (keysOnly && node.btype() == BNODE_LEAF) {
+				t.Fatalf("%s with flags %#x", nodeTypeName(node), node.flags())
+			}
+		}
+
+		if !keysOnly {
+			continue
+		}
+
+		refused := []byte("val")
+		if err := tree.Insert([]byte("a"), refused); !errors.Is(err, ErrKeysOnly) {
+			t.Fatalf("insert: %v", err)
+		}
+		if err := tree.Merge([]byte("a"), func([]byte, bool) []byte { return refused }); !errors.Is(err, ErrKeysOnly) {
+			t.Fatalf("merge: %v", err)
+		}
+		if _, err := tree.PutIf([]byte("a"), refused, nil); !errors.Is(err, ErrKeysOnly) {
+			t.Fatalf("put if: %v", err)
+		}
+		if err := tree.PutMany([]KV{{Key: []byte("a")}, {Key: []byte("b"), Val: refused}}); !errors.Is(err, ErrKeysOnly) {
+			t.Fatalf("put many: %v", err)
+		}
+		checkTree(t, tree, mem, want)
+
+		for key := range want {
+			if deleted, err := tree.Delete([]byte(key)); err != nil || !deleted {
+				t.Fatalf("delete %q: %v, %v", key, deleted, err)
+			}
+			delete(want, key)
+		}
+		checkTree(t, tree, mem, want)
+
+		empty, _ := newTestTree(t, Config{KeysOnly: true})
+		if err := empty.BulkLoad(seqKVs([]KV{{Key: []byte("a"), Val: refused}}), 1); !errors.Is(err, ErrKeysOnly) {
+			t.Fatalf("bulk load: %v", err)
+		}
+	}
+
+	// 20B a key against 23B
+	if leaves[true] > leaves[false]*9/10 {
+		t.Fatalf("%d leaves keys-only, %d otherwise", leaves[true], leaves[false])
+	}
+}
+
+// Leaves are linked by the shortest prefix that tells them apart, so long keys
+// that differ early leave the internal nodes with short links.
+func TestLinkKeys(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	want := map[string]string{}
+	for i := range 3000 {
+		key := fmt.Sprintf("%04d%s", i*7919%10000, strings.Repeat("k", 900))
+		tree.Insert([]byte(key), []byte("val"))
+		want[key] = "val"
+	}
+	checkTree(t, tree, mem, want)
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	links := 0
+	for _, page := range mem.pages {
+		node := BNode(page)
+		if node.btype() != BNODE_NODE {
+			continue
+		}
+		for i := uint16(1); i < node.nkeys(); i++ {
+			if key := node.getKey(i); len(key) > 4 {
+				t.Fatalf("link %q", key)
+			}
+			links++
+		}
+	}
+	if links < len(tree.LeafPages())-1 {
+		t.Fatalf("%d links for %d leaves", links, len(tree.LeafPages()))
+	}
+
+	// the first leaf gets a smaller key than its link
+	tree.Insert([]byte("0"), []byte("first"))
+	want["0"] = "first"
+	checkTree(t, tree, mem, want)
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// and the links stay put as the keys go away
+	for key := range want {
+		if deleted, err := tree.Delete([]byte(key)); err != nil || !deleted {
+			t.Fatalf("delete %q: %v, %v", key, deleted, err)
+		}
+		delete(want, key)
+		if len(want)%500 == 0 {
+			checkTree(t, tree, mem, want)
+			if err := tree.Verify(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestPutIf(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	want := map[string]string{}
+	big := strings.Repeat("o", 2*BTREE_MAX_VAL_SIZE)
+
+	tests := []struct {
+		key, val string
+		expected []byte
+		ok       bool
+	}{
+		{"a", "1", []byte("1"), false}, // absent, a value expected
+		{"a", "1", nil, true},          // absent
+		{"a", "2", nil, false},         // present, absence expected
+		{"a", "2", []byte("0"), false}, // another value
+		{"a", "2", []byte("1"), true},
+		{"a", "", []byte("2"), true},
+		{"a", "3", nil, false}, // an empty value is still there
+		{"a", big, []byte(""), true},
+		{"a", "4", []byte(big[1:]), false},
+		{"a", "4", []byte(big), true},
+		{"b", "1", []byte{}, false},
+	}
+	for _, test := range tests {
+		if ok, err := tree.PutIf([]byte(test.key), []byte(test.val), test.expected); ok != test.ok || err != nil {
+			t.Fatalf("%q = %.10q if %.10q: %v, %v", test.key, test.val, test.expected, ok, err)
+		}
+		if test.ok {
+			want[test.key] = test.val
+		}
+		checkTree(t, tree, mem, want)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	want := map[string]string{}
+
+	// counters, every key is bumped a few times in no particular order
+	incr := func(old []byte, exists bool) []byte {
+		n := uint64(0)
+		if exists {
+			n = binary.LittleEndian.Uint64(old)
+		}
+		return binary.LittleEndian.AppendUint64(nil, n+1)
+	}
+	for j := range 3 * 1000 {
+		tree.Merge(fmt.Appendf(nil, "count%04d", j*7919%1000), incr)
+	}
+	for i := range 1000 {
+		want[fmt.Sprintf("count%04d", i)] = string(binary.LittleEndian.AppendUint64(nil, 3))
+	}
+	checkTree(t, tree, mem, want)
+
+	// lists, growing into overflow pages and back
+	push := func(old []byte, exists bool) []byte {
+		if !exists {
+			return []byte("x")
+		}
+		return append(bytes.Clone(old), strings.Repeat("x", 1000)...)
+	}
+	for range 5 {
+		tree.Merge([]byte("list"), push)
+	}
+	want["list"] = "x" + strings.Repeat("x", 4*1000)
+	checkTree(t, tree, mem, want)
+
+	tree.Merge([]byte("list"), func(old []byte, exists bool) []byte {
+		if !exists || string(old) != want["list"] {
+			t.Fatalf("list: %d bytes, %v", len(old), exists)
+		}
+		return old[:1]
+	})
+	want["list"] = "x"
+	checkTree(t, tree, mem, want)
+}
+
+// The scratch nodes of an insert are reused, what's left is mostly the pages
+// it writes.
+func BenchmarkInsert(b *testing.B) {
+	tree, _ := newTestTree(b, Config{})
+	val := make([]byte, 100)
+	b.ReportAllocs()
+	for i := range b.N {
+		tree.Insert(fmt.Appendf(nil, "key%09d", i*7919%(b.N+1)), val)
+	}
+}
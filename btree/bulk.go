@@ -0,0 +1,147 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"iter"
+)
+
+var (
+	ErrNotEmpty = errors.New("btree: tree is not empty")
+	ErrUnsorted = errors.New("btree: keys are not in ascending order")
+)
+
+// Fills an empty tree from key-value pairs in ascending key order, building it
+// bottom-up: every leaf is packed up to `fillRatio` of a page and written once,
+// then the internal levels are built on top of them. A ratio outside of (0, 1]
+// is treated as 1. If the keys are out of order or a pair can't be stored
+// nothing is kept.
+func (tree *BTree) BulkLoad(pairs iter.Seq2[[]byte, []byte], fillRatio float64) error {
+	if tree.readOnly {
+		return ErrReadOnly
+	}
+	if tree.root != 0 {
+		return ErrNotEmpty
+	}
+
+	if fillRatio <= 0 || fillRatio > 1 {
+		fillRatio = 1
+	}
+	target := int(float64(tree.pageSize) * fillRatio)
+
+	leaves := newLevelBuilder(tree, BNODE_LEAF, target)
+	var prev []byte
+	var err error
+
+	for key, val := range pairs {
+		if prev != nil && tree.compare(prev, key) >= 0 {
+			err = ErrUnsorted
+			break
+		}
+		if err = tree.checkKV(key, val); err != nil {
+			break
+		}
+
+		// the caller is free to reuse its buffers
+		key = append([]byte{}, key...) // never nil
+		prev = key
+
+		var ptr uint64
+		if overflows(key, val) {
+			ptr, val = writeOverflow(tree, val)
+		} else {
+			val = bytes.Clone(val)
+		}
+
+		leaves.add(ptr, key, val)
+	}
+
+	leaves.flush()
+	links := leaves.links
+
+	if err != nil {
+		for _, link := range links {
+			freeSubtree(tree, link.ptr)
+		}
+		return err
+	}
+
+	// each level only holds the first key, page and key count of the nodes below
+	for len(links) > 1 {
+		level := newLevelBuilder(tree, BNODE_NODE, target)
+		for _, link := range links {
+			level.add(link.ptr, link.key, link.count)
+		}
+
+		level.flush()
+		links = level.links
+	}
+
+	if len(links) == 1 {
+		tree.root = links[0].ptr
+	}
+
+	return nil
+}
+
+// Packs the entries of one level into nodes, writing each node once it's full.
+type levelBuilder struct {
+	tree   *BTree
+	btype  uint16
+	target int
+
+	batch []bulkKV   // entries of the node being packed
+	used  int        // bytes taken by the node being packed
+	links []rangeKid // first key and page of every node written
+}
+
+type bulkKV struct {
+	ptr uint64
+	key []byte
+	val []byte
+}
+
+func newLevelBuilder(tree *BTree, btype uint16, target int) *levelBuilder {
+	return &levelBuilder{tree: tree, btype: btype, target: target, used: HEADER}
+}
+
+func (lb *levelBuilder) add(ptr uint64, key, val []byte) {
+	size := kvSize(key, val)
+	if packFull(len(lb.batch), lb.used, size, lb.target, int(lb.tree.pageSize), lb.btype == BNODE_NODE) {
+		lb.flush()
+	}
+
+	lb.batch = append(lb.batch, bulkKV{ptr, key, val})
+	lb.used += size
+}
+
+// Writes the node being packed, if any.
+func (lb *levelBuilder) flush() {
+	if len(lb.batch) == 0 {
+		return
+	}
+
+	node := BNode(make([]byte, lb.tree.pageSize))
+	node.setHeader(lb.btype, uint16(len(lb.batch)))
+	for i, kv := range lb.batch {
+		nodeAppendKV(node, uint16(i), kv.ptr, kv.key, kv.val)
+	}
+
+	lb.links = append(lb.links, rangeKid{ptr: lb.tree.new(node), key: lb.batch[0].key, count: countVal(node)})
+	lb.batch = lb.batch[:0]
+	lb.used = HEADER
+}
+
+// Decides whether a node being packed with `n` entries and `used` bytes must
+// be closed before adding an entry of `size` bytes. Internal nodes take at
+// least 2 kids so that every level is smaller than the one below it.
+func packFull(n, used, size, target, pageSize int, internal bool) bool {
+	if n == 0 {
+		return false
+	}
+	if used+size > pageSize {
+		return true
+	}
+
+	return used+size > target && (n >= 2 || !internal)
+}
@@ -0,0 +1,124 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"iter"
+	"testing"
+)
+
+// Yields `pairs` in order.
+func seqKVs(pairs []KV) iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, val []byte) bool) {
+		for _, kv := range pairs {
+			if !yield(kv.Key, kv.Val) {
+				return
+			}
+		}
+	}
+}
+
+// Returns `n` pairs in key order, with values of varied sizes and a few large
+// enough for overflow pages.
+func sortedKVs(n int) []KV {
+	pairs := make([]KV, n)
+	for i := range pairs {
+		val := bytes.Repeat([]byte{'v'}, i%97)
+		if i%1000 == 999 {
+			val = bytes.Repeat([]byte{'o'}, 3*BTREE_MAX_VAL_SIZE)
+		}
+		pairs[i] = KV{fmt.Appendf(nil, "key%08d", i), val}
+	}
+	return pairs
+}
+
+// The tree built holds the pairs, in as many pages as estimated.
+func TestBulkLoad(t *testing.T) {
+	for _, ratio := range []float64{1, 0.7, 0.3, 0} {
+		for _, n := range []int{0, 1, 100, 20000} {
+			pairs := sortedKVs(n)
+			tree, mem := newTestTree(t, Config{})
+
+			// the pairs are copied, the buffers yielded are reused
+			var key, val []byte
+			err := tree.BulkLoad(func(yield func([]byte, []byte) bool) {
+				for _, kv := range pairs {
+					key, val = append(key[:0], kv.Key...), append(val[:0], kv.Val...)
+					if !yield(key, val) {
+						return
+					}
+				}
+			}, ratio)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[string]string{}
+			for _, kv := range pairs {
+				want[string(kv.Key)] = string(kv.Val)
+			}
+			checkTree(t, tree, mem, want)
+
+			leaves, _, total := EstimatePages(pairs, BTREE_PAGE_SIZE, ratio)
+			if got := uint64(len(tree.LeafPages())); got != leaves {
+				t.Errorf("ratio %v, %d pairs: %d leaves, %d estimated", ratio, n, got, leaves)
+			}
+			if got := uint64(len(mem.pages)); got != total {
+				t.Errorf("ratio %v, %d pairs: %d pages, %d estimated", ratio, n, got, total)
+			}
+
+			// and it can be updated like any other
+			tree.Insert([]byte("key"), []byte("new"))
+			want["key"] = "new"
+			for _, kv := range pairs[:n/2] {
+				tree.Delete(kv.Key)
+				delete(want, string(kv.Key))
+			}
+			checkTree(t, tree, mem, want)
+		}
+	}
+}
+
+// A lower fill ratio leaves room in the leaves: half full takes about twice
+// the leaves.
+func TestBulkLoadFillRatio(t *testing.T) {
+	pairs := sortedKVs(20000)
+	leaves := map[float64]int{}
+	for _, ratio := range []float64{1, 0.5} {
+		tree, _ := newTestTree(t, Config{})
+		if err := tree.BulkLoad(seqKVs(pairs), ratio); err != nil {
+			t.Fatal(err)
+		}
+		leaves[ratio] = len(tree.LeafPages())
+	}
+	if r := float64(leaves[0.5]) / float64(leaves[1]); r < 1.8 || r > 2.2 {
+		t.Fatalf("%d leaves half full, %d full", leaves[0.5], leaves[1])
+	}
+}
+
+func TestBulkLoadErrors(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	tree.Insert([]byte("key"), []byte("val"))
+	if err := tree.BulkLoad(seqKVs(sortedKVs(10)), 1); !errors.Is(err, ErrNotEmpty) {
+		t.Fatalf("a tree with a key: %v", err)
+	}
+	checkTree(t, tree, mem, map[string]string{"key": "val"})
+
+	// nothing is kept from pairs out of order, or with a key twice
+	for _, at := range []int{1, 5000, 19999} {
+		for _, dup := range []bool{false, true} {
+			pairs := sortedKVs(20000)
+			if dup {
+				pairs[at] = pairs[at-1]
+			} else {
+				pairs[at-1], pairs[at] = pairs[at], pairs[at-1]
+			}
+			tree, mem := newTestTree(t, Config{})
+			if err := tree.BulkLoad(seqKVs(pairs), 1); !errors.Is(err, ErrUnsorted) {
+				t.Fatalf("pair %d out of order: %v", at, err)
+			}
+			checkTree(t, tree, mem, nil)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package btree
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// Orders keys byte by byte like `bytes.Compare`, folding ASCII letters to
+// lower case first, so "Apple" and "apple" compare as equal. It can be plugged
+// in as `Config.Compare`.
+//
+// Keys that are equal under folding are the same key: writing "apple" after
+// "Apple" overwrites the value and the stored key takes the latest spelling
+// (last write wins).
+func CaseInsensitiveCompare(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ca, cb := asciiLower(a[i]), asciiLower(b[i])
+		if ca != cb {
+			return int(ca) - int(cb)
+		}
+	}
+
+	return len(a) - len(b)
+}
+
+// Same as `CaseInsensitiveCompare` but decodes UTF-8 and folds any rune with
+// a simple (one to one) lower case mapping. A byte that isn't valid UTF-8
+// sorts after every rune, by its value, which keeps the order total for keys
+// that mix both.
+func UnicodeCaseInsensitiveCompare(a, b []byte) int {
+	for len(a) > 0 && len(b) > 0 {
+		ra, na := foldRune(a)
+		rb, nb := foldRune(b)
+		if ra != rb {
+			return int(ra) - int(rb)
+		}
+
+		a, b = a[na:], b[nb:]
+	}
+
+	return len(a) - len(b)
+}
+
+// Decodes the first rune of `key` folded to lower case, or ranks its first
+// byte past unicode.MaxRune if it's not valid UTF-8. Returns the bytes read.
+func foldRune(key []byte) (rune, int) {
+	r, n := utf8.DecodeRune(key)
+	if r == utf8.RuneError && n == 1 {
+		return unicode.MaxRune + 1 + rune(key[0]), 1
+	}
+	return unicode.ToLower(r), n
+}
+
+func asciiLower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
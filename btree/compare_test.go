@@ -0,0 +1,160 @@
+package btree
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func sign(n int) int {
+	return cmp.Compare(n, 0)
+}
+
+func TestCaseInsensitiveCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"apple", "Apple", 0},
+		{"APPLE", "apple", 0},
+		{"apple", "Banana", -1},
+		{"Zebra", "apple", 1},
+		{"app", "APPLE", -1},
+		{"", "a", -1},
+		{"a[", "A_", -1}, // '[' sorts before '_', with the letters folded down
+	}
+	for _, test := range tests {
+		if got := sign(CaseInsensitiveCompare([]byte(test.a), []byte(test.b))); got != test.want {
+			t.Errorf("CaseInsensitiveCompare(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestUnicodeCaseInsensitiveCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"Ÿb", "ÿb", 0},
+		{"ÿa", "Ÿb", -1},
+		{"ÉCOLE", "école", 0},
+		{"straße", "STRASSE", 1}, // no full case folding, 'ß' is a rune of its own
+		{"\uFFFD", "a", 1},       // the replacement character is a rune like any other
+		{"\xff", "\U0010FFFF", 1},
+		{"\xc5", "Ÿb", 1}, // a rune cut in half sorts after the rune
+		{"\xc3", "\xc5", -1},
+		{"a\xff", "A\xff", 0},
+	}
+	for _, test := range tests {
+		if got := sign(UnicodeCaseInsensitiveCompare([]byte(test.a), []byte(test.b))); got != test.want {
+			t.Errorf("UnicodeCaseInsensitiveCompare(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+// The comparators must be orders for any bytes, valid UTF-8 or not.
+func TestCompareTotalOrder(t *testing.T) {
+	keys := []string{
+		"", "a", "A", "b", "ab", "aB", "z", "[", "_",
+		"ÿ", "Ÿ", "ÿa", "Ÿb", "ÿc", "é", "É",
+		"\uFFFD", "\U0010FFFF", "\xc3", "\xc5", "\xff", "a\xff", "\xc5b", "\xff\xfe",
+	}
+	comparators := map[string]func(a, b []byte) int{
+		"CaseInsensitiveCompare":        CaseInsensitiveCompare,
+		"UnicodeCaseInsensitiveCompare": UnicodeCaseInsensitiveCompare,
+	}
+	for name, compare := range comparators {
+		c := func(a, b string) int {
+			return sign(compare([]byte(a), []byte(b)))
+		}
+		for _, a := range keys {
+			for _, b := range keys {
+				if c(a, b) != -c(b, a) {
+					t.Fatalf("%s: %q and %q aren't antisymmetric", name, a, b)
+				}
+				for _, k := range keys {
+					if c(a, b) <= 0 && c(b, k) <= 0 && c(a, k) > 0 {
+						t.Fatalf("%s: %q <= %q <= %q but %q > %q", name, a, b, k, a, k)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Keys equal under folding are the same key, the last one written wins.
+func TestCaseInsensitiveTree(t *testing.T) {
+	tree, _ := newTestTree(t, Config{Compare: CaseInsensitiveCompare})
+	for _, kv := range [][2]string{{"Apple", "1"}, {"cherry", "2"}, {"Banana", "3"}, {"apple", "4"}} {
+		tree.Insert([]byte(kv[0]), []byte(kv[1]))
+	}
+
+	if val, ok := tree.Get([]byte("APPLE")); !ok || string(val) != "4" {
+		t.Fatalf("get APPLE: %q, %v", val, ok)
+	}
+	var keys []string
+	for key := range tree.Scan(nil) {
+		keys = append(keys, string(key))
+	}
+	if want := []string{"apple", "Banana", "cherry"}; !slices.Equal(keys, want) {
+		t.Fatalf("scan: %q, want %q", keys, want)
+	}
+}
+
+func TestUnicodeCaseInsensitiveTree(t *testing.T) {
+	tree, mem := newTestTree(t, Config{Compare: UnicodeCaseInsensitiveCompare})
+	want := map[string]string{}
+	for i := range 3000 {
+		key := fmt.Sprintf("%c%c%04d", []rune("ÿŸ")[i%2], 'a'+i%26, i)
+		if i%7 == 0 {
+			key += "\xff" // invalid UTF-8
+		}
+		tree.Insert([]byte(key), []byte(key))
+		want[key] = key
+	}
+	checkTree(t, tree, mem, want)
+}
+
+// Every operation follows the order of the tree, here the reverse of the
+// bytes.
+func TestCustomCompare(t *testing.T) {
+	reverse := func(a, b []byte) int { return bytes.Compare(b, a) }
+	tree, mem := newTestTree(t, Config{Compare: reverse})
+	want := map[string]string{}
+	for i := range 3000 {
+		key := fmt.Sprintf("key%05d", i*7919%3000)
+		tree.Insert([]byte(key), []byte("val"))
+		want[key] = "val"
+	}
+	checkTree(t, tree, mem, want)
+
+	cur := tree.Cursor()
+	if !cur.Seek([]byte("key01000x")) || string(cur.Key()) != "key01000" {
+		t.Fatalf("seek: at %q", cur.Key())
+	}
+	if !cur.Next() || string(cur.Key()) != "key00999" {
+		t.Fatalf("next: at %q", cur.Key())
+	}
+
+	// [lo, hi) in the order of the tree
+	if got, err := tree.DeleteRange([]byte("key02000"), []byte("key01000")); err != nil || got != 1000 {
+		t.Fatalf("delete range: %d keys, %v", got, err)
+	}
+	for i := 1001; i <= 2000; i++ {
+		delete(want, fmt.Sprintf("key%05d", i))
+	}
+	checkTree(t, tree, mem, want)
+
+	for i := range 3000 {
+		key := fmt.Sprintf("key%05d", i)
+		if _, ok := want[key]; !ok {
+			continue
+		}
+		if deleted, err := tree.Delete([]byte(key)); err != nil || !deleted {
+			t.Fatalf("delete %q: %v, %v", key, deleted, err)
+		}
+	}
+	checkTree(t, tree, mem, nil)
+}
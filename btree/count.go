@@ -0,0 +1,115 @@
+package btree
+
+import "encoding/binary"
+
+// Every link of an internal node holds the number of keys under its kid, so
+// that positions can be found without walking the leaves.
+
+// Returns the number of keys in the tree.
+func (tree *BTree) Len() uint64 {
+	if tree.root == 0 {
+		return 0
+	}
+	return nodeCount(tree.get(tree.root))
+}
+
+// Returns the number of keys smaller than `key`, which is the position `key`
+// has or would have in the tree.
+func (tree *BTree) Rank(key []byte) uint64 {
+	var rank uint64
+	for ptr := tree.root; ptr != 0; {
+		node := BNode(tree.get(ptr))
+		idx := nodeLookupLE(node, key, tree.compare)
+
+		if node.btype() == BNODE_LEAF {
+			if tree.compare(node.getKey(idx), key) < 0 {
+				idx++
+			}
+			return rank + uint64(idx)
+		}
+
+		for i := uint16(0); i < idx; i++ {
+			rank += node.getCount(i)
+		}
+		ptr = node.getPtr(idx)
+	}
+
+	return rank
+}
+
+// Returns the number of keys in [start, end), a nil `start` or `end` means no
+// bound on that side.
+func (tree *BTree) Count(start, end []byte) uint64 {
+	lo, hi := uint64(0), tree.Len()
+	if start != nil {
+		lo = tree.Rank(start)
+	}
+	if end != nil {
+		hi = tree.Rank(end)
+	}
+	return hi - min(lo, hi)
+}
+
+// Returns the key at position `k` in key order, counting from 0, and whether
+// there's one. Like the values `Get` returns, it's only valid until the next
+// update.
+func (tree *BTree) Select(k uint64) ([]byte, bool) {
+	cur := tree.Cursor()
+	if !cur.SeekIndex(k) {
+		return nil, false
+	}
+	return cur.Key(), true
+}
+
+// Positions the cursor at the key at position `k`, counting from 0, returns
+// whether there's one. It skips the keys before it in a single descent, for
+// paging through the tree by offset.
+func (cur *Cursor) SeekIndex(k uint64) bool {
+	cur.path, cur.pos = cur.path[:0], cur.pos[:0]
+	if k >= cur.tree.Len() {
+		return false
+	}
+
+	for ptr := cur.tree.root; ptr != 0; {
+		node := BNode(cur.tree.get(ptr))
+		if node.btype() == BNODE_LEAF {
+			cur.path = append(cur.path, node)
+			cur.pos = append(cur.pos, uint16(k))
+			break
+		}
+
+		idx := uint16(0)
+		for ; idx+1 < node.nkeys() && k >= node.getCount(idx); idx++ {
+			k -= node.getCount(idx)
+		}
+		cur.path = append(cur.path, node)
+		cur.pos = append(cur.pos, idx)
+		ptr = node.getPtr(idx)
+	}
+
+	return cur.Valid()
+}
+
+// Returns the number of keys under a node.
+func nodeCount(node BNode) uint64 {
+	if node.btype() == BNODE_LEAF {
+		return uint64(node.nkeys())
+	}
+
+	var count uint64
+	for i := uint16(0); i < node.nkeys(); i++ {
+		count += node.getCount(i)
+	}
+	return count
+}
+
+// Returns the number of keys under the nth kid of an internal node.
+func (node BNode) getCount(idx uint16) uint64 {
+	count, _ := binary.Uvarint(node.getVal(idx))
+	return count
+}
+
+// Returns the value of the link to a node.
+func countVal(node BNode) []byte {
+	return binary.AppendUvarint(nil, nodeCount(node))
+}
@@ -0,0 +1,111 @@
+package btree
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestRankSelect(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	if tree.Len() != 0 || tree.Rank([]byte("a")) != 0 || tree.Count(nil, nil) != 0 {
+		t.Fatal("empty tree: counted keys")
+	}
+	if _, ok := tree.Select(0); ok {
+		t.Fatal("empty tree: selected a key")
+	}
+
+	// odd numbers only, the even ones fall in between
+	want := map[string]string{}
+	for i := range 5000 {
+		key := fmt.Sprintf("key%05d", (i*7919%5000)*2+1)
+		tree.Insert([]byte(key), []byte("val"))
+		want[key] = "val"
+	}
+	for i := 0; i < 5000; i += 3 {
+		key := fmt.Sprintf("key%05d", i*2+1)
+		tree.Delete([]byte(key))
+		delete(want, key)
+	}
+	tree.DeleteRange([]byte("key04000"), []byte("key06000"))
+	for key := range want {
+		if key >= "key04000" && key < "key06000" {
+			delete(want, key)
+		}
+	}
+	checkTree(t, tree, mem, want)
+
+	keys := slices.Sorted(func(yield func(string) bool) {
+		for key := range want {
+			if !yield(key) {
+				return
+			}
+		}
+	})
+	if tree.Len() != uint64(len(keys)) {
+		t.Fatalf("len %d, want %d", tree.Len(), len(keys))
+	}
+
+	for k, key := range keys {
+		if got, ok := tree.Select(uint64(k)); !ok || string(got) != key {
+			t.Fatalf("select %d: %q, %v, want %q", k, got, ok, key)
+		}
+		if rank := tree.Rank([]byte(key)); rank != uint64(k) {
+			t.Fatalf("rank %q: %d, want %d", key, rank, k)
+		}
+		// the key right before it isn't in the tree
+		var n int
+		fmt.Sscanf(key, "key%05d", &n)
+		if rank := tree.Rank(fmt.Appendf(nil, "key%05d", n-1)); rank != uint64(k) {
+			t.Fatalf("rank before %q: %d, want %d", key, rank, k)
+		}
+	}
+	if _, ok := tree.Select(uint64(len(keys))); ok {
+		t.Fatal("selected a key past the end")
+	}
+	if rank := tree.Rank([]byte("z")); rank != uint64(len(keys)) {
+		t.Fatalf("rank past the end: %d", rank)
+	}
+
+	tests := []struct {
+		start, end string
+	}{
+		{"", ""},
+		{"key00100", ""},
+		{"", "key00100"},
+		{"key00100", "key09000"},
+		{"key03001", "key03003"},
+		{"key03000", "key03000"},
+		{"key09000", "key00100"},
+	}
+	for _, test := range tests {
+		var start, end []byte
+		if test.start != "" {
+			start = []byte(test.start)
+		}
+		if test.end != "" {
+			end = []byte(test.end)
+		}
+		n := 0
+		for _, key := range keys {
+			if (start == nil || key >= test.start) && (end == nil || key < test.end) {
+				n++
+			}
+		}
+		if got := tree.Count(start, end); got != uint64(n) {
+			t.Fatalf("count [%q, %q): %d, want %d", test.start, test.end, got, n)
+		}
+	}
+
+	// paging by offset
+	cur := tree.Cursor()
+	for offset := 0; offset < len(keys); offset += 100 {
+		ok := cur.SeekIndex(uint64(offset))
+		for i := offset; i < min(offset+100, len(keys)); i++ {
+			if !ok || string(cur.Key()) != keys[i] {
+				t.Fatalf("page at %d: key %d is %q, want %q", offset, i, cur.Key(), keys[i])
+			}
+			ok = cur.Next()
+		}
+	}
+}
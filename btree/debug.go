@@ -0,0 +1,15 @@
+//go:build btree_debug
+
+package btree
+
+/*
+Built with the `btree_debug` tag, the tree checks every node it writes before
+handing it to `Config.New`: a node is laid out in a scratch buffer of up to 3
+pages and cut to one by `encodeNode`, a node that got there without fitting
+would be cut short and stored, to show up as corruption long after the update
+that wrote it. The check panics right at the update instead, see
+`checkNodeSize`.
+*/
+
+// checks every node written, see the `btree_debug` build tag
+const BTREE_DEBUG = true
@@ -0,0 +1,6 @@
+//go:build !btree_debug
+
+package btree
+
+// checks every node written, see the `btree_debug` build tag
+const BTREE_DEBUG = false
@@ -0,0 +1,135 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Longest key or value printed whole, longer ones are cut.
+const DUMP_MAX_BYTES = 32
+
+// Writes a readable breakdown of every node, indented by depth: its page,
+// type, keys, size and key prefix, then each key with its kid and the keys
+// under it, or with its value.
+func (tree *BTree) Dump(w io.Writer) error {
+	d := dumper{w: w}
+	if tree.root == 0 {
+		d.printf("empty tree\n")
+		return d.err
+	}
+
+	var walk func(ptr uint64, depth int)
+	walk = func(ptr uint64, depth int) {
+		node := BNode(tree.get(ptr))
+		indent := strings.Repeat("  ", depth)
+		d.printf("%spage %d: %s, %d keys, %d/%d bytes", indent, ptr, nodeTypeName(node), node.nkeys(), node.nbytes(), tree.pageSize)
+		if prefix := node.prefix(); len(prefix) > 0 {
+			d.printf(", prefix %s", dumpBytes(prefix))
+		}
+		d.printf("\n")
+
+		for i := uint16(0); i < node.nkeys() && d.err == nil; i++ {
+			key := dumpBytes(node.getKey(i))
+			switch {
+			case node.btype() == BNODE_NODE:
+				d.printf("%s  %d %s -> page %d, %d keys\n", indent, i, key, node.getPtr(i), node.getCount(i))
+				walk(node.getPtr(i), depth+1)
+			case node.getPtr(i) != 0:
+				vlen := binary.LittleEndian.Uint64(node.getVal(i))
+				d.printf("%s  %d %s = %dB in overflow pages from %d\n", indent, i, key, vlen, node.getPtr(i))
+			default:
+				d.printf("%s  %d %s = %s\n", indent, i, key, dumpBytes(node.getVal(i)))
+			}
+		}
+	}
+
+	walk(tree.root, 0)
+	return d.err
+}
+
+// Writes the tree as a Graphviz digraph: a record per node with a field per
+// key, an edge per kid link and a box per overflow chain.
+func (tree *BTree) DumpDot(w io.Writer) error {
+	d := dumper{w: w}
+	d.printf("digraph btree {\n\tnode [shape=record];\n")
+
+	var walk func(ptr uint64)
+	walk = func(ptr uint64) {
+		node := BNode(tree.get(ptr))
+
+		fields := make([]string, node.nkeys())
+		for i := range fields {
+			fields[i] = fmt.Sprintf("<k%d> %s", i, dotEscape(dumpBytes(node.getKey(uint16(i)))))
+		}
+		d.printf("\tp%d [label=\"{page %d (%s)|{%s}}\"];\n", ptr, ptr, nodeTypeName(node), strings.Join(fields, "|"))
+
+		for i := uint16(0); i < node.nkeys() && d.err == nil; i++ {
+			kptr := node.getPtr(i)
+			switch {
+			case kptr == 0:
+			case node.btype() == BNODE_NODE:
+				d.printf("\tp%d:k%d -> p%d;\n", ptr, i, kptr)
+				walk(kptr)
+			default:
+				vlen := binary.LittleEndian.Uint64(node.getVal(i))
+				pages := overflowPages(vlen, tree.PageSize())
+				d.printf("\tp%d [shape=box, label=\"overflow: %d pages, %dB\"];\n", kptr, pages, vlen)
+				d.printf("\tp%d:k%d -> p%d [style=dashed];\n", ptr, i, kptr)
+			}
+		}
+	}
+
+	if tree.root != 0 {
+		walk(tree.root)
+	}
+
+	d.printf("}\n")
+	return d.err
+}
+
+// Writes formatted output, keeping the first error and skipping the rest.
+type dumper struct {
+	w   io.Writer
+	err error
+}
+
+func (d *dumper) printf(format string, args ...any) {
+	if d.err == nil {
+		_, d.err = fmt.Fprintf(d.w, format, args...)
+	}
+}
+
+func nodeTypeName(node BNode) string {
+	switch node.btype() {
+	case BNODE_NODE:
+		return "node"
+	case BNODE_LEAF:
+		return "leaf"
+	case BNODE_OVERFLOW:
+		return "overflow"
+	default:
+		return fmt.Sprintf("type %d", node.btype())
+	}
+}
+
+// Quotes the bytes, cutting them at `DUMP_MAX_BYTES`.
+func dumpBytes(b []byte) string {
+	if len(b) <= DUMP_MAX_BYTES {
+		return fmt.Sprintf("%q", b)
+	}
+	return fmt.Sprintf("%q...(%dB)", b[:DUMP_MAX_BYTES], len(b))
+}
+
+// Escapes the characters that have a meaning inside a record label.
+func dotEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`{}|<>"\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
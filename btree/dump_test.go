@@ -0,0 +1,80 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	tree, _ := newTestTree(t, Config{})
+	var out bytes.Buffer
+	if err := tree.Dump(&out); err != nil || out.String() != "empty tree\n" {
+		t.Fatalf("empty tree: %q, %v", out.String(), err)
+	}
+
+	tree.Insert([]byte("a"), []byte("1"))
+	tree.Insert([]byte("a|b"), bytes.Repeat([]byte("x"), 40))
+	tree.Insert([]byte("big"), bytes.Repeat([]byte("o"), 2*BTREE_MAX_VAL_SIZE))
+
+	out.Reset()
+	if err := tree.Dump(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf(`page %d: leaf, 3 keys, 114/4096 bytes
+  0 "a" = "1"
+  1 "a|b" = "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"...(40B)
+  2 "big" = 6000B in overflow pages from %d
+`, tree.root, BNode(tree.get(tree.root)).getPtr(2))
+	if out.String() != want {
+		t.Fatalf("dump:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	for i := range 3000 {
+		tree.Insert(fmt.Appendf(nil, "key%05d", i), []byte("val"))
+	}
+	out.Reset()
+	if err := tree.Dump(&out); err != nil {
+		t.Fatal(err)
+	}
+	stats := tree.Stats()
+	if got := strings.Count(out.String(), " keys, "); got != int(stats.InternalNodes+stats.LeafNodes) {
+		t.Fatalf("%d pages dumped, %+v", got, stats)
+	}
+	if !strings.Contains(out.String(), "\n  0 \"a\" -> page ") || !strings.Contains(out.String(), "\n  page ") {
+		t.Fatal("no kid links or indentation")
+	}
+}
+
+func TestDumpDot(t *testing.T) {
+	tree, _ := newTestTree(t, Config{})
+	var out bytes.Buffer
+	if err := tree.DumpDot(&out); err != nil || out.String() != "digraph btree {\n\tnode [shape=record];\n}\n" {
+		t.Fatalf("empty tree: %q, %v", out.String(), err)
+	}
+
+	tree.Insert([]byte("a|b"), []byte("1"))
+	tree.Insert([]byte("big"), bytes.Repeat([]byte("o"), 2*BTREE_MAX_VAL_SIZE))
+	for i := range 3000 {
+		tree.Insert(fmt.Appendf(nil, "key%05d", i), []byte("val"))
+	}
+
+	out.Reset()
+	if err := tree.DumpDot(&out); err != nil {
+		t.Fatal(err)
+	}
+	dot := out.String()
+
+	// a link per kid and 1 to the overflow chain
+	stats := tree.Stats()
+	if got := strings.Count(dot, " -> "); got != int(stats.InternalNodes+stats.LeafNodes-1)+1 {
+		t.Fatalf("%d edges, %+v", got, stats)
+	}
+	if !strings.Contains(dot, `<k0> \"a\|b\"`) {
+		t.Fatal("the key isn't escaped")
+	}
+	if !strings.Contains(dot, `label="overflow: 2 pages, 6000B"`) {
+		t.Fatal("no overflow chain")
+	}
+}
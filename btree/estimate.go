@@ -0,0 +1,176 @@
+package btree
+
+import "encoding/binary"
+
+// A key-value pair.
+type KV struct {
+	Key []byte
+	Val []byte
+}
+
+// Computes how many pages a tree built bottom-up from `pairs` (sorted) would
+// take, without building it. Each node is packed up to `fillRatio` of
+// `pageSize`, a ratio outside of (0, 1] is treated as 1. The total includes
+// the overflow pages of values too large to be stored inline.
+func EstimatePages(pairs []KV, pageSize int, fillRatio float64) (leafPages, internalPages, total uint64) {
+	if fillRatio <= 0 || fillRatio > 1 {
+		fillRatio = 1
+	}
+	target := int(float64(pageSize) * fillRatio)
+
+	// the first key of each node on the level being packed and the keys
+	// under it
+	firsts := make([][]byte, 0, len(pairs))
+	counts := make([]uint64, 0, len(pairs))
+	for _, kv := range pairs {
+		firsts = append(firsts, kv.Key)
+		counts = append(counts, 1)
+	}
+
+	var overflow uint64
+	sizes := make([]int, len(pairs))
+	for i, kv := range pairs {
+		if overflows(kv.Key, kv.Val) {
+			// only the 8B length is kept inline
+			overflow += overflowPages(uint64(len(kv.Val)), pageSize)
+			sizes[i] = kvSize(kv.Key, make([]byte, 8))
+		} else {
+			sizes[i] = kvSize(kv.Key, kv.Val)
+		}
+	}
+
+	firsts, counts = packLevel(firsts, counts, sizes, target, pageSize, false)
+	leafPages = uint64(len(firsts))
+
+	// internal levels only hold the first key of each kid, a pointer and the
+	// number of keys under it
+	for len(firsts) > 1 {
+		sizes = sizes[:len(firsts)]
+		for i, key := range firsts {
+			sizes[i] = kvSize(key, binary.AppendUvarint(nil, counts[i]))
+		}
+
+		firsts, counts = packLevel(firsts, counts, sizes, target, pageSize, true)
+		internalPages += uint64(len(firsts))
+	}
+
+	return leafPages, internalPages, leafPages + internalPages + overflow
+}
+
+// Returns the bytes taken by the KVs in [start, end) inside the leaves and by
+// their overflow pages, a nil `start` or `end` means no bound on that side.
+// Only the leaves at the 2 ends of the range are read: the keys of the kids
+// between them are counted from the links, and their bytes estimated from the
+// KVs of those leaves, so it's O(log n).
+func (tree *BTree) RangeSize(start, end []byte) uint64 {
+	if tree.root == 0 {
+		return 0
+	}
+
+	var est rangeEstimate
+	est.node(tree, tree.get(tree.root), start, end, true, true)
+	if est.sampled == 0 {
+		return est.exact
+	}
+	return est.exact + est.between*est.sampleBytes/est.sampled
+}
+
+// The bytes of a range, summed in the leaves at its ends and estimated for the
+// kids between them.
+type rangeEstimate struct {
+	exact       uint64 // of the KVs of the range in the leaves read
+	between     uint64 // keys of the kids between them
+	sampleBytes uint64 // of every KV of the leaves read
+	sampled     uint64 // KVs of the leaves read
+}
+
+// Walks down to the leaves holding the ends of the range, the first one if
+// `left` and the last one if `right`, the kids between are counted.
+func (est *rangeEstimate) node(tree *BTree, node BNode, start, end []byte, left, right bool) {
+	nkeys := node.nkeys()
+	if node.btype() == BNODE_LEAF {
+		for i := uint16(0); i < nkeys; i++ {
+			key, size := node.getKey(i), leafKVSize(tree, node, i)
+			est.sampleBytes += size
+			est.sampled++
+			if (start == nil || tree.compare(key, start) >= 0) && (end == nil || tree.compare(key, end) < 0) {
+				est.exact += size
+			}
+		}
+		return
+	}
+
+	lo, hi := uint16(0), nkeys-1
+	if start != nil {
+		lo = nodeLookupLE(node, start, tree.compare)
+	}
+	if end != nil {
+		hi = nodeLookupLE(node, end, tree.compare)
+		if tree.compare(node.getKey(hi), end) >= 0 {
+			if hi == 0 {
+				return // the range ends before the node
+			}
+			hi--
+		}
+	}
+
+	switch {
+	case lo > hi:
+	case lo == hi:
+		est.node(tree, tree.get(node.getPtr(lo)), start, end, left, right)
+	default:
+		if left {
+			est.node(tree, tree.get(node.getPtr(lo)), start, nil, true, false)
+		} else {
+			est.between += node.getCount(lo)
+		}
+		for i := lo + 1; i < hi; i++ {
+			est.between += node.getCount(i)
+		}
+		if right {
+			est.node(tree, tree.get(node.getPtr(hi)), nil, end, false, true)
+		} else {
+			est.between += node.getCount(hi)
+		}
+	}
+}
+
+// Bytes taken by the nth KV of a leaf and by its overflow pages.
+func leafKVSize(tree *BTree, node BNode, idx uint16) uint64 {
+	size := uint64(kvSize(node.getKey(idx), node.getVal(idx)))
+	if node.getPtr(idx) != 0 {
+		vlen := binary.LittleEndian.Uint64(node.getVal(idx))
+		size += overflowPages(vlen, tree.PageSize()) * uint64(tree.pageSize)
+	}
+	return size
+}
+
+// Bytes taken by a single KV in a node: pointer, offset, lengths and data.
+func kvSize(key, val []byte) int {
+	return 8 + 2 + 4 + len(key) + len(val)
+}
+
+// Greedily packs entries into nodes the way `BulkLoad` does, returning the
+// first key of each node and the keys under it.
+func packLevel(keys [][]byte, counts []uint64, sizes []int, target, pageSize int, internal bool) ([][]byte, []uint64) {
+	var firsts [][]byte
+	var sums []uint64
+	used, n := 0, 0 // bytes and entries in the current node
+
+	for i, size := range sizes {
+		if packFull(n, used, size, target, pageSize, internal) {
+			n = 0
+		}
+		if n == 0 {
+			firsts = append(firsts, keys[i])
+			sums = append(sums, 0)
+			used = HEADER
+		}
+
+		sums[len(sums)-1] += counts[i]
+		used += size
+		n++
+	}
+
+	return firsts, sums
+}
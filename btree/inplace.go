@@ -0,0 +1,85 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+`UpdateInPlace` overwrites a value with one of the same size, for values of
+a fixed size such as counters and flags. The leaf is still copied, the tree
+is copy-on-write, but the copy keeps every offset: the new bytes are written
+over the old ones, and the nodes above it only get the new page number of
+their kid. Nothing is split or merged, no separator or key count changes, so
+it costs a copy of each page on the path and no more.
+
+A value in overflow pages is written to a new chain of the same length, the
+leaf keeps its inline size and gets the first page of the new chain.
+*/
+
+var ErrSizeMismatch = errors.New("btree: value of another size")
+
+// Sets the value of a key to `val` of the same size as its current one,
+// without changing the layout of its leaf. Fails with `ErrKeyNotFound` if
+// the key is absent, with `ErrSizeMismatch` for a value of another size, or
+// like `Insert`.
+func (tree *BTree) UpdateInPlace(key, val []byte) (err error) {
+	if err := tree.checkKV(key, val); err != nil {
+		return err
+	}
+	if tree.root == 0 {
+		return fmt.Errorf("%w: %q", ErrKeyNotFound, key)
+	}
+	defer recoverWrite(&err)
+
+	// the nodes from the root down to the leaf, and the link taken in each
+	ptrs := []uint64{tree.root}
+	var path []BNode
+	var idxs []uint16
+	for {
+		node := BNode(tree.get(ptrs[len(ptrs)-1]))
+		idx := nodeLookupLE(node, key, tree.compare)
+		path, idxs = append(path, node), append(idxs, idx)
+		if node.btype() == BNODE_LEAF {
+			break
+		}
+		ptrs = append(ptrs, node.getPtr(idx))
+	}
+
+	leaf, idx := path[len(path)-1], idxs[len(idxs)-1]
+	if tree.compare(leaf.getKey(idx), key) != 0 {
+		return fmt.Errorf("%w: %q", ErrKeyNotFound, key)
+	}
+	size := uint64(len(leaf.getVal(idx)))
+	if leaf.getPtr(idx) != 0 {
+		size = binary.LittleEndian.Uint64(leaf.getVal(idx))
+	}
+	if uint64(len(val)) != size {
+		return fmt.Errorf("%w: %d bytes for %q, it holds %d", ErrSizeMismatch, len(val), key, size)
+	}
+
+	tree.undoable(func() {
+		// the copies of the pages handed out are written from the leaf up
+		updated := BNode(bytes.Clone(leaf))
+		if ptr := leaf.getPtr(idx); ptr != 0 {
+			next, _ := writeOverflow(tree, val)
+			updated.setPtr(idx, next)
+			freeOverflow(tree, ptr)
+		} else {
+			copy(updated.getVal(idx), val)
+		}
+
+		kid := tree.new(updated)
+		for i := len(path) - 2; i >= 0; i-- {
+			tree.del(ptrs[i+1])
+			node := BNode(bytes.Clone(path[i]))
+			node.setPtr(idxs[i], kid)
+			kid = tree.new(node)
+		}
+		tree.del(ptrs[0])
+		tree.root = kid
+	})
+	return nil
+}
@@ -0,0 +1,71 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Values of the same size are written over the old ones, inline or in
+// overflow pages, with the leaves and levels of the tree as they were and no
+// page left behind. A value of another size or a missing key is rejected,
+// leaving the tree as it was.
+func TestUpdateInPlace(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	want := map[string]string{}
+	for i := range 3000 {
+		key, val := fmt.Sprintf("key%05d", i), fmt.Sprintf("val%05d", i)
+		if i%500 == 7 {
+			val = strings.Repeat("o", 2*BTREE_MAX_VAL_SIZE+i)
+		}
+		want[key] = val
+		if err := tree.Insert([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leaves, levels := len(tree.LeafPages()), height(tree)
+
+	for _, key := range slices.Sorted(maps.Keys(want)) {
+		val := bytes.ToUpper([]byte(want[key]))
+		if err := tree.UpdateInPlace([]byte(key), val); err != nil {
+			t.Fatalf("update %q: %v", key, err)
+		}
+		want[key] = string(val)
+	}
+	checkTree(t, tree, mem, want)
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if n, h := len(tree.LeafPages()), height(tree); n != leaves || h != levels {
+		t.Fatalf("%d leaves and %d levels, there were %d and %d", n, h, leaves, levels)
+	}
+
+	root := tree.Root()
+	for _, test := range []struct {
+		key, val string
+		err      error
+	}{
+		{"key00001", "val1", ErrSizeMismatch},
+		{"key00001", "VAL000010", ErrSizeMismatch},
+		{"key00007", "short", ErrSizeMismatch},
+		{"key", "val00000", ErrKeyNotFound},
+		{"key99999", "val00000", ErrKeyNotFound},
+	} {
+		if err := tree.UpdateInPlace([]byte(test.key), []byte(test.val)); !errors.Is(err, test.err) {
+			t.Fatalf("update %q to %q: %v, want %v", test.key, test.val, err, test.err)
+		}
+	}
+	if tree.Root() != root {
+		t.Fatal("a rejected update wrote the tree")
+	}
+	checkTree(t, tree, mem, want)
+
+	empty, _ := newTestTree(t, Config{})
+	if err := empty.UpdateInPlace([]byte("key"), nil); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("update an empty tree: %v", err)
+	}
+}
@@ -0,0 +1,391 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"iter"
+)
+
+// A position in the tree. It remembers the path from the root down to a leaf
+// so it can step across leaf boundaries without starting over from the root.
+// Updating the tree invalidates it.
+type Cursor struct {
+	// bytes of a value `Val` returns at most, 0 for no limit: a longer value
+	// is cut and its overflow pages past the limit aren't read
+	MaxValueBytes int
+
+	// makes the cursor stop at a page it can't read, see `Err`, instead of
+	// panicking like `Config.Get` says
+	ReturnErrors bool
+
+	tree      *BTree
+	path      []BNode  // nodes from the root down to a leaf
+	pos       []uint16 // index into each node of the path
+	run       int      // leaves stepped into in a row, negative going backwards
+	truncated bool     // the last value returned was cut
+	err       error    // of the page it couldn't read, see `ReturnErrors`
+}
+
+// leaves stepped into in a row by a cursor before it reads ahead
+const READ_AHEAD_AFTER = 2
+
+// leaves read ahead at once, see `Config.Prefetch`
+const READ_AHEAD_LEAVES = 8
+
+// leaf position of a cursor that went past the first key
+const beforeFirst = ^uint16(0)
+
+// Returns an unpositioned cursor, one of the seek methods must be called first.
+func (tree *BTree) Cursor() *Cursor {
+	return &Cursor{tree: tree}
+}
+
+// Yields every key-value pair whose key starts with `prefix` in key order, an
+// empty prefix yields the whole tree. The tree must not be updated meanwhile.
+// The prefix is matched bytewise and the scan stops at the first key without
+// it, so a custom comparator must keep the keys sharing a prefix together.
+func (tree *BTree) Scan(prefix []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, val []byte) bool) {
+		cur := tree.Cursor()
+
+		var ok bool
+		if len(prefix) == 0 {
+			ok = cur.SeekToFirst() // the empty key is not the smallest for every comparator
+		} else {
+			ok = cur.Seek(prefix)
+		}
+
+		for ; ok && bytes.HasPrefix(cur.Key(), prefix); ok = cur.Next() {
+			if !yield(cur.Key(), cur.Val()) {
+				return
+			}
+		}
+	}
+}
+
+// Yields the key-value pairs of a run of leaves from `LeafPages` in key order,
+// so that disjoint runs can be scanned by parallel workers: together they yield
+// what `Scan(nil)` does. The tree must not be updated meanwhile, a clone can be
+// scanned while it is, and `Config.Get` must allow the concurrent reads. Panics
+// with an error wrapping `ErrCorrupt` for a page that isn't a leaf.
+func (tree *BTree) ScanLeaves(pages []uint64) iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, val []byte) bool) {
+		for i, ptr := range pages {
+			if tree.prefetch != nil && i%READ_AHEAD_LEAVES == 0 {
+				tree.prefetch(pages[i:min(i+READ_AHEAD_LEAVES, len(pages))])
+			}
+
+			node := BNode(tree.get(ptr))
+			if node.btype() != BNODE_LEAF {
+				panic(corruptf(ptr, "listed as a leaf, type %d", node.btype()))
+			}
+			for j := range node.nkeys() {
+				if !yield(node.getKey(j), tree.leafVal(node, j)) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Yields the key-value pairs whose value satisfies `pred` in key order, for
+// maintenance scans such as finding the keys with an empty value. There's no
+// index of the values, it's a scan of the whole tree, O(n) in the keys and
+// the overflow pages of their values, that only yields the pairs kept. The
+// tree must not be updated meanwhile.
+func (tree *BTree) FindByValue(pred func(val []byte) bool) iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, val []byte) bool) {
+		for key, val := range tree.Scan(nil) {
+			if pred(val) && !yield(key, val) {
+				return
+			}
+		}
+	}
+}
+
+// Returns the error wrapping `ErrCorrupt` or `ErrVersion` of the page that
+// stopped a cursor with `ReturnErrors`, which names the page, or nil. The
+// cursor isn't valid meanwhile, seeking again clears it.
+func (cur *Cursor) Err() error {
+	return cur.err
+}
+
+// Turns the panic of an unreadable page into the error of the cursor, which
+// is left unpositioned, must be deferred by the methods reading pages with
+// `ReturnErrors` set.
+func (cur *Cursor) recoverRead() {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	if e, ok := r.(error); ok && (errors.Is(e, ErrCorrupt) || errors.Is(e, ErrVersion)) {
+		cur.err = e
+		cur.path, cur.pos = cur.path[:0], cur.pos[:0]
+		return
+	}
+	panic(r)
+}
+
+// Descends to the last key <= `key`, or to the first key if they're all greater.
+func (cur *Cursor) seekLE(key []byte) {
+	cur.path, cur.pos = cur.path[:0], cur.pos[:0]
+	cur.run = 0
+	cur.err = nil
+
+	for ptr := cur.tree.root; ptr != 0; {
+		node := BNode(cur.tree.get(ptr))
+		idx := nodeLookupLE(node, key, cur.tree.compare)
+		cur.path = append(cur.path, node)
+		cur.pos = append(cur.pos, idx)
+
+		if node.btype() == BNODE_LEAF {
+			break
+		}
+		ptr = node.getPtr(idx)
+	}
+}
+
+// Positions the cursor at the smallest key, returns whether there's one.
+func (cur *Cursor) SeekToFirst() bool {
+	return cur.seekEdge(func(BNode) uint16 { return 0 })
+}
+
+// Positions the cursor at the largest key, returns whether there's one.
+func (cur *Cursor) SeekToLast() bool {
+	return cur.seekEdge(func(node BNode) uint16 { return node.nkeys() - 1 })
+}
+
+// Descends through the position `pick` gives in every node.
+func (cur *Cursor) seekEdge(pick func(BNode) uint16) bool {
+	if cur.ReturnErrors {
+		defer cur.recoverRead()
+	}
+	cur.path, cur.pos = cur.path[:0], cur.pos[:0]
+	cur.run = 0
+	cur.err = nil
+
+	for ptr := cur.tree.root; ptr != 0; {
+		node := BNode(cur.tree.get(ptr))
+		idx := pick(node)
+		cur.path = append(cur.path, node)
+		cur.pos = append(cur.pos, idx)
+
+		if node.btype() == BNODE_LEAF {
+			break
+		}
+		ptr = node.getPtr(idx)
+	}
+
+	return cur.Valid()
+}
+
+// Returns the smallest key and whether the tree has one. Like the values `Get`
+// returns, it's only valid until the next update.
+func (tree *BTree) First() ([]byte, bool) {
+	cur := tree.Cursor()
+	if !cur.SeekToFirst() {
+		return nil, false
+	}
+	return cur.Key(), true
+}
+
+// Returns the largest key and whether the tree has one, see `First`.
+func (tree *BTree) Last() ([]byte, bool) {
+	cur := tree.Cursor()
+	if !cur.SeekToLast() {
+		return nil, false
+	}
+	return cur.Key(), true
+}
+
+// Positions the cursor at the first key >= `key`, returns whether there's one.
+func (cur *Cursor) Seek(key []byte) bool {
+	if cur.ReturnErrors {
+		defer cur.recoverRead()
+	}
+	cur.seekLE(key)
+	if cur.Valid() && cur.tree.compare(cur.Key(), key) < 0 {
+		cur.Next()
+	}
+
+	return cur.Valid()
+}
+
+// Positions the cursor at the last key <= `key`, returns whether there's one.
+// Followed by `Prev` calls it walks the keys in descending order.
+func (cur *Cursor) SeekForPrev(key []byte) bool {
+	if cur.ReturnErrors {
+		defer cur.recoverRead()
+	}
+	cur.seekLE(key)
+	if cur.Valid() && cur.tree.compare(cur.Key(), key) > 0 {
+		cur.Prev() // every key is greater
+	}
+
+	return cur.Valid()
+}
+
+// Reports whether the cursor is at a key.
+func (cur *Cursor) Valid() bool {
+	if len(cur.path) == 0 {
+		return false
+	}
+
+	leaf := len(cur.path) - 1
+	return cur.pos[leaf] < cur.path[leaf].nkeys()
+}
+
+// Returns the current key, the cursor must be valid.
+func (cur *Cursor) Key() []byte {
+	leaf := len(cur.path) - 1
+	return cur.path[leaf].getKey(cur.pos[leaf])
+}
+
+// Returns the current value, cut to `MaxValueBytes`, the cursor must be
+// valid. The whole value is read with `BTree.Get`. With `ReturnErrors`, it's
+// nil for a value whose overflow pages can't be read, see `Err`.
+func (cur *Cursor) Val() []byte {
+	if cur.ReturnErrors {
+		defer cur.recoverRead()
+	}
+	leaf := len(cur.path) - 1
+	if cur.MaxValueBytes <= 0 {
+		cur.truncated = false
+		return cur.tree.leafVal(cur.path[leaf], cur.pos[leaf])
+	}
+
+	var val []byte
+	val, cur.truncated = cur.tree.leafValPrefix(cur.path[leaf], cur.pos[leaf], uint64(cur.MaxValueBytes))
+	return val
+}
+
+// Reports whether the last value `Val` returned was cut to `MaxValueBytes`.
+func (cur *Cursor) Truncated() bool {
+	return cur.truncated
+}
+
+// Moves to the next key, returns whether there's one. Going past the last key
+// leaves the cursor right after it, where `Prev` can step back.
+func (cur *Cursor) Next() bool {
+	if len(cur.path) == 0 {
+		return false
+	}
+	if cur.ReturnErrors {
+		defer cur.recoverRead()
+	}
+
+	leaf := len(cur.path) - 1
+	switch nkeys := cur.path[leaf].nkeys(); {
+	case cur.pos[leaf] == beforeFirst:
+		cur.pos[leaf] = 0
+	case cur.pos[leaf] >= nkeys:
+		return false // already past the end
+	case !cur.next(leaf):
+		cur.pos[leaf] = nkeys // past the last key
+	}
+
+	return cur.Valid()
+}
+
+// Moves to the previous key, returns whether there's one. Going past the first
+// key leaves the cursor right before it, where `Next` can step forward.
+func (cur *Cursor) Prev() bool {
+	if len(cur.path) == 0 {
+		return false
+	}
+	if cur.ReturnErrors {
+		defer cur.recoverRead()
+	}
+
+	leaf := len(cur.path) - 1
+	switch nkeys := cur.path[leaf].nkeys(); {
+	case cur.pos[leaf] == beforeFirst:
+		return false // already before the start
+	case cur.pos[leaf] >= nkeys:
+		cur.pos[leaf] = nkeys - 1
+	case !cur.prev(leaf):
+		cur.pos[leaf] = beforeFirst // before the first key
+	}
+
+	return cur.Valid()
+}
+
+// Advances the position at `level`, moving to a sibling node through the
+// parent when the node runs out. Returns false, changing nothing, at the end.
+func (cur *Cursor) next(level int) bool {
+	if cur.pos[level]+1 < cur.path[level].nkeys() {
+		cur.pos[level]++ // move within this node
+	} else if level == 0 || !cur.next(level-1) {
+		return false
+	}
+
+	if level+1 < len(cur.path) {
+		// update the kid node
+		if level+2 == len(cur.path) {
+			cur.readAhead(level, 1)
+		}
+		kid := BNode(cur.tree.get(cur.path[level].getPtr(cur.pos[level])))
+		cur.path[level+1] = kid
+		cur.pos[level+1] = 0
+	}
+
+	return true
+}
+
+// Same as `next` but backwards.
+func (cur *Cursor) prev(level int) bool {
+	if cur.pos[level] > 0 {
+		cur.pos[level]-- // move within this node
+	} else if level == 0 || !cur.prev(level-1) {
+		return false
+	}
+
+	if level+1 < len(cur.path) {
+		// update the kid node
+		if level+2 == len(cur.path) {
+			cur.readAhead(level, -1)
+		}
+		kid := BNode(cur.tree.get(cur.path[level].getPtr(cur.pos[level])))
+		cur.path[level+1] = kid
+		cur.pos[level+1] = kid.nkeys() - 1
+	}
+
+	return true
+}
+
+// Counts a step into the next leaf in direction `dir`, from the parent at
+// `level`. Once the cursor went through `READ_AHEAD_AFTER` leaves in a row,
+// the next `READ_AHEAD_LEAVES` under the same parent are prefetched, and again
+// every time it went through them or moved to another parent.
+func (cur *Cursor) readAhead(level int, dir int) {
+	if cur.run*dir < 0 {
+		cur.run = 0
+	}
+	cur.run += dir
+	n := cur.run * dir
+	if cur.tree.prefetch == nil || n < READ_AHEAD_AFTER {
+		return
+	}
+
+	parent := cur.path[level]
+	first := cur.pos[level] == 0
+	if dir < 0 {
+		first = cur.pos[level] == parent.nkeys()-1
+	}
+	if !first && (n-READ_AHEAD_AFTER)%READ_AHEAD_LEAVES != 0 {
+		return
+	}
+
+	var ptrs []uint64
+	for i := 1; i <= READ_AHEAD_LEAVES; i++ {
+		idx := int(cur.pos[level]) + i*dir
+		if idx < 0 || idx >= int(parent.nkeys()) {
+			break
+		}
+		ptrs = append(ptrs, parent.getPtr(uint16(idx)))
+	}
+	if len(ptrs) > 0 {
+		cur.tree.prefetch(ptrs)
+	}
+}
@@ -0,0 +1,449 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Returns a tree of several levels holding "key00000", "key00002" and so on,
+// `n` keys with even numbers.
+func newEvenTree(t *testing.T, n int) *BTree {
+	tree, _ := newTestTree(t, Config{})
+	for i := range n {
+		tree.Insert(fmt.Appendf(nil, "key%05d", 2*i), fmt.Appendf(nil, "val%d", i))
+	}
+	return tree
+}
+
+func TestCursor(t *testing.T) {
+	const n = 3000
+	tree := newEvenTree(t, n)
+	key := func(i int) string { return fmt.Sprintf("key%05d", 2*i) }
+
+	// forward from the first key to past the last one
+	cur := tree.Cursor()
+	i := 0
+	for ok := cur.Seek(nil); ok; ok = cur.Next() {
+		if string(cur.Key()) != key(i) || string(cur.Val()) != fmt.Sprintf("val%d", i) {
+			t.Fatalf("next: %q = %q at %d", cur.Key(), cur.Val(), i)
+		}
+		i++
+	}
+	if i != n || cur.Valid() || cur.Next() {
+		t.Fatalf("%d keys forward, valid %v past the end", i, cur.Valid())
+	}
+
+	// and back from past the last key to before the first one
+	for ok := cur.Prev(); ok; ok = cur.Prev() {
+		i--
+		if string(cur.Key()) != key(i) {
+			t.Fatalf("prev: %q at %d", cur.Key(), i)
+		}
+	}
+	if i != 0 || cur.Valid() || cur.Prev() {
+		t.Fatalf("%d keys left backwards, valid %v before the start", i, cur.Valid())
+	}
+	if !cur.Next() || string(cur.Key()) != key(0) {
+		t.Fatal("next from before the first key")
+	}
+
+	// seeking lands on the key or on the one after the gap
+	for i := range n {
+		for _, target := range []string{key(i), fmt.Sprintf("key%05d", 2*i-1)} {
+			if !cur.Seek([]byte(target)) || string(cur.Key()) != key(i) {
+				t.Fatalf("seek %q: %v at %q", target, cur.Valid(), cur.Key())
+			}
+		}
+		if i > 0 && (!cur.Prev() || string(cur.Key()) != key(i-1)) {
+			t.Fatalf("prev after seeking %q", key(i))
+		}
+	}
+	if cur.Seek([]byte("zzz")) {
+		t.Fatalf("seek past the keys: at %q", cur.Key())
+	}
+	if !cur.Prev() || string(cur.Key()) != key(n-1) {
+		t.Fatal("prev after seeking past the keys")
+	}
+}
+
+func TestCursorEmpty(t *testing.T) {
+	tree, _ := newTestTree(t, Config{})
+	cur := tree.Cursor()
+	if cur.Valid() || cur.Next() || cur.Prev() {
+		t.Fatal("an unpositioned cursor moved")
+	}
+	if cur.Seek(nil) || cur.Valid() || cur.Next() || cur.Prev() {
+		t.Fatal("a cursor on an empty tree moved")
+	}
+
+	// a single leaf
+	tree.Insert([]byte("b"), []byte("1"))
+	if !cur.Seek([]byte("a")) || string(cur.Key()) != "b" || cur.Next() || !cur.Prev() || cur.Prev() {
+		t.Fatal("a cursor on a single key")
+	}
+}
+
+func TestSeekForPrev(t *testing.T) {
+	const n = 2000
+	tree := newEvenTree(t, n) // the odd numbers fall in between
+
+	cur := tree.Cursor()
+	for q := -1; q <= 2*n; q++ {
+		key := fmt.Appendf(nil, "key%05d", q)
+		if q < 0 {
+			key = []byte("a") // before every key
+		}
+		want := min(q, 2*n-1) / 2 // position of the last key <= `key`
+		if q < 0 {
+			want = -1
+		}
+
+		if ok := cur.SeekForPrev(key); ok != (want >= 0) {
+			t.Fatalf("seek for prev %q: %v", key, ok)
+		}
+		for i := want; i >= max(want-3, 0); i-- {
+			if got := fmt.Sprintf("key%05d", 2*i); !cur.Valid() || string(cur.Key()) != got {
+				t.Fatalf("seek for prev %q: at %q, want %q", key, cur.Key(), got)
+			}
+			cur.Prev()
+		}
+	}
+
+	cur.SeekForPrev([]byte("key00002"))
+	if cur.Prev(); !cur.Valid() || string(cur.Key()) != "key00000" {
+		t.Fatal("prev from the second key")
+	}
+	if cur.Prev() || cur.Valid() {
+		t.Fatal("prev from the first key")
+	}
+	if !cur.Next() || string(cur.Key()) != "key00000" {
+		t.Fatal("next from before the first key")
+	}
+}
+
+func TestFirstLast(t *testing.T) {
+	tree, _ := newTestTree(t, Config{})
+	if _, ok := tree.First(); ok {
+		t.Fatal("empty tree: a first key")
+	}
+	if _, ok := tree.Last(); ok {
+		t.Fatal("empty tree: a last key")
+	}
+
+	const n = 3000
+	tree = newEvenTree(t, n)
+	first, ok1 := tree.First()
+	last, ok2 := tree.Last()
+	if !ok1 || !ok2 || string(first) != "key00000" || string(last) != fmt.Sprintf("key%05d", 2*n-2) {
+		t.Fatalf("first %q, last %q", first, last)
+	}
+
+	// the cursor can step inwards from either end
+	cur := tree.Cursor()
+	if !cur.SeekToLast() || string(cur.Val()) != fmt.Sprintf("val%d", n-1) || cur.Next() || !cur.Prev() || !cur.Prev() {
+		t.Fatal("seek to last")
+	}
+	if string(cur.Key()) != fmt.Sprintf("key%05d", 2*n-4) {
+		t.Fatalf("prev from the last key: at %q", cur.Key())
+	}
+	if !cur.SeekToFirst() || cur.Prev() || !cur.Next() || string(cur.Key()) != "key00000" {
+		t.Fatal("seek to first")
+	}
+
+	// the ends follow the updates
+	tree.Insert([]byte("a"), nil)
+	tree.Delete(last)
+	first, _ = tree.First()
+	last, _ = tree.Last()
+	if string(first) != "a" || string(last) != fmt.Sprintf("key%05d", 2*n-4) {
+		t.Fatalf("after updating: first %q, last %q", first, last)
+	}
+}
+
+func TestScan(t *testing.T) {
+	tree, _ := newTestTree(t, Config{})
+	for range tree.Scan(nil) {
+		t.Fatal("empty tree: yielded a pair")
+	}
+
+	want := map[string][]string{}
+	for i := range 3000 {
+		// "a/0000", "b/0001", ... and keys without a slash in between
+		key := fmt.Sprintf("%c/%04d", 'a'+i%5, i)
+		if i%7 == 0 {
+			key = fmt.Sprintf("%c%04d", 'a'+i%5, i)
+		}
+		tree.Insert([]byte(key), []byte(key))
+		want[key[:2]] = append(want[key[:2]], key)
+	}
+
+	for _, prefix := range []string{"a/", "c/", "e/", "b0", "f/", "a/00", "a/0000"} {
+		var keys []string
+		for key, val := range tree.Scan([]byte(prefix)) {
+			if string(key) != string(val) {
+				t.Fatalf("scan %q: %q = %q", prefix, key, val)
+			}
+			keys = append(keys, string(key))
+		}
+		if !slices.IsSorted(keys) {
+			t.Fatalf("scan %q: out of order", prefix)
+		}
+		exp := slices.Sorted(func(yield func(string) bool) {
+			for _, key := range want[prefix[:2]] {
+				if strings.HasPrefix(key, prefix) && !yield(key) {
+					return
+				}
+			}
+		})
+		if !slices.Equal(keys, exp) {
+			t.Fatalf("scan %q: %d keys, want %d", prefix, len(keys), len(exp))
+		}
+	}
+
+	n := 0
+	for range tree.Scan(nil) {
+		n++
+	}
+	if n != 3000 {
+		t.Fatalf("the whole tree yielded %d pairs", n)
+	}
+
+	// the loop can stop early
+	n = 0
+	for range tree.Scan([]byte("a/")) {
+		if n++; n == 10 {
+			break
+		}
+	}
+	if n != 10 {
+		t.Fatalf("stopped after %d pairs", n)
+	}
+}
+
+// Among empty, short and overflowing values, the keys with an empty value
+// are found in order, and so are the ones of a value prefix.
+func TestFindByValue(t *testing.T) {
+	tree, _ := newTestTree(t, Config{})
+	var empty, large []string
+	for i := range 3000 {
+		key := fmt.Sprintf("key%05d", i)
+		val := fmt.Sprintf("val%d", i)
+		switch {
+		case i%3 == 0:
+			val = ""
+			empty = append(empty, key)
+		case i%100 == 1:
+			val = strings.Repeat("o", 2*BTREE_MAX_VAL_SIZE)
+			large = append(large, key)
+		}
+		if err := tree.Insert([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	find := func(pred func(val []byte) bool) []string {
+		var keys []string
+		for key, val := range tree.FindByValue(pred) {
+			if !pred(val) {
+				t.Fatalf("%q = %q yielded", key, val)
+			}
+			keys = append(keys, string(key))
+		}
+		return keys
+	}
+	if keys := find(func(val []byte) bool { return len(val) == 0 }); !slices.Equal(keys, empty) {
+		t.Fatalf("%d keys with an empty value, want %d", len(keys), len(empty))
+	}
+	if keys := find(func(val []byte) bool { return strings.HasPrefix(string(val), "oo") }); !slices.Equal(keys, large) {
+		t.Fatalf("%d keys with a large value, want %d", len(keys), len(large))
+	}
+	if keys := find(func(val []byte) bool { return false }); keys != nil {
+		t.Fatalf("%d keys yielded for no value", len(keys))
+	}
+
+	// the loop can stop early
+	n := 0
+	for range tree.FindByValue(func(val []byte) bool { return len(val) == 0 }) {
+		if n++; n == 10 {
+			break
+		}
+	}
+	if n != 10 {
+		t.Fatalf("stopped after %d pairs", n)
+	}
+}
+
+// A cursor going through consecutive leaves, either way, prefetches the
+// leaves ahead of it, but not one only stepping into the next leaf.
+func TestReadAhead(t *testing.T) {
+	fetched := map[uint64]int{}
+	tree, _ := newTestTree(t, Config{Prefetch: func(ptrs []uint64) {
+		for _, ptr := range ptrs {
+			fetched[ptr]++
+		}
+	}})
+	for i := range 3000 {
+		tree.Insert(fmt.Appendf(nil, "key%05d", i), []byte("val"))
+	}
+	leaves := tree.LeafPages()
+
+	cur := tree.Cursor()
+	cur.Seek([]byte("key00000"))
+	for cur.Next() && string(cur.Key()) < "key00100" {
+	}
+	if len(fetched) != 0 {
+		t.Fatalf("%d pages prefetched stepping into a single leaf", len(fetched))
+	}
+
+	for _, back := range []bool{false, true} {
+		clear(fetched)
+		if back {
+			for ok := cur.SeekToLast(); ok; ok = cur.Prev() {
+			}
+		} else {
+			for ok := cur.SeekToFirst(); ok; ok = cur.Next() {
+			}
+		}
+		for ptr := range fetched {
+			if !slices.Contains(leaves, ptr) {
+				t.Fatalf("back %v: prefetched page %d isn't a leaf", back, ptr)
+			}
+		}
+		if len(fetched) < len(leaves)/2 {
+			t.Fatalf("back %v: %d of %d leaves prefetched", back, len(fetched), len(leaves))
+		}
+	}
+}
+
+// A cursor with a limit cuts the longer values and says so, reading only the
+// overflow pages it returns, while `Get` returns them whole.
+func TestMaxValueBytes(t *testing.T) {
+	reads := 0
+	mem := &memPages{pages: map[uint64][]byte{}, next: 1}
+	cfg := mem.config(Config{})
+	get := cfg.Get
+	cfg.Get = func(ptr uint64) []byte {
+		reads++
+		return get(ptr)
+	}
+	tree, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vals := map[string]string{}
+	for i := range 200 {
+		val := strings.Repeat(fmt.Sprint(i%10), i%20)
+		if i%50 == 0 {
+			val = strings.Repeat(fmt.Sprint(i%10), 20*BTREE_PAGE_SIZE)
+		}
+		key := fmt.Sprintf("key%03d", i)
+		tree.Insert([]byte(key), []byte(val))
+		vals[key] = val
+	}
+
+	for _, limit := range []int{0, 1, 10, BTREE_PAGE_SIZE} {
+		cur := tree.Cursor()
+		cur.MaxValueBytes = limit
+		n := 0
+		for ok := cur.SeekToFirst(); ok; ok = cur.Next() {
+			full := vals[string(cur.Key())]
+			want, cut := full, false
+			if limit > 0 && len(full) > limit {
+				want, cut = full[:limit], true
+			}
+			reads = 0
+			if val := cur.Val(); string(val) != want || cur.Truncated() != cut {
+				t.Fatalf("limit %d: %q: %d bytes, truncated %v, want %d", limit, cur.Key(), len(val), cur.Truncated(), len(want))
+			}
+			if len(full) > BTREE_MAX_VAL_SIZE && cut && reads > limit/BTREE_PAGE_SIZE+1 {
+				t.Fatalf("limit %d: %d overflow pages read for %d bytes", limit, reads, limit)
+			}
+			if val, _ := tree.Get(cur.Key()); string(val) != full {
+				t.Fatalf("limit %d: get %q: %d bytes, want %d", limit, cur.Key(), len(val), len(full))
+			}
+			n++
+		}
+		if n != len(vals) {
+			t.Fatalf("limit %d: %d keys", limit, n)
+		}
+	}
+}
+
+// A cursor with `ReturnErrors` stops at a damaged leaf, or a damaged overflow
+// page, with an error naming the page instead of panicking. Seeking past it
+// goes on, and a cursor without it still panics.
+func TestCursorErr(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	for i := range 3000 {
+		val := fmt.Appendf(nil, "val%d", i)
+		if i == 2500 {
+			val = []byte(strings.Repeat("o", 2*BTREE_MAX_VAL_SIZE))
+		}
+		tree.Insert(fmt.Appendf(nil, "key%05d", i), val)
+	}
+	leaves := tree.LeafPages()
+	damaged := leaves[len(leaves)/2]
+	first := BNode(tree.get(damaged)).getKey(0)
+	mem.pages[damaged][HEADER] ^= 1
+
+	check := func(cur *Cursor, ptr uint64) {
+		t.Helper()
+		if cur.Valid() {
+			t.Fatal("valid at a damaged page")
+		}
+		err := cur.Err()
+		if !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), fmt.Sprintf("page %d:", ptr)) {
+			t.Fatalf("damaged page %d: %v", ptr, err)
+		}
+	}
+	cur := tree.Cursor()
+	cur.ReturnErrors = true
+	n := 0
+	for ok := cur.SeekToFirst(); ok; ok = cur.Next() {
+		if string(cur.Key()) >= string(first) {
+			t.Fatalf("%q read from the damaged leaf", cur.Key())
+		}
+		n++
+	}
+	check(cur, damaged)
+	if n == 0 || cur.Next() || cur.Prev() {
+		t.Fatalf("%d keys before the damaged leaf, then moved on", n)
+	}
+	for ok := cur.SeekToLast(); ok; ok = cur.Prev() {
+		n++
+	}
+	check(cur, damaged)
+	if n >= 3000 {
+		t.Fatalf("%d keys read around the damaged leaf", n)
+	}
+	if cur.Seek(first) {
+		t.Fatal("seek into the damaged leaf")
+	}
+	check(cur, damaged)
+
+	// past it
+	if !cur.Seek([]byte("key02000")) || cur.Err() != nil || string(cur.Val()) != "val2000" {
+		t.Fatalf("seek past the damaged leaf: %q, %v", cur.Key(), cur.Err())
+	}
+	cur.Seek([]byte("key02500"))
+	overflow := cur.path[len(cur.path)-1].getPtr(cur.pos[len(cur.pos)-1])
+	if overflow == 0 {
+		t.Fatal("the large value is inline")
+	}
+	mem.pages[overflow][HEADER] ^= 1
+	if val := cur.Val(); val != nil {
+		t.Fatalf("%d bytes of a damaged value", len(val))
+	}
+	check(cur, overflow)
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("no panic without ReturnErrors")
+		}
+	}()
+	for range tree.Scan(nil) {
+	}
+}
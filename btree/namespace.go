@@ -0,0 +1,85 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"iter"
+)
+
+/*
+A namespace is a keyspace of its own within the tree: `Namespace` returns a
+view whose keys are stored behind the name of the namespace, which it adds on
+the way in and strips on the way out. The name is stored with its length in
+front, 2 bytes big-endian, so that no key of a namespace starts like a key of
+another one: "a" and "ab" hold the same keys apart, which a bare prefix
+wouldn't. The keys of a namespace sit together in the tree, a range from the
+name to the next one, so its scans stop at its last key.
+
+The view is only a way of naming keys, it holds no state: the keys inserted
+into the tree directly share it with the namespaces, and must not be made like
+theirs. A key of a namespace takes `len(name)+2` bytes more of
+`BTREE_MAX_KEY_SIZE`. Like `Scan` with a prefix, a custom comparator must keep
+the keys sharing a prefix together.
+*/
+
+// A view of the keys of a namespace of a tree, see `BTree.Namespace`. It's
+// used like the tree, and updates it.
+type Scoped struct {
+	tree   *BTree
+	prefix []byte // in front of every key of the namespace
+}
+
+// Returns a view of the keys of the namespace `name`, apart from the keys of
+// every other namespace.
+func (tree *BTree) Namespace(name []byte) *Scoped {
+	prefix := binary.BigEndian.AppendUint16(nil, uint16(len(name)))
+	return &Scoped{tree: tree, prefix: append(prefix, name...)}
+}
+
+// Returns the key a key of the namespace is stored under.
+func (s *Scoped) key(key []byte) []byte {
+	return append(s.prefix[:len(s.prefix):len(s.prefix)], key...)
+}
+
+// Returns the first key past the namespace, nil if there's none.
+func (s *Scoped) end() []byte {
+	end := bytes.Clone(s.prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i]++; end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// Returns the value of a key of the namespace, like `BTree.Get`.
+func (s *Scoped) Get(key []byte) ([]byte, bool) {
+	return s.tree.Get(s.key(key))
+}
+
+// Inserts or updates a key of the namespace, like `BTree.Insert`.
+func (s *Scoped) Insert(key, val []byte) error {
+	return s.tree.Insert(s.key(key), val)
+}
+
+// Removes a key of the namespace, like `BTree.Delete`.
+func (s *Scoped) Delete(key []byte) (bool, error) {
+	return s.tree.Delete(s.key(key))
+}
+
+// Yields the key-value pairs of the namespace whose key starts with `prefix`
+// in key order, like `BTree.Scan`. The keys are yielded without the name.
+func (s *Scoped) Scan(prefix []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, val []byte) bool) {
+		for key, val := range s.tree.Scan(s.key(prefix)) {
+			if !yield(key[len(s.prefix):], val) {
+				return
+			}
+		}
+	}
+}
+
+// Returns the number of keys in the namespace.
+func (s *Scoped) Len() uint64 {
+	return s.tree.Count(s.prefix, s.end())
+}
@@ -0,0 +1,80 @@
+package btree
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+	"testing"
+)
+
+// Namespaces holding the same keys, one of them named like the start of
+// another, and keys of the tree around them, each read, scan and count their
+// own keys only.
+func TestNamespace(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	names := []string{"", "a", "ab", "b", "\xff\xff"}
+	wants := map[string]map[string]string{}
+	for _, name := range names {
+		ns := tree.Namespace([]byte(name))
+		wants[name] = map[string]string{}
+		for i := range 300 {
+			key, val := fmt.Sprintf("key%03d", i), fmt.Sprintf("%s=%d", name, i)
+			if i%10 == 0 {
+				key = "b" + key // the name of another namespace
+			}
+			if err := ns.Insert([]byte(key), []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+			wants[name][key] = val
+		}
+	}
+	for _, key := range []string{"", "\x00", "\x00\x01", "\xff"} {
+		tree.Insert([]byte(key), []byte("tree"))
+	}
+
+	for i, name := range names {
+		ns := tree.Namespace([]byte(name))
+		want := wants[name]
+		if i%2 == 0 {
+			for key := range want {
+				if strings.HasSuffix(key, "7") {
+					if deleted, err := ns.Delete([]byte(key)); !deleted || err != nil {
+						t.Fatalf("%q: delete %q: %v, %v", name, key, deleted, err)
+					}
+					delete(want, key)
+				}
+			}
+		}
+		if deleted, _ := ns.Delete([]byte("missing")); deleted {
+			t.Fatalf("%q: deleted a missing key", name)
+		}
+
+		for key, val := range want {
+			if got, ok := ns.Get([]byte(key)); !ok || string(got) != val {
+				t.Fatalf("%q: get %q: %q, %v, want %q", name, key, got, ok, val)
+			}
+		}
+		got := map[string]string{}
+		for key, val := range ns.Scan(nil) {
+			got[string(key)] = string(val)
+		}
+		if !maps.Equal(got, want) {
+			t.Fatalf("%q: scanned %d keys, want %d", name, len(got), len(want))
+		}
+		n := 0
+		for key := range ns.Scan([]byte("b")) {
+			if !strings.HasPrefix(string(key), "b") {
+				t.Fatalf("%q: scan of b yields %q", name, key)
+			}
+			n++
+		}
+		if n != 30 {
+			t.Fatalf("%q: %d keys with b", name, n)
+		}
+		if n := ns.Len(); n != uint64(len(want)) {
+			t.Fatalf("%q: %d keys counted, want %d", name, n, len(want))
+		}
+	}
+
+	checkTree(t, tree, mem, treePairs(tree))
+}
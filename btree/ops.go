@@ -0,0 +1,173 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+/*
+A batch of ops is applied all or nothing: `Apply` first works out what every
+op would do, each one seeing the ones before it, and writes nothing if one of
+them can't be applied. `DryRun` stops there, so a caller can look at the
+outcome of a batch before deciding to apply it, or check it on a copy made by
+`Clone` while the tree is updated.
+
+`Swap` writes both of its keys in a single update the same way: the pages
+written for the first key are taken back if the second one fails, and the
+ones the first key freed are only freed once both are written.
+*/
+
+// kinds of `Op`
+const (
+	OP_PUT    = 0 // sets `Key` to `Val`
+	OP_DELETE = 1 // removes `Key`, if it's there
+	OP_PUT_IF = 2 // sets `Key` to `Val` if its value is `Expected`, or if it's absent for a nil `Expected`
+)
+
+// An update of a batch, see `Apply`.
+type Op struct {
+	Kind     int
+	Key      []byte
+	Val      []byte
+	Expected []byte // for `OP_PUT_IF`
+}
+
+// What an op of a batch does, or would do.
+type OpResult struct {
+	Existed bool  // the key was there before the op
+	Changed bool  // the op writes the key: every put that can be applied, a delete of a key that's there
+	Err     error // why the op can't be applied, `ErrConflict` for a condition that doesn't hold
+}
+
+var (
+	ErrConflict    = errors.New("btree: condition of an op doesn't hold")
+	ErrBadOp       = errors.New("btree: unknown op")
+	ErrKeyNotFound = errors.New("btree: key not found")
+)
+
+// Returns what applying the ops would do to the tree as it is, without
+// writing anything. Works on a copy made by `Clone` too. Fails with an error
+// wrapping `ErrCorrupt` or `ErrVersion` for a damaged page.
+func (tree *BTree) DryRun(ops []Op) (results []OpResult, err error) {
+	defer recoverWrite(&err)
+	return tree.evalOps(ops), nil
+}
+
+// Applies the ops in order, all of them or, if one can't be applied, none.
+// Returns what each one did, the same `DryRun` returns right before. Fails
+// with the error of the first op that can't be applied, or like `Delete`.
+func (tree *BTree) Apply(ops []Op) (results []OpResult, err error) {
+	if tree.readOnly {
+		return nil, ErrReadOnly
+	}
+	defer recoverWrite(&err)
+
+	results = tree.evalOps(ops)
+	for i, res := range results {
+		if res.Err != nil {
+			return results, fmt.Errorf("op %d: %w", i, res.Err)
+		}
+	}
+
+	tree.undoable(func() {
+		for _, op := range ops {
+			var err error
+			if op.Kind == OP_DELETE {
+				_, err = tree.Delete(op.Key)
+			} else {
+				err = tree.Insert(op.Key, op.Val)
+			}
+			if err != nil {
+				panic(err) // takes back the ops before it
+			}
+		}
+	})
+	return results, nil
+}
+
+// Exchanges the values of 2 keys, both or neither. Fails with
+// `ErrKeyNotFound` if either of them is absent, or like `Apply`.
+func (tree *BTree) Swap(keyA, keyB []byte) (err error) {
+	if tree.readOnly {
+		return ErrReadOnly
+	}
+	defer recoverWrite(&err)
+
+	valA, okA := tree.Get(keyA)
+	valB, okB := tree.Get(keyB)
+	switch {
+	case !okA:
+		return fmt.Errorf("%w: %q", ErrKeyNotFound, keyA)
+	case !okB:
+		return fmt.Errorf("%w: %q", ErrKeyNotFound, keyB)
+	}
+	// they point into pages the update frees
+	valA, valB = bytes.Clone(valA), bytes.Clone(valB)
+
+	tree.undoable(func() {
+		if err := tree.Insert(keyA, valB); err != nil {
+			panic(err)
+		}
+		if err := tree.Insert(keyB, valA); err != nil {
+			panic(err) // takes back the first one
+		}
+	})
+	return nil
+}
+
+// A key an evaluation of a batch went through, and its value after the ops so
+// far.
+type opKey struct {
+	key    []byte
+	val    []byte
+	exists bool
+}
+
+// Works out what every op does, each one seeing the ones before it that can
+// be applied.
+func (tree *BTree) evalOps(ops []Op) []OpResult {
+	results := make([]OpResult, len(ops))
+	var keys []opKey // sorted
+
+	for i, op := range ops {
+		idx, found := slices.BinarySearchFunc(keys, op.Key, func(k opKey, key []byte) int {
+			return tree.compare(k.key, key)
+		})
+		if !found {
+			val, ok := tree.Get(op.Key)
+			keys = slices.Insert(keys, idx, opKey{key: op.Key, val: val, exists: ok})
+		}
+		state, res := &keys[idx], &results[i]
+		res.Existed = state.exists
+
+		switch op.Kind {
+		case OP_PUT, OP_PUT_IF:
+			res.Err = tree.checkSize(op.Key, op.Val)
+			if res.Err == nil && op.Kind == OP_PUT_IF && !matches(state.val, state.exists, op.Expected) {
+				res.Err = ErrConflict
+			}
+			if res.Err == nil {
+				state.val, state.exists = op.Val, true
+				res.Changed = true
+			}
+		case OP_DELETE:
+			res.Changed = state.exists
+			state.val, state.exists = nil, false
+		default:
+			res.Err = fmt.Errorf("%w: kind %d", ErrBadOp, op.Kind)
+		}
+	}
+
+	return results
+}
+
+// Reports whether a value matches the one a conditional update expects, nil
+// meaning that the key is absent.
+func matches(val []byte, exists bool, expected []byte) bool {
+	if expected == nil {
+		return !exists
+	}
+	return exists && bytes.Equal(val, expected)
+}
@@ -0,0 +1,242 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// What `DryRun` predicts on a copy is what `Apply` then does: the same
+// results, and the tree updated by every op, or by none when one of them
+// can't be applied. `DryRun` writes nothing.
+func TestDryRun(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	tree, mem := newTestTree(t, Config{})
+	want := map[string]string{}
+	key := func() []byte { return fmt.Appendf(nil, "key%03d", rng.IntN(300)) }
+	for range 200 {
+		k := key()
+		tree.Insert(k, []byte("v0"))
+		want[string(k)] = "v0"
+	}
+
+	applied, failed := 0, 0
+	for round := range 200 {
+		ops := make([]Op, 1+rng.IntN(20))
+		for i := range ops {
+			k := key()
+			val := []byte(fmt.Sprintf("v%d", round))
+			if rng.IntN(10) == 0 {
+				val = []byte(strings.Repeat("o", 2*BTREE_MAX_VAL_SIZE))
+			}
+			switch rng.IntN(4) {
+			case 0:
+				ops[i] = Op{Kind: OP_PUT, Key: k, Val: val}
+			case 1:
+				ops[i] = Op{Kind: OP_DELETE, Key: k}
+			case 2:
+				// mostly right, as it would be after reading it
+				old, ok := want[string(k)]
+				var expected []byte
+				if ok {
+					expected = []byte(old)
+				}
+				if rng.IntN(20) == 0 {
+					expected = []byte("stale")
+				}
+				ops[i] = Op{Kind: OP_PUT_IF, Key: k, Val: val, Expected: expected}
+			case 3:
+				// a put of this key in the batch must come first
+				ops[i] = Op{Kind: OP_PUT_IF, Key: k, Val: val, Expected: []byte(fmt.Sprintf("v%d", round))}
+			}
+		}
+		if rng.IntN(50) == 0 {
+			ops[rng.IntN(len(ops))].Key = make([]byte, BTREE_MAX_KEY_SIZE+1)
+		}
+
+		before := treePairs(tree)
+		pages := len(mem.pages)
+		snap := tree.Clone()
+		predicted, err := snap.DryRun(ops)
+		snap.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(mem.pages) != pages {
+			t.Fatalf("round %d: the dry run wrote %d pages", round, len(mem.pages)-pages)
+		}
+
+		results, err := tree.Apply(ops)
+		if !slices.EqualFunc(results, predicted, func(a, b OpResult) bool {
+			return a.Existed == b.Existed && a.Changed == b.Changed && fmt.Sprint(a.Err) == fmt.Sprint(b.Err)
+		}) {
+			t.Fatalf("round %d: applied %v, predicted %v", round, results, predicted)
+		}
+		firstErr := slices.IndexFunc(predicted, func(res OpResult) bool { return res.Err != nil })
+		if firstErr >= 0 {
+			if want := fmt.Sprintf("op %d: %v", firstErr, predicted[firstErr].Err); err == nil || err.Error() != want {
+				t.Fatalf("round %d: %v, predicted %v", round, err, predicted[firstErr].Err)
+			}
+			if !maps.Equal(treePairs(tree), before) {
+				t.Fatalf("round %d: a batch that failed was written", round)
+			}
+			failed++
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, op := range ops {
+			_, existed := want[string(op.Key)]
+			if results[i].Existed != existed {
+				t.Fatalf("round %d: op %d: existed %v", round, i, results[i].Existed)
+			}
+			if op.Kind == OP_DELETE {
+				delete(want, string(op.Key))
+			} else {
+				want[string(op.Key)] = string(op.Val)
+			}
+		}
+		checkTree(t, tree, mem, want)
+		applied++
+	}
+	if applied < 20 || failed < 20 {
+		t.Fatalf("%d batches applied, %d failed", applied, failed)
+	}
+}
+
+// An op with a condition sees the ops before it in the batch, and a failed
+// batch gives every op's outcome.
+func TestApply(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	tree.Insert([]byte("a"), []byte("1"))
+
+	ops := []Op{
+		{Kind: OP_PUT_IF, Key: []byte("b"), Val: []byte("1")},
+		{Kind: OP_PUT_IF, Key: []byte("b"), Val: []byte("2"), Expected: []byte("1")},
+		{Kind: OP_DELETE, Key: []byte("a")},
+		{Kind: OP_DELETE, Key: []byte("a")},
+		{Kind: OP_PUT_IF, Key: []byte("a"), Val: []byte("3"), Expected: []byte("1")},
+		{Kind: 7, Key: []byte("c")},
+	}
+	want := []OpResult{
+		{Changed: true},
+		{Existed: true, Changed: true},
+		{Existed: true, Changed: true},
+		{},
+		{Err: ErrConflict},
+		{Err: ErrBadOp},
+	}
+	results, err := tree.Apply(ops)
+	if !errors.Is(err, ErrConflict) || len(results) != len(want) {
+		t.Fatalf("%v: %v", results, err)
+	}
+	for i, res := range results {
+		if res.Existed != want[i].Existed || res.Changed != want[i].Changed || !errors.Is(res.Err, want[i].Err) {
+			t.Fatalf("op %d: %+v, want %+v", i, res, want[i])
+		}
+	}
+	checkTree(t, tree, mem, map[string]string{"a": "1"})
+
+	if _, err := tree.Apply(ops[:4]); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, tree, mem, map[string]string{"b": "2"})
+
+	snap := tree.Clone()
+	defer snap.Close()
+	if _, err := snap.Apply(ops[:1]); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("apply to a copy: %v", err)
+	}
+}
+
+// A swap exchanges the values of 2 keys, overflow pages and all. One with a
+// key missing writes nothing, and so does one that crashes halfway: the tree
+// keeps both values.
+func TestSwap(t *testing.T) {
+	crashAt := -1 // allocations left before a crash
+	crash := errors.New("crash")
+	mem := &memPages{pages: map[uint64][]byte{}, next: 1}
+	cfg := mem.config(Config{})
+	alloc := cfg.New
+	cfg.New = func(page []byte) uint64 {
+		if crashAt == 0 {
+			panic(crash)
+		}
+		crashAt--
+		return alloc(page)
+	}
+	tree, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{}
+	for i := range 2000 {
+		key, val := fmt.Sprintf("key%04d", i), fmt.Sprint(i)
+		if i%100 == 0 {
+			val = strings.Repeat("o", 2*BTREE_MAX_VAL_SIZE+i)
+		}
+		tree.Insert([]byte(key), []byte(val))
+		want[key] = val
+	}
+
+	swap := func(a, b string) {
+		t.Helper()
+		if err := tree.Swap([]byte(a), []byte(b)); err != nil {
+			t.Fatal(err)
+		}
+		want[a], want[b] = want[b], want[a]
+		checkTree(t, tree, mem, want)
+	}
+	swap("key0001", "key1999")
+	swap("key0100", "key0002")
+	swap("key0500", "key0500")
+	if err := tree.Swap([]byte("key0001"), []byte("nope")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("swap with a missing key: %v", err)
+	}
+	if err := tree.Swap([]byte("nope"), []byte("key0001")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("swap with a missing key: %v", err)
+	}
+	checkTree(t, tree, mem, want)
+
+	// crashes at every allocation of a swap, in the second key too
+	crashes := 0
+	for n := 0; ; n++ {
+		root := tree.root
+		crashAt = n
+		crashed := func() (crashed bool) {
+			defer func() {
+				if r := recover(); r != nil {
+					if r != crash {
+						panic(r)
+					}
+					crashed = true
+				}
+			}()
+			if err := tree.Swap([]byte("key0000"), []byte("key1500")); err != nil {
+				t.Fatal(err)
+			}
+			return false
+		}()
+		crashAt = -1
+		if !crashed {
+			want["key0000"], want["key1500"] = want["key1500"], want["key0000"]
+			checkTree(t, tree, mem, want)
+			break
+		}
+		crashes++
+		if tree.root != root {
+			t.Fatalf("crash at allocation %d: the root changed", n)
+		}
+		checkTree(t, tree, mem, want)
+	}
+	if crashes < 4 {
+		t.Fatalf("%d crashes", crashes)
+	}
+}
@@ -0,0 +1,136 @@
+package btree
+
+import "encoding/binary"
+
+/*
+Values larger than `BTREE_MAX_VAL_SIZE` are stored in a chain of overflow pages.
+The leaf keeps the first page of the chain in the KV's pointer (unused in leaves)
+and the total length of the value as an 8B inline value.
+
+# Overflow page:
+
+	| type | flags | size | checksum | commit | next | data | unused |
+	|  1B  |   1B  |  2B  |    4B    |   8B   |  8B  | ...  |        |
+
+With `Config.LongKeys`, a key can take up to `BTREE_MAX_LONG_KEY_SIZE`, and
+leaves it less room for its value: a value that would take a KV past the
+largest one without them, `BTREE_MAX_KEY_SIZE` plus `BTREE_MAX_VAL_SIZE`, is
+moved to overflow pages too, so a leaf still fits any KV with its key whole.
+The internal nodes only hold as much of a key as it takes to route to its
+leaf, see `linkKey`, and the prefix the keys of a node share is stored once,
+so keys sharing a long prefix don't take it over and over. A page must still
+fit 2 links of the longest key, which takes `BTREE_MIN_LONG_KEY_PAGE_SIZE`.
+A key never gets past the 2B length of a KV, none is split across pages.
+*/
+const BNODE_OVERFLOW = 3
+
+const OVERFLOW_HEADER = HEADER + 8
+
+// Writes a large value into a chain of overflow pages, returns the first page
+// and the inline value that describes it.
+func writeOverflow(tree *BTree, val []byte) (uint64, []byte) {
+	next := uint64(0)
+	capacity := int(tree.pageSize) - OVERFLOW_HEADER
+
+	// written back to front so every page knows the next one
+	for end := len(val); end > 0; {
+		start := (end - 1) / capacity * capacity
+
+		page := BNode(make([]byte, tree.pageSize))
+		page.setHeader(BNODE_OVERFLOW, uint16(end-start))
+		binary.LittleEndian.PutUint64(page[HEADER:], next)
+		copy(page[OVERFLOW_HEADER:], val[start:end])
+
+		next = tree.new(page)
+		end = start
+	}
+
+	inline := binary.LittleEndian.AppendUint64(nil, uint64(len(val)))
+	return next, inline
+}
+
+// Reports whether the value of a key is moved to overflow pages, see
+// `Config.LongKeys`.
+func overflows(key, val []byte) bool {
+	return len(val) > BTREE_MAX_VAL_SIZE || len(key)+len(val) > BTREE_MAX_KEY_SIZE+BTREE_MAX_VAL_SIZE
+}
+
+// Returns the pointer and the inline value that store the value of a key in a
+// leaf, writing it to overflow pages if it's too large.
+func (tree *BTree) storeVal(key, val []byte) (uint64, []byte) {
+	if overflows(key, val) {
+		return writeOverflow(tree, val)
+	}
+	return 0, val
+}
+
+// Reads back the first `size` bytes of the value stored in the chain starting
+// at `ptr`, from the pages holding them.
+func readOverflow(tree *BTree, ptr uint64, size uint64) []byte {
+	val := make([]byte, 0, size)
+	for ptr != 0 && uint64(len(val)) < size {
+		page := BNode(tree.get(ptr))
+		val = append(val, page[OVERFLOW_HEADER:][:page.nkeys()]...)
+		ptr = binary.LittleEndian.Uint64(page[HEADER:])
+	}
+
+	return val[:min(uint64(len(val)), size)]
+}
+
+// Deallocates every page of the chain starting at `ptr`. The whole chain is
+// read first, so nothing is freed if a page of it is damaged.
+func freeOverflow(tree *BTree, ptr uint64) {
+	for _, ptr := range overflowChain(tree, ptr) {
+		tree.del(ptr)
+	}
+}
+
+// Returns the pages of the chain starting at `ptr`.
+func overflowChain(tree *BTree, ptr uint64) []uint64 {
+	var pages []uint64
+	for ptr != 0 {
+		pages = append(pages, ptr)
+		ptr = binary.LittleEndian.Uint64(tree.get(ptr)[HEADER:])
+	}
+	return pages
+}
+
+// Number of overflow pages taken by a value of `size` bytes.
+func overflowPages(size uint64, pageSize int) uint64 {
+	capacity := uint64(pageSize - OVERFLOW_HEADER)
+	return (size + capacity - 1) / capacity
+}
+
+// Returns the nth value of a leaf, reading it from its overflow pages if it
+// didn't fit inline.
+func (tree *BTree) leafVal(node BNode, idx uint16) []byte {
+	ptr := node.getPtr(idx)
+	if ptr == 0 {
+		return node.getVal(idx)
+	}
+
+	return readOverflow(tree, ptr, binary.LittleEndian.Uint64(node.getVal(idx)))
+}
+
+// Returns the first `limit` bytes of the nth value of a leaf, reading only the
+// overflow pages holding them, and whether the value is longer.
+func (tree *BTree) leafValPrefix(node BNode, idx uint16, limit uint64) ([]byte, bool) {
+	val := node.getVal(idx)
+	ptr := node.getPtr(idx)
+	if ptr == 0 {
+		if uint64(len(val)) <= limit {
+			return val, false
+		}
+		return val[:limit:limit], true
+	}
+
+	size := binary.LittleEndian.Uint64(val)
+	return readOverflow(tree, ptr, min(size, limit)), size > limit
+}
+
+// Deallocates the overflow pages of the nth value of a leaf, if it has any.
+func (tree *BTree) freeLeafVal(node BNode, idx uint16) {
+	if ptr := node.getPtr(idx); ptr != 0 {
+		freeOverflow(tree, ptr)
+	}
+}
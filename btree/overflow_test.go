@@ -0,0 +1,169 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+func TestOverflow(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	want := map[string]string{}
+	set := func(key string, size int) {
+		t.Helper()
+		val := bytes.Repeat([]byte{byte('a' + size%26)}, size)
+		tree.Insert([]byte(key), val)
+		want[key] = string(val)
+		checkTree(t, tree, mem, want)
+	}
+
+	sizes := []int{
+		0, BTREE_MAX_VAL_SIZE, BTREE_MAX_VAL_SIZE + 1,
+		BTREE_PAGE_SIZE - OVERFLOW_HEADER, BTREE_PAGE_SIZE - OVERFLOW_HEADER + 1, 10 * BTREE_PAGE_SIZE, 1 << 20,
+	}
+	for i, size := range sizes {
+		set(fmt.Sprintf("key%d", i), size)
+	}
+	for i := range 200 {
+		set(fmt.Sprintf("small%03d", i), i)
+	}
+
+	// replacing a value frees the chain it had, whatever the new size
+	for i, size := range sizes {
+		set(fmt.Sprintf("key%d", i), sizes[len(sizes)-1-i])
+		set(fmt.Sprintf("key%d", i), size)
+	}
+
+	// the cursor reads them back whole
+	cur := tree.Cursor()
+	for ok := cur.Seek([]byte("key")); ok && bytes.HasPrefix(cur.Key(), []byte("key")); ok = cur.Next() {
+		if string(cur.Val()) != want[string(cur.Key())] {
+			t.Fatalf("cursor at %q: %d bytes", cur.Key(), len(cur.Val()))
+		}
+	}
+
+	// so do deletions
+	if deleted, err := tree.Delete([]byte("key6")); err != nil || !deleted {
+		t.Fatalf("delete: %v, %v", deleted, err)
+	}
+	delete(want, "key6")
+	checkTree(t, tree, mem, want)
+
+	if got, err := tree.DeleteRange([]byte("key"), []byte("key9")); err != nil || got != len(sizes)-1 {
+		t.Fatalf("delete range: %d keys, %v", got, err)
+	}
+	for i := range sizes {
+		delete(want, fmt.Sprintf("key%d", i))
+	}
+	checkTree(t, tree, mem, want)
+
+	tree.DeleteRange(nil, nil)
+	checkTree(t, tree, mem, nil)
+}
+
+// The overflow pages of a value are counted by the estimates.
+func TestOverflowEstimate(t *testing.T) {
+	pairs := []KV{{[]byte("a"), make([]byte, 1<<20)}, {[]byte("b"), nil}}
+	leaves, internal, total := EstimatePages(pairs, BTREE_PAGE_SIZE, 1)
+	if want := overflowPages(1<<20, BTREE_PAGE_SIZE); leaves != 1 || internal != 0 || total != 1+want {
+		t.Fatalf("%d leaves, %d internal, %d in total, want %d overflow pages", leaves, internal, total, want)
+	}
+
+	tree, mem := newTestTree(t, Config{})
+	for _, kv := range pairs {
+		tree.Insert(kv.Key, kv.Val)
+	}
+	if len(mem.pages) != int(total) {
+		t.Fatalf("%d pages, %d estimated", len(mem.pages), total)
+	}
+	if size := tree.RangeSize(nil, nil); size < 1<<20 {
+		t.Fatalf("the range takes %d bytes", size)
+	}
+}
+
+// Long keys sharing a long prefix are stored whole in the leaves and found
+// exactly, the internal nodes only route on as much of them as they need.
+func TestLongKeys(t *testing.T) {
+	if _, err := New(Config{LongKeys: true}); !errors.Is(err, ErrPageSize) {
+		t.Fatalf("long keys on small pages: %v", err)
+	}
+	short, _ := newTestTree(t, Config{PageSize: BTREE_MIN_LONG_KEY_PAGE_SIZE})
+	if err := short.Insert(make([]byte, BTREE_MAX_KEY_SIZE+1), nil); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("long key without LongKeys: %v", err)
+	}
+
+	tree, mem := newTestTree(t, Config{PageSize: BTREE_MIN_LONG_KEY_PAGE_SIZE, LongKeys: true})
+	prefix := strings.Repeat("p", 2*BTREE_MAX_KEY_SIZE)
+	want := map[string]string{}
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range 500 {
+		key := fmt.Sprintf("%s%04d", prefix, i)
+		key += strings.Repeat("k", rng.IntN(BTREE_MAX_LONG_KEY_SIZE-len(key)+1))
+		val := strings.Repeat("v", rng.IntN(BTREE_MAX_VAL_SIZE+1))
+		if err := tree.Insert([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = val
+	}
+	for i := range 100 {
+		key, val := fmt.Sprintf("short%03d", i), fmt.Sprint(i)
+		tree.Insert([]byte(key), []byte(val))
+		want[key] = val
+	}
+	longest := strings.Repeat("z", BTREE_MAX_LONG_KEY_SIZE)
+	if err := tree.Insert([]byte(longest), []byte(strings.Repeat("v", BTREE_MAX_VAL_SIZE))); err != nil {
+		t.Fatal(err)
+	}
+	want[longest] = strings.Repeat("v", BTREE_MAX_VAL_SIZE)
+	if err := tree.Insert([]byte(longest+"z"), nil); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("key past the max: %v", err)
+	}
+	checkTree(t, tree, mem, want)
+
+	// only whole keys match
+	for key := range want {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for _, other := range []string{key[:len(prefix)+4], key + "k", key[:len(key)-1] + "j"} {
+			if _, ok := want[other]; ok {
+				continue
+			}
+			if val, ok := tree.Get([]byte(other)); ok {
+				t.Fatalf("%d byte key found under one of %d: %q", len(key), len(other), val)
+			}
+		}
+	}
+
+	// the links don't hold the keys whole
+	var walk func(ptr uint64)
+	walk = func(ptr uint64) {
+		node := BNode(tree.get(ptr))
+		if node.btype() != BNODE_NODE {
+			return
+		}
+		for i := range node.nkeys() {
+			if link := node.getKey(i); i > 0 && len(link) > len(prefix)+4 {
+				t.Fatalf("link of %d bytes", len(link))
+			}
+			walk(node.getPtr(i))
+		}
+	}
+	if BNode(tree.get(tree.root)).btype() != BNODE_NODE {
+		t.Fatal("a single leaf")
+	}
+	walk(tree.root)
+
+	for key := range want {
+		if rng.IntN(2) == 0 {
+			if _, err := tree.Delete([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, key)
+		}
+	}
+	checkTree(t, tree, mem, want)
+}
@@ -0,0 +1,162 @@
+package btree
+
+import "encoding/binary"
+
+/*
+Nodes are written with the prefix shared by all their keys stored once, when
+that takes less space, and the `BNODE_FLAG_PREFIX` flag set. The KVs then hold
+only what's left of each key.
+
+# Node with a prefix:
+
+	| header |  pointers  |   offsets  | plen | prefix | key-values | unused |
+	|   16B  | nkeys * 8B | nkeys * 2B |  2B  |  ...   |     ...    |        |
+
+Nodes whose values are all empty are also written with the `BNODE_FLAG_NO_VALS`
+flag set and without the vlen field of their KVs, saving 2B per key. That's
+every leaf of a keys-only tree.
+
+Nodes being updated are kept uncompressed. A page holds up to 2 pages worth of
+uncompressed KVs, so the scratch nodes of an update still fit the 2B offsets.
+*/
+const (
+	BNODE_FLAG_PREFIX  = 0x01
+	BNODE_FLAG_NO_VALS = 0x02
+)
+
+// Returns the prefix shared by the keys of the node, empty if it has none.
+func (node BNode) prefix() []byte {
+	if node.flags()&BNODE_FLAG_PREFIX == 0 {
+		return nil
+	}
+
+	pos := HEADER + 10*node.nkeys()
+	plen := binary.LittleEndian.Uint16(node[pos:])
+	return node[pos+2:][:plen]
+}
+
+// Bytes taken by the prefix of the node, its length included.
+func (node BNode) prefixSize() uint16 {
+	if node.flags()&BNODE_FLAG_PREFIX == 0 {
+		return 0
+	}
+	return 2 + uint16(len(node.prefix()))
+}
+
+// Size of the node with its keys uncompressed.
+func (node BNode) rawBytes() int {
+	size := int(node.nbytes())
+	if node.flags()&BNODE_FLAG_PREFIX != 0 {
+		plen := len(node.prefix())
+		size += int(node.nkeys())*plen - 2 - plen
+	}
+	if node.flags()&BNODE_FLAG_NO_VALS != 0 {
+		size += 2 * int(node.nkeys())
+	}
+	return size
+}
+
+// Returns the bytes an uncompressed node would take once written with the
+// KVs in [start, end), the length of the prefix that would be stripped from
+// their keys, 0 if that doesn't save space, and whether their values are all
+// empty and left out.
+func nodeSizeRange(node BNode, start, end uint16) (size, plen int, noVals bool) {
+	n := int(end - start)
+	size = HEADER + 10*n + int(node.kvPos(end)-node.kvPos(start))
+	if n == 0 {
+		return size, 0, false
+	}
+
+	noVals = true
+	prefix := node.getKey(start)
+	for i := start; i < end; i++ {
+		if i > start && len(prefix) > 0 {
+			prefix = prefix[:commonPrefix(prefix, node.getKey(i))]
+		}
+		noVals = noVals && len(node.getVal(i)) == 0
+	}
+
+	if noVals {
+		size -= 2 * n
+	}
+	if saved := n*len(prefix) - 2 - len(prefix); saved > 0 {
+		return size - saved, len(prefix), noVals
+	}
+	return size, 0, noVals
+}
+
+// Reports whether the KVs in [start, end) of an uncompressed node fit a page.
+func rangeFits(node BNode, start, end, pageSize uint16) bool {
+	raw := HEADER + 10*int(end-start) + int(node.kvPos(end)-node.kvPos(start))
+	size, _, _ := nodeSizeRange(node, start, end)
+	return raw <= 2*int(pageSize) && size <= int(pageSize)
+}
+
+// Reports whether an uncompressed node fits a page.
+func nodeFits(node BNode, pageSize uint16) bool {
+	return rangeFits(node, 0, node.nkeys(), pageSize)
+}
+
+// Length of the common prefix of 2 keys.
+func commonPrefix(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// Writes a node into a page, stripping the prefix shared by its keys when
+// that saves space and leaving out the values if they are all empty. The node
+// must fit a page, it's returned as is if it's already 1 page long and has
+// nothing to strip.
+func encodeNode(node BNode, pageSize uint16) BNode {
+	nkeys := node.nkeys()
+	_, plen, noVals := nodeSizeRange(node, 0, nkeys)
+
+	if plen == 0 && !noVals && node.flags()&(BNODE_FLAG_PREFIX|BNODE_FLAG_NO_VALS) == 0 {
+		if len(node) == int(pageSize) {
+			return node
+		}
+		page := BNode(make([]byte, pageSize))
+		copy(page, node[:node.nbytes()])
+		return page
+	}
+
+	page := BNode(make([]byte, pageSize))
+	page.setHeader(node.btype(), nkeys)
+	page.setFlags(node.flags() &^ (BNODE_FLAG_PREFIX | BNODE_FLAG_NO_VALS))
+	if noVals {
+		page.setFlags(page.flags() | BNODE_FLAG_NO_VALS)
+	}
+
+	if plen > 0 {
+		page.setFlags(page.flags() | BNODE_FLAG_PREFIX)
+		pos := HEADER + 10*nkeys
+		binary.LittleEndian.PutUint16(page[pos:], uint16(plen))
+		copy(page[pos+2:], node.getKey(0)[:plen])
+	}
+
+	var key []byte
+	for i := uint16(0); i < nkeys; i++ {
+		key = node.appendKey(key[:0], i)
+		if noVals {
+			nodeAppendKey(page, i, node.getPtr(i), key[plen:])
+		} else {
+			nodeAppendKV(page, i, node.getPtr(i), key[plen:], node.getVal(i))
+		}
+	}
+
+	return page
+}
+
+// Like `nodeAppendKV` for a node with `BNODE_FLAG_NO_VALS` set.
+func nodeAppendKey(node BNode, idx uint16, ptr uint64, key []byte) {
+	node.setPtr(idx, ptr)
+	pos := node.kvPos(idx)
+	binary.LittleEndian.PutUint16(node[pos:], uint16(len(key)))
+	copy(node[pos+2:], key)
+	node.setOffset(idx+1, node.getOffset(idx)+2+uint16(len(key)))
+}
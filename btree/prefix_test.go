@@ -0,0 +1,69 @@
+package btree
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Keys sharing a long prefix take about half the leaves, and keys without one
+// break up the nodes they land in without losing anything.
+func TestPrefixCompression(t *testing.T) {
+	prefix := "user:" + strings.Repeat("x", 40) + ":"
+	leaves := map[bool]int{}
+	for _, shared := range []bool{true, false} {
+		tree, mem := newTestTree(t, Config{})
+		want := map[string]string{}
+		for i := range 5000 {
+			key := fmt.Sprintf("%s%05d", prefix, i)
+			if !shared {
+				// same length, but the prefix moves to the end
+				key = fmt.Sprintf("%05d%s", i, prefix)
+			}
+			tree.Insert([]byte(key), []byte("val"))
+			want[key] = "val"
+		}
+		checkTree(t, tree, mem, want)
+		leaves[shared] = len(tree.LeafPages())
+
+		if !shared {
+			continue
+		}
+
+		for _, page := range mem.pages {
+			if node := BNode(page); node.btype() == BNODE_LEAF && !strings.HasPrefix(string(node.prefix()), prefix) {
+				t.Fatalf("leaf prefix %q", node.prefix())
+			}
+		}
+
+		// the keys without the prefix go before or after all the rest
+		for i := range 500 {
+			for _, key := range []string{fmt.Sprintf("a%04d", i), fmt.Sprintf("z%04d", i)} {
+				tree.Insert([]byte(key), []byte(strings.Repeat("v", i)))
+				want[key] = strings.Repeat("v", i)
+			}
+		}
+		// and among them
+		for i := 0; i < 5000; i += 50 {
+			key := fmt.Sprintf("%s%05d-", prefix[:len(prefix)-10], i)
+			tree.Insert([]byte(key), []byte("val"))
+			want[key] = "val"
+		}
+		checkTree(t, tree, mem, want)
+		if err := tree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+
+		for key := range want {
+			if deleted, err := tree.Delete([]byte(key)); err != nil || !deleted {
+				t.Fatalf("delete %q: %v, %v", key, deleted, err)
+			}
+			delete(want, key)
+		}
+		checkTree(t, tree, mem, want)
+	}
+
+	if leaves[true] > leaves[false]*6/10 {
+		t.Fatalf("%d leaves with a shared prefix, %d without", leaves[true], leaves[false])
+	}
+}
@@ -0,0 +1,319 @@
+package btree
+
+// Removes every key in [lo, hi) and returns how many there were, a nil `lo` or
+// `hi` means no bound on that side. Kids that fall entirely inside the range
+// are dropped whole, only the (at most 2) kids straddling its ends are
+// rewritten. Fails like `Delete`.
+func (tree *BTree) DeleteRange(lo, hi []byte) (count int, err error) {
+	if tree.readOnly {
+		return 0, ErrReadOnly
+	}
+	if tree.root == 0 || (lo != nil && hi != nil && tree.compare(lo, hi) >= 0) {
+		return 0, nil
+	}
+	return tree.removeKeys(func(root BNode) (BNode, int) {
+		return treeDeleteRange(tree, root, lo, hi)
+	})
+}
+
+// Removes every key smaller than `key` and returns how many there were, like
+// `DeleteRange(nil, key)`: the kids left of the one holding `key` are dropped
+// whole on every level, their keys counted from their links. Fails like
+// `Delete`.
+func (tree *BTree) TruncateBefore(key []byte) (count int, err error) {
+	if tree.readOnly {
+		return 0, ErrReadOnly
+	}
+	if tree.root == 0 {
+		return 0, nil
+	}
+	return tree.removeKeys(func(root BNode) (BNode, int) {
+		depth := 0
+		for node := root; node.btype() == BNODE_NODE; depth++ {
+			node = tree.get(node.getPtr(0))
+		}
+		return treeTruncate(tree, root, key, depth)
+	})
+}
+
+// Replaces the root with the node `remove` makes of it, which returns the
+// number of keys it removed and allocates nothing if there were none.
+// Removes the levels left with a single kid.
+func (tree *BTree) removeKeys(remove func(root BNode) (BNode, int)) (count int, err error) {
+	defer recoverWrite(&err)
+	if err := tree.reserveScratch(); err != nil {
+		return 0, err
+	}
+	defer tree.releaseScratch()
+
+	tree.undoable(func() {
+		updated, n := remove(tree.get(tree.root))
+		if n == 0 {
+			return
+		}
+
+		tree.del(tree.root)
+		switch {
+		case updated.nkeys() == 0:
+			tree.root = 0 // the last key is gone
+		case updated.btype() == BNODE_NODE && updated.nkeys() == 1:
+			// several levels might be left with a single kid, remove them all
+			ptr := updated.getPtr(0)
+			for {
+				node := BNode(tree.get(ptr))
+				if node.btype() == BNODE_LEAF || node.nkeys() != 1 {
+					break
+				}
+
+				next := node.getPtr(0)
+				tree.del(ptr)
+				ptr = next
+			}
+			tree.root = ptr
+		default:
+			tree.setRoot(updated)
+		}
+		tree.freeScratch(updated)
+		count = n
+	})
+	return count, nil
+}
+
+// A kid of a node being rebuilt, either an untouched page or a new node.
+type rangeKid struct {
+	ptr   uint64 // 0 for new nodes
+	key   []byte
+	count []byte // keys under the page, see `countVal`
+	node  BNode
+}
+
+// Removes [lo, hi) from the subtree, returns the new node and the number of
+// keys removed. Nothing is allocated and the node is empty if none were.
+func treeDeleteRange(tree *BTree, node BNode, lo, hi []byte) (BNode, int) {
+	if node.btype() == BNODE_LEAF {
+		return leafDeleteRange(tree, node, lo, hi)
+	}
+
+	removed := 0
+	nkeys := node.nkeys()
+	kids := make([]rangeKid, 0, nkeys)
+
+	for i := uint16(0); i < nkeys; i++ {
+		// the kid holds the keys in [first, last)
+		ptr, first, count := node.getPtr(i), node.getKey(i), node.getVal(i)
+		var last []byte
+		if i+1 < nkeys {
+			last = node.getKey(i + 1)
+		}
+
+		switch {
+		case (lo != nil && last != nil && tree.compare(last, lo) <= 0) || (hi != nil && tree.compare(first, hi) >= 0):
+			kids = append(kids, rangeKid{ptr: ptr, key: first, count: count}) // outside of the range
+		case (lo == nil || tree.compare(lo, first) <= 0) && (hi == nil || (last != nil && tree.compare(last, hi) <= 0)):
+			removed += freeSubtree(tree, ptr) // inside of the range
+		default:
+			updated, n := treeDeleteRange(tree, tree.get(ptr), lo, hi)
+			if n == 0 {
+				kids = append(kids, rangeKid{ptr: ptr, key: first, count: count})
+				continue
+			}
+
+			removed += n
+			tree.del(ptr)
+			if updated.nkeys() > 0 {
+				kids = append(kids, rangeKid{node: updated})
+			} else {
+				tree.freeScratch(updated)
+			}
+		}
+	}
+
+	if removed == 0 {
+		return BNode{}, 0
+	}
+
+	return rangeNode(tree, kids), removed
+}
+
+// Removes the keys smaller than `key` from the subtree, whose leaves are
+// `depth` levels below it. Returns the new node and the number of keys
+// removed, nothing is allocated and the node is empty if none were.
+func treeTruncate(tree *BTree, node BNode, key []byte, depth int) (BNode, int) {
+	if depth == 0 {
+		return leafDeleteRange(tree, node, nil, key)
+	}
+
+	// the kids before `idx` only hold smaller keys
+	idx := nodeLookupLE(node, key, tree.compare)
+	removed := 0
+	for i := uint16(0); i < idx; i++ {
+		removed += int(node.getCount(i))
+		dropSubtree(tree, node.getPtr(i), depth-1)
+	}
+
+	kids := make([]rangeKid, 0, node.nkeys()-idx)
+	ptr := node.getPtr(idx)
+	updated, n := treeTruncate(tree, tree.get(ptr), key, depth-1)
+	switch {
+	case n == 0:
+		kids = append(kids, rangeKid{ptr: ptr, key: node.getKey(idx), count: node.getVal(idx)})
+	case updated.nkeys() > 0:
+		tree.del(ptr)
+		kids = append(kids, rangeKid{node: updated})
+	default:
+		tree.del(ptr)
+		tree.freeScratch(updated)
+	}
+	removed += n
+	if removed == 0 {
+		return BNode{}, 0
+	}
+
+	for i := idx + 1; i < node.nkeys(); i++ {
+		kids = append(kids, rangeKid{ptr: node.getPtr(i), key: node.getKey(i), count: node.getVal(i)})
+	}
+	return rangeNode(tree, kids), removed
+}
+
+// Returns an internal node linking the kids, merging the small new ones into
+// a neighbour and allocating them. The new kids are given back to the scratch
+// pool.
+func rangeNode(tree *BTree, kids []rangeKid) BNode {
+	kids = mergeRangeKids(tree, kids)
+
+	// allocate the new kids, splitting the ones that grew past a page, the
+	// links keep their keys until they're copied
+	links := make([]rangeKid, 0, len(kids))
+	var scratch []BNode
+	for _, kid := range kids {
+		if kid.ptr != 0 {
+			links = append(links, kid)
+			continue
+		}
+
+		split := nodeSplit(tree, kid.node)
+		for _, knode := range split {
+			links = append(links, rangeKid{ptr: tree.new(knode), key: knode.getKey(0), count: countVal(knode)})
+		}
+		if len(split) > 1 {
+			scratch = append(scratch, split...)
+		}
+		scratch = append(scratch, kid.node)
+	}
+
+	// It can exceed 1 page temporarily.
+	newNode := tree.newScratch()
+	newNode.setHeader(BNODE_NODE, uint16(len(links)))
+	for i, link := range links {
+		nodeAppendKV(newNode, uint16(i), link.ptr, link.key, link.count)
+	}
+	tree.freeScratch(scratch...)
+
+	return newNode
+}
+
+// Merges the rewritten kids that got too small into a neighbour when they fit.
+func mergeRangeKids(tree *BTree, kids []rangeKid) []rangeKid {
+	load := func(kid rangeKid) BNode {
+		if kid.ptr == 0 {
+			return kid.node
+		}
+		return tree.get(kid.ptr)
+	}
+	small := func(kid rangeKid) bool {
+		if kid.ptr != 0 {
+			return false
+		}
+		size, _, _ := nodeSizeRange(kid.node, 0, kid.node.nkeys())
+		return size <= int(tree.pageSize)/4
+	}
+
+	merged := kids[:0]
+	for _, kid := range kids {
+		if n := len(merged); n > 0 && (small(merged[n-1]) || small(kid)) {
+			if node, ok := tryMerge(tree, load(merged[n-1]), load(kid)); ok {
+				for _, old := range []rangeKid{merged[n-1], kid} {
+					if old.ptr != 0 {
+						tree.del(old.ptr)
+					} else {
+						tree.freeScratch(old.node)
+					}
+				}
+
+				merged[n-1] = rangeKid{node: node}
+				continue
+			}
+		}
+
+		merged = append(merged, kid)
+	}
+
+	return merged
+}
+
+// Removes [lo, hi) from a leaf.
+func leafDeleteRange(tree *BTree, node BNode, lo, hi []byte) (BNode, int) {
+	nkeys := node.nkeys()
+
+	// the range to remove is [start, end)
+	start := uint16(0)
+	for start < nkeys && lo != nil && tree.compare(node.getKey(start), lo) < 0 {
+		start++
+	}
+	end := start
+	for end < nkeys && (hi == nil || tree.compare(node.getKey(end), hi) < 0) {
+		end++
+	}
+
+	if start == end {
+		return BNode{}, 0
+	}
+
+	for i := start; i < end; i++ {
+		tree.freeLeafVal(node, i)
+	}
+
+	newNode := tree.newScratch()
+	newNode.setHeader(BNODE_LEAF, nkeys-(end-start))
+	nodeAppendRange(newNode, node, 0, 0, start)
+	nodeAppendRange(newNode, node, start, end, nkeys-end)
+	return newNode, int(end - start)
+}
+
+// Deallocates every page of a subtree, returns the number of keys it held.
+func freeSubtree(tree *BTree, ptr uint64) int {
+	node := BNode(tree.get(ptr))
+	count := 0
+
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if node.btype() == BNODE_LEAF {
+			tree.freeLeafVal(node, i)
+			count++
+		} else {
+			count += freeSubtree(tree, node.getPtr(i))
+		}
+	}
+
+	tree.del(ptr)
+	return count
+}
+
+// Deallocates every page of a subtree whose leaves are `depth` levels below
+// it, without counting its keys. The leaves are only read for their overflow
+// values, not at all in a keys-only tree.
+func dropSubtree(tree *BTree, ptr uint64, depth int) {
+	switch {
+	case depth > 0:
+		node := BNode(tree.get(ptr))
+		for i := uint16(0); i < node.nkeys(); i++ {
+			dropSubtree(tree, node.getPtr(i), depth-1)
+		}
+	case !tree.keysOnly:
+		node := BNode(tree.get(ptr))
+		for i := uint16(0); i < node.nkeys(); i++ {
+			tree.freeLeafVal(node, i)
+		}
+	}
+
+	tree.del(ptr)
+}
@@ -0,0 +1,191 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDeleteRange(t *testing.T) {
+	const n = 5000
+	key := func(i int) string { return fmt.Sprintf("key%05d", i) }
+	bound := func(i int) []byte {
+		if i < 0 {
+			return nil
+		}
+		return []byte(key(i))
+	}
+
+	tests := []struct {
+		name   string
+		lo, hi int // -1 is a nil bound
+	}{
+		{"empty", 100, 100},
+		{"reversed", 200, 100},
+		{"single key", 100, 101},
+		{"within a leaf", 100, 110},
+		{"across leaves", 100, 900},
+		{"most of the tree", 10, n - 10},
+		{"prefix", -1, 2500},
+		{"suffix", 2500, -1},
+		{"everything", -1, -1},
+		{"past the keys", n, -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tree, mem := newTestTree(t, Config{})
+			want := map[string]string{}
+			for i := range n {
+				tree.Insert([]byte(key(i)), []byte("val"))
+				want[key(i)] = "val"
+			}
+
+			lo, hi := bound(test.lo), bound(test.hi)
+			removed := 0
+			for i := range n {
+				k := []byte(key(i))
+				if string(k) >= string(lo) && (hi == nil || string(k) < string(hi)) {
+					delete(want, key(i))
+					removed++
+				}
+			}
+
+			if got, err := tree.DeleteRange(lo, hi); err != nil || got != removed {
+				t.Fatalf("removed %d keys, want %d: %v", got, removed, err)
+			}
+			checkTree(t, tree, mem, want)
+			if len(want) <= 1 && height(tree) > 1 {
+				t.Fatalf("%d keys left in %d levels", len(want), height(tree))
+			}
+
+			// the range is empty now
+			if got, err := tree.DeleteRange(lo, hi); err != nil || got != 0 {
+				t.Fatalf("removed %d keys again: %v", got, err)
+			}
+			tree.Insert([]byte("again"), []byte("val"))
+			want["again"] = "val"
+			checkTree(t, tree, mem, want)
+		})
+	}
+}
+
+// Cutting ranges out one after the other keeps the nodes packed and frees
+// every page it drops.
+func TestDeleteRangeRepeated(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	want := map[string]string{}
+	for i := range 5000 {
+		key := fmt.Sprintf("key%05d", i)
+		tree.Insert([]byte(key), []byte("val"))
+		want[key] = "val"
+	}
+
+	for i := 0; i < 5000; i += 100 {
+		lo, hi := fmt.Sprintf("key%05d", i+1), fmt.Sprintf("key%05d", i+100)
+		if got, err := tree.DeleteRange([]byte(lo), []byte(hi)); err != nil || got != 99 {
+			t.Fatalf("[%s, %s): removed %d keys: %v", lo, hi, got, err)
+		}
+		for j := i + 1; j < i+100; j++ {
+			delete(want, fmt.Sprintf("key%05d", j))
+		}
+		checkTree(t, tree, mem, want)
+	}
+	if len(tree.LeafPages()) > 2 {
+		t.Fatalf("%d leaves for %d keys", len(tree.LeafPages()), len(want))
+	}
+
+	if got, err := tree.DeleteRange(nil, nil); err != nil || got != 50 {
+		t.Fatalf("removed %d keys, want 50: %v", got, err)
+	}
+	checkTree(t, tree, mem, nil)
+}
+
+// Truncating the oldest 40% of time-ordered keys leaves the rest as
+// `DeleteRange` would, frees every page it drops and, in a keys-only tree,
+// doesn't read the leaves it drops.
+func TestTruncateBefore(t *testing.T) {
+	const n = 5000
+	key := func(i int) []byte { return fmt.Appendf(nil, "ts%016x", int64(1700000000000)+int64(i)*1000) }
+
+	for _, keysOnly := range []bool{false, true} {
+		// counts the pages read while `read` isn't nil
+		var read map[uint64]bool
+		mem := &memPages{pages: map[uint64][]byte{}, next: 1}
+		cfg := mem.config(Config{KeysOnly: keysOnly})
+		get := cfg.Get
+		cfg.Get = func(ptr uint64) []byte {
+			if read != nil {
+				read[ptr] = true
+			}
+			return get(ptr)
+		}
+		tree, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		twin, _ := newTestTree(t, Config{KeysOnly: keysOnly})
+		want := map[string]string{}
+		for i := range n {
+			val := ""
+			if !keysOnly {
+				val = fmt.Sprintf("val%d", i)
+				if i%500 == 0 {
+					val = strings.Repeat("o", 2*BTREE_MAX_VAL_SIZE)
+				}
+			}
+			tree.Insert(key(i), []byte(val))
+			twin.Insert(key(i), []byte(val))
+			want[string(key(i))] = val
+		}
+
+		if got, err := tree.TruncateBefore([]byte("ts")); err != nil || got != 0 {
+			t.Fatalf("keys only %v: truncated %d keys before the first: %v", keysOnly, got, err)
+		}
+
+		read = map[uint64]bool{}
+		pages := len(mem.pages)
+		cut := n * 4 / 10
+		if got, err := tree.TruncateBefore(key(cut)); err != nil || got != cut {
+			t.Fatalf("keys only %v: truncated %d keys, want %d: %v", keysOnly, got, cut, err)
+		}
+		if keysOnly && len(read) >= (pages-len(mem.pages))/2 {
+			t.Fatalf("read %d pages to free %d", len(read), pages-len(mem.pages))
+		}
+		read = nil
+		for i := range cut {
+			delete(want, string(key(i)))
+		}
+		if err := tree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		checkTree(t, tree, mem, want)
+
+		if _, err := twin.DeleteRange(nil, key(cut)); err != nil {
+			t.Fatal(err)
+		}
+		if a, b := tree.Stats(), twin.Stats(); a.LeafNodes != b.LeafNodes || a.Depth != b.Depth {
+			t.Fatalf("keys only %v: %d leaves in %d levels, %d in %d for DeleteRange", keysOnly, a.LeafNodes, a.Depth, b.LeafNodes, b.Depth)
+		}
+
+		// between 2 keys, then past the last one
+		bound := append(key(n/2), 0)
+		if got, err := tree.TruncateBefore(bound); err != nil || got != n/2+1-cut {
+			t.Fatalf("keys only %v: truncated %d keys, want %d: %v", keysOnly, got, n/2+1-cut, err)
+		}
+		for i := cut; i <= n/2; i++ {
+			delete(want, string(key(i)))
+		}
+		checkTree(t, tree, mem, want)
+		if got, err := tree.TruncateBefore([]byte("tt")); err != nil || got != len(want) {
+			t.Fatalf("keys only %v: truncated %d keys, want %d: %v", keysOnly, got, len(want), err)
+		}
+		checkTree(t, tree, mem, nil)
+	}
+
+	tree, _ := newTestTree(t, Config{})
+	tree.Insert([]byte("key"), []byte("val"))
+	if _, err := tree.Clone().TruncateBefore([]byte("z")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("truncate a clone: %v", err)
+	}
+}
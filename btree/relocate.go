@@ -0,0 +1,121 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+)
+
+/*
+A store packs the tree into the front of its file by relocating the pages
+past a point: each one is copied into a new page, which the store takes from
+the front, and the old one is freed. The nodes pointing to a copied page are
+copied along with it, up to the root, like the path of any update.
+
+A large tree is relocated a few pages at a time, each run picking up at the
+key where the last one stopped, so that every run is an update of its own.
+*/
+
+// Copies the pages of the tree for which `move` is true into new pages, along
+// with the nodes pointing to them, and frees the old ones. Starts with the
+// subtree holding `from`, nil for the first key, and stops after the subtree
+// in which about `limit` pages were copied, 0 means no limit. Returns the key
+// to start the next run from, nil once the last key is done, and the number
+// of pages copied. Fails with `ErrReadOnly` for a copy made by `Clone` or,
+// with an error wrapping `ErrCorrupt`, if a page is damaged, in which case
+// the tree is left as it was and no page is freed, but the copies made so far
+// are not.
+func (tree *BTree) Relocate(move func(ptr uint64) bool, from []byte, limit int) (next []byte, copied int, err error) {
+	if tree.readOnly {
+		return nil, 0, ErrReadOnly
+	}
+	if tree.root == 0 {
+		return nil, 0, nil
+	}
+
+	defer recoverWrite(&err)
+	r := relocation{tree: tree, move: move, limit: limit}
+	root, _ := r.node(tree.root, from)
+	tree.root = root
+	for _, ptr := range r.freed {
+		tree.del(ptr)
+	}
+	return r.next, r.copied, nil
+}
+
+// A run of `Relocate`.
+type relocation struct {
+	tree   *BTree
+	move   func(uint64) bool
+	limit  int
+	copied int
+	freed  []uint64 // once the run is done
+	next   []byte   // first key of the subtrees left, once the limit is reached
+}
+
+// Relocates the pages under the node at `ptr`, from the kid holding `from`
+// on. Returns its new page if it was copied.
+func (r *relocation) node(ptr uint64, from []byte) (uint64, bool) {
+	node := BNode(r.tree.get(ptr))
+	var updated BNode
+
+	start := uint16(0)
+	if node.btype() == BNODE_NODE && from != nil {
+		start = nodeLookupLE(node, from, r.tree.compare)
+	}
+	for i := start; i < node.nkeys(); i++ {
+		kid, moved := node.getPtr(i), false
+		if node.btype() == BNODE_NODE {
+			if r.limit > 0 && r.copied >= r.limit {
+				r.next = node.appendKey(nil, i)
+				break
+			}
+			if i > start {
+				from = nil
+			}
+			kid, moved = r.node(kid, from)
+		} else if kid != 0 {
+			kid, moved = r.overflow(kid)
+		}
+
+		if moved {
+			if updated == nil {
+				updated = BNode(bytes.Clone(node))
+			}
+			updated.setPtr(i, kid)
+		}
+		if r.next != nil {
+			break
+		}
+	}
+
+	if updated == nil {
+		if !r.move(ptr) {
+			return ptr, false
+		}
+		updated = BNode(bytes.Clone(node))
+	}
+	r.freed = append(r.freed, ptr)
+	r.copied++
+	return r.tree.new(updated), true
+}
+
+// Copies the overflow chain starting at `ptr` if a page of it is to be moved,
+// and returns its new first page.
+func (r *relocation) overflow(ptr uint64) (uint64, bool) {
+	chain := overflowChain(r.tree, ptr)
+	if !slices.ContainsFunc(chain, r.move) {
+		return ptr, false
+	}
+
+	// written back to front so every page knows the next one
+	next := uint64(0)
+	for i := len(chain) - 1; i >= 0; i-- {
+		page := BNode(bytes.Clone(r.tree.get(chain[i])))
+		binary.LittleEndian.PutUint64(page[HEADER:], next)
+		next = r.tree.new(page)
+		r.freed = append(r.freed, chain[i])
+		r.copied++
+	}
+	return next, true
+}
@@ -0,0 +1,70 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Runs of `Relocate` move every page asked for, overflow pages included, and
+// free the old ones, leaving the same tree.
+func TestRelocate(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	want := map[string]string{}
+	for i := range 3000 {
+		key, val := fmt.Sprintf("key%05d", i), fmt.Sprint(i)
+		if i%200 == 0 {
+			val = string(bytes.Repeat([]byte{'o'}, 2*BTREE_MAX_VAL_SIZE))
+		}
+		if err := tree.Insert([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = val
+	}
+
+	// every page there is now, as an allocator that never reuses one does
+	cut := mem.next
+	move := func(ptr uint64) bool { return ptr < cut }
+	pages := len(mem.pages)
+
+	var from []byte
+	runs, total := 0, 0
+	for {
+		next, copied, err := tree.Relocate(move, from, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if copied > 10+height(tree)+2*int(overflowPages(2*BTREE_MAX_VAL_SIZE, BTREE_PAGE_SIZE)) {
+			t.Fatalf("run %d from %q: %d pages copied", runs, from, copied)
+		}
+		if next != nil && bytes.Compare(next, from) <= 0 {
+			t.Fatalf("run %d from %q stopped at %q", runs, from, next)
+		}
+		runs++
+		total += copied
+		if from = next; from == nil {
+			break
+		}
+	}
+	if runs < 2 || total < pages {
+		t.Fatalf("%d pages copied in %d runs, %d in the tree", total, runs, pages)
+	}
+	for _, ptr := range tree.Pages() {
+		if move(ptr) {
+			t.Fatalf("page %d was left", ptr)
+		}
+	}
+	checkTree(t, tree, mem, want)
+
+	// nothing is left to move
+	if next, copied, err := tree.Relocate(move, nil, 0); next != nil || copied != 0 || err != nil {
+		t.Fatalf("relocate again: %q, %d, %v", next, copied, err)
+	}
+
+	snap := tree.Clone()
+	defer snap.Close()
+	if _, _, err := snap.Relocate(move, nil, 0); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("relocate a copy: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package btree
+
+/*
+A deletion merges the kid it shrank into a sibling once the kid holds a
+quarter of a page or less, if the two fit a page. A tree written by a version
+that didn't can hold nodes that small next to a sibling they fit with, which
+are valid but waste pages and depth. `Underfilled` lists them.
+
+With `Config.RepairOnWrite` an insertion merges them too, on its way back up:
+every kid it rewrote is merged like a deletion would, so the tree recovers a
+subtree at a time as it's written to instead of in a whole compaction. The
+siblings are read after pages were freed, so the insertion is undoable.
+*/
+
+// Returns the non-root nodes, in key order, that hold at most a quarter of a
+// page and fit a page along with a sibling, the ones a deletion would have
+// merged. They aren't damage, `Verify` accepts them, see `Config.RepairOnWrite`.
+func (tree *BTree) Underfilled() []uint64 {
+	// a read, the merges aren't built in scratch nodes
+	fits := func(left, right BNode) bool {
+		raw := left.rawBytes() + right.rawBytes() - HEADER
+		if raw > 2*int(tree.pageSize) {
+			return false
+		}
+		merged := BNode(make([]byte, raw))
+		nodeMerge(merged, left, right)
+		return nodeFits(merged, tree.pageSize)
+	}
+
+	var pages []uint64
+	var walk func(node BNode)
+	walk = func(node BNode) {
+		if node.btype() != BNODE_NODE {
+			return
+		}
+
+		nkeys := node.nkeys()
+		for i := uint16(0); i < nkeys; i++ {
+			kid := BNode(tree.get(node.getPtr(i)))
+			size, _, _ := nodeSizeRange(kid, 0, kid.nkeys())
+			if size <= int(tree.pageSize)/4 &&
+				(i > 0 && fits(tree.get(node.getPtr(i-1)), kid) || i+1 < nkeys && fits(kid, tree.get(node.getPtr(i+1)))) {
+				pages = append(pages, node.getPtr(i))
+			}
+			walk(kid)
+		}
+	}
+
+	if tree.root != 0 {
+		walk(tree.get(tree.root))
+	}
+	return pages
+}
+
+// Merges the updated kid at `idx` into its left or right sibling if it got
+// too small, writing the parent into `newNode`. Returns false, writing
+// nothing, if it's big enough or nothing fits.
+func mergeKid(tree *BTree, newNode, node BNode, idx uint16, updated BNode) bool {
+	mergeDir, merged := shouldMerge(tree, node, idx, updated)
+	switch {
+	case mergeDir < 0: // left
+		tree.del(node.getPtr(idx - 1))
+		nodeReplace2Kid(newNode, node, idx-1, tree.new(merged), node.getKey(idx-1), countVal(merged))
+		tree.freeScratch(merged)
+	case mergeDir > 0: // right
+		// an insertion can give the first kid a smaller key than its link
+		key := node.getKey(idx)
+		if tree.compare(key, merged.getKey(0)) > 0 {
+			key = merged.getKey(0)
+		}
+		tree.del(node.getPtr(idx + 1))
+		nodeReplace2Kid(newNode, node, idx, tree.new(merged), key, countVal(merged))
+		tree.freeScratch(merged)
+	default:
+		return false
+	}
+	return true
+}
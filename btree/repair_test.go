@@ -0,0 +1,107 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Returns a tree of 3 levels of nodes holding a few keys each, like a version
+// that never merged would leave after deleting most of them.
+func underfilledTree(t *testing.T, cfg Config) (*BTree, *memPages, map[string]string) {
+	t.Helper()
+	tree, mem := newTestTree(t, cfg)
+	want := map[string]string{}
+	var kvs [][2][]byte
+	for i := range 1000 {
+		key, val := fmt.Sprintf("key%04d", i), fmt.Sprintf("val%d", i)
+		kvs = append(kvs, [2][]byte{[]byte(key), []byte(val)})
+		want[key] = val
+	}
+
+	kvs, ptrs := buildLevel(tree, BNODE_LEAF, kvs, nil, 4)
+	kvs, ptrs = buildLevel(tree, BNODE_NODE, kvs, ptrs, 8)
+	_, ptrs = buildLevel(tree, BNODE_NODE, kvs, ptrs, len(kvs))
+	tree.root = ptrs[0]
+
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(tree.Underfilled()); n != 250+32 {
+		t.Fatalf("%d under-filled nodes, want every one but the root", n)
+	}
+	return tree, mem, want
+}
+
+// Under-filled nodes are merged by the insertions going through them with
+// `RepairOnWrite`, and only then: rewriting every key leaves none and the
+// tree is sound.
+func TestRepairOnWrite(t *testing.T) {
+	for _, repair := range []bool{false, true} {
+		tree, mem, want := underfilledTree(t, Config{RepairOnWrite: repair})
+		before := len(tree.Underfilled())
+		leaves := len(tree.LeafPages())
+
+		// a key before every other, in the first leaf
+		want["a"] = "first"
+		if err := tree.Insert([]byte("a"), []byte("first")); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(tree.Underfilled()); (n < before) != repair {
+			t.Fatalf("repair %v: %d under-filled nodes after an insertion, %d before", repair, n, before)
+		}
+
+		for i := range 1000 {
+			key := fmt.Sprintf("key%04d", i)
+			want[key] = fmt.Sprintf("new%d", i)
+			if err := tree.Insert([]byte(key), []byte(want[key])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tree.Verify(); err != nil {
+			t.Fatalf("repair %v: %v", repair, err)
+		}
+		checkTree(t, tree, mem, want)
+
+		n := len(tree.Underfilled())
+		switch {
+		case !repair && n != before:
+			t.Fatalf("%d under-filled nodes without repairs, %d before", n, before)
+		case repair && n != 0:
+			t.Fatalf("%d under-filled nodes left: %v", n, tree.Underfilled())
+		case repair && len(tree.LeafPages()) > leaves/4:
+			t.Fatalf("%d leaves after the repairs, %d before", len(tree.LeafPages()), leaves)
+		}
+	}
+}
+
+// An insertion reaching a damaged sibling to merge with fails with
+// `ErrCorrupt` and leaves the pages as they were, none freed or allocated.
+func TestRepairCorrupt(t *testing.T) {
+	tree, mem, want := underfilledTree(t, Config{RepairOnWrite: true})
+	leaves := tree.LeafPages()
+	key := BNode(tree.get(leaves[10])).getKey(0)
+	page := bytes.Clone(mem.pages[leaves[9]])
+	mem.pages[leaves[9]][HEADER] ^= 1
+
+	before := map[uint64]string{}
+	for ptr, page := range mem.pages {
+		before[ptr] = string(page)
+	}
+	root := tree.root
+	if err := tree.Insert(key, []byte("new")); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("insert: %v", err)
+	}
+	if tree.root != root || len(mem.pages) != len(before) {
+		t.Fatal("the tree changed")
+	}
+	for ptr, page := range mem.pages {
+		if string(page) != before[ptr] {
+			t.Fatalf("page %d changed", ptr)
+		}
+	}
+
+	mem.pages[leaves[9]] = page
+	checkTree(t, tree, mem, want)
+}
@@ -0,0 +1,174 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+/*
+An update builds its nodes in scratch nodes of 3 pages, which hold a node
+that outgrew its page until it's split, and copies them into pages. They're
+taken from a pool and given back once copied, the pool keeps a few for the
+next updates.
+
+A pool shared by trees, see `Config.Scratch`, can bound the scratch nodes
+they have allocated at once, in use or kept. An insertion into a tree of `h`
+levels holds at most `h+3` of them at once: a node per level on the way down,
+plus up to 3 pieces a kid is split into. A deletion builds its nodes on the
+way back up, holding the kid it rewrote, its parent and a merge or the pieces
+of a split, and a range deletion one more: the kid it rewrote at one end of
+the range while it rewrites the other end. Every update reserves
+`h+SCRATCH_RESERVE` before it starts, and waits while the reservations of the
+others leave no room. As it never waits holding any, the updates can't
+deadlock waiting for each other. The pool only allocates a node once it has
+none left to hand out, so there are never more than the reservations allow.
+*/
+
+// most scratch nodes kept for reuse
+const BTREE_MAX_SCRATCH = 16
+
+// scratch nodes an update reserves on top of one per level of the tree
+const SCRATCH_RESERVE = 4
+
+var ErrScratchLimit = errors.New("btree: scratch pool too small")
+
+// Scratch nodes shared by trees, see `Config.Scratch`. It's safe for
+// concurrent use.
+type ScratchPool struct {
+	limit int // most nodes allocated at once, 0 for no limit
+
+	mu       sync.Mutex
+	cond     sync.Cond // signaled when reservations are released
+	reserved int       // by the updates running
+	live     int       // nodes allocated, in use or kept
+	peak     int       // most nodes allocated at once
+	idle     []BNode   // nodes kept for reuse
+}
+
+// Returns a pool with at most `limit` scratch nodes allocated at once, 0 means
+// no limit. A tree of `h` levels needs `h+SCRATCH_RESERVE` of them.
+func NewScratchPool(limit int) *ScratchPool {
+	pool := &ScratchPool{limit: max(limit, 0)}
+	pool.cond.L = &pool.mu
+	return pool
+}
+
+// Returns the most scratch nodes the pool had allocated at once.
+func (pool *ScratchPool) Peak() int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return pool.peak
+}
+
+// Reserves `n` nodes for an update, waiting until there's room. Fails with
+// `ErrScratchLimit` if there never will be.
+func (pool *ScratchPool) reserve(n int) error {
+	if pool.limit == 0 {
+		return nil
+	}
+	if n > pool.limit {
+		return fmt.Errorf("%w: an update needs %d scratch nodes, at most %d", ErrScratchLimit, n, pool.limit)
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for pool.reserved+n > pool.limit {
+		pool.cond.Wait()
+	}
+	pool.reserved += n
+	return nil
+}
+
+// Ends the reservation of `n` nodes by an update which didn't give back
+// `dropped` of them.
+func (pool *ScratchPool) release(n, dropped int) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.live -= dropped
+	if n > 0 {
+		pool.reserved -= n
+		pool.cond.Broadcast()
+	}
+}
+
+// Returns a node of `size` bytes, its contents are left over from its last use.
+func (pool *ScratchPool) get(size int) BNode {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for n := len(pool.idle); n > 0; n-- {
+		node := pool.idle[n-1]
+		pool.idle = pool.idle[:n-1]
+		if len(node) == size {
+			return node
+		}
+		pool.live-- // of a tree with other pages, left to the GC
+	}
+
+	pool.live++
+	pool.peak = max(pool.peak, pool.live)
+	return BNode(make([]byte, size))
+}
+
+// Gives back a node from `get`.
+func (pool *ScratchPool) put(node BNode) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if len(pool.idle) < BTREE_MAX_SCRATCH {
+		pool.idle = append(pool.idle, node)
+	} else {
+		pool.live--
+	}
+}
+
+// Reserves the scratch nodes of an update of the tree in its pool, which must
+// call `releaseScratch` once it's done.
+func (tree *BTree) reserveScratch() error {
+	if tree.scratch.limit == 0 {
+		return nil
+	}
+
+	h := 1
+	for node := BNode(tree.get(tree.root)); node.btype() == BNODE_NODE; h++ {
+		node = tree.get(node.getPtr(0))
+	}
+	if err := tree.scratch.reserve(h + SCRATCH_RESERVE); err != nil {
+		return err
+	}
+	tree.reserved = h + SCRATCH_RESERVE
+	return nil
+}
+
+// Ends the reservation of an update, the scratch nodes it didn't give back
+// are left to the GC.
+func (tree *BTree) releaseScratch() {
+	tree.scratch.release(tree.reserved, len(tree.held))
+	clear(tree.held)
+	tree.reserved = 0
+}
+
+// Returns a node of 3 pages to build an update in, which can be larger than a
+// page until it's split. Its contents are left over from its last use.
+func (tree *BTree) newScratch() BNode {
+	if tree.reserved > 0 && len(tree.held) == tree.reserved {
+		panic(fmt.Sprintf("btree: an update took more than the %d scratch nodes it reserved", tree.reserved))
+	}
+	node := tree.scratch.get(3 * int(tree.pageSize))
+	tree.held[&node[0]] = true
+	return node
+}
+
+// Gives back scratch nodes that are no longer used, nodes that aren't scratch
+// nodes are left to the GC.
+func (tree *BTree) freeScratch(nodes ...BNode) {
+	for _, node := range nodes {
+		if cap(node) == 0 {
+			continue
+		}
+		node = node[:cap(node)]
+		if tree.held[&node[0]] {
+			delete(tree.held, &node[0])
+			tree.scratch.put(node)
+		}
+	}
+}
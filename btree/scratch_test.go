@@ -0,0 +1,139 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Trees updated at once never have more scratch nodes allocated than the pool
+// they share allows, whatever the updates, and an update needing more than
+// the pool has fails.
+func TestScratchPool(t *testing.T) {
+	const limit = 12
+	pool := NewScratchPool(limit)
+
+	var wg sync.WaitGroup
+	errs, errs2 := make(chan error, 8), make(chan error, 8)
+	trees, mems, wants := make([]*BTree, 8), make([]*memPages, 8), make([]map[string]string, 8)
+	for w := range 8 {
+		trees[w], mems[w] = newTestTree(t, Config{Scratch: pool})
+		wants[w] = map[string]string{}
+		tree, want := trees[w], wants[w]
+		wg.Go(func() {
+			rng := rand.New(rand.NewPCG(uint64(w), 0))
+			for i := range 3000 {
+				// long keys and values, so that nodes split in 3
+				key := fmt.Sprintf("%0*d", 1+rng.IntN(BTREE_MAX_KEY_SIZE), rng.IntN(2000))
+				switch rng.IntN(10) {
+				case 0:
+					if _, err := tree.Delete([]byte(key)); err != nil {
+						errs <- err
+						return
+					}
+					delete(want, key)
+				case 1:
+					hi := fmt.Sprintf("%0*d", 1+rng.IntN(BTREE_MAX_KEY_SIZE), rng.IntN(2000))
+					if _, err := tree.DeleteRange([]byte(key), []byte(hi)); err != nil {
+						errs <- err
+						return
+					}
+					for k := range want {
+						if k >= key && k < hi {
+							delete(want, k)
+						}
+					}
+				default:
+					val := strings.Repeat("v", rng.IntN(BTREE_MAX_VAL_SIZE))
+					if err := tree.Insert([]byte(key), []byte(val)); err != nil {
+						errs <- fmt.Errorf("insert %d: %w", i, err)
+						return
+					}
+					want[key] = val
+				}
+			}
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	for w := range trees {
+		checkTree(t, trees[w], mems[w], wants[w])
+	}
+	if peak := pool.Peak(); peak > limit || peak == 0 {
+		t.Fatalf("%d scratch nodes at once, at most %d", peak, limit)
+	}
+
+	// a burst of deletions and merges takes its nodes from the pool too
+	pool = NewScratchPool(limit)
+	for w := range trees {
+		tree, err := New(mems[w].config(Config{Scratch: pool, Root: trees[w].Root()}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		trees[w] = tree
+		want := wants[w]
+		keys := slices.Sorted(maps.Keys(want))
+		wg.Go(func() {
+			rng := rand.New(rand.NewPCG(uint64(w), 1))
+			for i, key := range keys {
+				if rng.IntN(8) == 0 && i+1 < len(keys) {
+					hi := keys[i+1+rng.IntN(len(keys)-i-1)]
+					n, err := tree.DeleteRange([]byte(key), []byte(hi))
+					if err != nil {
+						errs2 <- err
+						return
+					}
+					removed := 0
+					for k := range want {
+						if k >= key && k < hi {
+							delete(want, k)
+							removed++
+						}
+					}
+					if n != removed {
+						errs2 <- fmt.Errorf("DeleteRange removed %d keys, not %d", n, removed)
+						return
+					}
+				} else if _, ok := want[key]; ok {
+					if _, err := tree.Delete([]byte(key)); err != nil {
+						errs2 <- err
+						return
+					}
+					delete(want, key)
+				}
+			}
+		})
+	}
+	wg.Wait()
+	close(errs2)
+	for err := range errs2 {
+		t.Fatal(err)
+	}
+	for w := range trees {
+		checkTree(t, trees[w], mems[w], wants[w])
+	}
+	if peak := pool.Peak(); peak > limit || peak == 0 {
+		t.Fatalf("%d scratch nodes at once deleting, at most %d", peak, limit)
+	}
+
+	// a single level takes 1+SCRATCH_RESERVE
+	tree, mem := newTestTree(t, Config{Scratch: NewScratchPool(SCRATCH_RESERVE)})
+	if err := tree.Insert([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Insert([]byte("b"), []byte("2")); !errors.Is(err, ErrScratchLimit) {
+		t.Fatalf("insert past the limit: %v", err)
+	}
+	if _, err := tree.Delete([]byte("a")); !errors.Is(err, ErrScratchLimit) {
+		t.Fatalf("delete past the limit: %v", err)
+	}
+	checkTree(t, tree, mem, map[string]string{"a": "1"})
+}
@@ -0,0 +1,140 @@
+package btree
+
+import "iter"
+
+/*
+A set is a keys-only tree, see `Config.KeysOnly`: its members are the keys,
+with empty values, in the order of the tree.
+
+`Union`, `Intersect` and `Difference` walk both sets side by side in order,
+stepping the one behind, or both on a member they share, and bulk load the
+members they keep into an empty set: each set is read once and the result is
+written once, packed. Both sets must order their members the same way.
+*/
+
+// An ordered set of byte strings, kept in a keys-only tree.
+type Set struct {
+	tree *BTree
+}
+
+// Returns the set kept in the keys-only tree of `cfg`, `Config.KeysOnly` is
+// set for it. Fails like `New`.
+func NewSet(cfg Config) (*Set, error) {
+	cfg.KeysOnly = true
+	tree, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Set{tree: tree}, nil
+}
+
+// Returns the tree of the set, for `BTree.Root` and the like. Values can't
+// be stored in it.
+func (s *Set) Tree() *BTree {
+	return s.tree
+}
+
+// Adds a member, fails like `BTree.Insert`.
+func (s *Set) Add(member []byte) error {
+	return s.tree.Insert(member, nil)
+}
+
+// Reports whether `member` is in the set.
+func (s *Set) Has(member []byte) bool {
+	_, ok := s.tree.Get(member)
+	return ok
+}
+
+// Removes a member, returns whether it was there. Fails like `BTree.Delete`.
+func (s *Set) Remove(member []byte) (bool, error) {
+	return s.tree.Delete(member)
+}
+
+// Returns the number of members.
+func (s *Set) Len() uint64 {
+	return s.tree.Len()
+}
+
+// Yields the members in [start, end) in order, a nil `start` or `end` means
+// no bound on that side. The set must not be updated meanwhile.
+func (s *Set) Range(start, end []byte) iter.Seq[[]byte] {
+	return func(yield func(member []byte) bool) {
+		cur := s.tree.Cursor()
+		var ok bool
+		if start == nil {
+			ok = cur.SeekToFirst()
+		} else {
+			ok = cur.Seek(start)
+		}
+
+		for ; ok; ok = cur.Next() {
+			if end != nil && s.tree.compare(cur.Key(), end) >= 0 {
+				return
+			}
+			if !yield(cur.Key()) {
+				return
+			}
+		}
+	}
+}
+
+// Fills `dst`, which must be empty, with the members of either set. Fails
+// with `ErrNotEmpty` for a `dst` with members, or like `BTree.BulkLoad`.
+func (s *Set) Union(other, dst *Set) error {
+	return dst.tree.BulkLoad(mergeSets(s, other, func(inS, inOther bool) bool {
+		return true
+	}), 1)
+}
+
+// Fills `dst`, which must be empty, with the members of both sets. Fails
+// like `Union`.
+func (s *Set) Intersect(other, dst *Set) error {
+	return dst.tree.BulkLoad(mergeSets(s, other, func(inS, inOther bool) bool {
+		return inS && inOther
+	}), 1)
+}
+
+// Fills `dst`, which must be empty, with the members of `s` that aren't in
+// `other`. Fails like `Union`.
+func (s *Set) Difference(other, dst *Set) error {
+	return dst.tree.BulkLoad(mergeSets(s, other, func(inS, inOther bool) bool {
+		return inS && !inOther
+	}), 1)
+}
+
+// Walks both sets in order and yields the members `keep` keeps, given which
+// sets have them, as keys with empty values.
+func mergeSets(a, b *Set, keep func(inA, inB bool) bool) iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, val []byte) bool) {
+		curA, curB := a.tree.Cursor(), b.tree.Cursor()
+		okA, okB := curA.SeekToFirst(), curB.SeekToFirst()
+
+		for okA || okB {
+			var member []byte
+			var inA, inB bool
+			switch {
+			case !okB:
+				member, inA = curA.Key(), true
+			case !okA:
+				member, inB = curB.Key(), true
+			default:
+				cmp := a.tree.compare(curA.Key(), curB.Key())
+				inA, inB = cmp <= 0, cmp >= 0
+				member = curA.Key()
+				if !inA {
+					member = curB.Key()
+				}
+			}
+
+			if keep(inA, inB) && !yield(member, nil) {
+				return
+			}
+			if inA {
+				okA = curA.Next()
+			}
+			if inB {
+				okB = curB.Next()
+			}
+		}
+	}
+}
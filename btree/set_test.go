@@ -0,0 +1,152 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// Returns a set on pages in memory holding `members`.
+func newTestSet(t *testing.T, members ...string) (*Set, *memPages) {
+	t.Helper()
+	mem := &memPages{pages: map[uint64][]byte{}, next: 1}
+	set, err := NewSet(mem.config(Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, member := range members {
+		if err := set.Add([]byte(member)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return set, mem
+}
+
+// Returns the members of a range of a set in the order it yields them.
+func setMembers(set *Set, start, end []byte) []string {
+	var members []string
+	for member := range set.Range(start, end) {
+		members = append(members, string(member))
+	}
+	return members
+}
+
+// Members are added once, found, removed and yielded in order, in a range or
+// all of them.
+func TestSet(t *testing.T) {
+	set, mem := newTestSet(t, "c", "a", "b", "a", "", "e")
+	if set.Len() != 5 || !set.Has([]byte("a")) || !set.Has(nil) || set.Has([]byte("d")) {
+		t.Fatalf("%d members: %q", set.Len(), setMembers(set, nil, nil))
+	}
+	if removed, err := set.Remove([]byte("c")); !removed || err != nil {
+		t.Fatalf("remove c: %v, %v", removed, err)
+	}
+	if removed, _ := set.Remove([]byte("c")); removed {
+		t.Fatal("removed c twice")
+	}
+	for _, tc := range []struct {
+		start, end []byte
+		want       []string
+	}{
+		{nil, nil, []string{"", "a", "b", "e"}},
+		{[]byte("a"), []byte("e"), []string{"a", "b"}},
+		{[]byte("aa"), nil, []string{"b", "e"}},
+		{nil, []byte("a"), []string{""}},
+		{[]byte("f"), nil, nil},
+	} {
+		if got := setMembers(set, tc.start, tc.end); !slices.Equal(got, tc.want) {
+			t.Fatalf("[%q, %q): %q, want %q", tc.start, tc.end, got, tc.want)
+		}
+	}
+	if err := set.Tree().Insert([]byte("x"), []byte("val")); !errors.Is(err, ErrKeysOnly) {
+		t.Fatalf("value in a set: %v", err)
+	}
+	checkTree(t, set.Tree(), mem, map[string]string{"": "", "a": "", "b": "", "e": ""})
+}
+
+// The set operations give the members they should, in order, for sets that
+// overlap, are disjoint, nested or empty, and for large ones spanning many
+// pages.
+func TestSetOps(t *testing.T) {
+	for _, tc := range []struct {
+		a, b                         []string
+		union, intersect, difference []string
+	}{
+		{[]string{"a", "c", "e"}, []string{"b", "c", "d"}, []string{"a", "b", "c", "d", "e"}, []string{"c"}, []string{"a", "e"}},
+		{[]string{"a", "b"}, []string{"c", "d"}, []string{"a", "b", "c", "d"}, nil, []string{"a", "b"}},
+		{[]string{"b"}, []string{"a", "b", "c"}, []string{"a", "b", "c"}, []string{"b"}, nil},
+		{[]string{"a", "b", "c"}, []string{"b"}, []string{"a", "b", "c"}, []string{"b"}, []string{"a", "c"}},
+		{nil, []string{"a"}, []string{"a"}, nil, nil},
+		{[]string{"", "a"}, nil, []string{"", "a"}, nil, []string{"", "a"}},
+		{nil, nil, nil, nil, nil},
+	} {
+		a, _ := newTestSet(t, tc.a...)
+		b, _ := newTestSet(t, tc.b...)
+		for name, op := range map[string]struct {
+			run  func(other, dst *Set) error
+			want []string
+		}{
+			"union":      {a.Union, tc.union},
+			"intersect":  {a.Intersect, tc.intersect},
+			"difference": {a.Difference, tc.difference},
+		} {
+			dst, mem := newTestSet(t)
+			if err := op.run(b, dst); err != nil {
+				t.Fatal(err)
+			}
+			if got := setMembers(dst, nil, nil); !slices.Equal(got, op.want) || dst.Len() != uint64(len(op.want)) {
+				t.Fatalf("%q %s %q: %q, want %q", tc.a, name, tc.b, got, op.want)
+			}
+			want := map[string]string{}
+			for _, member := range op.want {
+				want[member] = ""
+			}
+			checkTree(t, dst.Tree(), mem, want)
+		}
+	}
+
+	// multiples of 2 and 3
+	twos, _ := newTestSet(t)
+	threes, _ := newTestSet(t)
+	var union, intersect, difference []string
+	for i := range 6000 {
+		member := fmt.Sprintf("%05d", i)
+		switch {
+		case i%6 == 0:
+			intersect = append(intersect, member)
+		case i%2 == 0:
+			difference = append(difference, member)
+		}
+		if i%2 == 0 {
+			twos.Add([]byte(member))
+		}
+		if i%3 == 0 {
+			threes.Add([]byte(member))
+		}
+		if i%2 == 0 || i%3 == 0 {
+			union = append(union, member)
+		}
+	}
+	for name, op := range map[string]struct {
+		run  func(other, dst *Set) error
+		want []string
+	}{
+		"union":      {twos.Union, union},
+		"intersect":  {twos.Intersect, intersect},
+		"difference": {twos.Difference, difference},
+	} {
+		dst, _ := newTestSet(t)
+		if err := op.run(threes, dst); err != nil {
+			t.Fatal(err)
+		}
+		if got := setMembers(dst, nil, nil); !slices.Equal(got, op.want) {
+			t.Fatalf("%s: %d members, want %d", name, len(got), len(op.want))
+		}
+	}
+
+	full, _ := newTestSet(t, "x")
+	if err := twos.Union(threes, full); !errors.Is(err, ErrNotEmpty) {
+		t.Fatalf("union into a set with members: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package btree
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrReadOnly = errors.New("btree: read-only tree")
+
+// Returns a read-only copy of the tree as it is now, sharing its pages. Since
+// updates never modify a page but write a new one, the copy stays consistent
+// while the tree is updated: the pages it needs are only freed once it's
+// closed. Writes to the copy fail with `ErrReadOnly`. It can be read from
+// another goroutine while the tree is updated if `Config.Get` allows it, and
+// it must be closed to free the pages it holds.
+func (tree *BTree) Clone() *BTree {
+	if tree.readOnly && tree.snaps == nil {
+		// a closed copy, there's nothing left to share
+		return &BTree{pageSize: tree.pageSize, compare: tree.compare, keysOnly: tree.keysOnly, maxKey: tree.maxKey, readOnly: true}
+	}
+	if tree.snaps == nil {
+		tree.snaps = &snapshots{del: tree.del, live: map[uint64]int{}}
+		tree.del = tree.snaps.free
+	}
+
+	s := tree.snaps
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// a copy of a copy needs what the first one did
+	id := tree.snapID
+	if !tree.readOnly {
+		s.taken++
+		id = s.taken
+	}
+	s.live[id]++
+
+	return &BTree{
+		root:     tree.root,
+		pageSize: tree.pageSize,
+		compare:  tree.compare,
+		keysOnly: tree.keysOnly,
+		maxKey:   tree.maxKey,
+		get:      tree.get,
+		read:     tree.read,
+		prefetch: tree.prefetch,
+		readOnly: true,
+		snapID:   id,
+		snaps:    s,
+	}
+}
+
+// Releases a copy made by `Clone`, freeing the pages only it still needed. It
+// reads as empty afterwards. Closing the tree itself, or a copy twice, does
+// nothing.
+func (tree *BTree) Close() {
+	if !tree.readOnly || tree.snaps == nil {
+		return
+	}
+
+	tree.snaps.release(tree.snapID)
+	tree.root, tree.snaps = 0, nil
+}
+
+// The copies of a tree that are open, and the pages freed by the tree that
+// they might still read.
+type snapshots struct {
+	mu      sync.Mutex
+	del     func(uint64)   // `Config.Del`
+	taken   uint64         // copies made so far, a copy's id is the count when it was made
+	live    map[uint64]int // open copies by id
+	pending []pendingFree  // in the order they were freed
+}
+
+// A page freed after `taken` copies were made, which those copies might read.
+type pendingFree struct {
+	ptr   uint64
+	taken uint64
+}
+
+// Frees a page, or keeps it until the copies made so far are closed.
+func (s *snapshots) free(ptr uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.live) == 0 {
+		s.del(ptr)
+		return
+	}
+	s.pending = append(s.pending, pendingFree{ptr: ptr, taken: s.taken})
+}
+
+// Closes a copy, then frees the pages that no open copy was made before.
+func (s *snapshots) release(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.live[id]--; s.live[id] == 0 {
+		delete(s.live, id)
+	}
+
+	oldest := s.taken + 1
+	for id := range s.live {
+		oldest = min(oldest, id)
+	}
+
+	n := 0
+	for ; n < len(s.pending) && s.pending[n].taken < oldest; n++ {
+		s.del(s.pending[n].ptr)
+	}
+	s.pending = s.pending[n:]
+}
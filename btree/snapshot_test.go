@@ -0,0 +1,103 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"testing"
+)
+
+// Returns the pairs of the tree.
+func treePairs(tree *BTree) map[string]string {
+	pairs := map[string]string{}
+	for key, val := range tree.Scan(nil) {
+		pairs[string(key)] = string(val)
+	}
+	return pairs
+}
+
+// A copy keeps reading the tree as it was while the tree is rewritten, and
+// the pages only it needed are freed once it's closed.
+func TestClone(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	want := map[string]string{}
+	update := func(round int) {
+		for i := range 2000 {
+			key := fmt.Sprintf("key%05d", i*7919%5000)
+			val := fmt.Sprintf("val%d-%d", round, i)
+			tree.Insert([]byte(key), []byte(val))
+			want[key] = val
+		}
+		for i := range 500 {
+			key := fmt.Sprintf("key%05d", (i+round*500)*7919%5000)
+			tree.Delete([]byte(key))
+			delete(want, key)
+		}
+	}
+
+	update(0)
+	first := tree.Clone()
+	firstWant := maps.Clone(want)
+
+	update(1)
+	second := tree.Clone()
+	secondWant := maps.Clone(want)
+	third := second.Clone() // shares what `second` needs
+
+	tree.DeleteRange([]byte("key01000"), []byte("key03000"))
+	for key := range want {
+		if key >= "key01000" && key < "key03000" {
+			delete(want, key)
+		}
+	}
+	update(2)
+
+	for name, c := range map[string]struct {
+		tree *BTree
+		want map[string]string
+	}{"first": {first, firstWant}, "second": {second, secondWant}, "third": {third, secondWant}} {
+		if err := c.tree.Verify(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := treePairs(c.tree); !maps.Equal(got, c.want) {
+			t.Fatalf("%s: %d pairs, want %d", name, len(got), len(c.want))
+		}
+		if c.tree.Len() != uint64(len(c.want)) {
+			t.Fatalf("%s: len %d", name, c.tree.Len())
+		}
+	}
+
+	// copies can't be written
+	if err := first.Insert([]byte("a"), nil); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("insert: %v", err)
+	}
+	if err := first.PutMany([]KV{{Key: []byte("a")}}); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("put many: %v", err)
+	}
+	if _, err := first.Delete([]byte("key00000")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := first.DeleteRange(nil, nil); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("delete range: %v", err)
+	}
+
+	// closing them in any order frees what they held
+	second.Close()
+	if got := treePairs(third); !maps.Equal(got, secondWant) {
+		t.Fatalf("third after closing second: %d pairs", len(got))
+	}
+	first.Close()
+	first.Close()
+	if got := treePairs(third); !maps.Equal(got, secondWant) {
+		t.Fatalf("third after closing first: %d pairs", len(got))
+	}
+	third.Close()
+	if third.Len() != 0 {
+		t.Fatal("a closed copy isn't empty")
+	}
+	checkTree(t, tree, mem, want)
+
+	// without copies pages are freed right away
+	update(3)
+	checkTree(t, tree, mem, want)
+}
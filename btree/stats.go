@@ -0,0 +1,76 @@
+package btree
+
+import "encoding/binary"
+
+// Shape and size of a tree, see `BTree.Stats`.
+type Stats struct {
+	Depth         int    // number of levels, 0 for an empty tree
+	InternalNodes uint64 // internal nodes
+	LeafNodes     uint64 // leaf nodes
+	OverflowPages uint64 // pages taken by values stored out of the leaves
+	Keys          uint64 // keys in the leaves
+	KeyBytes      uint64 // total length of the keys in the leaves
+	ValBytes      uint64 // total length of the values, including overflow ones
+
+	Levels []LevelStats // from the root down to the leaves
+}
+
+// Nodes on a single level of a tree.
+type LevelStats struct {
+	Nodes uint64
+	Keys  uint64  // keys or kid links
+	Bytes uint64  // bytes used by the nodes, see `BNode.nbytes`
+	Fill  float64 // average fraction of a page used by a node
+}
+
+// Walks the whole tree and returns its stats.
+func (tree *BTree) Stats() Stats {
+	var stats Stats
+	if tree.root == 0 {
+		return stats
+	}
+
+	var walk func(ptr uint64, depth int)
+	walk = func(ptr uint64, depth int) {
+		node := BNode(tree.get(ptr))
+		if depth == len(stats.Levels) {
+			stats.Levels = append(stats.Levels, LevelStats{})
+		}
+
+		level := &stats.Levels[depth]
+		level.Nodes++
+		level.Keys += uint64(node.nkeys())
+		level.Bytes += uint64(node.nbytes())
+
+		if node.btype() == BNODE_NODE {
+			stats.InternalNodes++
+			for i := uint16(0); i < node.nkeys(); i++ {
+				walk(node.getPtr(i), depth+1)
+			}
+			return
+		}
+
+		stats.LeafNodes++
+		for i := uint16(0); i < node.nkeys(); i++ {
+			stats.Keys++
+			stats.KeyBytes += uint64(len(node.getKey(i)))
+			if node.getPtr(i) == 0 {
+				stats.ValBytes += uint64(len(node.getVal(i)))
+				continue
+			}
+
+			vlen := binary.LittleEndian.Uint64(node.getVal(i))
+			stats.ValBytes += vlen
+			stats.OverflowPages += overflowPages(vlen, tree.PageSize())
+		}
+	}
+
+	walk(tree.root, 0)
+	stats.Depth = len(stats.Levels)
+	for i := range stats.Levels {
+		level := &stats.Levels[i]
+		level.Fill = float64(level.Bytes) / float64(level.Nodes*uint64(tree.pageSize))
+	}
+
+	return stats
+}
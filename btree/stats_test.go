@@ -0,0 +1,66 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	if stats := tree.Stats(); stats.Depth != 0 || stats.Levels != nil {
+		t.Fatalf("empty tree: %+v", stats)
+	}
+
+	var kvs [][2][]byte
+	for i := range 3000 {
+		kvs = append(kvs, [2][]byte{fmt.Appendf(nil, "key%05d", i), []byte("val")})
+	}
+	buildTree(tree, kvs)
+
+	stats := tree.Stats()
+	if stats.Depth != 3 || stats.InternalNodes != 7 || stats.LeafNodes != 60 || stats.OverflowPages != 0 {
+		t.Fatalf("shape: %+v", stats)
+	}
+	if stats.Keys != 3000 || stats.KeyBytes != 3000*8 || stats.ValBytes != 3000*3 {
+		t.Fatalf("sizes: %+v", stats)
+	}
+
+	// the keys of each node share a prefix of 4, 5 and 6 bytes, stored once,
+	// and the internal nodes count 500 and 50 keys under each kid
+	levels := []LevelStats{
+		{Nodes: 1, Keys: 6, Bytes: HEADER + 6*(14+8-4+2) + 2 + 4},
+		{Nodes: 6, Keys: 60, Bytes: 6 * (HEADER + 10*(14+8-5+1) + 2 + 5)},
+		{Nodes: 60, Keys: 3000, Bytes: 60 * (HEADER + 50*(14+11-6) + 2 + 6)},
+	}
+	for i, want := range levels {
+		want.Fill = float64(want.Bytes) / float64(want.Nodes*BTREE_PAGE_SIZE)
+		if stats.Levels[i] != want {
+			t.Fatalf("level %d: %+v, want %+v", i, stats.Levels[i], want)
+		}
+	}
+
+	// a value moved out of its leaf counts whole, and so do its pages
+	tree.Insert([]byte("key99999"), bytes.Repeat([]byte("o"), 10*BTREE_PAGE_SIZE))
+	stats = tree.Stats()
+	if stats.Keys != 3001 || stats.ValBytes != 3000*3+10*BTREE_PAGE_SIZE {
+		t.Fatalf("with overflow: %+v", stats)
+	}
+	nodes := stats.InternalNodes + stats.LeafNodes
+	if stats.OverflowPages != 11 || nodes+stats.OverflowPages != uint64(len(mem.pages)) {
+		t.Fatalf("%d nodes and %d overflow pages, %d allocated", nodes, stats.OverflowPages, len(mem.pages))
+	}
+
+	// which are the pages listed
+	pages := tree.Pages()
+	seen := map[uint64]bool{}
+	for _, ptr := range pages {
+		if _, ok := mem.pages[ptr]; !ok || seen[ptr] {
+			t.Fatalf("page %d listed twice or not allocated", ptr)
+		}
+		seen[ptr] = true
+	}
+	if len(seen) != len(mem.pages) {
+		t.Fatalf("%d pages listed, %d allocated", len(seen), len(mem.pages))
+	}
+}
@@ -0,0 +1,307 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+`Stress` runs writers, readers and scanners on a tree at once for a while and
+checks that what each of them sees is consistent, to be run under `-race`.
+
+The tree takes one update at a time, so the writers take turns: each one sets
+and removes keys of its own under `STRESS_PREFIX`, checking right after every
+update that it reads back what it wrote, and from time to time that one of
+its keys holds what it last wrote there. Readers and scanners work on copies
+made by `Clone`, which stay the same while the writers go on: a reader reads
+every key it picks twice and expects the same value, a scanner goes through
+the whole copy and expects its keys in order and as many as `Len` says.
+Every value names its key, so that a value read under another key shows.
+
+Once the time is up, the tree must hold the last value each writer wrote
+under each of its keys, and nothing else under `STRESS_PREFIX`, and pass
+`Verify`.
+*/
+
+// keys set by `Stress` start with it
+const STRESS_PREFIX = "stress/"
+
+// keys per writer when `StressConfig.Keys` is 0
+const STRESS_KEYS = 1000
+
+// keys a reader reads from a copy before it takes a new one
+const STRESS_READS_PER_COPY = 64
+
+// most violations kept in a `StressReport`
+const STRESS_MAX_VIOLATIONS = 100
+
+// What `Stress` runs.
+type StressConfig struct {
+	Writers  int
+	Readers  int
+	Scanners int
+	Duration time.Duration
+	Keys     int    // per writer, 0 means STRESS_KEYS
+	Seed     uint64 // of the random ops, each goroutine gets its own stream
+}
+
+// What a `Stress` run did, and what it found.
+type StressReport struct {
+	Writes     uint64 // keys set or removed
+	Reads      uint64 // keys read
+	Scans      uint64 // copies scanned whole
+	Elapsed    time.Duration
+	Violations []string // the first `STRESS_MAX_VIOLATIONS`, none for a consistent tree
+	Dropped    int      // violations past those
+}
+
+// Returns the keys written and read per second.
+func (r StressReport) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Writes+r.Reads) / r.Elapsed.Seconds()
+}
+
+// Runs the goroutines of `cfg` on the tree until `cfg.Duration` is over and
+// reports what they did and the inconsistencies they found, see
+// `STRESS_PREFIX`. The keys under the prefix are left as the writers left
+// them. `Config.Get`, `Config.New` and `Config.Del` must be safe for
+// concurrent use, the readers go on while the tree is updated.
+func Stress(tree *BTree, cfg StressConfig) StressReport {
+	s := &stress{tree: tree, cfg: cfg, models: make([]map[string]string, cfg.Writers)}
+	if s.cfg.Keys <= 0 {
+		s.cfg.Keys = STRESS_KEYS
+	}
+	for w := range s.models {
+		s.models[w] = map[string]string{}
+	}
+	// left by an earlier run
+	for key, val := range tree.Scan([]byte(STRESS_PREFIX)) {
+		if w, ok := s.writer(key); ok {
+			s.models[w][string(key)] = string(val)
+		}
+	}
+
+	start := time.Now()
+	deadline := start.Add(cfg.Duration)
+	var wg sync.WaitGroup
+	run := func(n int, worker func(rng *rand.Rand, id int)) {
+		for i := range n {
+			id := int(s.streams.Add(1))
+			wg.Go(func() {
+				defer func() {
+					if r := recover(); r != nil {
+						s.violation("goroutine %d: panic: %v", id, r)
+					}
+				}()
+				rng := rand.New(rand.NewPCG(cfg.Seed, uint64(id)))
+				for time.Now().Before(deadline) {
+					worker(rng, i)
+				}
+			})
+		}
+	}
+	run(cfg.Writers, s.write)
+	run(cfg.Readers, s.read)
+	run(cfg.Scanners, s.scan)
+	wg.Wait()
+
+	report := StressReport{
+		Writes:  s.writes.Load(),
+		Reads:   s.reads.Load(),
+		Scans:   s.scans.Load(),
+		Elapsed: time.Since(start),
+	}
+	s.checkEnd()
+	report.Violations, report.Dropped = s.violations, s.dropped
+	return report
+}
+
+// The state of a `Stress` run.
+type stress struct {
+	tree    *BTree
+	cfg     StressConfig
+	mu      sync.Mutex          // held by the writer updating the tree, and to copy it
+	models  []map[string]string // by writer, the values it last wrote, under `mu`
+	seq     uint64              // of the values written, under `mu`
+	streams atomic.Uint64       // of random ops handed out
+	writes  atomic.Uint64
+	reads   atomic.Uint64
+	scans   atomic.Uint64
+
+	failed     sync.Mutex
+	violations []string
+	dropped    int
+}
+
+func (s *stress) violation(format string, args ...any) {
+	s.failed.Lock()
+	defer s.failed.Unlock()
+	if len(s.violations) < STRESS_MAX_VIOLATIONS {
+		s.violations = append(s.violations, fmt.Sprintf(format, args...))
+	} else {
+		s.dropped++
+	}
+}
+
+func stressKey(writer, k int) []byte {
+	return fmt.Appendf(nil, "%sw%03d/%06d", STRESS_PREFIX, writer, k)
+}
+
+// Returns a value naming its key.
+func stressVal(key []byte, seq uint64) []byte {
+	return fmt.Appendf(nil, "%s#%d", key, seq)
+}
+
+// Reports whether a value read under a key of `Stress` was written under it.
+func stressValOK(key, val []byte) bool {
+	return bytes.HasPrefix(val, key) && len(val) > len(key) && val[len(key)] == '#'
+}
+
+// Sets or removes a key of writer `w`, then reads it back.
+func (s *stress) write(rng *rand.Rand, w int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := stressKey(w, rng.IntN(s.cfg.Keys))
+	model := s.models[w]
+	if rng.IntN(4) == 0 {
+		_, had := model[string(key)]
+		deleted, err := s.tree.Delete(key)
+		switch {
+		case err != nil:
+			s.violation("delete %q: %v", key, err)
+			return
+		case deleted != had:
+			s.violation("delete %q: removed %v, it was there %v", key, deleted, had)
+		}
+		delete(model, string(key))
+		if _, ok := s.tree.Get(key); ok {
+			s.violation("%q still there once deleted", key)
+		}
+	} else {
+		s.seq++
+		val := stressVal(key, s.seq)
+		if err := s.tree.Insert(key, val); err != nil {
+			s.violation("insert %q: %v", key, err)
+			return
+		}
+		model[string(key)] = string(val)
+		if got, ok := s.tree.Get(key); !ok || !bytes.Equal(got, val) {
+			s.violation("%q = %q, %v just after setting it to %q", key, got, ok, val)
+		}
+	}
+	s.writes.Add(1)
+
+	// one of the keys written earlier
+	key = stressKey(w, rng.IntN(s.cfg.Keys))
+	want, had := model[string(key)]
+	if got, ok := s.tree.Get(key); ok != had || string(got) != want {
+		s.violation("%q = %q, %v, last written %q, %v", key, got, ok, want, had)
+	}
+}
+
+// Returns a copy of the tree to read while it's updated.
+func (s *stress) clone() *BTree {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Clone()
+}
+
+// Reads keys of the writers twice from a copy.
+func (s *stress) read(rng *rand.Rand, _ int) {
+	snap := s.clone()
+	defer snap.Close()
+
+	type read struct {
+		key []byte
+		val []byte // nil if it wasn't there
+	}
+	reads := make([]read, STRESS_READS_PER_COPY)
+	for i := range reads {
+		key := stressKey(rng.IntN(max(s.cfg.Writers, 1)), rng.IntN(s.cfg.Keys))
+		reads[i].key = key
+		if val, ok := snap.Get(key); ok {
+			if !stressValOK(key, val) {
+				s.violation("%q = %q, written under another key", key, val)
+			}
+			reads[i].val = bytes.Clone(val)
+		}
+		s.reads.Add(1)
+	}
+	for _, r := range reads {
+		if val, ok := snap.Get(r.key); ok != (r.val != nil) || !bytes.Equal(val, r.val) {
+			s.violation("%q = %q, %v in a copy that read %q", r.key, val, ok, r.val)
+		}
+	}
+}
+
+// Scans a whole copy.
+func (s *stress) scan(_ *rand.Rand, _ int) {
+	snap := s.clone()
+	defer snap.Close()
+
+	var last []byte
+	n := uint64(0)
+	for key, val := range snap.Scan(nil) {
+		if n > 0 && snap.compare(last, key) >= 0 {
+			s.violation("scan: %q after %q", key, last)
+		}
+		if bytes.HasPrefix(key, []byte(STRESS_PREFIX)) && !stressValOK(key, val) {
+			s.violation("scan: %q = %q, written under another key", key, val)
+		}
+		last = append(last[:0], key...)
+		n++
+	}
+	if count := snap.Len(); n != count {
+		s.violation("scan: %d keys, %d counted", n, count)
+	}
+	s.scans.Add(1)
+}
+
+// Checks the tree against what the writers last wrote.
+func (s *stress) checkEnd() {
+	if err := s.tree.Verify(); err != nil {
+		s.violation("verify: %v", err)
+	}
+
+	want := map[string]string{}
+	for _, model := range s.models {
+		for key, val := range model {
+			want[key] = val
+		}
+	}
+	for key, val := range s.tree.Scan([]byte(STRESS_PREFIX)) {
+		w, ok := want[string(key)]
+		switch {
+		case !ok && s.isWriters(key):
+			s.violation("end: %q is there, the writer removed it", key)
+		case ok && w != string(val):
+			s.violation("end: %q = %q, last written %q", key, val, w)
+		}
+		delete(want, string(key))
+	}
+	for key := range want {
+		s.violation("end: %q is missing", key)
+	}
+}
+
+// Returns the writer of the run a key belongs to, if it's one of theirs
+// rather than one left by an earlier run with more writers or keys.
+func (s *stress) writer(key []byte) (int, bool) {
+	var w, k int
+	_, err := fmt.Sscanf(strings.TrimPrefix(string(key), STRESS_PREFIX), "w%03d/%06d", &w, &k)
+	ok := err == nil && w < s.cfg.Writers && k < s.cfg.Keys && bytes.Equal(key, stressKey(w, k))
+	return w, ok
+}
+
+func (s *stress) isWriters(key []byte) bool {
+	_, ok := s.writer(key)
+	return ok
+}
@@ -0,0 +1,37 @@
+package btree
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// A short run of every kind of goroutine finds nothing wrong, twice on the
+// same tree, and leaves it consistent. Writes to a copy, which fail, are
+// reported.
+func TestStress(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	tree.Insert([]byte("other"), []byte("kept"))
+	cfg := StressConfig{Writers: 2, Readers: 3, Scanners: 2, Duration: 100 * time.Millisecond, Keys: 300, Seed: 1}
+	for run := range 2 {
+		report := Stress(tree, cfg)
+		if len(report.Violations) > 0 || report.Dropped > 0 {
+			t.Fatalf("run %d: %d violations: %q", run, len(report.Violations)+report.Dropped, report.Violations)
+		}
+		if report.Writes == 0 || report.Reads == 0 || report.Scans == 0 || report.Throughput() <= 0 {
+			t.Fatalf("run %d: %+v", run, report)
+		}
+	}
+	want := treePairs(tree)
+	if want["other"] != "kept" || len(want) < 100 {
+		t.Fatalf("%d keys left", len(want))
+	}
+	checkTree(t, tree, mem, want)
+
+	snap := tree.Clone()
+	defer snap.Close()
+	report := Stress(snap, StressConfig{Writers: 1, Duration: 10 * time.Millisecond})
+	if len(report.Violations) == 0 || !strings.Contains(report.Violations[0], ErrReadOnly.Error()) {
+		t.Fatalf("writes to a copy: %q", report.Violations)
+	}
+}
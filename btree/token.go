@@ -0,0 +1,111 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+A scan served a page at a time, to clients that hold no state in between,
+hands out tokens saying where the next page starts:
+
+| version | start | key | crc32 |
+|   1B    |  1B   | ... |  4B   |
+
+encoded in URL-safe base64 without padding. `start` is one of the
+`TOKEN_FROM_*` positions. The token holds a key and no page, so it resumes
+right where it left off even if the tree was updated in between: keys added
+before it are skipped and keys added after it are yielded.
+
+The checksum catches a token that was cut or mangled on its way. It isn't a
+signature: a client can still make up a token for any key, which only lets
+it start a scan anywhere.
+*/
+
+const TOKEN_VERSION = 1
+
+// where a token resumes from
+const (
+	TOKEN_FROM_FIRST = 0 // the first key of the tree
+	TOKEN_FROM_KEY   = 1 // the first key >= the token's
+	TOKEN_AFTER_KEY  = 2 // the first key > the token's
+)
+
+var ErrBadCursor = errors.New("btree: bad cursor token")
+
+// Returns a token that resumes a scan at the first key >= `key`, or at the
+// first key of the tree for a nil key, see `ScanFromToken`.
+func (tree *BTree) CursorToken(key []byte) string {
+	if key == nil {
+		return encodeToken(TOKEN_FROM_FIRST, nil)
+	}
+	return encodeToken(TOKEN_FROM_KEY, key)
+}
+
+// Returns up to `limit` key-value pairs in key order from where the token says,
+// copied so that the tree can be updated before the next page is asked for, and
+// the token of the next page, empty once the last key is returned. A `limit`
+// under 1 is treated as 1. Fails with `ErrBadCursor` for a token that isn't
+// one from `CursorToken` or `ScanFromToken`.
+func (tree *BTree) ScanFromToken(token string, limit int) ([]KV, string, error) {
+	start, key, err := decodeToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	limit = max(limit, 1)
+
+	cur := tree.Cursor()
+	var ok bool
+	switch start {
+	case TOKEN_FROM_FIRST:
+		ok = cur.SeekToFirst()
+	case TOKEN_FROM_KEY:
+		ok = cur.Seek(key)
+	case TOKEN_AFTER_KEY:
+		ok = cur.Seek(key)
+		if ok && tree.compare(cur.Key(), key) == 0 {
+			ok = cur.Next()
+		}
+	}
+
+	var kvs []KV
+	for ; ok && len(kvs) < limit; ok = cur.Next() {
+		kvs = append(kvs, KV{Key: bytes.Clone(cur.Key()), Val: bytes.Clone(cur.Val())})
+	}
+	if !ok {
+		return kvs, "", nil
+	}
+	return kvs, encodeToken(TOKEN_AFTER_KEY, kvs[len(kvs)-1].Key), nil
+}
+
+func encodeToken(start byte, key []byte) string {
+	buf := append([]byte{TOKEN_VERSION, start}, key...)
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// Returns the start position and the key of a token.
+func decodeToken(token string) (byte, []byte, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", ErrBadCursor, err)
+	}
+	if len(buf) < 6 {
+		return 0, nil, fmt.Errorf("%w: %d bytes", ErrBadCursor, len(buf))
+	}
+
+	data, sum := buf[:len(buf)-4], binary.LittleEndian.Uint32(buf[len(buf)-4:])
+	switch start := data[1]; {
+	case crc32.ChecksumIEEE(data) != sum:
+		return 0, nil, fmt.Errorf("%w: checksum mismatch", ErrBadCursor)
+	case data[0] != TOKEN_VERSION:
+		return 0, nil, fmt.Errorf("%w: version %d", ErrBadCursor, data[0])
+	case start > TOKEN_AFTER_KEY || start == TOKEN_FROM_FIRST && len(data) > 2:
+		return 0, nil, fmt.Errorf("%w: start %d", ErrBadCursor, start)
+	}
+	return data[1], data[2:], nil
+}
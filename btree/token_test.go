@@ -0,0 +1,100 @@
+package btree
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"slices"
+	"testing"
+)
+
+// Chaining the tokens of pages of every size goes through every key once and
+// in order, picking up the keys added ahead of the token between two pages,
+// and a damaged token is refused.
+func TestScanFromToken(t *testing.T) {
+	tree, _ := newTestTree(t, Config{})
+	var want []string
+	for i := range 1000 {
+		key := fmt.Sprintf("key%04d", 2*i)
+		tree.Insert([]byte(key), []byte("val"+key))
+		want = append(want, key)
+	}
+
+	for _, limit := range []int{0, 1, 7, 100, 999, 1000, 5000} {
+		var got []string
+		pages := 0
+		for token := tree.CursorToken(nil); token != ""; pages++ {
+			kvs, next, err := tree.ScanFromToken(token, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(kvs) == 0 || len(kvs) > max(limit, 1) {
+				t.Fatalf("limit %d: page %d of %d pairs", limit, pages, len(kvs))
+			}
+			for _, kv := range kvs {
+				if string(kv.Val) != "val"+string(kv.Key) {
+					t.Fatalf("limit %d: %q = %q", limit, kv.Key, kv.Val)
+				}
+				got = append(got, string(kv.Key))
+			}
+			token = next
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("limit %d: %d keys in %d pages, want %d", limit, len(got), pages, len(want))
+		}
+	}
+
+	// from a key, which is there or not
+	for _, from := range []string{"key0100", "key0101", "a", "z"} {
+		kvs, _, err := tree.ScanFromToken(tree.CursorToken([]byte(from)), 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, kv := range kvs {
+			keys = append(keys, string(kv.Key))
+		}
+		i, _ := slices.BinarySearch(want, from)
+		if wantKeys := want[i:min(i+3, len(want))]; !slices.Equal(keys, wantKeys) {
+			t.Fatalf("from %q: %q, want %q", from, keys, wantKeys)
+		}
+	}
+
+	// updates between the pages
+	kvs, token, err := tree.ScanFromToken(tree.CursorToken(nil), 500)
+	if err != nil || len(kvs) != 500 {
+		t.Fatalf("%d pairs: %v", len(kvs), err)
+	}
+	for i := range 1000 {
+		tree.Insert(fmt.Appendf(nil, "key%04d", 2*i+1), nil)
+	}
+	tree.Delete([]byte(want[500]))
+	kvs, _, err = tree.ScanFromToken(token, 2)
+	if err != nil || len(kvs) != 2 || string(kvs[0].Key) != "key0999" || string(kvs[1].Key) != "key1001" {
+		t.Fatalf("after the updates: %q, %v", kvs, err)
+	}
+
+	// a token with another key and the checksum of the old one, and tokens
+	// with a right checksum that can't be
+	buf, _ := base64.RawURLEncoding.DecodeString(token)
+	forged := slices.Concat(buf[:2], []byte("key1998"), buf[len(buf)-4:])
+	sealed := func(data ...byte) string {
+		return base64.RawURLEncoding.EncodeToString(binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(data)))
+	}
+	for name, bad := range map[string]string{
+		"empty":     "",
+		"base64":    token + "!",
+		"cut":       token[:len(token)-2],
+		"short":     base64.RawURLEncoding.EncodeToString(buf[:5]),
+		"key":       base64.RawURLEncoding.EncodeToString(forged),
+		"version":   sealed(TOKEN_VERSION+1, TOKEN_FROM_KEY, 'k'),
+		"start":     sealed(TOKEN_VERSION, TOKEN_AFTER_KEY+1, 'k'),
+		"first key": sealed(TOKEN_VERSION, TOKEN_FROM_FIRST, 'k'),
+	} {
+		if _, _, err := tree.ScanFromToken(bad, 10); !errors.Is(err, ErrBadCursor) {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
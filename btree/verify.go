@@ -0,0 +1,296 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var ErrCorrupt = errors.New("btree: corrupt tree")
+
+// Walks the whole tree checking the page checksums, the node types, the
+// offsets and sizes of every KV, the key order within and across nodes, that
+// no separator is greater than the first key of its kid, that every link holds
+// the number of keys under it, that every leaf is at the same depth, that the
+// overflow chains hold the length they claim and that no page was written by
+// a later update than the node pointing to it.
+// The root is checked first to be a page long, with its KVs inside it.
+// Returns the first violation found, wrapping `ErrCorrupt`, or `ErrVersion`
+// for a page of an unknown format.
+func (tree *BTree) Verify() error {
+	if tree.root == 0 {
+		return nil
+	}
+	if err := checkNodeSize(tree.root, tree.read(tree.root), int(tree.pageSize)); err != nil {
+		return err
+	}
+
+	v := verifier{tree: tree, leafDepth: -1}
+	_, err := v.node(tree.root, 0, math.MaxUint64, nil, nil)
+	return err
+}
+
+// Goes through every key with a cursor and checks that `Get` finds the same
+// value for it, that the keys come in order and that there are `Len` of them:
+// the lookups, the scans and the key counts checked against each other. It's
+// O(n), reading every value twice, for tests and diagnostics. Returns the
+// first mismatch, wrapping `ErrCorrupt`, or the error of a damaged page.
+func (tree *BTree) SelfCheck() (err error) {
+	defer recoverWrite(&err)
+
+	var last []byte
+	n := uint64(0)
+	cur := tree.Cursor()
+	for ok := cur.SeekToFirst(); ok; ok = cur.Next() {
+		key := cur.Key()
+		if n > 0 && tree.compare(last, key) >= 0 {
+			return fmt.Errorf("%w: key %q scanned after %q", ErrCorrupt, key, last)
+		}
+		val, found := tree.Get(key)
+		switch {
+		case !found:
+			return fmt.Errorf("%w: key %q scanned, Get doesn't find it", ErrCorrupt, key)
+		case !bytes.Equal(val, cur.Val()):
+			return fmt.Errorf("%w: key %q scanned with %d bytes, Get reads %d", ErrCorrupt, key, len(cur.Val()), len(val))
+		}
+		last = append(last[:0], key...)
+		n++
+	}
+
+	if count := tree.Len(); count != n {
+		return fmt.Errorf("%w: %d keys scanned, Len says %d", ErrCorrupt, n, count)
+	}
+	return nil
+}
+
+type verifier struct {
+	tree      *BTree
+	leafDepth int // depth of the first leaf seen
+}
+
+func (v *verifier) errorf(ptr uint64, format string, args ...any) error {
+	return corruptf(ptr, format, args...)
+}
+
+// A page whose checksum doesn't match its contents, damaged on disk or in
+// memory. It wraps `ErrCorrupt`.
+type ChecksumError struct {
+	Page     uint64 // page number
+	Stored   uint32 // checksum in the page
+	Computed uint32 // checksum of its contents
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%v: page %d: checksum %#08x, the contents give %#08x", ErrCorrupt, e.Page, e.Stored, e.Computed)
+}
+
+func (e *ChecksumError) Unwrap() error {
+	return ErrCorrupt
+}
+
+// Returns an error wrapping `ErrCorrupt` about a page.
+func corruptf(ptr uint64, format string, args ...any) error {
+	return fmt.Errorf("%w: page %d: %s", ErrCorrupt, ptr, fmt.Sprintf(format, args...))
+}
+
+// Checks the subtree at `ptr`, whose keys must be in [first, last) and whose
+// pages must be written by the update `commit` at the latest. A nil `first`
+// is the root, a nil `last` means no upper bound. Returns the number of keys
+// in it.
+func (v *verifier) node(ptr uint64, depth int, commit uint64, first, last []byte) (uint64, error) {
+	tree := v.tree
+	node, err := v.page(ptr)
+	if err != nil {
+		return 0, err
+	}
+	if node.commit() > commit {
+		return 0, v.errorf(ptr, "written by commit %d, after its parent %d", node.commit(), commit)
+	}
+
+	if err := checkLayout(ptr, node, int(tree.pageSize)); err != nil {
+		return 0, err
+	}
+
+	nkeys := node.nkeys()
+	if first != nil && tree.compare(node.getKey(0), first) < 0 {
+		return 0, v.errorf(ptr, "first key %q is smaller than the separator %q", node.getKey(0), first)
+	}
+
+	for i := uint16(0); i < nkeys; i++ {
+		key := node.getKey(i)
+		if i > 0 && tree.compare(node.getKey(i-1), key) >= 0 {
+			return 0, v.errorf(ptr, "key %d is not greater than the previous one", i)
+		}
+		if last != nil && tree.compare(key, last) >= 0 {
+			return 0, v.errorf(ptr, "key %d is not smaller than the next separator", i)
+		}
+	}
+
+	if node.btype() == BNODE_LEAF {
+		if v.leafDepth < 0 {
+			v.leafDepth = depth
+		} else if v.leafDepth != depth {
+			return 0, v.errorf(ptr, "leaf at depth %d, expected %d", depth, v.leafDepth)
+		}
+
+		for i := uint16(0); i < nkeys; i++ {
+			if err := v.overflow(ptr, node, i); err != nil {
+				return 0, err
+			}
+		}
+		return uint64(nkeys), nil
+	}
+
+	var count uint64
+	for i := uint16(0); i < nkeys; i++ {
+		if node.getPtr(i) == 0 {
+			return 0, v.errorf(ptr, "kid %d has a null pointer", i)
+		}
+		val := node.getVal(i)
+		if _, n := binary.Uvarint(val); n != len(val) {
+			return 0, v.errorf(ptr, "kid %d has a bad key count %x", i, val)
+		}
+
+		kidLast := last
+		if i+1 < nkeys {
+			kidLast = node.getKey(i + 1)
+		}
+		n, err := v.node(node.getPtr(i), depth+1, node.commit(), node.getKey(i), kidLast)
+		if err != nil {
+			return 0, err
+		}
+		if n != node.getCount(i) {
+			return 0, v.errorf(ptr, "kid %d holds %d keys, the link says %d", i, n, node.getCount(i))
+		}
+		count += n
+	}
+
+	return count, nil
+}
+
+// Reads a page, checking its checksum instead of panicking.
+func (v *verifier) page(ptr uint64) (BNode, error) {
+	page := BNode(v.tree.read(ptr))
+	return page, checkPage(ptr, page)
+}
+
+// Checks that a node is a page long and that its KVs end inside it, as
+// `encodeNode` leaves it: a node cut to a page without fitting it ends past
+// it. The node's layout isn't checked otherwise, see `checkLayout`.
+func checkNodeSize(ptr uint64, node BNode, pageSize int) error {
+	if len(node) != pageSize {
+		return corruptf(ptr, "node of %d bytes, expected a page of %d", len(node), pageSize)
+	}
+
+	end := HEADER + 10*int(node.nkeys())
+	if node.flags()&BNODE_FLAG_PREFIX != 0 {
+		if end += 2; end <= pageSize {
+			end += int(binary.LittleEndian.Uint16(node[end-2:]))
+		}
+	}
+	if end <= pageSize {
+		end += int(node.getOffset(node.nkeys()))
+	}
+	if end > pageSize {
+		return corruptf(ptr, "node of %d bytes, past the page of %d", end, pageSize)
+	}
+	return nil
+}
+
+// Checks the header and that every KV sits where the offsets say, inside the page.
+func checkLayout(ptr uint64, node BNode, pageSize int) error {
+	if len(node) != pageSize {
+		return corruptf(ptr, "%d bytes long, expected %d", len(node), pageSize)
+	}
+
+	if t := node.btype(); t != BNODE_NODE && t != BNODE_LEAF {
+		return corruptf(ptr, "bad node type %d", t)
+	}
+	if node.flags()&BNODE_FLAGS_RESERVED != 0 {
+		return corruptf(ptr, "reserved flags set %#x", node.flags())
+	}
+
+	nkeys := int(node.nkeys())
+	if nkeys == 0 {
+		return corruptf(ptr, "empty node")
+	}
+	if HEADER+10*nkeys > pageSize {
+		return corruptf(ptr, "%d keys don't fit a page", nkeys)
+	}
+
+	plen := 0
+	if node.flags()&BNODE_FLAG_PREFIX != 0 {
+		pos := HEADER + 10*nkeys
+		if pos+2 > pageSize {
+			return corruptf(ptr, "the prefix starts past the page")
+		}
+		plen = int(binary.LittleEndian.Uint16(node[pos:]))
+		if plen > BTREE_MAX_LONG_KEY_SIZE || pos+2+plen > pageSize {
+			return corruptf(ptr, "prefix of %dB doesn't fit", plen)
+		}
+	}
+
+	hsize := int(node.kvHeaderSize())
+	for i := 0; i < nkeys; i++ {
+		pos := int(node.kvPos(uint16(i)))
+		if pos+hsize > pageSize {
+			return corruptf(ptr, "KV %d starts past the page", i)
+		}
+
+		klen, vlen := int(binary.LittleEndian.Uint16(node[pos:])), 0
+		if hsize == 4 {
+			vlen = int(binary.LittleEndian.Uint16(node[pos+2:]))
+		}
+		if plen+klen > BTREE_MAX_LONG_KEY_SIZE || vlen > BTREE_MAX_VAL_SIZE {
+			return corruptf(ptr, "KV %d is too large (%d, %d)", i, plen+klen, vlen)
+		}
+
+		end := pos + hsize + klen + vlen
+		if end > pageSize || end != int(node.kvPos(uint16(i+1))) {
+			return corruptf(ptr, "KV %d ends at %d, the next offset says %d", i, end, node.kvPos(uint16(i+1)))
+		}
+	}
+
+	return nil
+}
+
+// Checks the overflow chain of the nth value of a leaf, if it has one.
+func (v *verifier) overflow(ptr uint64, node BNode, idx uint16) error {
+	next := node.getPtr(idx)
+	if next == 0 {
+		return nil
+	}
+
+	val := node.getVal(idx)
+	if len(val) != 8 {
+		return v.errorf(ptr, "KV %d has overflow pages but a %dB inline value", idx, len(val))
+	}
+
+	want := binary.LittleEndian.Uint64(val)
+	capacity := uint64(v.tree.pageSize) - OVERFLOW_HEADER
+	size := uint64(0)
+
+	for next != 0 {
+		page, err := v.page(next)
+		if err != nil {
+			return err
+		}
+		if page.btype() != BNODE_OVERFLOW || uint64(page.nkeys()) > capacity {
+			return v.errorf(next, "bad overflow page of KV %d in page %d", idx, ptr)
+		}
+		if page.commit() > node.commit() {
+			return v.errorf(next, "overflow page of KV %d written by commit %d, after page %d", idx, page.commit(), ptr)
+		}
+
+		size += uint64(page.nkeys())
+		next = binary.LittleEndian.Uint64(page[HEADER:])
+	}
+
+	if size != want {
+		return v.errorf(ptr, "KV %d has %d bytes of overflow, expected %d", idx, size, want)
+	}
+
+	return nil
+}
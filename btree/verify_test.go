@@ -0,0 +1,187 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(tree *BTree, mem *memPages)
+	}{
+		{"key order", func(tree *BTree, mem *memPages) {
+			leaf := BNode(mem.pages[tree.LeafPages()[1]])
+			a, b := leaf.getSuffix(0), leaf.getSuffix(1)
+			tmp := bytes.Clone(a)
+			copy(a, b)
+			copy(b, tmp)
+		}},
+		{"separator", func(tree *BTree, mem *memPages) {
+			// the last key of the first leaf goes past the separator of the
+			// second
+			leaves := tree.LeafPages()
+			first := BNode(mem.pages[leaves[0]])
+			next := BNode(mem.pages[leaves[1]]).getKey(0)
+			copy(first.getSuffix(first.nkeys()-1), next[len(first.prefix()):])
+		}},
+		{"first key", func(tree *BTree, mem *memPages) {
+			leaf := BNode(mem.pages[tree.LeafPages()[1]])
+			suffix := leaf.getSuffix(0)
+			suffix[len(suffix)-1]-- // still above the previous leaf
+		}},
+		{"type", func(tree *BTree, mem *memPages) {
+			mem.pages[tree.LeafPages()[2]][0] = BNODE_VERSION<<4 | 7
+		}},
+		{"flags", func(tree *BTree, mem *memPages) {
+			BNode(mem.pages[tree.root]).setFlags(0x80)
+		}},
+		{"offsets", func(tree *BTree, mem *memPages) {
+			leaf := BNode(mem.pages[tree.LeafPages()[2]])
+			leaf.setOffset(leaf.nkeys(), BTREE_PAGE_SIZE)
+		}},
+		{"depth", func(tree *BTree, mem *memPages) {
+			// a link to a leaf where there was an internal node
+			root := BNode(mem.pages[tree.root])
+			kid := BNode(mem.pages[root.getPtr(0)])
+			root.setPtr(0, kid.getPtr(0))
+		}},
+		{"key count", func(tree *BTree, mem *memPages) {
+			BNode(mem.pages[tree.root]).getVal(0)[0] ^= 1
+		}},
+		{"overflow", func(tree *BTree, mem *memPages) {
+			for _, ptr := range tree.LeafPages() {
+				leaf := BNode(mem.pages[ptr])
+				for i := range leaf.nkeys() {
+					if leaf.getPtr(i) != 0 {
+						val := leaf.getVal(i)
+						binary.LittleEndian.PutUint64(val, binary.LittleEndian.Uint64(val)-1)
+						return
+					}
+				}
+			}
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// values large enough for 3 levels out of a few thousand keys
+			tree, mem := newTestTree(t, Config{})
+			for i := range 3000 {
+				val := bytes.Repeat([]byte("v"), 300)
+				if i == 500 {
+					val = bytes.Repeat([]byte("o"), 2*BTREE_MAX_VAL_SIZE)
+				}
+				if err := tree.Insert(fmt.Appendf(nil, "key%05d", i), val); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tree.Verify(); err != nil {
+				t.Fatalf("before the damage: %v", err)
+			}
+
+			if height(tree) != 3 {
+				t.Fatalf("%d levels", height(tree))
+			}
+
+			// the checksums are fixed up so the damage gets past them
+			test.damage(tree, mem)
+			for _, page := range mem.pages {
+				BNode(page).setChecksum()
+			}
+			if err := tree.Verify(); !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("verify: %v", err)
+			}
+		})
+	}
+}
+
+// A root that isn't a page long, or whose KVs end past the page, fails
+// `Verify` before anything else is checked. A node cut to a page without
+// fitting it fails the check the debug builds run on every node written.
+func TestRootSize(t *testing.T) {
+	tree, mem := newTestTree(t, Config{})
+	for i := range 3000 {
+		if err := tree.Insert(fmt.Appendf(nil, "key%05d", i), bytes.Repeat([]byte("v"), 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	root := mem.pages[tree.root]
+	for name, page := range map[string][]byte{
+		"untrimmed": append(bytes.Clone(root), make([]byte, BTREE_PAGE_SIZE)...),
+		"short":     root[:BTREE_PAGE_SIZE/2],
+	} {
+		mem.pages[tree.root] = page
+		err := tree.Verify()
+		if !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), fmt.Sprintf("page %d:", tree.root)) {
+			t.Fatalf("%s root: %v", name, err)
+		}
+	}
+	mem.pages[tree.root] = root
+
+	// KVs past the page, with no prefix to strip
+	node := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
+	node.setHeader(BNODE_LEAF, 30)
+	for i := range uint16(30) {
+		nodeAppendKV(node, i, 0, []byte{byte('A' + i)}, bytes.Repeat([]byte("v"), 200))
+	}
+	if node.nbytes() <= BTREE_PAGE_SIZE {
+		t.Fatalf("node of %d bytes fits a page", node.nbytes())
+	}
+	if err := checkNodeSize(0, encodeNode(node, BTREE_PAGE_SIZE), BTREE_PAGE_SIZE); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("node cut to a page: %v", err)
+	}
+	if err := checkNodeSize(tree.root, root, BTREE_PAGE_SIZE); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A tree whose lookups, scans and counts agree passes `SelfCheck`, a stale
+// key count or a key that `Get` routes away from doesn't.
+func TestSelfCheck(t *testing.T) {
+	empty, _ := newTestTree(t, Config{})
+	if err := empty.SelfCheck(); err != nil {
+		t.Fatalf("empty tree: %v", err)
+	}
+
+	for _, damage := range []string{"", "stale count", "separator"} {
+		tree, mem := newTestTree(t, Config{})
+		for i := range 3000 {
+			val := fmt.Appendf(nil, "val%d", i)
+			if i%500 == 3 {
+				val = bytes.Repeat([]byte("o"), 2*BTREE_MAX_VAL_SIZE)
+			}
+			if err := tree.Insert(fmt.Appendf(nil, "key%05d", i), val); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		root := BNode(mem.pages[tree.root])
+		switch damage {
+		case "stale count":
+			// the last link counts a key more or less, as a bug missing one would
+			root.getVal(root.nkeys() - 1)[0] ^= 1
+		case "separator":
+			// the first key of the second kid is looked up in the first one
+			suffix := root.getSuffix(1)
+			suffix[len(suffix)-1]++
+		}
+		root.setChecksum()
+
+		err := tree.SelfCheck()
+		if damage == "" && err != nil {
+			t.Fatal(err)
+		}
+		if damage != "" && !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("%s: %v", damage, err)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+package kv
+
+import "syscall"
+
+// Asks the OS to start reading a mapped page. It's only a hint, failing
+// changes nothing.
+func mmapPrefetch(page []byte) {
+	syscall.Madvise(page, syscall.MADV_WILLNEED)
+}
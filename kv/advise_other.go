@@ -0,0 +1,7 @@
+//go:build !linux
+
+package kv
+
+// The mapped pages are read when they're touched, the syscall package has no
+// way to ask for them sooner here.
+func mmapPrefetch(page []byte) {}
@@ -0,0 +1,105 @@
+package kv
+
+/*
+The pages an update writes to a file are picked by an `Allocator`, chosen by
+`KV.Allocator`. `FreeListAllocator`, the default, hands out the pages of the
+free list first and appends to the file once it's empty, so that the file
+stays as small as the tree. `AppendOnlyAllocator` always appends: no page
+is ever written over, the writes go to the end of the file, and the pages of
+the older commits stay as they were until `Compact`.
+
+An allocator works on the `PageSpace` of its file, and both of them put the
+pages freed into the free list when the update is written. `Compact` moves
+the tree into the free pages under its limit whatever the allocator, and
+cuts the file: an append-only file is brought back to the size of the tree.
+*/
+
+// The pages of a file an `Allocator` hands out, used by one update at a time.
+type PageSpace interface {
+	// Returns the first of `n` new pages at the end of the file.
+	Append(n int) uint64
+	// Returns a page taken off the free list, if there's one left.
+	TakeFree() (uint64, bool)
+	// Frees a page, put into the free list once the update is written.
+	Release(ptr uint64)
+}
+
+// Picks the pages of the updates of a file, see `KV.Allocator`.
+type Allocator interface {
+	// Returns the first of `size` consecutive pages, the store asks for one
+	// at a time.
+	Alloc(size int) uint64
+	// Frees a page of the tree.
+	Free(pageno uint64)
+}
+
+// Returns an allocator that reuses the free pages before appending.
+func FreeListAllocator(space PageSpace) Allocator {
+	return freeListAllocator{space}
+}
+
+// Returns an allocator that always appends, never reusing a page.
+func AppendOnlyAllocator(space PageSpace) Allocator {
+	return appendOnlyAllocator{space}
+}
+
+type freeListAllocator struct {
+	space PageSpace
+}
+
+func (a freeListAllocator) Alloc(size int) uint64 {
+	if size == 1 {
+		if ptr, ok := a.space.TakeFree(); ok {
+			return ptr
+		}
+	}
+	return a.space.Append(size)
+}
+
+func (a freeListAllocator) Free(pageno uint64) {
+	a.space.Release(pageno)
+}
+
+type appendOnlyAllocator struct {
+	space PageSpace
+}
+
+func (a appendOnlyAllocator) Alloc(size int) uint64 {
+	return a.space.Append(size)
+}
+
+func (a appendOnlyAllocator) Free(pageno uint64) {
+	a.space.Release(pageno)
+}
+
+// The `PageSpace` of a file store.
+type fileSpace struct {
+	fs *fileStore
+}
+
+func (s fileSpace) Append(n int) uint64 {
+	fs := s.fs
+	ptr := fs.page.flushed + uint64(fs.page.nappend)
+	fs.page.nappend += n
+	return ptr
+}
+
+// Takes the next page of the free list, skipping the ones past the limit of
+// `LimitPages`, which are dropped from it.
+func (s fileSpace) TakeFree() (uint64, bool) {
+	fs := s.fs
+	for fs.page.nfree < fs.free.Total() {
+		ptr := fs.free.Get(fs.page.nfree)
+		fs.page.nfree++
+		if fs.page.limit > 0 && ptr >= fs.page.limit {
+			// `Shrink` cuts it
+			continue
+		}
+		return ptr, true
+	}
+	return 0, false
+}
+
+func (s fileSpace) Release(ptr uint64) {
+	s.fs.page.updates[ptr] = nil
+}
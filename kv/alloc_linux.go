@@ -0,0 +1,25 @@
+package kv
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Grows the file from `from` to `size` bytes with fallocate, reserving the
+// blocks on disk so that writing them later doesn't change the file metadata.
+// Falls back to ftruncate where the file system has no fallocate.
+func allocateFile(fp dbFile, from, size int64) error {
+	osFile, ok := fp.(*os.File)
+	if !ok {
+		return fp.Truncate(size)
+	}
+	err := syscall.Fallocate(int(osFile.Fd()), 0, from, size-from)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return fp.Truncate(size)
+	}
+	if err != nil {
+		return os.NewSyscallError("fallocate", err)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package kv
+
+// Grows the file from `from` to `size` bytes with ftruncate, the blocks are
+// allocated as they're written.
+func allocateFile(fp dbFile, from, size int64) error {
+	return fp.Truncate(size)
+}
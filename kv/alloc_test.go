@@ -0,0 +1,84 @@
+package kv
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// Records the pages an allocator hands out.
+type recordingAllocator struct {
+	Allocator
+	allocs map[uint64]int
+}
+
+func (a *recordingAllocator) Alloc(size int) uint64 {
+	ptr := a.Allocator.Alloc(size)
+	a.allocs[ptr]++
+	return ptr
+}
+
+// The append-only allocator never hands out a page twice, however many are
+// freed, while the free-list one reuses them. Both leave the freed pages in
+// the free list, and `Compact` brings the append-only file back to the size
+// of the tree.
+func TestAllocator(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		alloc func(PageSpace) Allocator
+		reuse bool
+	}{
+		{"append only", AppendOnlyAllocator, false},
+		{"free list", FreeListAllocator, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			rec := &recordingAllocator{allocs: map[uint64]int{}}
+			// the commits aren't synced, the allocator sees them all the same
+			db := &KV{Path: path, Sync: SyncNone, Allocator: func(space PageSpace) Allocator {
+				rec.Allocator = test.alloc(space)
+				return rec
+			}}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			want := map[string]string{}
+			for round := range 5 {
+				for i := range 500 {
+					key, val := fmt.Sprintf("key%04d", i), fmt.Sprintf("val%d-%d", i, round)
+					if err := db.Set([]byte(key), []byte(val)); err != nil {
+						t.Fatal(err)
+					}
+					want[key] = val
+				}
+			}
+			checkKV(t, db, want)
+
+			reused := 0
+			for _, n := range rec.allocs {
+				if n > 1 {
+					reused++
+				}
+			}
+			if reused > 0 != test.reuse {
+				t.Fatalf("%d pages handed out more than once", reused)
+			}
+			fs := db.store.(*fileStore)
+			free := freePages(t, fs)
+			if !test.reuse && free < len(rec.allocs)/2 {
+				t.Fatalf("%d free pages after %d allocations", free, len(rec.allocs))
+			}
+
+			before := db.Stats().Pages
+			if err := db.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			checkKV(t, db, want)
+			if pages := db.Stats().Pages; !test.reuse && pages > before/4 {
+				t.Fatalf("%d pages after compacting %d", pages, before)
+			}
+		})
+	}
+}
@@ -0,0 +1,382 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"db/btree"
+)
+
+// first bytes of a backup
+const BACKUP_MAGIC = "BYODB\x00bk"
+
+const BACKUP_HEADER = 8 + 2 + 4 + 2 + 8 + 8
+
+// bytes of the meta page at the end of a backup
+const BACKUP_META = 8 + 8 + 8 + 2*KEY_CHECK_SIZE
+
+var (
+	ErrBadBackup = errors.New("kv: bad backup")
+	ErrNoBackup  = errors.New("kv: the store can't be backed up")
+)
+
+/*
+Every page is stamped with the number of the update that wrote it, see
+`btree.Config.Commit`, and pages are never written over while they're in use:
+the pages that changed since a commit are the ones in use stamped with a
+later number. A node is as new as the pages under it, and the nodes of the
+free list written by an update are at its head, so they're found without
+reading the rest.
+
+A backup since commit 0 holds every page in use, a full backup. One since the
+commit of an earlier backup holds the pages that changed after it, and
+`ApplyBackup` writes them over the file restored from the earlier ones. The
+pages it writes are free at that commit, but they may be in use in the file
+it's applied to, which is why it's applied to a copy.
+
+Updates go on while a backup is written. It reads the meta of the last
+commit, and copies the nodes of its free list, which the next updates write
+over, then the pages freed from there on are held back until it's done
+instead of being listed: the pages of the commit stay as they are. Its pages
+are read one at a time under the lock of the readers, between the updates.
+`Compact` would cut the file under it, they wait for each other.
+
+# Backup:
+
+	| magic | version | page size | flags | since | commit |    pages    | 0  | root | used | free | keys  | crc32 |
+	|  8B   |   2B    |    4B     |  2B   |  8B   |   8B   | n * (8B+P)  | 8B |  8B  |  8B  |  8B  | 2*32B |  4B   |
+
+`magic` is `BACKUP_MAGIC`, `version` and `page size` those of the file, and
+`flags` its `META_FLAG_COMPRESSED` and `META_FLAG_ENCRYPTED`. `since` is the
+commit the backup was taken since, `commit` the last one it holds. Each page
+of the file is its number and its `PAGE_SIZE` bytes, in order, sealed again
+in an encrypted file, then a 0 ends them, followed by the meta page of the
+last commit. The checksum covers the rest of the backup.
+*/
+
+// Writes a backup of the database to `w`: the pages written by the updates
+// after commit `since`, and the meta page of the last one, whose number is
+// returned. One since 0 holds the whole database, one since the commit
+// returned for another holds what changed after it, see `ApplyBackup`.
+// Reads and updates go on while it's written, it holds the database as of
+// the commit it started at. Waits for `Compact`, and `Close` waits for it.
+// Fails with `ErrNoBackup` for a store that isn't a `BackupStore`, or a
+// database with a value log, whose values aren't in the pages.
+func (db *KV) Backup(w io.Writer, since uint64) (uint64, error) {
+	db.exclusive.RLock()
+	defer db.exclusive.RUnlock()
+
+	db.mu.RLock()
+	store, ok := db.store.(BackupStore)
+	db.mu.RUnlock()
+	if !ok || db.vlog != nil {
+		return 0, ErrNoBackup
+	}
+	return store.Backup(w, since, db.mu.RLocker())
+}
+
+// Writes a full backup of the database into a new database file at `path`,
+// see `Backup`, and returns the commit it's at. Incremental backups taken
+// since that commit can be applied to it.
+func (db *KV) BackupTo(path string) (uint64, error) {
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := db.Backup(w, 0)
+		w.CloseWithError(err)
+		done <- err
+	}()
+	commit, err := applyBackup(path, r, db.retry())
+	r.Close() // stops the backup if it failed
+	return commit, cmp.Or(err, <-done)
+}
+
+func (fs *fileStore) Backup(w io.Writer, since uint64, lock sync.Locker) (commit uint64, err error) {
+	lock.Lock()
+	commit, meta, nodes, err := fs.holdPages(since)
+	lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	defer fs.Release(commit)
+	defer recoverCorrupt(&err)
+
+	// the pages of the commit aren't freed until the backup is done, but
+	// reading them waits for the update being committed
+	read := func(ptr uint64) []byte {
+		lock.Lock()
+		defer lock.Unlock()
+		return fs.ReadPage(ptr)
+	}
+	readTree := func(ptr uint64) []byte {
+		lock.Lock()
+		defer lock.Unlock()
+		return fs.readTree(ptr)
+	}
+	root := binary.LittleEndian.Uint64(meta[8:])
+	tree, err := btree.New(fs.treeConfig(root, readTree))
+	if err != nil {
+		return 0, err
+	}
+	pages := fs.filePages(tree.PagesSince(since))
+	for ptr := range nodes {
+		pages = append(pages, ptr)
+	}
+	slices.Sort(pages)
+
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	header := make([]byte, BACKUP_HEADER)
+	copy(header, BACKUP_MAGIC)
+	binary.LittleEndian.PutUint16(header[8:], DB_VERSION)
+	binary.LittleEndian.PutUint32(header[10:], PAGE_SIZE)
+	binary.LittleEndian.PutUint16(header[14:], fs.meta.flags&(META_FLAG_COMPRESSED|META_FLAG_ENCRYPTED))
+	binary.LittleEndian.PutUint64(header[16:], since)
+	binary.LittleEndian.PutUint64(header[24:], commit)
+	bw.Write(header)
+
+	for _, ptr := range pages {
+		bw.Write(binary.LittleEndian.AppendUint64(nil, ptr))
+		page, ok := nodes[ptr]
+		if !ok {
+			page = read(ptr)
+		}
+		bw.Write(fs.sealPage(ptr, page))
+	}
+	bw.Write(meta[:])
+
+	if err := bw.Flush(); err != nil {
+		return 0, fmt.Errorf("write backup: %w", err)
+	}
+	if _, err := w.Write(binary.LittleEndian.AppendUint32(nil, crc.Sum32())); err != nil {
+		return 0, fmt.Errorf("write backup: %w", err)
+	}
+	return commit, nil
+}
+
+// Returns the last commit with the end of a backup of it, the 0 ending the
+// pages then its root, pages used, free list and keys, and a copy of the nodes of
+// its free list written after `since`, which the next updates write over.
+// Holds back the pages freed from then on until the backup is done.
+func (fs *fileStore) holdPages(since uint64) (commit uint64, meta [8 + BACKUP_META]byte, nodes map[uint64][]byte, err error) {
+	defer recoverCorrupt(&err)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if since > fs.commit {
+		return 0, meta, nil, fmt.Errorf("%w: since commit %d, the last one is %d", ErrBadBackup, since, fs.commit)
+	}
+
+	nodes = map[uint64][]byte{}
+	for ptr := fs.free.head; ptr != 0; {
+		node := fs.free.node(ptr)
+		if flnCommit(node) <= since {
+			break
+		}
+		nodes[ptr] = bytes.Clone(node)
+		ptr = flnNext(node)
+	}
+	binary.LittleEndian.PutUint64(meta[8:], fs.root)
+	binary.LittleEndian.PutUint64(meta[16:], fs.page.flushed)
+	binary.LittleEndian.PutUint64(meta[24:], fs.free.head)
+	copy(meta[32:], fs.meta.keys[0][:])
+	copy(meta[32+KEY_CHECK_SIZE:], fs.meta.keys[1][:])
+	fs.hold.hold(fs.commit)
+	return fs.commit, meta, nodes, nil
+}
+
+// Applies a backup written by `KV.Backup` to the database file at `path`,
+// which must be at the commit the backup was taken since: the one of the
+// last backup applied to it, or 0 for a missing file. The database must not
+// be open. The backup is written into a copy of the file that replaces it
+// once it's whole, the file is left as it was if it fails. Returns the commit
+// the file is at.
+func ApplyBackup(path string, r io.Reader) (uint64, error) {
+	return applyBackup(path, r, DEFAULT_RETRY)
+}
+
+// Applies a backup, writing and renaming the copy with `retry`.
+func applyBackup(path string, r io.Reader, retry RetryPolicy) (uint64, error) {
+	br := bufio.NewReader(r)
+	crc := crc32.NewIEEE()
+	read := func(buf []byte) error {
+		if _, err := io.ReadFull(br, buf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("read backup: %w", err)
+		}
+		crc.Write(buf)
+		return nil
+	}
+
+	header := make([]byte, BACKUP_HEADER)
+	if err := read(header); err != nil {
+		return 0, err
+	}
+	if string(header[:8]) != BACKUP_MAGIC {
+		return 0, fmt.Errorf("%w: magic %q", ErrBadBackup, header[:8])
+	}
+	if version := binary.LittleEndian.Uint16(header[8:]); version != DB_VERSION {
+		return 0, fmt.Errorf("%w: version %d, want %d", ErrUnsupportedVersion, version, DB_VERSION)
+	}
+	if size := binary.LittleEndian.Uint32(header[10:]); size != PAGE_SIZE {
+		return 0, fmt.Errorf("%w: %d bytes, want %d", ErrPageSizeMismatch, size, PAGE_SIZE)
+	}
+	flags := binary.LittleEndian.Uint16(header[14:])
+	since := binary.LittleEndian.Uint64(header[16:])
+	commit := binary.LittleEndian.Uint64(header[24:])
+	if flags&^(META_FLAG_COMPRESSED|META_FLAG_ENCRYPTED) != 0 {
+		return 0, fmt.Errorf("%w: flags %#x", ErrUnsupportedVersion, flags)
+	}
+
+	base, err := os.Open(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		base = nil
+	case err != nil:
+		return 0, fmt.Errorf("open: %w", err)
+	default:
+		defer base.Close()
+	}
+	seq, baseCommit, baseFlags, err := backupBase(base, path)
+	if err != nil {
+		return 0, err
+	}
+	if base != nil && baseCommit > 0 && baseFlags != flags {
+		return 0, fmt.Errorf("%w: flags %#x, the file has %#x", ErrBadBackup, flags, baseFlags)
+	}
+	if baseCommit != since {
+		return 0, fmt.Errorf("%w: taken since commit %d, the file is at %d", ErrBadBackup, since, baseCommit)
+	}
+
+	tmp := fmt.Sprintf("%s.tmp.%d", path, rand.Int())
+	fp, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("open: %w", err)
+	}
+	done := false
+	defer func() {
+		if !done {
+			fp.Close()
+			os.Remove(tmp)
+		}
+	}()
+	if base != nil {
+		if _, err := io.Copy(fp, base); err != nil {
+			return 0, fmt.Errorf("copy: %w", err)
+		}
+	}
+
+	page := make([]byte, PAGE_SIZE)
+	last := uint64(0)
+	for {
+		var ptr [8]byte
+		if err := read(ptr[:]); err != nil {
+			return 0, err
+		}
+		n := binary.LittleEndian.Uint64(ptr[:])
+		if n == 0 {
+			break
+		}
+		if n <= last {
+			return 0, fmt.Errorf("%w: page %d after %d", ErrBadBackup, n, last)
+		}
+		if err := read(page); err != nil {
+			return 0, err
+		}
+		if _, err := retry.WriteAt(fp, page, int64(n)*PAGE_SIZE); err != nil {
+			return 0, fmt.Errorf("write: %w", err)
+		}
+		last = n
+	}
+
+	var meta [BACKUP_META]byte
+	if err := read(meta[:]); err != nil {
+		return 0, err
+	}
+	sum := crc.Sum32()
+	var stored [4]byte
+	if _, err := io.ReadFull(br, stored[:]); err != nil {
+		return 0, fmt.Errorf("read backup: %w", io.ErrUnexpectedEOF)
+	}
+	if binary.LittleEndian.Uint32(stored[:]) != sum {
+		return 0, fmt.Errorf("%w: checksum mismatch", ErrBadBackup)
+	}
+	root := binary.LittleEndian.Uint64(meta[0:])
+	used := binary.LittleEndian.Uint64(meta[8:])
+	free := binary.LittleEndian.Uint64(meta[16:])
+	var keys [2]keyCheck
+	copy(keys[0][:], meta[24:])
+	copy(keys[1][:], meta[24+KEY_CHECK_SIZE:])
+	if used < 1 || last >= used || filePage(flags, root) >= used || free >= used {
+		return 0, fmt.Errorf("%w: %d pages used, page %d, root %d, free list %d", ErrBadBackup, used, last, root, free)
+	}
+	if (flags&META_FLAG_ENCRYPTED != 0) != (keys[0].id() != 0) {
+		return 0, fmt.Errorf("%w: flags %#x with key %d", ErrBadBackup, flags, keys[0].id())
+	}
+
+	seq++
+	if _, err := retry.WriteAt(fp, encodeMeta(flags, root, used, free, seq, commit, keys), META_OFFSETS[seq%2]); err != nil {
+		return 0, fmt.Errorf("write meta page: %w", err)
+	}
+	if err := retry.Do(func() error { return fp.Truncate(int64(used) * PAGE_SIZE) }); err != nil {
+		return 0, fmt.Errorf("truncate: %w", err)
+	}
+	if err := fp.Sync(); err != nil {
+		return 0, fmt.Errorf("fsync: %w", err)
+	}
+
+	done = true
+	fp.Close()
+	if base != nil {
+		base.Close() // it can't be renamed over while it's open on some systems
+	}
+	if err := retry.Do(func() error { return os.Rename(tmp, path) }); err != nil {
+		os.Remove(tmp)
+		return 0, fmt.Errorf("rename: %w", err)
+	}
+	return commit, SyncDir(filepath.Dir(path))
+}
+
+// Returns the seq, the commit and the flags of the meta page of a file a
+// backup is applied to, 0 for a missing one, which must not be open or need a
+// recovery.
+func backupBase(fp *os.File, path string) (seq, commit uint64, flags uint16, err error) {
+	if fp == nil {
+		return 0, 0, 0, nil
+	}
+	if err := lockFile(fp, true, 0); err != nil {
+		return 0, 0, 0, err
+	}
+	if fi, err := os.Stat(path + WAL_SUFFIX); err == nil && fi.Size() > 0 {
+		return 0, 0, 0, fmt.Errorf("%w: the WAL of the file isn't checkpointed", ErrBadBackup)
+	}
+
+	page := make([]byte, PAGE_SIZE)
+	if _, err := fp.ReadAt(page, 0); err != nil && err != io.EOF {
+		return 0, 0, 0, fmt.Errorf("read meta page: %w", err)
+	}
+	meta, err := pickMeta(page)
+	if err != nil || meta == nil {
+		return 0, 0, 0, err
+	}
+	if err := checkHeader(meta); err != nil {
+		return 0, 0, 0, err
+	}
+	flags = binary.LittleEndian.Uint16(meta[14:])
+	if flags&META_FLAG_OPEN != 0 {
+		return 0, 0, 0, fmt.Errorf("%w: the file wasn't closed", ErrBadBackup)
+	}
+	return binary.LittleEndian.Uint64(meta[40:]), binary.LittleEndian.Uint64(meta[48:]), flags, nil
+}
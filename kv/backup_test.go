@@ -0,0 +1,313 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// A full backup and the incremental ones after it, compaction included,
+// restore the database commit by commit, and only hold the pages that
+// changed. A backup that doesn't apply leaves the file as it was.
+func TestBackup(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		dir := t.TempDir()
+		path, restored := filepath.Join(dir, "test.db"), filepath.Join(dir, "restored.db")
+		db := &KV{Path: path, Sync: SyncNone, WAL: wal}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]string{}
+		update := func(n int) {
+			t.Helper()
+			for i := range n {
+				key, val := fmt.Sprintf("key%05d", (len(want)*7+i*13)%3000), fmt.Sprint(wal, i)
+				if i%100 == 0 {
+					val = strings.Repeat("o", 2*PAGE_SIZE)
+				}
+				if i%3 == 0 {
+					if _, err := db.Del([]byte(key)); err != nil {
+						t.Fatal(err)
+					}
+					delete(want, key)
+					continue
+				}
+				if err := db.Set([]byte(key), []byte(val)); err != nil {
+					t.Fatal(err)
+				}
+				want[key] = val
+			}
+		}
+		backup := func(since uint64) (*bytes.Buffer, uint64) {
+			t.Helper()
+			var buf bytes.Buffer
+			commit, err := db.Backup(&buf, since)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if commit <= since {
+				t.Fatalf("wal %v: backup since %d at commit %d", wal, since, commit)
+			}
+			return &buf, commit
+		}
+		restore := func(buf *bytes.Buffer, commit uint64) {
+			t.Helper()
+			got, err := ApplyBackup(restored, buf)
+			if err != nil || got != commit {
+				t.Fatalf("wal %v: apply backup of commit %d: %d, %v", wal, commit, got, err)
+			}
+			db := openTestKV(t, restored)
+			checkKV(t, db, want)
+			if err := db.tree.Verify(); err != nil {
+				t.Fatal(err)
+			}
+			fs := db.store.(*fileStore)
+			stats := db.tree.Stats()
+			if used := 1 + stats.InternalNodes + stats.LeafNodes + stats.OverflowPages + uint64(freePages(t, fs)); used != fs.page.flushed {
+				t.Fatalf("wal %v: %d pages found, %d used", wal, used, fs.page.flushed)
+			}
+			db.Close()
+		}
+
+		update(3000)
+		full, commit := backup(0)
+		size := full.Len()
+		restore(full, commit)
+
+		update(300)
+		inc, next := backup(commit)
+		if inc.Len() >= size/2 {
+			t.Fatalf("wal %v: incremental backup of %d bytes, the full one %d", wal, inc.Len(), size)
+		}
+		again := bytes.Clone(inc.Bytes())
+		restore(inc, next)
+		commit = next
+
+		// applied once only, and not at all if it's damaged
+		before, err := os.ReadFile(restored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ApplyBackup(restored, bytes.NewReader(again)); !errors.Is(err, ErrBadBackup) {
+			t.Fatalf("wal %v: apply twice: %v", wal, err)
+		}
+		update(300)
+		inc, next = backup(commit)
+		damaged := bytes.Clone(inc.Bytes())
+		damaged[len(damaged)/2] ^= 1
+		if _, err := ApplyBackup(restored, bytes.NewReader(damaged)); !errors.Is(err, ErrBadBackup) {
+			t.Fatalf("wal %v: apply a damaged backup: %v", wal, err)
+		}
+		if _, err := ApplyBackup(restored, bytes.NewReader(inc.Bytes()[:inc.Len()-10])); err == nil {
+			t.Fatalf("wal %v: applied a backup cut short", wal)
+		}
+		if after, err := os.ReadFile(restored); err != nil || !bytes.Equal(before, after) {
+			t.Fatalf("wal %v: the file changed, %v", wal, err)
+		}
+		restore(inc, next)
+		commit = next
+
+		// the file of a compacted database shrinks as well
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		inc, next = backup(commit)
+		restore(inc, next)
+		fi, err := os.Stat(restored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fs := db.store.(*fileStore); fi.Size() != int64(fs.page.flushed)*PAGE_SIZE {
+			t.Fatalf("wal %v: restored %d bytes, %d pages used", wal, fi.Size(), fs.page.flushed)
+		}
+
+		if _, err := db.Backup(&bytes.Buffer{}, next+1); !errors.Is(err, ErrBadBackup) {
+			t.Fatalf("wal %v: backup since a later commit: %v", wal, err)
+		}
+		db.Close()
+	}
+
+	db := &KV{}
+	if err := db.OpenMemory(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Backup(&bytes.Buffer{}, 0); !errors.Is(err, ErrNoBackup) {
+		t.Fatalf("backup in memory: %v", err)
+	}
+}
+
+// Holds the first write until `gate` is closed.
+type gateWriter struct {
+	w    io.Writer
+	gate chan struct{}
+}
+
+func (g *gateWriter) Write(p []byte) (int, error) {
+	<-g.gate
+	return g.w.Write(p)
+}
+
+// Updates commit while a backup is written, which holds the database as of
+// the commit it started at, and the pages they free are listed once it's
+// done, by the next update or by `Close`.
+func TestHotBackup(t *testing.T) {
+	for _, opts := range []struct {
+		wal   bool
+		cache int
+	}{{}, {wal: true}, {cache: 64 * PAGE_SIZE}} {
+		name := fmt.Sprintf("wal %v, cache %d", opts.wal, opts.cache)
+		dir := t.TempDir()
+		path := filepath.Join(dir, "test.db")
+		open := func() *KV {
+			t.Helper()
+			db := &KV{Path: path, Sync: SyncNone, WAL: opts.wal, CacheSize: opts.cache}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			return db
+		}
+		// update n sets a key and "last" to n, the database after it holds
+		// the keys of the updates before
+		value := func(n int) string {
+			if n%50 == 0 {
+				return strings.Repeat("o", 2*PAGE_SIZE) + fmt.Sprint(n)
+			}
+			return fmt.Sprint(n)
+		}
+		wantAt := func(last int) map[string]string {
+			want := map[string]string{"last": fmt.Sprint(last)}
+			for n := range last + 1 {
+				want[fmt.Sprintf("key%03d", n%300)] = value(n)
+			}
+			return want
+		}
+		db := open()
+		n := 0
+		write := func() error {
+			err := db.update(func() error {
+				if err := db.tree.Insert([]byte(fmt.Sprintf("key%03d", n%300)), []byte(value(n))); err != nil {
+					return err
+				}
+				return db.tree.Insert([]byte("last"), []byte(fmt.Sprint(n)))
+			})
+			n++
+			return err
+		}
+		check := func(path string) {
+			t.Helper()
+			db := &KV{Path: path}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			val, _ := db.Get([]byte("last"))
+			last, err := strconv.Atoi(string(val))
+			if err != nil {
+				t.Fatalf("%s: last %q", name, val)
+			}
+			checkKV(t, db, wantAt(last))
+			if err := db.tree.Verify(); err != nil {
+				t.Fatal(err)
+			}
+			fs := db.store.(*fileStore)
+			stats := db.tree.Stats()
+			if used := 1 + stats.InternalNodes + stats.LeafNodes + stats.OverflowPages + uint64(freePages(t, fs)); used != fs.page.flushed {
+				t.Fatalf("%s: %d pages found, %d used", name, used, fs.page.flushed)
+			}
+		}
+		for range 1000 {
+			if err := write(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// updates go on while the backup waits to write
+		gate, done := make(chan struct{}), make(chan error)
+		var buf bytes.Buffer
+		var commit uint64
+		go func() {
+			var err error
+			commit, err = db.Backup(&gateWriter{&buf, gate}, 0)
+			done <- err
+		}()
+		fs := db.store.(*fileStore)
+		for running := 0; running == 0; {
+			runtime.Gosched()
+			fs.mu.Lock()
+			running = len(fs.hold.readers)
+			fs.mu.Unlock()
+		}
+		for range 300 {
+			if err := write(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		close(gate)
+		if err := <-done; err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if commit >= fs.commit || len(fs.hold.pages) == 0 {
+			t.Fatalf("%s: backup at commit %d of %d, %d pages held", name, commit, fs.commit, len(fs.hold.pages))
+		}
+		restored := filepath.Join(dir, "restored.db")
+		if _, err := ApplyBackup(restored, &buf); err != nil {
+			t.Fatal(err)
+		}
+		check(restored)
+		if val, _ := db.Get([]byte("last")); string(val) != fmt.Sprint(n-1) {
+			t.Fatalf("%s: last %q after %d updates", name, val, n)
+		}
+
+		// the pages held are listed by `Close`
+		db.Close()
+		check(path)
+
+		// or by the next update, here during `BackupTo`
+		db = open()
+		stop, errs := make(chan struct{}), make(chan error)
+		go func() {
+			for {
+				select {
+				case <-stop:
+					errs <- nil
+					return
+				default:
+				}
+				if err := write(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+		copied := filepath.Join(dir, "copied.db")
+		_, err := db.BackupTo(copied)
+		close(stop)
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := write(); err != nil {
+			t.Fatal(err)
+		}
+		if fs := db.store.(*fileStore); len(fs.hold.pages) != 0 {
+			t.Fatalf("%s: %d pages still held", name, len(fs.hold.pages))
+		}
+		if _, err := db.BackupTo(copied); err == nil {
+			t.Fatalf("%s: backup over a database", name)
+		}
+		db.Close()
+		check(copied)
+		check(path)
+	}
+}
@@ -0,0 +1,79 @@
+package kv
+
+import "bytes"
+
+/*
+With `KV.Changes` set, every key set or removed by `Set`, `Del`, a
+transaction or a bulk update is passed to it once the update is committed,
+in the order of the commits: replaying the changes gives the database as it
+is. `Import` and `ImportInto` pass a set for each pair they write, and
+`TruncateBefore` a removal for each key, read before its subtrees are
+dropped. Compaction and the value log's collection move the pairs without
+changing them, they pass nothing.
+
+The changes of a group are passed by its leader, after the group is flushed
+and the database let go: the stream lock is taken before it is, so the next
+group waits for the changes before it to be passed. `Changes` can read the
+database, and must not update it.
+
+A removal carries the value the key had when `KV.CaptureOldValues` is set,
+read by the update before it removes the key.
+*/
+
+// kinds of `Change`
+const (
+	CHANGE_SET     = 0 // `Key` was set to `Val`
+	CHANGE_REMOVED = 1 // `Key` was removed, its value was `OldVal`
+)
+
+// A key set or removed by a commit, see `KV.Changes`.
+type Change struct {
+	Kind   int
+	Key    []byte
+	Val    []byte // of `CHANGE_SET`
+	OldVal []byte // of `CHANGE_REMOVED`, with `KV.CaptureOldValues`
+}
+
+// Returns the removal of a key, with the value `get` finds for it if it's
+// captured: it must be called before the key is removed.
+func (db *KV) removal(get func(key []byte) ([]byte, bool), key []byte) Change {
+	change := Change{Kind: CHANGE_REMOVED, Key: key}
+	if db.CaptureOldValues {
+		if val, ok := get(key); ok {
+			change.OldVal = bytes.Clone(db.loadVal(val))
+		}
+	}
+	return change
+}
+
+// Returns the removals of the first `n` keys of the tree, see `removal`.
+func (db *KV) removalsOfFirst(n uint64) []Change {
+	changes := make([]Change, 0, n)
+	for key, val := range db.tree.Scan(nil) {
+		if uint64(len(changes)) == n {
+			break
+		}
+		change := Change{Kind: CHANGE_REMOVED, Key: bytes.Clone(key)}
+		if db.CaptureOldValues {
+			change.OldVal = bytes.Clone(db.loadVal(val))
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// Lets go of `db.mu` after a commit, then passes its changes to `Changes`,
+// after the ones of the commits before it.
+func (db *KV) streamChanges(changes []Change) {
+	if db.Changes == nil || len(changes) == 0 {
+		db.mu.Unlock()
+		return
+	}
+
+	db.stream.Lock()
+	db.mu.Unlock()
+	defer db.stream.Unlock()
+	for _, change := range changes {
+		db.Changes(change)
+	}
+}
@@ -0,0 +1,173 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Returns a database streaming its changes into the slice returned, which is
+// only read once the updates are done.
+func openStreamKV(t *testing.T, capture bool) (*KV, *[]Change) {
+	t.Helper()
+	var changes []Change
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), CaptureOldValues: capture}
+	db.Changes = func(change Change) {
+		changes = append(changes, change)
+	}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db, &changes
+}
+
+// Keys set and removed are streamed once committed, the removals with the
+// value they had when it's captured, and nothing for what isn't committed.
+func TestChanges(t *testing.T) {
+	long := strings.Repeat("o", 3*PAGE_SIZE)
+	for _, capture := range []bool{false, true} {
+		db, changes := openStreamKV(t, capture)
+		db.Set([]byte("a"), []byte("1"))
+		db.Set([]byte("b"), []byte(long))
+		db.Del([]byte("a"))
+		db.Del([]byte("a"))
+		db.Set(make([]byte, 10*PAGE_SIZE), nil) // fails
+
+		tx, _ := db.Begin()
+		key := []byte("c")
+		tx.Set(key, []byte("3"))
+		key[0] = 'x' // reused after the update
+		tx.Del([]byte("b"))
+		tx.Del([]byte("d"))
+		if _, err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		tx, _ = db.Begin()
+		tx.Del([]byte("c"))
+		tx.Rollback()
+
+		old := func(val string) []byte {
+			if !capture {
+				return nil
+			}
+			return []byte(val)
+		}
+		want := []Change{
+			{Kind: CHANGE_SET, Key: []byte("a"), Val: []byte("1")},
+			{Kind: CHANGE_SET, Key: []byte("b"), Val: []byte(long)},
+			{Kind: CHANGE_REMOVED, Key: []byte("a"), OldVal: old("1")},
+			{Kind: CHANGE_SET, Key: []byte("c"), Val: []byte("3")},
+			{Kind: CHANGE_REMOVED, Key: []byte("b"), OldVal: old(long)},
+		}
+		if !slices.EqualFunc(*changes, want, func(a, b Change) bool {
+			return a.Kind == b.Kind && string(a.Key) == string(b.Key) && string(a.Val) == string(b.Val) && string(a.OldVal) == string(b.OldVal)
+		}) {
+			t.Fatalf("capture %v: %d changes, want %d", capture, len(*changes), len(want))
+		}
+	}
+}
+
+// Replaying the changes of concurrent updates and transactions in the order
+// they're streamed gives the database as it is.
+func TestChangesOrder(t *testing.T) {
+	db, changes := openStreamKV(t, true)
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Go(func() {
+			rng := rand.New(rand.NewPCG(uint64(w), 0))
+			for i := range 300 {
+				key := fmt.Appendf(nil, "key%02d", rng.IntN(30))
+				switch rng.IntN(4) {
+				case 0:
+					db.Del(key)
+				case 1:
+					tx, _ := db.Begin()
+					tx.Set(key, fmt.Appendf(nil, "tx%d.%d", w, i))
+					tx.Del(fmt.Appendf(nil, "key%02d", rng.IntN(30)))
+					tx.Commit()
+				default:
+					db.Set(key, fmt.Appendf(nil, "%d.%d", w, i))
+				}
+			}
+		})
+	}
+	wg.Wait()
+	checkReplay(t, db, *changes)
+}
+
+// Pairs loaded by the imports and keys dropped by `TruncateBefore` are
+// streamed like the ones of `Set` and `Del`.
+func TestChangesBulk(t *testing.T) {
+	export := func(gen int, keys ...int) []byte {
+		t.Helper()
+		src := openNoSyncKV(t, filepath.Join(t.TempDir(), "src.db"))
+		for _, i := range keys {
+			if err := src.Set(fmt.Appendf(nil, "key%04d", i), fmt.Appendf(nil, "val%d-%d", i, gen)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var buf bytes.Buffer
+		if err := src.Export(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	var first, second []int
+	for i := range 2000 {
+		first = append(first, i)
+		if i%3 == 0 {
+			second = append(second, i+1000)
+		}
+	}
+
+	db, changes := openStreamKV(t, true)
+	if err := db.Import(bytes.NewReader(export(0, first...))); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(*changes); n != len(first) {
+		t.Fatalf("%d changes imported, want %d", n, len(first))
+	}
+	if n, err := db.TruncateBefore([]byte("key0500")); err != nil || n != 500 {
+		t.Fatalf("truncated %d keys: %v", n, err)
+	}
+	if _, err := db.ImportInto(bytes.NewReader(export(1, second...)), 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(*changes); n != len(first)+500+len(second) {
+		t.Fatalf("%d changes, want %d", n, len(first)+500+len(second))
+	}
+	checkReplay(t, db, *changes)
+}
+
+// Checks that replaying the changes in the order they're streamed gives the
+// database as it is, and that the removals carry the values the keys had.
+func checkReplay(t *testing.T, db *KV, changes []Change) {
+	t.Helper()
+	replayed := map[string]string{}
+	for _, change := range changes {
+		val, ok := replayed[string(change.Key)]
+		switch change.Kind {
+		case CHANGE_SET:
+			replayed[string(change.Key)] = string(change.Val)
+		case CHANGE_REMOVED:
+			if !ok || string(change.OldVal) != val {
+				t.Fatalf("%q removed with %q, was %q", change.Key, change.OldVal, val)
+			}
+			delete(replayed, string(change.Key))
+		}
+	}
+	got := map[string]string{}
+	for key, val := range db.Scan(nil) {
+		got[string(key)] = string(val)
+	}
+	if !maps.Equal(got, replayed) {
+		t.Fatalf("%d keys, %d replayed", len(got), len(replayed))
+	}
+}
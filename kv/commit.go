@@ -0,0 +1,126 @@
+package kv
+
+/*
+Concurrent updates are committed in groups: the first writer to come leads,
+applying the updates queued so far to the tree and flushing them all at once,
+while the others wait for it. The updates queued meanwhile make the next
+group, so the cost of a sync is shared by every writer that came during the
+previous one.
+
+An update that fails leaves the tree as it was and only fails its own
+writer, a failed flush fails the whole group. A group whose pages go over
+`KV.MemoryLimit` is flushed in parts, see `MEMORY_CACHE_PERCENT`.
+*/
+
+// An update waiting for its group to be committed.
+type pendingUpdate struct {
+	op      func() error
+	changes *[]Change // left by `op`, nil if it makes none
+	err     error
+	panic   any // from `op`, raised again in the writer
+	done    chan struct{}
+}
+
+// Queues an update and waits for its group to be committed, leading it if
+// no one else is.
+func (db *KV) commitUpdate(op func() error, changes *[]Change) error {
+	u := &pendingUpdate{op: op, changes: changes, done: make(chan struct{})}
+
+	db.commit.mu.Lock()
+	db.commit.queue = append(db.commit.queue, u)
+	lead := !db.commit.leading
+	db.commit.leading = true
+	db.commit.mu.Unlock()
+
+	if lead {
+		db.leadCommits()
+	}
+
+	<-u.done
+	if u.panic != nil {
+		panic(u.panic)
+	}
+	return u.err
+}
+
+// Commits the queued updates group by group until the queue is empty.
+func (db *KV) leadCommits() {
+	for {
+		db.commit.mu.Lock()
+		group := db.commit.queue
+		db.commit.queue = nil
+		if len(group) == 0 {
+			db.commit.leading = false
+			db.commit.mu.Unlock()
+			return
+		}
+		db.commit.mu.Unlock()
+
+		db.commitGroup(group)
+		for _, u := range group {
+			close(u.done)
+		}
+	}
+}
+
+// Applies a group of updates to the tree and flushes them together, in parts
+// if their pages go over `KV.MemoryLimit`, then streams their changes.
+func (db *KV) commitGroup(group []*pendingUpdate) {
+	db.mu.Lock()
+	var changes []Change
+	defer func() {
+		db.streamChanges(changes)
+	}()
+
+	store, _ := db.store.(MemoryStore)
+	root := db.tree.Root()
+	start := 0
+	for i, u := range group {
+		u.err = applyUpdate(u)
+		if store != nil && i+1 < len(group) && store.MemoryFull() {
+			db.flushGroup(group[start:i+1], root)
+			root, start = db.tree.Root(), i+1
+		}
+	}
+	db.flushGroup(group[start:], root)
+
+	for _, u := range group {
+		if u.err == nil && u.panic == nil && u.changes != nil {
+			changes = append(changes, *u.changes...)
+		}
+	}
+}
+
+// Flushes the updates of a group applied to the tree since `root`, or fails
+// them all and goes back to it.
+func (db *KV) flushGroup(group []*pendingUpdate, root uint64) {
+	applied := 0
+	for _, u := range group {
+		if u.err == nil && u.panic == nil {
+			applied++
+		}
+	}
+	if applied == 0 {
+		db.store.Abort()
+		return
+	}
+
+	if err := db.store.Flush(db.tree.Root()); err != nil {
+		for _, u := range group {
+			if u.err == nil && u.panic == nil {
+				u.err = err
+			}
+		}
+		if root != db.tree.Root() {
+			db.openTree(root)
+		}
+	}
+}
+
+// Runs an update, catching its panic.
+func applyUpdate(u *pendingUpdate) error {
+	defer func() {
+		u.panic = recover()
+	}()
+	return u.op()
+}
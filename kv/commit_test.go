@@ -0,0 +1,74 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"db/btree"
+)
+
+// A store with slow flushes, counting them.
+type slowStore struct {
+	PageStore
+	flushes atomic.Int64
+}
+
+func (ss *slowStore) Flush(root uint64) error {
+	ss.flushes.Add(1)
+	time.Sleep(time.Millisecond)
+	return ss.PageStore.Flush(root)
+}
+
+// Concurrent writers share flushes, and one failing doesn't fail the others.
+func TestGroupCommit(t *testing.T) {
+	store := &slowStore{PageStore: newMemStore()}
+	db := &KV{}
+	if err := db.OpenStore(store); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const writers, updates = 16, 50
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range updates {
+				key := fmt.Sprintf("w%02d-%03d", w, i)
+				if err := db.Set([]byte(key), []byte(key)); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, ok := db.Get([]byte(key)); !ok {
+					t.Errorf("%q not found after its update", key)
+					return
+				}
+			}
+			if err := db.Set(make([]byte, PAGE_SIZE), nil); !errors.Is(err, btree.ErrKeyTooLarge) {
+				t.Errorf("set a large key: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := map[string]string{}
+	for w := range writers {
+		for i := range updates {
+			key := fmt.Sprintf("w%02d-%03d", w, i)
+			want[key] = key
+		}
+	}
+	checkKV(t, db, want)
+
+	if n := store.flushes.Load(); n >= writers*updates {
+		t.Fatalf("%d flushes for %d updates", n, writers*updates)
+	}
+	if err := db.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
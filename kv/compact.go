@@ -0,0 +1,291 @@
+package kv
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+
+	"db/btree"
+)
+
+// most pages copied by a step of `Compact`, which is also the room it leaves
+// for the steps past the pages in use
+const COMPACT_STEP_PAGES = 64
+
+// most passes of `Compact` over the tree, the next one moves the pages that
+// had to go past the limit of the last one, see `compressStore.LimitPages`
+const COMPACT_PASSES = 2
+
+// fill ratio `CompactWithFillRatio` must go past, the nodes at a quarter of a
+// page or less are merged by the next deletion
+const COMPACT_MIN_FILL_RATIO = 0.25
+
+/*
+The free list reuses the pages freed by updates, but the file never shrinks
+by itself: a page in use at its end keeps every free one before it.
+`Compact` packs the tree into the front of the file, then cuts the rest.
+
+It picks a limit, the number of pages in use and some room, and has
+`AllocPage` only hand out the free pages under it. The pages of the tree past
+the limit are then copied under it with `btree.BTree.Relocate`, along with
+the nodes pointing to them, in steps of `COMPACT_STEP_PAGES` committed like
+any update: readers and writers go on between the steps, and a crash in the
+middle leaves the last step committed. The free pages past the limit that
+`AllocPage` skips are dropped from the free list.
+
+Once the tree is under the limit, `Shrink` commits a new free list of the
+pages before the last one of the tree, the one of the last commit isn't
+written over until then, and cuts the file after it.
+
+`CompactWithFillRatio` first rebuilds the tree with `btree.BTree.BulkLoad`,
+its leaves filled to the ratio asked for, and frees the old one, in a single
+update whose pages are held until it's committed, like a transaction's. The
+file is then compacted like `Compact` does.
+*/
+
+// returned by a step of `Compact` with no page left to move, so that it isn't
+// committed
+var errNothingToMove = errors.New("kv: no page to move")
+
+var ErrFillRatio = errors.New("kv: fill ratio out of range")
+
+// Gives back the free pages of the file, moving the pages in use at its end
+// into free ones closer to its start, then cutting it. Reads and updates go
+// on while it's done, step by step. Does nothing for a store that isn't a
+// `CompactStore`.
+func (db *KV) Compact() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	db.exclusive.Lock()
+	defer db.exclusive.Unlock()
+	return db.compact()
+}
+
+// Rebuilds the tree with its leaves filled to `ratio` of a page, in
+// (`COMPACT_MIN_FILL_RATIO`, 1], then compacts the file like `Compact`: 1
+// packs the leaves for data that's mostly read, less leaves room for
+// insertions before they split. Reads and updates wait for the rebuild. Fails
+// with `ErrFillRatio` for a ratio out of range.
+func (db *KV) CompactWithFillRatio(ratio float64) error {
+	if !(ratio > COMPACT_MIN_FILL_RATIO && ratio <= 1) {
+		return fmt.Errorf("%w: %v, want (%v, 1]", ErrFillRatio, ratio, COMPACT_MIN_FILL_RATIO)
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	db.exclusive.Lock()
+	defer db.exclusive.Unlock()
+	err := db.update(func() error {
+		old := db.tree
+		tree, err := db.newTree(0)
+		if err != nil {
+			return err
+		}
+		if err := tree.BulkLoad(old.Scan(nil), ratio); err != nil {
+			return err
+		}
+		for _, ptr := range old.Pages() {
+			db.store.FreePage(ptr)
+		}
+		db.tree = tree
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return db.compact()
+}
+
+// Compacts the file, see `Compact`. `db.exclusive` must be held.
+func (db *KV) compact() error {
+	db.mu.RLock()
+	store, ok := db.store.(CompactStore)
+	db.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	for range COMPACT_PASSES {
+		copied, err := db.relocate(store)
+
+		// the pages dropped from the free list are added back even if a step
+		// failed
+		db.mu.Lock()
+		err = cmp.Or(err, store.Shrink(db.tree))
+		db.mu.Unlock()
+		if err != nil || copied == 0 {
+			return err
+		}
+	}
+	return nil
+}
+
+// Moves the pages of the tree past a new limit under it, step by step, and
+// returns how many were copied.
+func (db *KV) relocate(store CompactStore) (total int, err error) {
+	db.mu.Lock()
+	move, err := store.LimitPages()
+	db.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	var from []byte
+	for {
+		err = db.update(func() error {
+			next, copied, err := db.tree.Relocate(move, from, COMPACT_STEP_PAGES)
+			if err == nil && copied == 0 {
+				err = errNothingToMove
+			}
+			from = next
+			total += copied
+			return err
+		})
+		if err == errNothingToMove {
+			err = nil
+		}
+		if err != nil || from == nil {
+			return total, err
+		}
+	}
+}
+
+// Counts the pages in use, and makes `AllocPage` take free pages from the
+// ones under that count, see `limitPages`.
+func (fs *fileStore) LimitPages() (func(ptr uint64) bool, error) {
+	used, err := fs.usedPages()
+	if err != nil {
+		return nil, err
+	}
+	return fs.rekeyPages(fs.limitPages(used))
+}
+
+// Returns the number of pages of the file that aren't free.
+func (fs *fileStore) usedPages() (used uint64, err error) {
+	defer recoverCorrupt(&err)
+
+	free := uint64(fs.free.Total())
+	for ptr := fs.free.head; ptr != 0; ptr = flnNext(fs.free.node(ptr)) {
+		free++ // the node itself
+	}
+	return fs.page.flushed - free, nil
+}
+
+// Makes `AllocPage` take free pages from the first `used`, with
+// `COMPACT_STEP_PAGES` of room and a sixteenth more, and returns whether a
+// page of the tree is past them.
+func (fs *fileStore) limitPages(used uint64) func(ptr uint64) bool {
+	limit := min(used+used/16+COMPACT_STEP_PAGES, fs.page.flushed)
+	fs.page.limit = limit
+	return func(ptr uint64) bool { return fs.filePage(ptr) >= limit }
+}
+
+// Writes a free list of the pages before the last one of the tree that it
+// doesn't use, then the meta page with that many pages in use, and cuts the
+// file. Lifts the limit of `LimitPages`, and ends a `Rekey` once every page
+// was moved.
+func (fs *fileStore) Shrink(tree *btree.BTree) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer recoverCorrupt(&err)
+	fs.page.limit = 0
+	pages := fs.filePages(tree.Pages())
+
+	if fs.wal != nil {
+		if err := fs.checkpoint(); err != nil {
+			return err
+		}
+	}
+
+	used := make([]bool, fs.page.flushed)
+	used[0] = true // the meta page
+	for _, ptr := range pages {
+		if ptr == 0 || ptr >= fs.page.flushed || used[ptr] {
+			return fmt.Errorf("%w: page %d of %d reached twice or out of the file", ErrBadFile, ptr, fs.page.flushed)
+		}
+		used[ptr] = true
+	}
+	listNodes := make([]bool, fs.page.flushed)
+	for ptr := fs.free.head; ptr != 0; ptr = flnNext(fs.free.node(ptr)) {
+		listNodes[ptr] = true
+	}
+
+	end := fs.page.flushed
+	for end > 1 && !used[end-1] {
+		end--
+	}
+	listed := 0
+	for _, ok := range used[:end] {
+		if !ok {
+			listed++
+		}
+	}
+
+	// the new nodes go in free pages that aren't nodes of the old list, which
+	// is read until the new one is committed, past the tree if there aren't
+	// enough of them. A page taken is one fewer to list: it's only taken if
+	// the ones left need another node, else the last node goes past the tree
+	var nodes []uint64
+	for ptr := end - 1; ptr > 0 && listed > 0 && len(nodes) < flNodes(listed-1); ptr-- {
+		if !used[ptr] && !listNodes[ptr] {
+			used[ptr] = true
+			nodes = append(nodes, ptr)
+			listed--
+		}
+	}
+	for ; len(nodes) < flNodes(listed); end++ {
+		if end < fs.page.flushed && listNodes[end] {
+			listed++
+			continue
+		}
+		nodes = append(nodes, end)
+	}
+	var free []uint64
+	for ptr := uint64(1); ptr < end; ptr++ {
+		if (ptr >= fs.page.flushed || !used[ptr]) && !slices.Contains(nodes, ptr) {
+			free = append(free, ptr)
+		}
+	}
+
+	head := fs.free.head
+	fs.free.reset(free, nodes)
+	rekeyed := fs.rekeyDone(tree)
+	if rekeyed {
+		// what the old key sealed there is written over, but for the nodes of
+		// the old list
+		for _, ptr := range free {
+			if ptr >= fs.page.flushed || !listNodes[ptr] {
+				fs.page.updates[ptr] = make([]byte, PAGE_SIZE)
+			}
+		}
+	}
+	err = fs.writePages(fs.page.updates, int(end))
+	if err == nil {
+		err = fs.syncFile(fs.fp)
+	}
+	if err != nil {
+		fs.free.head = head
+		fs.Abort()
+		return err
+	}
+
+	fs.page.flushed = end
+	fs.commit++
+	fs.Abort()
+	// listed with the other free pages, no one reads them during `Compact`
+	fs.hold.pages = nil
+	if rekeyed {
+		fs.dropOldKey()
+	}
+	if err := fs.storeMeta(); err != nil {
+		return err
+	}
+	if err := fs.syncFile(fs.fp); err != nil {
+		return err
+	}
+	return fs.truncate()
+}
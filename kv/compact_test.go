@@ -0,0 +1,248 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// `Compact` cuts the file to about the pages in use, with a WAL or a buffer
+// pool too, while a reader scans the keys, and leaves every page either in
+// the tree or free.
+func TestCompact(t *testing.T) {
+	for _, opts := range []struct {
+		wal   bool
+		cache int
+	}{{}, {wal: true}, {cache: 64 * PAGE_SIZE}} {
+		name := fmt.Sprintf("wal %v, cache %d", opts.wal, opts.cache)
+		path := filepath.Join(t.TempDir(), "test.db")
+		open := func() *KV {
+			t.Helper()
+			db := &KV{Path: path, Sync: SyncNone, WAL: opts.wal, CacheSize: opts.cache, Extent: 16 * PAGE_SIZE}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			return db
+		}
+
+		db := open()
+		want := map[string]string{}
+		for i := range 10000 {
+			key, val := fmt.Sprintf("key%05d", i), strings.Repeat("v", 100)
+			if i%1000 == 0 {
+				val = strings.Repeat("o", 3*PAGE_SIZE)
+			}
+			if err := db.Set([]byte(key), []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = val
+		}
+		for i := range 10000 {
+			if i%8 == 0 {
+				continue
+			}
+			key := fmt.Sprintf("key%05d", i)
+			if _, err := db.Del([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, key)
+		}
+		fs := db.store.(*fileStore)
+		before := fs.page.flushed
+
+		stop, scans := make(chan struct{}), make(chan error)
+		go func() {
+			n := 0
+			for {
+				select {
+				case <-stop:
+					scans <- nil
+					return
+				default:
+				}
+				keys := 0
+				for key, val := range db.Scan([]byte("key")) {
+					if want[string(key)] != string(val) {
+						scans <- fmt.Errorf("scan %d: %q is %d bytes", n, key, len(val))
+						return
+					}
+					keys++
+				}
+				if keys != len(want) {
+					scans <- fmt.Errorf("scan %d: %d keys, want %d", n, keys, len(want))
+					return
+				}
+				n++
+			}
+		}()
+		err := db.Compact()
+		close(stop)
+		if err := <-scans; err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		stats := db.tree.Stats()
+		after := fs.page.flushed
+		if used := 1 + stats.InternalNodes + stats.LeafNodes + stats.OverflowPages + uint64(freePages(t, fs)); used != after {
+			t.Fatalf("%s: %d pages found, %d used", name, used, after)
+		}
+		if live := 1 + stats.InternalNodes + stats.LeafNodes + stats.OverflowPages; after > live+live/16+COMPACT_STEP_PAGES+2 || after > before/3 {
+			t.Fatalf("%s: %d pages of %d left, %d in the tree", name, after, before, live)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != int64(fs.extentPages(int(after))*PAGE_SIZE) {
+			t.Fatalf("%s: file of %d bytes for %d pages", name, fi.Size(), after)
+		}
+		checkKV(t, db, want)
+		if err := db.tree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range 1000 {
+			key := fmt.Sprintf("new%05d", i)
+			if err := db.Set([]byte(key), []byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = key
+		}
+		db.Close()
+
+		db = open()
+		checkKV(t, db, want)
+		if err := db.tree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	openTestKV(t, path).Close()
+	db := &KV{Path: path}
+	if err := db.OpenReadOnly(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Compact(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("compact read-only: %v", err)
+	}
+}
+
+// Truncating the oldest 40% of time-ordered keys keeps the rest, and the file
+// shrinks by about as much once compacted.
+func TestTruncateBefore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openNoSyncKV(t, path)
+	key := func(i int) []byte { return fmt.Appendf(nil, "event%016x", int64(1700000000000)+int64(i)*1000) }
+	want := map[string]string{}
+	for i := range 10000 {
+		val := strings.Repeat("v", 100)
+		if err := db.Set(key(i), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		want[string(key(i))] = val
+	}
+	fs := db.store.(*fileStore)
+	before := fs.page.flushed
+
+	if n, err := db.TruncateBefore(key(4000)); err != nil || n != 4000 {
+		t.Fatalf("truncated %d keys: %v", n, err)
+	}
+	for i := range 4000 {
+		delete(want, string(key(i)))
+	}
+	checkKV(t, db, want)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	stats := db.tree.Stats()
+	live := 1 + stats.InternalNodes + stats.LeafNodes
+	if after := fs.page.flushed; after > live+live/16+COMPACT_STEP_PAGES+2 || after >= before {
+		t.Fatalf("%d pages of %d left, %d in the tree", after, before, live)
+	}
+	if err := db.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = openTestKV(t, path)
+	checkKV(t, db, want)
+	if n, err := db.TruncateBefore(key(4000)); err != nil || n != 0 {
+		t.Fatalf("truncated %d keys again: %v", n, err)
+	}
+}
+
+// Compacting at half a page of fill gives about twice the leaves of packing
+// them, with the same pairs, and the file follows. A ratio out of range is
+// refused.
+func TestCompactWithFillRatio(t *testing.T) {
+	for _, memory := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := &KV{Path: path, Sync: SyncNone}
+		open := db.Open
+		if memory {
+			open = db.OpenMemory
+		}
+		if err := open(); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		want := map[string]string{}
+		for _, i := range rand.New(rand.NewPCG(1, 2)).Perm(5000) {
+			key, val := fmt.Sprintf("key%05d", i), strings.Repeat("v", 50)
+			if i%250 == 0 {
+				val = strings.Repeat("o", 3*PAGE_SIZE)
+			}
+			if err := db.Set([]byte(key), []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = val
+		}
+		for _, ratio := range []float64{0, COMPACT_MIN_FILL_RATIO, 1.5, math.NaN()} {
+			if err := db.CompactWithFillRatio(ratio); !errors.Is(err, ErrFillRatio) {
+				t.Fatalf("ratio %v: %v", ratio, err)
+			}
+		}
+
+		compact := func(ratio float64) (leaves, pages uint64) {
+			t.Helper()
+			if err := db.CompactWithFillRatio(ratio); err != nil {
+				t.Fatal(err)
+			}
+			checkKV(t, db, want)
+			if err := db.tree.Verify(); err != nil {
+				t.Fatal(err)
+			}
+			if !memory {
+				stats := db.tree.Stats()
+				pages = db.store.(*fileStore).page.flushed
+				if live := 1 + stats.InternalNodes + stats.LeafNodes + stats.OverflowPages; pages > live+live/16+COMPACT_STEP_PAGES+2 {
+					t.Fatalf("ratio %v: %d pages left, %d in the tree", ratio, pages, live)
+				}
+			}
+			return db.tree.Stats().LeafNodes, pages
+		}
+		packed, packedPages := compact(1)
+		loose, loosePages := compact(0.5)
+		if float64(loose) < 1.8*float64(packed) || float64(loose) > 2.2*float64(packed) {
+			t.Fatalf("memory %v: %d leaves at 0.5, %d at 1", memory, loose, packed)
+		}
+		if !memory && loosePages <= packedPages {
+			t.Fatalf("%d pages at 0.5, %d at 1", loosePages, packedPages)
+		}
+		if again, _ := compact(1); again != packed {
+			t.Fatalf("memory %v: %d leaves packed again, %d before", memory, again, packed)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"iter"
+)
+
+var ErrFilesDiffer = errors.New("kv: the databases differ")
+
+/*
+`CompareFiles` tells whether two database files hold the same pairs, however
+their pages are laid out: a compacted or migrated copy of a file differs
+from it byte by byte, and holds the same pairs. Both are opened read-only and
+scanned side by side in key order, stepping the one behind, until a key only
+one has or a key whose values differ, which is reported. Values kept in a
+value log are compared as read from it.
+*/
+
+// Reports whether the databases of the files at `a` and `b` hold the same
+// pairs. When they don't, the error wraps `ErrFilesDiffer` and names the
+// first key they differ on. Fails like `KV.OpenReadOnly`, an encrypted file
+// can't be opened.
+func CompareFiles(a, b string) (bool, error) {
+	dbA := &KV{Path: a}
+	if err := dbA.OpenReadOnly(); err != nil {
+		return false, fmt.Errorf("%s: %w", a, err)
+	}
+	defer dbA.Close()
+	dbB := &KV{Path: b}
+	if err := dbB.OpenReadOnly(); err != nil {
+		return false, fmt.Errorf("%s: %w", b, err)
+	}
+	defer dbB.Close()
+
+	if key, ok := firstDiff(dbA.Scan(nil), dbB.Scan(nil)); ok {
+		return false, fmt.Errorf("%w: at key %q", ErrFilesDiffer, key)
+	}
+	return true, nil
+}
+
+// Walks two scans in key order and returns the first key they differ on, a
+// key only one of them has or whose values differ.
+func firstDiff(a, b iter.Seq2[[]byte, []byte]) ([]byte, bool) {
+	nextA, stopA := iter.Pull2(a)
+	defer stopA()
+	nextB, stopB := iter.Pull2(b)
+	defer stopB()
+
+	keyA, valA, okA := nextA()
+	keyB, valB, okB := nextB()
+	for okA && okB {
+		switch cmp := bytes.Compare(keyA, keyB); {
+		case cmp < 0:
+			return keyA, true
+		case cmp > 0:
+			return keyB, true
+		case !bytes.Equal(valA, valB):
+			return keyA, true
+		}
+		keyA, valA, okA = nextA()
+		keyB, valB, okB = nextB()
+	}
+	switch {
+	case okA:
+		return keyA, true
+	case okB:
+		return keyB, true
+	}
+	return nil, false
+}
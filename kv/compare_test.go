@@ -0,0 +1,93 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A file compares equal to its compacted copies, whose bytes differ, and not
+// to a copy with a key changed, removed or added, naming that key.
+func TestCompareFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "orig.db")
+	db := openNoSyncKV(t, path)
+	for i := range 3000 {
+		val := fmt.Sprint(i)
+		if i%300 == 0 {
+			val = strings.Repeat("o", 2*PAGE_SIZE+i)
+		}
+		if err := db.Set(fmt.Appendf(nil, "key%05d", i), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3000; i += 3 {
+		db.Del(fmt.Appendf(nil, "key%05d", i))
+	}
+	snapshot := filepath.Join(dir, "snapshot.db")
+	if err := db.SnapshotToFile(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	compacted := filepath.Join(dir, "compacted.db")
+	copyFile(t, path, compacted)
+	db = openTestKV(t, compacted)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	for _, other := range []string{snapshot, compacted} {
+		orig, _ := os.ReadFile(path)
+		copied, _ := os.ReadFile(other)
+		if string(orig) == string(copied) {
+			t.Fatalf("%s: same bytes as the original", other)
+		}
+		if equal, err := CompareFiles(path, other); !equal || err != nil {
+			t.Fatalf("%s: %v, %v", other, equal, err)
+		}
+	}
+
+	for _, test := range []struct {
+		name   string
+		update func(db *KV) error
+		key    string
+	}{
+		{"changed", func(db *KV) error { return db.Set([]byte("key01000"), []byte("tampered")) }, "key01000"},
+		{"removed", func(db *KV) error { _, err := db.Del([]byte("key02000")); return err }, "key02000"},
+		{"added", func(db *KV) error { return db.Set([]byte("key00300"), []byte("back")) }, "key00300"},
+		{"last", func(db *KV) error { return db.Set([]byte("zzz"), nil) }, "zzz"},
+	} {
+		tampered := filepath.Join(dir, test.name+".db")
+		copyFile(t, snapshot, tampered)
+		db := openTestKV(t, tampered)
+		if err := test.update(db); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		for _, files := range [][2]string{{path, tampered}, {tampered, path}} {
+			equal, err := CompareFiles(files[0], files[1])
+			if equal || !errors.Is(err, ErrFilesDiffer) || !strings.Contains(err.Error(), fmt.Sprintf("%q", test.key)) {
+				t.Fatalf("%s: %v, %v, want %q", test.name, equal, err, test.key)
+			}
+		}
+	}
+
+	if _, err := CompareFiles(path, filepath.Join(dir, "missing.db")); err == nil || errors.Is(err, ErrFilesDiffer) {
+		t.Fatalf("missing file: %v", err)
+	}
+}
+
+func copyFile(t *testing.T, from, to string) {
+	t.Helper()
+	data, err := os.ReadFile(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(to, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,360 @@
+package kv
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"db/btree"
+)
+
+// flag of the meta page of a file whose pages are packed, see `KV.Compress`
+const META_FLAG_COMPRESSED = 2
+
+// low bits of the number of a tree page that tell its slot in a packed page
+const PACK_BITS = 4
+
+// pages packed into one at most
+const PACK_SLOTS = 1<<PACK_BITS - 1
+
+const PACK_HEADER = 2 + 2*PACK_SLOTS
+
+// most bytes a page is compressed into to be packed, it's written as is
+// otherwise
+const PACK_MAX_SIZE = PAGE_SIZE / 2
+
+// pages of the tree left in a packed page for `Compact` to pack them again
+const PACK_SPARSE = 2
+
+// packed pages kept uncompressed, the last ones read
+const UNPACKED_PAGES = 256
+
+/*
+With `KV.Compress`, the pages of the tree are compressed with DEFLATE as
+they're written, and the ones that compress to `PACK_MAX_SIZE` or less are
+packed together into pages of the file. A page of the tree is numbered by
+the page of the file it's in, shifted by `PACK_BITS`, and its slot there, 0
+for a page written as is: the number never changes, since a page is never
+written over, and the tree keeps its layout. The free list, the WAL and the
+backups deal in pages of the file.
+
+# Packed page:
+
+	| n  | ends  |  pages  |
+	| 2B | 15*2B | ...     |
+
+`n` is the number of pages in it, in slots 1 to n, and `ends` is where each
+of them ends, the first one starts after the header. The pages of the tree
+have their own checksums, a damaged page fails them once uncompressed.
+
+Pages are packed with the others written by the same update, which packs
+well for bulk loads and batches, but an update of a single key writes a few
+pages that don't live as long as each other. A page of the file is freed
+once every page packed into it is: the number left of each one is counted
+from the tree when it's opened, then along the updates. `Compact` packs
+the ones left with `PACK_SPARSE` pages or less again.
+
+The last `UNPACKED_PAGES` pages read are kept uncompressed, the top of the
+tree is read by every lookup. They're dropped once the page they're packed
+into is handed out again, its number is reused for other pages afterwards:
+until then a snapshot can still read them, see `KV.BeginRead`.
+*/
+
+// The `PageStore` of a file whose pages are packed, see `META_FLAG_COMPRESSED`.
+type compressStore struct {
+	*fileStore
+	live    map[uint64]int    // pages of the tree left in each packed page
+	pending map[uint64]int    // changes to `live` made by the update
+	nodes   map[uint64][]byte // pages of the tree written by the update
+	pack    struct {
+		ptr  uint64 // page of the file being packed by the update, 0 for none
+		page []byte
+	}
+	zw  *flate.Writer
+	buf bytes.Buffer
+
+	// of the readers, see `UNPACKED_PAGES`
+	unpacked struct {
+		mu    sync.Mutex
+		pages map[uint64][]byte
+		order []uint64 // oldest first, some of them dropped already
+		max   int      // pages kept at most, fewer under `KV.MemoryLimit`
+	}
+}
+
+// readers of compressed pages, shared by the goroutines reading the tree
+var flateReaders = sync.Pool{
+	New: func() any { return flate.NewReader(nil) },
+}
+
+// Wraps a file whose meta page has `META_FLAG_COMPRESSED`, counting the pages
+// packed into each page of the file.
+func newCompressStore(fs *fileStore) (cs *compressStore, err error) {
+	defer recoverCorrupt(&err)
+
+	cs = &compressStore{
+		fileStore: fs,
+		live:      map[uint64]int{},
+		pending:   map[uint64]int{},
+		nodes:     map[uint64][]byte{},
+	}
+	cs.zw, _ = flate.NewWriter(&cs.buf, flate.BestSpeed)
+	cs.unpacked.pages = map[uint64][]byte{}
+	cs.unpacked.max = fs.unpackedPages()
+
+	tree, err := btree.New(fs.treeConfig(fs.root, fs.readTree))
+	if err != nil {
+		return nil, err
+	}
+	for _, ptr := range tree.Pages() {
+		if ptr&PACK_SLOTS != 0 {
+			cs.live[ptr>>PACK_BITS]++
+		}
+	}
+	return cs, nil
+}
+
+func (cs *compressStore) ReadPage(ptr uint64) []byte {
+	if node, ok := cs.nodes[ptr]; ok {
+		return node
+	}
+	if ptr&PACK_SLOTS == 0 {
+		return cs.fileStore.ReadPage(ptr >> PACK_BITS)
+	}
+
+	u := &cs.unpacked
+	u.mu.Lock()
+	node, ok := u.pages[ptr]
+	u.mu.Unlock()
+	if ok {
+		return node
+	}
+	node = unpackPage(cs.fileStore.ReadPage, ptr)
+	u.mu.Lock()
+	cs.keepUnpacked(ptr, node)
+	u.mu.Unlock()
+	return node
+}
+
+// Keeps a page uncompressed, dropping the oldest one past `UNPACKED_PAGES`, or
+// fewer under a memory limit.
+func (cs *compressStore) keepUnpacked(ptr uint64, node []byte) {
+	u := &cs.unpacked
+	if _, ok := u.pages[ptr]; !ok {
+		u.pages[ptr] = node
+		u.order = append(u.order, ptr)
+	}
+	for len(u.pages) > u.max {
+		delete(u.pages, u.order[0])
+		u.order = u.order[1:]
+	}
+	if len(u.order) > 2*max(u.max, 1) {
+		u.order = slices.DeleteFunc(u.order, func(ptr uint64) bool {
+			_, ok := u.pages[ptr]
+			return !ok
+		})
+	}
+}
+
+// Packs the page into the one being packed, or into a new one, if it
+// compresses well, else writes it as is. The packed page is filled until the
+// update is flushed.
+func (cs *compressStore) AllocPage(node []byte) uint64 {
+	cs.buf.Reset()
+	cs.zw.Reset(&cs.buf)
+	cs.zw.Write(node)
+	cs.zw.Close()
+	if cs.buf.Len() > PACK_MAX_SIZE {
+		return cs.fileStore.AllocPage(node) << PACK_BITS
+	}
+
+	page := cs.pack.page
+	n := 0
+	if cs.pack.ptr != 0 {
+		n = int(binary.LittleEndian.Uint16(page))
+	}
+	if cs.pack.ptr == 0 || n == PACK_SLOTS || packEnd(page, n)+cs.buf.Len() > PAGE_SIZE-cs.Reserved() {
+		page = make([]byte, PAGE_SIZE)
+		cs.pack.ptr, cs.pack.page = cs.fileStore.AllocPage(page), page
+		cs.dropUnpacked(cs.pack.ptr)
+		n = 0
+	}
+	end := packEnd(page, n) + copy(page[packEnd(page, n):], cs.buf.Bytes())
+	n++
+	binary.LittleEndian.PutUint16(page, uint16(n))
+	binary.LittleEndian.PutUint16(page[2*n:], uint16(end))
+
+	ptr := cs.pack.ptr<<PACK_BITS | uint64(n)
+	cs.pending[cs.pack.ptr]++
+	cs.nodes[ptr] = node
+	return ptr
+}
+
+// Frees the page of the file once no page of the tree is left in it.
+func (cs *compressStore) FreePage(ptr uint64) {
+	file := ptr >> PACK_BITS
+	if ptr&PACK_SLOTS == 0 {
+		cs.fileStore.FreePage(file)
+		return
+	}
+
+	delete(cs.nodes, ptr)
+	cs.pending[file]--
+	if cs.live[file]+cs.pending[file] > 0 {
+		return
+	}
+	if file == cs.pack.ptr {
+		cs.pack.ptr, cs.pack.page = 0, nil
+	}
+	cs.fileStore.FreePage(file)
+}
+
+// Drops the pages that were packed into a page of the file handed out again.
+func (cs *compressStore) dropUnpacked(file uint64) {
+	cs.unpacked.mu.Lock()
+	defer cs.unpacked.mu.Unlock()
+	for slot := range uint64(PACK_SLOTS) {
+		delete(cs.unpacked.pages, file<<PACK_BITS|(slot+1))
+	}
+}
+
+func (cs *compressStore) Flush(root uint64) error {
+	err := cs.fileStore.Flush(root)
+	if err == nil {
+		for file, n := range cs.pending {
+			if cs.live[file] += n; cs.live[file] == 0 {
+				delete(cs.live, file)
+			}
+		}
+		// the next update reads the top of the tree this one wrote
+		cs.unpacked.mu.Lock()
+		for ptr, node := range cs.nodes {
+			cs.keepUnpacked(ptr, node)
+		}
+		cs.unpacked.mu.Unlock()
+	}
+	cs.reset()
+	return err
+}
+
+func (cs *compressStore) Abort() {
+	cs.fileStore.Abort()
+	cs.reset()
+}
+
+// Drops what the update packed.
+func (cs *compressStore) reset() {
+	clear(cs.pending)
+	clear(cs.nodes)
+	cs.pack.ptr, cs.pack.page = 0, nil
+}
+
+// Also moves the pages of the tree packed into a page of the file with few
+// others left, counting them as packed as the others once they're moved.
+func (cs *compressStore) LimitPages() (func(ptr uint64) bool, error) {
+	used, err := cs.usedPages()
+	if err != nil {
+		return nil, err
+	}
+	sparse := map[uint64]bool{} // the ones packed by the move aren't moved again
+	moved, dense, packed := 0, 0, 0
+	for file, n := range cs.live {
+		if n <= PACK_SPARSE {
+			sparse[file] = true
+			moved += n
+		} else {
+			dense, packed = dense+1, packed+n
+		}
+	}
+	per := PACK_SLOTS / 2
+	if dense > 0 {
+		per = packed / dense
+	}
+
+	// they may not fit under the limit before they're moved, the pages they
+	// leave are freed along the way
+	move := cs.limitPages(used - uint64(len(sparse)) + uint64((moved+per-1)/per))
+	return cs.rekeyPages(func(ptr uint64) bool {
+		return move(ptr) || ptr&PACK_SLOTS != 0 && sparse[ptr>>PACK_BITS]
+	})
+}
+
+func (cs *compressStore) Prefetch(ptrs []uint64) {
+	cs.fileStore.Prefetch(cs.filePages(ptrs))
+}
+
+// Returns the end of the last of the first `n` pages packed into `page`.
+func packEnd(page []byte, n int) int {
+	if n == 0 {
+		return PACK_HEADER
+	}
+	return int(binary.LittleEndian.Uint16(page[2*n:]))
+}
+
+// Returns a page of the tree, reading the page of the file it's in with
+// `read` and uncompressing it if it's packed.
+func unpackPage(read func(uint64) []byte, ptr uint64) []byte {
+	file, slot := ptr>>PACK_BITS, int(ptr&PACK_SLOTS)
+	page := read(file)
+	if slot == 0 {
+		return page
+	}
+
+	n := int(binary.LittleEndian.Uint16(page))
+	start, end := packEnd(page, slot-1), packEnd(page, slot)
+	if slot > n || n > PACK_SLOTS || start > end || end > PAGE_SIZE {
+		panic(fmt.Errorf("%w: page %d of the file packs %d pages, slot %d at [%d, %d)", btree.ErrCorrupt, file, n, slot, start, end))
+	}
+
+	zr := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(zr)
+	zr.(flate.Resetter).Reset(bytes.NewReader(page[start:end]), nil)
+	node := make([]byte, PAGE_SIZE)
+	if _, err := io.ReadFull(zr, node); err != nil {
+		panic(fmt.Errorf("%w: page %d of the file, slot %d: %v", btree.ErrCorrupt, file, slot, err))
+	}
+	return node
+}
+
+// Returns the page of the file holding a page of the tree.
+func filePage(flags uint16, ptr uint64) uint64 {
+	if flags&META_FLAG_COMPRESSED != 0 {
+		return ptr >> PACK_BITS
+	}
+	return ptr
+}
+
+func (fs *fileStore) filePage(ptr uint64) uint64 {
+	return filePage(fs.meta.flags, ptr)
+}
+
+// Returns the config of a tree on the pages of the file, read with `get`.
+func (fs *fileStore) treeConfig(root uint64, get func(uint64) []byte) btree.Config {
+	return btree.Config{PageSize: PAGE_SIZE, Reserved: fs.Reserved(), Root: root, Get: get}
+}
+
+// Reads a page of the tree, which is packed in a compressed file.
+func (fs *fileStore) readTree(ptr uint64) []byte {
+	if fs.meta.flags&META_FLAG_COMPRESSED == 0 {
+		return fs.ReadPage(ptr)
+	}
+	return unpackPage(fs.ReadPage, ptr)
+}
+
+// Returns the pages of the file holding pages of the tree, in order, each
+// once.
+func (fs *fileStore) filePages(ptrs []uint64) []uint64 {
+	if fs.meta.flags&META_FLAG_COMPRESSED == 0 {
+		return ptrs
+	}
+	files := make([]uint64, len(ptrs))
+	for i, ptr := range ptrs {
+		files[i] = ptr >> PACK_BITS
+	}
+	slices.Sort(files)
+	return slices.Compact(files)
+}
@@ -0,0 +1,144 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Text packs into a fraction of the pages, and the file stays whole through
+// updates, reopening without the option, a crash, compaction and a backup:
+// every page of the file is either packed pages of the tree, one of the tree
+// as is, or free.
+func TestCompress(t *testing.T) {
+	words := strings.Fields("the quick brown fox jumps over the lazy dog while a database packs its pages")
+	text := func(i, n int) string {
+		var sb strings.Builder
+		for sb.Len() < n {
+			sb.WriteString(words[(i+sb.Len())%len(words)])
+			sb.WriteByte(' ')
+		}
+		return sb.String()
+	}
+
+	for _, opts := range []struct {
+		wal   bool
+		cache int
+	}{{}, {wal: true}, {cache: 64 * PAGE_SIZE}} {
+		name := fmt.Sprintf("wal %v, cache %d", opts.wal, opts.cache)
+		dir := t.TempDir()
+		open := func(path string, compress bool) (*KV, *fileStore) {
+			t.Helper()
+			db := &KV{Path: path, Sync: SyncNone, WAL: opts.wal, CacheSize: opts.cache, Compress: compress}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			if cs, ok := db.store.(*compressStore); ok {
+				return db, cs.fileStore
+			}
+			return db, db.store.(*fileStore)
+		}
+		check := func(db *KV, fs *fileStore, want map[string]string) {
+			t.Helper()
+			checkKV(t, db, want)
+			if n := db.tree.Len(); n != uint64(len(want)) {
+				t.Fatalf("%s: %d keys, want %d", name, n, len(want))
+			}
+			if err := db.tree.Verify(); err != nil {
+				t.Fatal(err)
+			}
+			if used := 1 + len(fs.filePages(db.tree.Pages())) + freePages(t, fs); uint64(used) != fs.page.flushed {
+				t.Fatalf("%s: %d pages found, %d used", name, used, fs.page.flushed)
+			}
+			if cs, ok := db.store.(*compressStore); ok {
+				packed := map[uint64]int{}
+				for _, ptr := range db.tree.Pages() {
+					if ptr&PACK_SLOTS != 0 {
+						packed[ptr>>PACK_BITS]++
+					}
+				}
+				if fmt.Sprint(packed) != fmt.Sprint(cs.live) {
+					t.Fatalf("%s: %d packed pages counted, %d in the tree", name, len(cs.live), len(packed))
+				}
+			}
+		}
+
+		path, plain := filepath.Join(dir, "test.db"), filepath.Join(dir, "plain.db")
+		db, fs := open(path, true)
+		other, otherFS := open(plain, false)
+		want := map[string]string{}
+		update := func(n int) {
+			t.Helper()
+			for i := range n {
+				key := fmt.Sprintf("key%05d", (len(want)*7+i*13)%4000)
+				if i%4 == 0 {
+					delete(want, key)
+					for _, db := range []*KV{db, other} {
+						if _, err := db.Del([]byte(key)); err != nil {
+							t.Fatal(err)
+						}
+					}
+					continue
+				}
+				val := text(i, 200)
+				if i%100 == 1 {
+					val = text(i, 3*PAGE_SIZE)
+				}
+				want[key] = val
+				for _, db := range []*KV{db, other} {
+					if err := db.Set([]byte(key), []byte(val)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+		}
+		update(4000)
+		check(db, fs, want)
+		check(other, otherFS, want)
+		// packed again by `Compact`, with the ones written by single keys
+		for _, db := range []*KV{db, other} {
+			if err := db.Compact(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		check(db, fs, want)
+		if fs.page.flushed > otherFS.page.flushed/3 {
+			t.Fatalf("%s: %d pages packed, %d as is", name, fs.page.flushed, otherFS.page.flushed)
+		}
+		defer other.Close()
+
+		// the file keeps the option it was created with
+		db.Close()
+		db, fs = open(path, false)
+		if _, ok := db.store.(*compressStore); !ok {
+			t.Fatalf("%s: not packed once reopened", name)
+		}
+		check(db, fs, want)
+		update(1000)
+		check(db, fs, want)
+
+		crashKV(db)
+		db, fs = open(path, true)
+		check(db, fs, want)
+
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		check(db, fs, want)
+
+		var buf bytes.Buffer
+		if _, err := db.Backup(&buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		restored := filepath.Join(dir, "restored.db")
+		if _, err := ApplyBackup(restored, &buf); err != nil {
+			t.Fatal(err)
+		}
+		db, fs = open(restored, false)
+		check(db, fs, want)
+		db.Close()
+	}
+}
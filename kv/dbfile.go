@@ -0,0 +1,38 @@
+package kv
+
+import (
+	"io"
+	"os"
+)
+
+/*
+The database file and the WAL are read, written and synced through `dbFile`.
+It's the *os.File itself, but for the tests, which wrap it with
+`KV.wrapFile` to fail, drop or tear writes and check what a crash leaves.
+The lock is taken on the *os.File before it's wrapped, and a wrapped database
+file is read into the buffer pool, never mapped: the writes through the
+mapping would go around the wrapper.
+*/
+
+// A file of the database, see `KV.wrapFile`.
+type dbFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Close() error
+}
+
+// Wraps a file opened for the database, see `KV.wrapFile`.
+func (fs *fileStore) wrapFile(fp *os.File) dbFile {
+	if fs.wrap == nil {
+		return fp
+	}
+	return fs.wrap(fp)
+}
+
+// Returns the file under a mapping, which is never wrapped.
+func (fs *fileStore) osFile() *os.File {
+	return fs.fp.(*os.File)
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package kv
+
+import "os"
+
+// Flushes a directory, so that the files renamed into it are there after a
+// crash.
+func SyncDir(dir string) error {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	return fp.Sync()
+}
@@ -0,0 +1,7 @@
+package kv
+
+// Directories can't be flushed on Windows, a rename is made durable by the
+// journal of the file system instead.
+func SyncDir(dir string) error {
+	return nil
+}
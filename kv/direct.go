@@ -0,0 +1,83 @@
+package kv
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"unsafe"
+)
+
+// alignment of the buffers of direct I/O, the largest logical block size of
+// common disks
+const DIRECT_IO_ALIGN = 4096
+
+// default `KV.CacheSize` with `KV.DirectIO`
+const CACHE_SIZE = 64 << 20
+
+/*
+With `KV.DirectIO` set, the file is read and written around the OS page
+cache: the buffer pool is the only cache of its pages, instead of caching
+them a second time. It takes buffers aligned to the disk blocks, the pages go
+through one on the way to the pool. Only whole pages are written, the meta
+page included. Where there is no direct I/O, or the file system doesn't take
+it, the file is opened as usual, see `Stats.DirectIO`.
+*/
+
+// aligned pages for direct I/O
+var alignedPages = sync.Pool{New: func() any { return alignedPage() }}
+
+// Allocates a page aligned to `DIRECT_IO_ALIGN`. The Go heap doesn't move.
+func alignedPage() []byte {
+	buf := make([]byte, PAGE_SIZE+DIRECT_IO_ALIGN)
+	off := -int(uintptr(unsafe.Pointer(&buf[0]))) & (DIRECT_IO_ALIGN - 1)
+	return buf[off : off+PAGE_SIZE]
+}
+
+// Reads a page of the file, through an aligned buffer for direct I/O.
+func (fs *fileStore) readAt(ptr uint64, page []byte) error {
+	off := int64(ptr) * PAGE_SIZE
+	if !fs.direct {
+		_, err := fs.fp.ReadAt(page, off)
+		return err
+	}
+
+	buf := alignedPages.Get().([]byte)
+	defer alignedPages.Put(buf)
+	n, err := fs.fp.ReadAt(buf, off)
+	copy(page, buf[:n])
+	return err
+}
+
+// Writes a page of the file, through an aligned buffer for direct I/O.
+func (fs *fileStore) writeAt(ptr uint64, page []byte) error {
+	off := int64(ptr) * PAGE_SIZE
+	if fs.direct {
+		buf := alignedPages.Get().([]byte)
+		defer alignedPages.Put(buf)
+		copy(buf, page)
+		page = buf
+	}
+
+	if _, err := fs.retry.WriteAt(fs.fp, page, off); err != nil {
+		return fmt.Errorf("write page %d: %w", ptr, err)
+	}
+	return nil
+}
+
+// Writes a copy of the meta page at `off` of the file. Direct I/O only writes
+// whole pages, the other copy is written again as it is.
+func (fs *fileStore) writeMetaCopy(meta []byte, off int64) error {
+	if !fs.direct {
+		fs.io.bytes.Add(uint64(len(meta)))
+		_, err := fs.retry.WriteAt(fs.fp, meta, off)
+		return err
+	}
+	fs.io.bytes.Add(PAGE_SIZE)
+
+	page := make([]byte, PAGE_SIZE)
+	if err := fs.readAt(0, page); err != nil && err != io.EOF {
+		return err
+	}
+	copy(page[off:], meta)
+	return fs.writeAt(0, page)
+}
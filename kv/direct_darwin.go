@@ -0,0 +1,18 @@
+package kv
+
+import (
+	"os"
+	"syscall"
+)
+
+// Opens the database file, with F_NOCACHE for `direct`, which keeps its pages
+// out of the OS cache without any alignment. Returns whether it's set.
+func openFile(path string, flag int, direct bool) (*os.File, bool, error) {
+	fp, err := os.OpenFile(path, flag, 0644)
+	if err != nil || !direct {
+		return fp, false, err
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fp.Fd(), syscall.F_NOCACHE, 1)
+	return fp, errno == 0, nil
+}
@@ -0,0 +1,24 @@
+package kv
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Opens the database file, with O_DIRECT for `direct` unless the file system
+// refuses it, like tmpfs. Returns whether it's opened for direct I/O.
+func openFile(path string, flag int, direct bool) (*os.File, bool, error) {
+	if direct {
+		fp, err := os.OpenFile(path, flag|syscall.O_DIRECT, 0644)
+		if err == nil {
+			return fp, true, nil
+		}
+		if !errors.Is(err, syscall.EINVAL) {
+			return nil, false, err
+		}
+	}
+
+	fp, err := os.OpenFile(path, flag, 0644)
+	return fp, false, err
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package kv
+
+import "os"
+
+// Opens the database file. There's no direct I/O here, `direct` is ignored.
+func openFile(path string, flag int, direct bool) (*os.File, bool, error) {
+	fp, err := os.OpenFile(path, flag, 0644)
+	return fp, false, err
+}
@@ -0,0 +1,51 @@
+package kv
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"unsafe"
+)
+
+// A database opened for direct I/O, where it's supported, works like any
+// other, the meta page and the WAL included.
+func TestDirectIO(t *testing.T) {
+	for range 10 {
+		if page := alignedPage(); uintptr(unsafe.Pointer(&page[0]))%DIRECT_IO_ALIGN != 0 || len(page) != PAGE_SIZE {
+			t.Fatalf("page of %d bytes at %p", len(page), &page[0])
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	want := map[string]string{}
+	for _, wal := range []bool{false, true} {
+		db := &KV{Path: path, WAL: wal, DirectIO: true, CacheSize: 64 * PAGE_SIZE}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("direct I/O: %v", db.Stats().DirectIO)
+
+		for i := range 2000 {
+			key, val := fmt.Sprintf("key%05d", i%700), fmt.Sprint(wal, i)
+			if err := db.Set([]byte(key), []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = val
+		}
+		checkKV(t, db, want)
+		db.Close()
+
+		db = &KV{Path: path, DirectIO: true}
+		if err := db.OpenReadOnly(); err != nil {
+			t.Fatal(err)
+		}
+		checkKV(t, db, want)
+		if err := db.tree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+
+	// and the file reads back without it
+	checkKV(t, openTestKV(t, path), want)
+}
@@ -0,0 +1,330 @@
+package kv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"db/btree"
+)
+
+// flag of the meta page of a file whose pages are encrypted, see `KV.Key`
+const META_FLAG_ENCRYPTED = 4
+
+// bytes of a key, AES-256
+const ENCRYPT_KEY_SIZE = 32
+
+// bytes at the end of every page of an encrypted file holding its tag, nonce
+// and key number
+const ENCRYPT_RESERVED = 16 + 12 + 4
+
+// bytes of a key check in the meta page
+const KEY_CHECK_SIZE = 4 + 12 + 16
+
+var ErrBadKey = errors.New("kv: bad encryption key")
+
+/*
+With `KV.Key` set, a new file is encrypted with AES-256-GCM. Every page but
+the meta page is sealed as it's written, into the file, the WAL and the
+backups, and opened as it's read: the file is read into the buffer pool,
+never mapped. The tree and the free list leave the last `ENCRYPT_RESERVED`
+bytes of their pages for it, see `btree.Config.Reserved`.
+
+# Sealed page:
+
+	|     data      | tag | nonce | key |
+	| P - 32B       | 16B |  12B  | 4B  |
+
+`data` is the page encrypted, authenticated along with its number by `tag`,
+so that a page moved elsewhere in the file fails like a damaged one. `nonce`
+is random, and `key` the number of the key that sealed it.
+
+The meta page is left as it is, but for the key checks in it: an empty
+message sealed with a key and its number, which tells a wrong key apart from
+a damaged file.
+
+	| key | nonce | tag |
+	| 4B  |  12B  | 16B |
+
+The first check is of the key new pages are sealed with, the second of the
+key it replaces, 0s unless `KV.Rekey` is under way. The old key is needed to
+open the file until every page sealed with it is written again: `Compact`
+moves them, and once none is left it drops the old key, and writes the free
+pages over. A rekey cut short by a crash takes both keys to open the file,
+the next `Compact` ends it.
+*/
+
+// Seals the pages with `key` from now on, and seals the others again while
+// compacting the file, see `Compact`. Until it's done the file takes both
+// keys to open it, see `KV.OldKey`, and `Key` the new one afterwards. Fails
+// with `ErrBadKey` for a file that isn't encrypted, or if a rekey is under
+// way.
+func (db *KV) Rekey(key []byte) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	db.exclusive.Lock()
+	db.mu.Lock()
+	err := fmt.Errorf("%w: the store isn't encrypted", ErrBadKey)
+	if store, ok := db.store.(RekeyStore); ok {
+		err = store.Rekey(key)
+	}
+	db.mu.Unlock()
+	db.exclusive.Unlock()
+	if err != nil {
+		return err
+	}
+	return db.Compact()
+}
+
+// The check of a key in the meta page.
+type keyCheck [KEY_CHECK_SIZE]byte
+
+// Returns the number of the key, 0 for none.
+func (kc keyCheck) id() uint32 {
+	return binary.LittleEndian.Uint32(kc[:])
+}
+
+// The keys of an encrypted file, by their number.
+type pageCipher struct {
+	mu    sync.RWMutex // of the flusher and the readers, against `Rekey`
+	keys  map[uint32]cipher.AEAD
+	write uint32 // of the key new pages are sealed with
+}
+
+// pages sealed on their way to or from the file
+var sealedPages = sync.Pool{New: func() any { return make([]byte, PAGE_SIZE) }}
+
+// Sets up AES-256-GCM with a key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != ENCRYPT_KEY_SIZE {
+		return nil, fmt.Errorf("%w: %d bytes, want %d", ErrBadKey, len(key), ENCRYPT_KEY_SIZE)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns the data authenticated with a key check.
+func keyCheckData(id uint32) []byte {
+	return binary.LittleEndian.AppendUint32([]byte(DB_MAGIC), id)
+}
+
+// Seals the check of key number `id`.
+func newKeyCheck(aead cipher.AEAD, id uint32) keyCheck {
+	var kc keyCheck
+	binary.LittleEndian.PutUint32(kc[:], id)
+	rand.Read(kc[4:16])
+	aead.Seal(kc[16:16], kc[4:16], nil, keyCheckData(id))
+	return kc
+}
+
+// Returns whether `aead` has the key of the check.
+func (kc keyCheck) matches(aead cipher.AEAD) bool {
+	_, err := aead.Open(nil, kc[4:16], kc[16:], keyCheckData(kc.id()))
+	return err == nil
+}
+
+// Sets up the keys of an encrypted file from its meta page: `key` must pass
+// the first check, and `old` the second one if there is one.
+func (fs *fileStore) openKeys(key, old []byte) error {
+	if fs.meta.flags&META_FLAG_ENCRYPTED == 0 {
+		return nil
+	}
+	if key == nil {
+		return fmt.Errorf("%w: the file is encrypted", ErrBadKey)
+	}
+
+	pc := &pageCipher{keys: map[uint32]cipher.AEAD{}, write: fs.meta.keys[0].id()}
+	for i, key := range [][]byte{key, old} {
+		kc := fs.meta.keys[i]
+		if kc.id() == 0 {
+			continue
+		}
+		if key == nil {
+			return fmt.Errorf("%w: a rekey was cut short, the old key is needed", ErrBadKey)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return err
+		}
+		if !kc.matches(aead) {
+			return fmt.Errorf("%w: key %d doesn't match", ErrBadKey, kc.id())
+		}
+		pc.keys[kc.id()] = aead
+	}
+	fs.cipher = pc
+	if fs.meta.keys[1].id() != 0 {
+		// which pages were sealed with the new key isn't known, they're all
+		// moved again
+		fs.rekey.since = fs.commit
+	}
+	return nil
+}
+
+// Makes a new file encrypted with `key`, from the next meta page written.
+func (fs *fileStore) newKey(key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	fs.meta.flags |= META_FLAG_ENCRYPTED
+	fs.meta.keys[0] = newKeyCheck(aead, 1)
+	fs.cipher = &pageCipher{keys: map[uint32]cipher.AEAD{1: aead}, write: 1}
+	return nil
+}
+
+// Returns the bytes at the end of every page left for the encryption.
+func (fs *fileStore) Reserved() int {
+	if fs.cipher == nil {
+		return 0
+	}
+	return ENCRYPT_RESERVED
+}
+
+// Seals the pages with `key` from now on, see `KV.Rekey`. The WAL is
+// checkpointed first, and the meta page written with both keys.
+func (fs *fileStore) Rekey(key []byte) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	switch {
+	case fs.cipher == nil:
+		return fmt.Errorf("%w: the file isn't encrypted", ErrBadKey)
+	case fs.meta.keys[1].id() != 0:
+		return fmt.Errorf("%w: a rekey is under way, Compact ends it", ErrBadKey)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	if fs.wal != nil {
+		if err := fs.checkpoint(); err != nil {
+			return err
+		}
+	}
+
+	pc := fs.cipher
+	id := pc.write + 1
+	keys := fs.meta.keys
+	fs.meta.keys = [2]keyCheck{newKeyCheck(aead, id), keys[0]}
+	if err := fs.writeMeta(); err != nil {
+		fs.meta.keys = keys
+		return err
+	}
+
+	pc.mu.Lock()
+	pc.keys[id] = aead
+	pc.write = id
+	pc.mu.Unlock()
+	fs.rekey.since = fs.commit
+	return nil
+}
+
+// Also moves the pages of the tree written before `KV.Rekey`, which may be
+// sealed with the old key.
+func (fs *fileStore) rekeyPages(move func(ptr uint64) bool) (func(ptr uint64) bool, error) {
+	if fs.meta.keys[1].id() == 0 {
+		return move, nil
+	}
+	tree, err := btree.New(fs.treeConfig(fs.root, fs.readTree))
+	if err != nil {
+		return nil, err
+	}
+	fresh := map[uint64]bool{}
+	for _, ptr := range tree.PagesSince(fs.rekey.since) {
+		fresh[ptr] = true
+	}
+	return func(ptr uint64) bool { return move(ptr) || !fresh[ptr] }, nil
+}
+
+// Returns whether the old key is left to drop: no page of `tree`, the tree of
+// the last commit, was written before `KV.Rekey`.
+func (fs *fileStore) rekeyDone(tree *btree.BTree) bool {
+	return fs.meta.keys[1].id() != 0 && len(tree.PagesSince(fs.rekey.since)) == len(tree.Pages())
+}
+
+// Forgets the old key, from the next meta page written.
+func (fs *fileStore) dropOldKey() {
+	old := fs.meta.keys[1].id()
+	fs.meta.keys[1] = keyCheck{}
+	fs.cipher.mu.Lock()
+	delete(fs.cipher.keys, old)
+	fs.cipher.mu.Unlock()
+}
+
+// Seals a page of the file, into `sealed`.
+func (pc *pageCipher) seal(ptr uint64, page, sealed []byte) {
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+
+	n := PAGE_SIZE - ENCRYPT_RESERVED
+	nonce := sealed[n+16 : n+28]
+	rand.Read(nonce)
+	binary.LittleEndian.PutUint32(sealed[n+28:], pc.write)
+	pc.keys[pc.write].Seal(sealed[:0], nonce, page[:n], binary.LittleEndian.AppendUint64(nil, ptr))
+}
+
+// Opens a sealed page of the file into `page`, or returns an error wrapping
+// `btree.ErrCorrupt`.
+func (pc *pageCipher) open(ptr uint64, sealed, page []byte) error {
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+
+	n := PAGE_SIZE - ENCRYPT_RESERVED
+	id := binary.LittleEndian.Uint32(sealed[n+28:])
+	aead := pc.keys[id]
+	if aead == nil {
+		return fmt.Errorf("%w: page %d sealed with key %d", btree.ErrCorrupt, ptr, id)
+	}
+	if _, err := aead.Open(page[:0], sealed[n+16:n+28], sealed[:n+16], binary.LittleEndian.AppendUint64(nil, ptr)); err != nil {
+		return fmt.Errorf("%w: page %d fails authentication", btree.ErrCorrupt, ptr)
+	}
+	clear(page[n:])
+	return nil
+}
+
+// Returns a page sealed for the WAL or a backup, or the page itself in a file
+// that isn't encrypted.
+func (fs *fileStore) sealPage(ptr uint64, page []byte) []byte {
+	if fs.cipher == nil {
+		return page
+	}
+	sealed := make([]byte, PAGE_SIZE)
+	fs.cipher.seal(ptr, page, sealed)
+	return sealed
+}
+
+// Reads a page of the file into the buffer pool, opening it in an encrypted
+// file.
+func (fs *fileStore) loadPage(ptr uint64, page []byte) error {
+	if fs.cipher == nil {
+		return fs.readAt(ptr, page)
+	}
+	sealed := sealedPages.Get().([]byte)
+	defer sealedPages.Put(sealed)
+	if err := fs.readAt(ptr, sealed); err != nil {
+		return err
+	}
+	return fs.cipher.open(ptr, sealed, page)
+}
+
+// Writes a page of the buffer pool into the file, sealing it in an encrypted
+// file.
+func (fs *fileStore) storePage(ptr uint64, page []byte) error {
+	fs.countPage()
+	if fs.cipher == nil {
+		return fs.writeAt(ptr, page)
+	}
+	sealed := sealedPages.Get().([]byte)
+	defer sealedPages.Put(sealed)
+	fs.cipher.seal(ptr, page, sealed)
+	return fs.writeAt(ptr, sealed)
+}
@@ -0,0 +1,212 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"db/btree"
+)
+
+// No plaintext reaches the file, the WAL or a backup, and the file only opens
+// with its key. A page damaged or moved fails to open. A rekey seals every
+// page again, and one cut short by a crash takes both keys until `Compact`
+// ends it.
+func TestEncrypt(t *testing.T) {
+	keys := make([][]byte, 4)
+	for i := range keys {
+		keys[i] = bytes.Repeat([]byte{byte(i + 1)}, ENCRYPT_KEY_SIZE)
+	}
+	secret := []byte("top secret")
+
+	for _, opts := range []struct {
+		wal      bool
+		compress bool
+	}{{}, {wal: true}, {compress: true}} {
+		name := fmt.Sprintf("wal %v, compress %v", opts.wal, opts.compress)
+		dir := t.TempDir()
+		path := filepath.Join(dir, "test.db")
+		open := func(path string, key, old []byte) (*KV, *fileStore, error) {
+			t.Helper()
+			db := &KV{Path: path, Sync: SyncNone, WAL: opts.wal, Compress: opts.compress, Key: key, OldKey: old}
+			if err := db.Open(); err != nil {
+				return nil, nil, err
+			}
+			if cs, ok := db.store.(*compressStore); ok {
+				return db, cs.fileStore, nil
+			}
+			return db, db.store.(*fileStore), nil
+		}
+		mustOpen := func(path string, key, old []byte) (*KV, *fileStore) {
+			t.Helper()
+			db, fs, err := open(path, key, old)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			return db, fs
+		}
+		noSecret := func(what string, data []byte) {
+			t.Helper()
+			if bytes.Contains(data, secret) {
+				t.Fatalf("%s: plaintext in the %s", name, what)
+			}
+		}
+		noSecretIn := func(path string) {
+			t.Helper()
+			data, err := os.ReadFile(path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				t.Fatal(err)
+			}
+			noSecret(filepath.Base(path), data)
+		}
+		check := func(db *KV, fs *fileStore, want map[string]string) {
+			t.Helper()
+			checkKV(t, db, want)
+			if err := db.tree.Verify(); err != nil {
+				t.Fatal(err)
+			}
+			if used := 1 + len(fs.filePages(db.tree.Pages())) + freePages(t, fs); uint64(used) != fs.page.flushed {
+				t.Fatalf("%s: %d pages found, %d used", name, used, fs.page.flushed)
+			}
+		}
+
+		db, fs := mustOpen(path, keys[0], nil)
+		want := map[string]string{}
+		update := func(n int) {
+			t.Helper()
+			for i := range n {
+				key := fmt.Sprintf("%s %05d", secret, (len(want)*7+i*13)%3000)
+				if i%4 == 0 {
+					if _, err := db.Del([]byte(key)); err != nil {
+						t.Fatal(err)
+					}
+					delete(want, key)
+					continue
+				}
+				val := fmt.Sprintf("%s %d", secret, i)
+				if i%100 == 1 {
+					val = strings.Repeat(val, PAGE_SIZE/len(val)*2)
+				}
+				if err := db.Set([]byte(key), []byte(val)); err != nil {
+					t.Fatal(err)
+				}
+				want[key] = val
+			}
+		}
+		update(3000)
+		check(db, fs, want)
+		noSecretIn(path)
+		noSecretIn(path + WAL_SUFFIX)
+		db.Close()
+		noSecretIn(path)
+
+		for _, test := range []struct {
+			name     string
+			key, old []byte
+		}{{"no key", nil, nil}, {"wrong key", keys[1], nil}, {"short key", keys[0][:16], nil}} {
+			if _, _, err := open(path, test.key, test.old); !errors.Is(err, ErrBadKey) {
+				t.Fatalf("%s: open with %s: %v", name, test.name, err)
+			}
+		}
+		plain := filepath.Join(dir, "plain.db")
+		openTestKV(t, plain).Close()
+		if _, _, err := open(plain, keys[0], nil); !errors.Is(err, ErrBadKey) {
+			t.Fatalf("%s: open a plain file with a key: %v", name, err)
+		}
+
+		// a page damaged, or another one in its place, fails
+		db, fs = mustOpen(path, keys[0], nil)
+		ptr := fs.filePage(db.tree.Root())
+		db.Close()
+		orig, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, damage := range []func(data []byte){
+			func(data []byte) { data[ptr*PAGE_SIZE+100] ^= 1 },
+			func(data []byte) { copy(data[ptr*PAGE_SIZE:][:PAGE_SIZE], data[(ptr+1)*PAGE_SIZE:]) },
+		} {
+			data := bytes.Clone(orig)
+			damage(data)
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			// on open if the tree is walked to count the packed pages
+			db, _, err := open(path, keys[0], nil)
+			if err == nil {
+				err = db.Export(io.Discard)
+				db.Close()
+			}
+			if !errors.Is(err, btree.ErrCorrupt) {
+				t.Fatalf("%s: read a damaged page: %v", name, err)
+			}
+		}
+		if err := os.WriteFile(path, orig, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// the pages sealed with the old key are moved, and the free ones
+		// written over
+		db, fs = mustOpen(path, keys[0], nil)
+		update(500)
+		if err := db.Rekey(keys[1]); err != nil {
+			t.Fatal(err)
+		}
+		if fs.meta.keys[1].id() != 0 || len(fs.cipher.keys) != 1 {
+			t.Fatalf("%s: %d keys left after a rekey", name, len(fs.cipher.keys))
+		}
+		check(db, fs, want)
+		update(500)
+		db.Close()
+		if _, _, err := open(path, keys[0], nil); !errors.Is(err, ErrBadKey) {
+			t.Fatalf("%s: open with the old key: %v", name, err)
+		}
+		db, fs = mustOpen(path, keys[1], nil)
+		check(db, fs, want)
+
+		// cut short
+		if err := fs.Rekey(keys[2]); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Rekey(keys[3]); !errors.Is(err, ErrBadKey) {
+			t.Fatalf("%s: rekey during a rekey: %v", name, err)
+		}
+		update(500)
+		crashKV(db)
+		if _, _, err := open(path, keys[2], nil); !errors.Is(err, ErrBadKey) {
+			t.Fatalf("%s: open without the old key: %v", name, err)
+		}
+		db, fs = mustOpen(path, keys[2], keys[1])
+		check(db, fs, want)
+		update(500)
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		check(db, fs, want)
+		db.Close()
+		db, fs = mustOpen(path, keys[2], nil)
+		check(db, fs, want)
+
+		var buf bytes.Buffer
+		if _, err := db.Backup(&buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		noSecret("backup", buf.Bytes())
+		db.Close()
+		restored := filepath.Join(dir, "restored.db")
+		if _, err := ApplyBackup(restored, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := open(restored, nil, nil); !errors.Is(err, ErrBadKey) {
+			t.Fatalf("%s: open a backup without the key: %v", name, err)
+		}
+		db, fs = mustOpen(restored, keys[2], nil)
+		check(db, fs, want)
+		db.Close()
+	}
+}
@@ -0,0 +1,492 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"db/btree"
+)
+
+// first bytes of an export
+const EXPORT_MAGIC = "BYODB\x00ex"
+
+// of the export format, which doesn't change with the one of the file
+const EXPORT_VERSION = 2
+
+// bytes of pairs after which an export starts a new chunk
+const EXPORT_CHUNK_SIZE = 64 << 10
+
+var ErrBadExport = errors.New("kv: bad export")
+
+/*
+A backup is made of pages, it's only read by a database of the same version
+and page size. An export holds the key-value pairs alone, in key order, so
+that a database can be moved to another version of the file, or to a machine
+that lays it out differently: `Import` builds the tree anew with
+`btree.BTree.BulkLoad`, packing every leaf.
+
+# Export:
+
+	| magic | version | chunks |  end  | nchunks |       index       | count | crc32 |
+	|  8B   |   2B    |  ...   |  4B   |   8B    | nchunks * (8B+8B) |  8B   |  4B   |
+
+# Chunk:
+
+	| npairs |         pairs          | crc32 |
+	|   4B   | n * (4B+4B+key+value)  |  4B   |
+
+`magic` is `EXPORT_MAGIC` and `version` is `EXPORT_VERSION`. The pairs are
+cut in chunks of about `EXPORT_CHUNK_SIZE` bytes, each checked by its own
+checksum. Each pair is the length of its key, then of its value, then both.
+`end` is the largest number of pairs, which no chunk has. The index lists the
+offset of every chunk in the export and its number of pairs, `count` is the
+number of pairs of the export. Numbers are
+little-endian, the last checksum covers the footer from `end`.
+
+A transfer cut short can go on from the last chunk received, see
+`ImportInto`: the chunks of the index that are read again have to be the
+same.
+
+Exports of version 1 are read by `Import`, their pairs aren't in chunks, and
+a checksum after `count` covers the rest of the export.
+*/
+
+// Writes every key-value pair of the database to `w`, see `Import`. Updates
+// wait for it to end.
+func (db *KV) Export(w io.Writer) (err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	bw := bufio.NewWriter(w)
+	header := make([]byte, 10)
+	copy(header, EXPORT_MAGIC)
+	binary.LittleEndian.PutUint16(header[8:], EXPORT_VERSION)
+	bw.Write(header)
+
+	offset := uint64(len(header))
+	count := uint64(0)
+	var index, chunk []byte
+	npairs := uint32(0)
+	flush := func() error {
+		binary.LittleEndian.PutUint32(chunk, npairs)
+		chunk = binary.LittleEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk))
+		index = binary.LittleEndian.AppendUint64(index, offset)
+		index = binary.LittleEndian.AppendUint64(index, uint64(npairs))
+		offset += uint64(len(chunk))
+		if _, err := bw.Write(chunk); err != nil {
+			return fmt.Errorf("write export: %w", err)
+		}
+		chunk, npairs = chunk[:0], 0
+		return nil
+	}
+	for key, val := range db.tree.Scan(nil) {
+		val = db.loadVal(val)
+		if npairs == 0 {
+			chunk = append(chunk, 0, 0, 0, 0) // npairs
+		}
+		chunk = binary.LittleEndian.AppendUint32(chunk, uint32(len(key)))
+		chunk = binary.LittleEndian.AppendUint32(chunk, uint32(len(val)))
+		chunk = append(chunk, key...)
+		chunk = append(chunk, val...)
+		npairs++
+		count++
+		if len(chunk) >= EXPORT_CHUNK_SIZE {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if npairs > 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+
+	footer := binary.LittleEndian.AppendUint32(nil, math.MaxUint32)
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(len(index)/16))
+	footer = append(footer, index...)
+	footer = binary.LittleEndian.AppendUint64(footer, count)
+	footer = binary.LittleEndian.AppendUint32(footer, crc32.ChecksumIEEE(footer))
+	bw.Write(footer)
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("write export: %w", err)
+	}
+	return nil
+}
+
+// Loads the key-value pairs written by `Export` into the database, which must
+// be empty, in a single update: nothing is kept if the export is damaged.
+// Each pair is streamed as a set to `KV.Changes` once it's committed, so the
+// changes are held until then. Fails with `btree.ErrNotEmpty` for a database
+// with keys.
+func (db *KV) Import(r io.Reader) error {
+	er := newExportReader(r, 0)
+	version, err := er.readHeader()
+	if err != nil {
+		return err
+	}
+
+	var count, size uint64
+	var changes []Change
+	// an error reading the pairs is left in err, which stops the load
+	pairs := func(yield func(key, val []byte) bool) {
+		pair := func(key, val []byte) error {
+			count++
+			size += uint64(len(key) + len(val))
+			stored, err := db.storeVal(val)
+			if err != nil {
+				return err
+			}
+			if !yield(key, stored) {
+				return errStopImport
+			}
+			if db.Changes != nil {
+				changes = append(changes, Change{Kind: CHANGE_SET, Key: bytes.Clone(key), Val: bytes.Clone(val)})
+			}
+			return nil
+		}
+		if version == 1 {
+			err = er.readPairsV1(pair)
+			return
+		}
+
+		var chunks []exportChunk
+		for {
+			var chunk exportChunk
+			var end bool
+			if chunk, end, err = er.readChunk(pair); err != nil || end {
+				break
+			}
+			chunks = append(chunks, chunk)
+		}
+		if err == nil {
+			err = er.readFooter(chunks, count)
+		}
+	}
+
+	err = db.updateStreamed(func() error {
+		db.hot.clear()
+		if loadErr := db.tree.BulkLoad(pairs, 1); loadErr != nil {
+			return loadErr
+		}
+		if err != nil {
+			// the pairs read before it stopped were loaded
+			if _, delErr := db.tree.DeleteRange(nil, nil); delErr != nil {
+				return delErr
+			}
+		}
+		return err
+	}, &changes)
+	if err == nil {
+		db.logical.Add(size)
+	}
+	return err
+}
+
+// Loads the key-value pairs written by `Export` into the database, which can
+// have other keys, one chunk at a time: each chunk is checked and written in
+// its own update. `r` is read from `resumeFrom` on, 0 for the start of the
+// export, or the offset a previous import of the same export stopped at.
+// Returns the offset to go on from: that of the first chunk that wasn't
+// loaded, or the end of the export once it's all in.
+//
+// A chunk whose pairs are all in the database is skipped without writing, so
+// that going on from an earlier offset loads the export once. The pairs of a
+// chunk written are streamed as sets to `KV.Changes`, replacing the values
+// of the keys that were there. Fails with `ErrBadExport` for a damaged chunk
+// or one that isn't in the index.
+func (db *KV) ImportInto(r io.Reader, resumeFrom int64) (int64, error) {
+	er := newExportReader(r, resumeFrom)
+	if resumeFrom == 0 {
+		version, err := er.readHeader()
+		if err != nil {
+			return 0, err
+		}
+		if version != EXPORT_VERSION {
+			return 0, fmt.Errorf("%w: version %d isn't in chunks", ErrBadExport, version)
+		}
+	}
+
+	var chunks []exportChunk
+	var count uint64
+	for {
+		start := er.offset
+		var pairs []btree.KV
+		var size uint64
+		chunk, end, err := er.readChunk(func(key, val []byte) error {
+			pairs = append(pairs, btree.KV{Key: key, Val: bytes.Clone(val)})
+			size += uint64(len(key) + len(val))
+			return nil
+		})
+		if err != nil {
+			return start, err
+		}
+		if end {
+			if err := er.readFooter(chunks, count); err != nil {
+				return start, err
+			}
+			return er.offset, nil
+		}
+		if err := db.importChunk(pairs, size); err != nil {
+			return start, err
+		}
+		chunks = append(chunks, chunk)
+		count += uint64(len(pairs))
+	}
+}
+
+// Writes the pairs of a chunk of an export in an update, unless they're all
+// in the database already.
+func (db *KV) importChunk(pairs []btree.KV, size uint64) error {
+	loaded := true
+	for _, pair := range pairs {
+		if val, ok := db.Get(pair.Key); !ok || !bytes.Equal(val, pair.Val) {
+			loaded = false
+			break
+		}
+	}
+	if loaded {
+		return nil
+	}
+
+	var changes []Change
+	err := db.updateStreamed(func() error {
+		db.hot.clear()
+		stored := make([]btree.KV, len(pairs))
+		for i, pair := range pairs {
+			val, err := db.storeVal(pair.Val)
+			if err != nil {
+				return err
+			}
+			stored[i] = btree.KV{Key: pair.Key, Val: val}
+		}
+		if err := db.tree.PutMany(stored); err != nil {
+			return err
+		}
+		if db.Changes != nil {
+			for _, pair := range pairs {
+				changes = append(changes, Change{Kind: CHANGE_SET, Key: pair.Key, Val: pair.Val})
+			}
+		}
+		return nil
+	}, &changes)
+	if err == nil {
+		db.logical.Add(size)
+	}
+	return err
+}
+
+// stops reading an export when the load doesn't take more pairs
+var errStopImport = errors.New("kv: import stopped")
+
+// A chunk of an export, as listed by the index.
+type exportChunk struct {
+	offset uint64
+	npairs uint64
+}
+
+// Reads an export, checking what it reads.
+type exportReader struct {
+	br     *bufio.Reader
+	crc    hash.Hash32 // of what's read since `checkSum`
+	offset int64       // in the export, of the next byte
+}
+
+func newExportReader(r io.Reader, offset int64) *exportReader {
+	return &exportReader{br: bufio.NewReader(r), crc: crc32.NewIEEE(), offset: offset}
+}
+
+func (er *exportReader) read(buf []byte) error {
+	if _, err := io.ReadFull(er.br, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("read export: %w", err)
+	}
+	er.crc.Write(buf)
+	er.offset += int64(len(buf))
+	return nil
+}
+
+// Reads the checksum of what was read since the last one and checks it.
+func (er *exportReader) checkSum() error {
+	sum := er.crc.Sum32()
+	var stored [4]byte
+	if err := er.read(stored[:]); err != nil {
+		return err
+	}
+	er.crc.Reset()
+	if binary.LittleEndian.Uint32(stored[:]) != sum {
+		return fmt.Errorf("%w: checksum mismatch at %d", ErrBadExport, er.offset-4)
+	}
+	return nil
+}
+
+// Reads the magic and version of the export, returns the version.
+func (er *exportReader) readHeader() (uint16, error) {
+	header := make([]byte, 10)
+	if err := er.read(header); err != nil {
+		return 0, err
+	}
+	if string(header[:8]) != EXPORT_MAGIC {
+		return 0, fmt.Errorf("%w: magic %q", ErrBadExport, header[:8])
+	}
+	version := binary.LittleEndian.Uint16(header[8:])
+	if version != 1 && version != EXPORT_VERSION {
+		return 0, fmt.Errorf("%w: version %d, want %d", ErrUnsupportedVersion, version, EXPORT_VERSION)
+	}
+	if version != 1 {
+		// chunks are checked on their own
+		er.crc.Reset()
+	}
+	return version, nil
+}
+
+// Reads a pair, unless it's the end of the pairs of a version 1 export. The
+// value is only valid until the next call.
+func (er *exportReader) readPair(val *bytes.Buffer) (key []byte, end bool, err error) {
+	var lens [8]byte
+	if err := er.read(lens[:4]); err != nil {
+		return nil, false, err
+	}
+	klen := binary.LittleEndian.Uint32(lens[0:])
+	if klen == math.MaxUint32 {
+		return nil, true, nil
+	}
+	if klen > btree.BTREE_MAX_KEY_SIZE {
+		return nil, false, fmt.Errorf("%w: key of %d bytes", ErrBadExport, klen)
+	}
+	key = make([]byte, klen)
+	if err := er.read(lens[4:]); err != nil {
+		return nil, false, err
+	}
+	if err := er.read(key); err != nil {
+		return nil, false, err
+	}
+	// grown as it's read, a damaged length doesn't allocate it all
+	val.Reset()
+	vlen := int64(binary.LittleEndian.Uint32(lens[4:]))
+	if _, err := io.CopyN(io.MultiWriter(val, er.crc), er.br, vlen); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, false, fmt.Errorf("read export: %w", err)
+	}
+	er.offset += vlen
+	return key, false, nil
+}
+
+// Reads the pairs of a version 1 export and its end.
+func (er *exportReader) readPairsV1(pair func(key, val []byte) error) error {
+	var val bytes.Buffer
+	count := uint64(0)
+	for {
+		key, end, err := er.readPair(&val)
+		if err != nil {
+			return err
+		}
+		if end {
+			break
+		}
+		if err := pair(key, val.Bytes()); err != nil {
+			return err
+		}
+		count++
+	}
+
+	var end [8]byte
+	if err := er.read(end[:]); err != nil {
+		return err
+	}
+	if err := er.checkSum(); err != nil {
+		return err
+	}
+	if n := binary.LittleEndian.Uint64(end[:]); n != count {
+		return fmt.Errorf("%w: %d pairs, %d read", ErrBadExport, n, count)
+	}
+	return nil
+}
+
+// Reads a chunk, passing its pairs to `pair` as they're read: they're only
+// known to be right once it returns. Reports the end of the chunks instead,
+// which leaves the footer to `readFooter`.
+func (er *exportReader) readChunk(pair func(key, val []byte) error) (exportChunk, bool, error) {
+	chunk := exportChunk{offset: uint64(er.offset)}
+	var npairs [4]byte
+	if err := er.read(npairs[:]); err != nil {
+		return chunk, false, err
+	}
+	n := binary.LittleEndian.Uint32(npairs[:])
+	if n == math.MaxUint32 {
+		return chunk, true, nil
+	}
+	if n == 0 {
+		return chunk, false, fmt.Errorf("%w: empty chunk at %d", ErrBadExport, chunk.offset)
+	}
+
+	var val bytes.Buffer
+	for range n {
+		key, end, err := er.readPair(&val)
+		if err == nil && end {
+			err = fmt.Errorf("%w: key length at %d", ErrBadExport, er.offset-4)
+		}
+		if err != nil {
+			return chunk, false, err
+		}
+		if err := pair(key, val.Bytes()); err != nil {
+			return chunk, false, err
+		}
+	}
+	chunk.npairs = uint64(n)
+	return chunk, false, er.checkSum()
+}
+
+// Reads the footer after the end of the chunks, and checks that `chunks`,
+// read from the first chunk or from where an import went on, end the index
+// and hold `count` pairs, all of them if they start with the first chunk.
+func (er *exportReader) readFooter(chunks []exportChunk, count uint64) error {
+	var buf [16]byte
+	if err := er.read(buf[:8]); err != nil {
+		return err
+	}
+	n := binary.LittleEndian.Uint64(buf[:8])
+	if n < uint64(len(chunks)) {
+		return fmt.Errorf("%w: %d chunks in the index, %d read", ErrBadExport, n, len(chunks))
+	}
+	// read one at a time, a damaged number doesn't allocate them all
+	first := n - uint64(len(chunks))
+	var before uint64 // pairs of the chunks that weren't read
+	for i := range n {
+		if err := er.read(buf[:]); err != nil {
+			return err
+		}
+		chunk := exportChunk{
+			offset: binary.LittleEndian.Uint64(buf[:8]),
+			npairs: binary.LittleEndian.Uint64(buf[8:]),
+		}
+		if i < first {
+			before += chunk.npairs
+		} else if chunk != chunks[i-first] {
+			return fmt.Errorf("%w: chunk at %d isn't in the index", ErrBadExport, chunks[i-first].offset)
+		}
+	}
+	if err := er.read(buf[:8]); err != nil {
+		return err
+	}
+	if err := er.checkSum(); err != nil {
+		return err
+	}
+
+	if total := binary.LittleEndian.Uint64(buf[:8]); total != before+count {
+		return fmt.Errorf("%w: %d pairs, %d read", ErrBadExport, total, before+count)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"db/btree"
+)
+
+// An export loads into an empty database, in memory or in a file, with the
+// same pairs. One that's damaged or cut short loads nothing.
+func TestExport(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+	want := map[string]string{"": "empty key", "empty": ""}
+	for i := range 3000 {
+		key, val := fmt.Sprintf("key%05d", i), fmt.Sprint(i)
+		if i%100 == 0 {
+			val = strings.Repeat("o", 2*PAGE_SIZE+i)
+		}
+		want[key] = val
+	}
+	for key, val := range want {
+		if err := db.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := db.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	export := buf.Bytes()
+
+	check := func(db *KV, want map[string]string) {
+		t.Helper()
+		checkKV(t, db, want)
+		if n := db.tree.Len(); n != uint64(len(want)) {
+			t.Fatalf("%d keys, want %d", n, len(want))
+		}
+		if err := db.tree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mem := &KV{}
+	if err := mem.OpenMemory(); err != nil {
+		t.Fatal(err)
+	}
+	defer mem.Close()
+	if err := mem.Import(bytes.NewReader(export)); err != nil {
+		t.Fatal(err)
+	}
+	check(mem, want)
+	if err := mem.Import(bytes.NewReader(export)); !errors.Is(err, btree.ErrNotEmpty) {
+		t.Fatalf("import twice: %v", err)
+	}
+
+	loaded := openTestKV(t, filepath.Join(t.TempDir(), "loaded.db"))
+	damaged := bytes.Clone(export)
+	damaged[len(damaged)/2] ^= 1
+	if err := loaded.Import(bytes.NewReader(damaged)); err == nil {
+		t.Fatal("imported a damaged export")
+	}
+	if err := loaded.Import(bytes.NewReader(export[:len(export)-10])); err == nil {
+		t.Fatal("imported an export cut short")
+	}
+	if err := loaded.Import(strings.NewReader("BYODB\x00bk\x04\x00")); !errors.Is(err, ErrBadExport) {
+		t.Fatalf("import a backup: %v", err)
+	}
+	check(loaded, nil)
+	if err := loaded.Import(bytes.NewReader(export)); err != nil {
+		t.Fatal(err)
+	}
+	check(loaded, want)
+	v1 := &KV{}
+	if err := v1.OpenMemory(); err != nil {
+		t.Fatal(err)
+	}
+	defer v1.Close()
+	if err := v1.Import(bytes.NewReader(exportV1(want))); err != nil {
+		t.Fatal(err)
+	}
+	check(v1, want)
+	// packed by the bulk load
+	if stats := loaded.tree.Stats(); stats.LeafNodes >= db.tree.Stats().LeafNodes {
+		t.Fatalf("%d leaves imported from %d", stats.LeafNodes, db.tree.Stats().LeafNodes)
+	}
+}
+
+// Returns an export of version 1 of the pairs.
+func exportV1(pairs map[string]string) []byte {
+	buf := []byte(EXPORT_MAGIC)
+	buf = binary.LittleEndian.AppendUint16(buf, 1)
+	for _, key := range slices.Sorted(maps.Keys(pairs)) {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(key)))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(pairs[key])))
+		buf = append(buf, key...)
+		buf = append(buf, pairs[key]...)
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, math.MaxUint32)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(pairs)))
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// An import cut short at any point, or stopped at a damaged chunk, goes on
+// from the offset it returns to the same contents as one in a go, keeping
+// the keys the database had. Going on from an earlier offset writes nothing
+// for the chunks already in.
+func TestImportInto(t *testing.T) {
+	src := openNoSyncKV(t, filepath.Join(t.TempDir(), "src.db"))
+	want := map[string]string{}
+	for i := range 5000 {
+		key, val := fmt.Sprintf("key%05d", i), fmt.Sprintf("val%d", i)
+		if i%200 == 0 {
+			val = strings.Repeat("o", 2*PAGE_SIZE+i)
+		}
+		want[key] = val
+		if err := src.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := src.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	export := buf.Bytes()
+	keys := slices.Sorted(maps.Keys(want))
+
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+	db.Set([]byte("other"), []byte("kept"))
+	db.Set([]byte("key00100"), []byte("replaced"))
+	// the keys in are the first ones of the export
+	checkPrefix := func(offset int64) {
+		t.Helper()
+		n := 0
+		for n < len(keys) {
+			if val, ok := db.Get([]byte(keys[n])); !ok || string(val) != want[keys[n]] {
+				break
+			}
+			n++
+		}
+		for _, key := range keys[n:] {
+			if _, ok := db.Get([]byte(key)); ok && key != "key00100" {
+				t.Fatalf("at %d: %q in after the first %d keys", offset, key, n)
+			}
+		}
+		checkKV(t, db, map[string]string{"other": "kept"})
+	}
+
+	link := errors.New("link down")
+	rng := rand.New(rand.NewPCG(1, 2))
+	offset, cuts := int64(0), 0
+	for {
+		cut := min(offset+1+rng.Int64N(2*EXPORT_CHUNK_SIZE), int64(len(export)))
+		r := io.MultiReader(bytes.NewReader(export[offset:cut]), iotest.ErrReader(link))
+		next, err := db.ImportInto(r, offset)
+		if cut == int64(len(export)) && err == nil {
+			offset = next
+			break
+		}
+		if !errors.Is(err, link) || next < offset || next > cut {
+			t.Fatalf("cut at %d from %d: %d, %v", cut, offset, next, err)
+		}
+		checkPrefix(next)
+		offset = next
+		if cuts++; cuts > 100 {
+			t.Fatalf("stuck at %d", offset)
+		}
+	}
+	if offset != int64(len(export)) || cuts < 5 {
+		t.Fatalf("ended at %d of %d after %d cuts", offset, len(export), cuts)
+	}
+	want["other"] = "kept"
+	checkKV(t, db, want)
+	if n := db.tree.Len(); n != uint64(len(want)) {
+		t.Fatalf("%d keys, want %d", n, len(want))
+	}
+
+	// from the start again
+	written := db.Stats().IO.BytesWritten
+	if next, err := db.ImportInto(bytes.NewReader(export), 0); err != nil || next != int64(len(export)) {
+		t.Fatalf("import again: %d, %v", next, err)
+	}
+	if n := db.Stats().IO.BytesWritten - written; n != 0 {
+		t.Fatalf("import again: %d bytes written", n)
+	}
+
+	// a damaged chunk stops it, until it's sent again
+	db = openTestKV(t, filepath.Join(t.TempDir(), "damaged.db"))
+	db.Set([]byte("other"), []byte("kept"))
+	damaged := bytes.Clone(export)
+	damaged[len(damaged)/2] ^= 1
+	next, err := db.ImportInto(bytes.NewReader(damaged), 0)
+	if !errors.Is(err, ErrBadExport) || next == 0 || next > int64(len(damaged)/2) {
+		t.Fatalf("damaged: %d, %v", next, err)
+	}
+	checkPrefix(next)
+	if next, err := db.ImportInto(bytes.NewReader(export[next:]), next); err != nil || next != int64(len(export)) {
+		t.Fatalf("after the damaged chunk: %d, %v", next, err)
+	}
+	checkKV(t, db, want)
+
+	// not from the start of a chunk
+	if _, err := db.ImportInto(bytes.NewReader(export[17:]), 17); err == nil {
+		t.Fatal("imported from the middle of a chunk")
+	}
+	if _, err := db.ImportInto(bytes.NewReader(exportV1(want)), 0); !errors.Is(err, ErrBadExport) {
+		t.Fatalf("import version 1 in chunks: %v", err)
+	}
+}
@@ -0,0 +1,475 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errInjected = errors.New("injected fault")
+
+// A disk in memory under the files of a database, failing, dropping or
+// tearing the writes on demand. What's written is kept apart, like in the OS
+// cache, until a sync writes it to the disk, and a crash decides what reaches
+// it of the rest. The real files only hold the locks.
+type faultDisk struct {
+	mu        sync.Mutex
+	disk      map[string][]byte // the files on disk, by name
+	files     []*faultFile
+	writes    int // writes and cuts so far
+	failAt    int // number of the write or cut that fails, 0 for none
+	failSyncs int // the next syncs fail
+	crashAt   int // number of the one the process dies at, 0 for none
+	crash     func(fp *faultFile)
+	crashed   bool // everything fails from then on, nothing reaches the disk
+	dropSyncs bool // syncs succeed without writing anything
+	// fails the writes and cuts it's true for
+	failIf func(fp *faultFile, w fileWrite) bool
+}
+
+// A file on a `faultDisk`.
+type faultFile struct {
+	disk    *faultDisk
+	fp      *os.File    // holds the lock
+	name    string      // on the disk
+	data    []byte      // the file as it's read back
+	pending []fileWrite // not synced yet, in order
+}
+
+// A write or a cut of a file, not synced yet.
+type fileWrite struct {
+	off  int64
+	data []byte // nil for a cut at `off`
+}
+
+// A file size as it's read back, not as it's on disk.
+type faultInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi faultInfo) Size() int64 {
+	return fi.size
+}
+
+// Wraps a file of the database, see `KV.wrapFile`.
+func (d *faultDisk) wrap(fp *os.File) dbFile {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.disk == nil {
+		d.disk = map[string][]byte{}
+	}
+	ff := &faultFile{disk: d, fp: fp, name: fp.Name(), data: slices.Clone(d.disk[fp.Name()])}
+	d.files = append(d.files, ff)
+	return ff
+}
+
+// Starts the process again after a crash, without faults.
+func (d *faultDisk) restart() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.files = nil
+	d.failAt, d.crashAt, d.crash = 0, 0, nil
+	d.failIf, d.failSyncs = nil, 0
+	d.crashed, d.dropSyncs = false, false
+}
+
+// Kills the process: every file gets what the disk had, and some of the
+// writes that weren't synced as `crash` says.
+func (d *faultDisk) kill(crash func(ff *faultFile)) {
+	for _, ff := range d.files {
+		if crash != nil {
+			crash(ff)
+		}
+		ff.pending = nil
+	}
+	d.crashed = true
+}
+
+// Nothing that wasn't synced reaches the disk.
+func crashLose(ff *faultFile) {}
+
+// The writes up to a random one reach the disk, the last one torn at a
+// sector.
+func crashTorn(rng *rand.Rand) func(ff *faultFile) {
+	return func(ff *faultFile) {
+		n := rng.IntN(len(ff.pending) + 1)
+		for i, w := range ff.pending[:n] {
+			if i == n-1 && w.data != nil {
+				w.data = w.data[:min(rng.IntN(len(w.data)/512+1)*512, len(w.data))]
+			}
+			ff.apply(w)
+		}
+	}
+}
+
+// A random half of the writes reach the disk.
+func crashReorder(rng *rand.Rand) func(ff *faultFile) {
+	return func(ff *faultFile) {
+		for _, w := range ff.pending {
+			if rng.IntN(2) == 0 {
+				ff.apply(w)
+			}
+		}
+	}
+}
+
+// Writes to the disk.
+func (ff *faultFile) apply(w fileWrite) {
+	ff.disk.disk[ff.name] = writeFile(ff.disk.disk[ff.name], w)
+}
+
+// Returns the file with a write or a cut made.
+func writeFile(data []byte, w fileWrite) []byte {
+	end := w.off + int64(len(w.data))
+	if w.data == nil && end < int64(len(data)) {
+		return data[:end]
+	}
+	if end > int64(len(data)) {
+		data = append(data, make([]byte, end-int64(len(data)))...)
+	}
+	copy(data[w.off:], w.data)
+	return data
+}
+
+func (ff *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	ff.disk.mu.Lock()
+	defer ff.disk.mu.Unlock()
+	n := copy(p, ff.data[min(off, int64(len(ff.data))):])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (ff *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	ff.disk.mu.Lock()
+	defer ff.disk.mu.Unlock()
+	if err := ff.write(fileWrite{off, slices.Clone(p)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (ff *faultFile) Truncate(size int64) error {
+	ff.disk.mu.Lock()
+	defer ff.disk.mu.Unlock()
+	return ff.write(fileWrite{off: size})
+}
+
+// Makes a write or a cut, unless it's the one that fails, or the one the
+// process dies at.
+func (ff *faultFile) write(w fileWrite) error {
+	d := ff.disk
+	if d.crashed {
+		return errInjected
+	}
+	d.writes++
+	if d.writes == d.failAt || d.failIf != nil && d.failIf(ff, w) {
+		return errInjected
+	}
+
+	ff.data = writeFile(ff.data, w)
+	ff.pending = append(ff.pending, w)
+	if d.writes == d.crashAt {
+		d.kill(d.crash)
+		return errInjected
+	}
+	return nil
+}
+
+// Returns the size of the file as it's read back.
+func (ff *faultFile) Stat() (os.FileInfo, error) {
+	fi, err := ff.fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	ff.disk.mu.Lock()
+	defer ff.disk.mu.Unlock()
+	return faultInfo{fi, int64(len(ff.data))}, nil
+}
+
+func (ff *faultFile) Sync() error {
+	ff.disk.mu.Lock()
+	defer ff.disk.mu.Unlock()
+	switch {
+	case ff.disk.crashed:
+		return errInjected
+	case ff.disk.dropSyncs:
+		return nil
+	case ff.disk.failSyncs > 0:
+		// what's pending might still be written back
+		ff.disk.failSyncs--
+		return errInjected
+	}
+	ff.writeBack()
+	return nil
+}
+
+// Writes what's pending to the disk.
+func (ff *faultFile) writeBack() {
+	for _, w := range ff.pending {
+		ff.apply(w)
+	}
+	ff.pending = nil
+}
+
+// Closes the file, the OS writes what's pending back unless the process died
+// or the syncs are dropped.
+func (ff *faultFile) Close() error {
+	ff.disk.mu.Lock()
+	defer ff.disk.mu.Unlock()
+	if !ff.disk.crashed && !ff.disk.dropSyncs {
+		ff.writeBack()
+	}
+	return ff.fp.Close()
+}
+
+// Returns whether the database opened after a crash holds `want`, and fails
+// unless its tree verifies and every page is in it or in the free list. The
+// database is closed.
+func checkRecovered(t *testing.T, name string, db *KV, want map[string]string) bool {
+	t.Helper()
+	defer db.Close()
+	if err := db.tree.Verify(); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	fs := db.store.(*fileStore)
+	if used := 1 + len(db.tree.Pages()) + freePages(t, fs); uint64(used) != fs.page.flushed {
+		t.Fatalf("%s: %d pages reached, %d used", name, used, fs.page.flushed)
+	}
+	if db.tree.Len() != uint64(len(want)) {
+		return false
+	}
+	for key, val := range want {
+		if got, ok := db.Get([]byte(key)); !ok || string(got) != val {
+			return false
+		}
+	}
+	return true
+}
+
+// A crash at any write, whatever reaches the disk of the writes that weren't
+// synced, leaves a database that opens with a tree that verifies, the pages
+// all accounted for, and the pairs of the last update acknowledged or of the
+// one cut short. A failed write only fails its update, and after syncs are
+// dropped a crash goes back to the last one that wasn't.
+func TestFaults(t *testing.T) {
+	type change struct {
+		key, val string // no val for a delete
+	}
+	changes := func(seed uint64) []change {
+		rng := rand.New(rand.NewPCG(seed, 0))
+		var changes []change
+		for range 60 {
+			key := fmt.Sprintf("key%03d", rng.IntN(200))
+			val := ""
+			if rng.IntN(4) != 0 {
+				val = strings.Repeat(key, 1+rng.IntN(300))
+			}
+			if rng.IntN(10) == 0 {
+				val = strings.Repeat(key, PAGE_SIZE/3)
+			}
+			changes = append(changes, change{key, val})
+		}
+		return changes
+	}
+	apply := func(want map[string]string, c change) {
+		if c.val == "" {
+			delete(want, c.key)
+		} else {
+			want[c.key] = c.val
+		}
+	}
+	update := func(db *KV, c change) error {
+		if c.val == "" {
+			_, err := db.Del([]byte(c.key))
+			return err
+		}
+		return db.Set([]byte(c.key), []byte(c.val))
+	}
+	for _, wal := range []bool{false, true} {
+		open := func(path string, disk *faultDisk) *KV {
+			t.Helper()
+			db := &KV{Path: path, WAL: wal, FlushInterval: time.Millisecond, wrapFile: disk.wrap}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			return db
+		}
+
+		// the writes of a whole run, to pick where to crash
+		writes := func(seed uint64) int {
+			disk := &faultDisk{}
+			db := open(filepath.Join(t.TempDir(), "test.db"), disk)
+			defer db.Close()
+			disk.mu.Lock()
+			disk.writes = 0
+			disk.mu.Unlock()
+			for _, c := range changes(seed) {
+				if err := update(db, c); err != nil {
+					t.Fatal(err)
+				}
+			}
+			disk.mu.Lock()
+			defer disk.mu.Unlock()
+			return disk.writes
+		}
+
+		for seed := range uint64(10) {
+			total := writes(seed)
+			for mode, crash := range map[string]func(*rand.Rand) func(*faultFile){
+				"lose":    func(*rand.Rand) func(*faultFile) { return crashLose },
+				"torn":    crashTorn,
+				"reorder": crashReorder,
+			} {
+				name := fmt.Sprintf("wal %v, seed %d, %s", wal, seed, mode)
+				rng := rand.New(rand.NewPCG(seed, uint64(len(mode))))
+				path := filepath.Join(t.TempDir(), "test.db")
+				disk := &faultDisk{}
+				db := open(path, disk)
+				disk.mu.Lock()
+				disk.writes, disk.crashAt, disk.crash = 0, 1+rng.IntN(total), crash(rng)
+				disk.mu.Unlock()
+
+				acked := map[string]string{}
+				var next map[string]string
+				for _, c := range changes(seed) {
+					next = maps.Clone(acked)
+					apply(next, c)
+					if err := update(db, c); err != nil {
+						break
+					}
+					acked = next
+				}
+				crashKV(db)
+				disk.restart()
+				if !checkRecovered(t, name, open(path, disk), acked) && !checkRecovered(t, name, open(path, disk), next) {
+					t.Fatalf("%s: neither the last update acknowledged nor the one cut short", name)
+				}
+			}
+		}
+
+		// a failed write fails its update only
+		path := filepath.Join(t.TempDir(), "test.db")
+		disk := &faultDisk{}
+		db := open(path, disk)
+		want := map[string]string{}
+		for i, c := range changes(100) {
+			if i%10 == 5 {
+				disk.mu.Lock()
+				disk.failAt = disk.writes + 1 + i%3
+				disk.mu.Unlock()
+			}
+			if err := update(db, c); err != nil {
+				if !errors.Is(err, errInjected) {
+					t.Fatal(err)
+				}
+				continue
+			}
+			apply(want, c)
+		}
+		checkKV(t, db, want)
+		db.Close()
+		disk.restart()
+		if !checkRecovered(t, fmt.Sprintf("wal %v, failed writes", wal), open(path, disk), want) {
+			t.Fatalf("wal %v: the updates acknowledged aren't there after failed writes", wal)
+		}
+
+		// the syncs that were dropped are lost
+		path = filepath.Join(t.TempDir(), "test.db")
+		disk = &faultDisk{}
+		db = open(path, disk)
+		want = map[string]string{}
+		for i, c := range changes(200) {
+			if i == 30 {
+				disk.mu.Lock()
+				disk.dropSyncs = true
+				disk.mu.Unlock()
+			}
+			if err := update(db, c); err != nil {
+				t.Fatal(err)
+			}
+			if i < 30 {
+				apply(want, c)
+			}
+		}
+		disk.mu.Lock()
+		disk.kill(crashLose)
+		disk.mu.Unlock()
+		crashKV(db)
+		disk.restart()
+		if !checkRecovered(t, fmt.Sprintf("wal %v, dropped syncs", wal), open(path, disk), want) {
+			t.Fatalf("wal %v: not the last update synced after dropped syncs", wal)
+		}
+	}
+}
+
+// A commit whose meta page fails to be written, or to be synced, might still
+// reach the disk: the store keeps it and fails every update after it, and
+// the database opens again with either commit.
+func TestFailedCommit(t *testing.T) {
+	for _, fail := range []string{"write", "sync"} {
+		path := filepath.Join(t.TempDir(), "test.db")
+		disk := &faultDisk{}
+		open := func() *KV {
+			db := &KV{Path: path, wrapFile: disk.wrap}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			return db
+		}
+		db := open()
+		before := map[string]string{}
+		for i := range 200 {
+			key := fmt.Sprintf("key%03d", i)
+			before[key] = strings.Repeat(key, 1+i%20)
+			if err := db.Set([]byte(key), []byte(before[key])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		after := maps.Clone(before)
+		after["key000"] = "new"
+
+		disk.mu.Lock()
+		disk.failIf = func(ff *faultFile, w fileWrite) bool {
+			if ff.name != path || w.off != META_OFFSETS[0] && w.off != META_OFFSETS[1] {
+				return false
+			}
+			disk.failIf = nil
+			if fail == "sync" {
+				disk.failSyncs = 1
+				return false
+			}
+			return true
+		}
+		disk.mu.Unlock()
+		if err := db.Set([]byte("key000"), []byte("new")); !errors.Is(err, ErrStoreFailed) || !errors.Is(err, errInjected) {
+			t.Fatalf("%s: set: %v", fail, err)
+		}
+		if err := db.Set([]byte("key001"), []byte("new")); !errors.Is(err, ErrStoreFailed) {
+			t.Fatalf("%s: set after the failure: %v", fail, err)
+		}
+		if _, err := db.Del([]byte("key002")); !errors.Is(err, ErrStoreFailed) {
+			t.Fatalf("%s: del after the failure: %v", fail, err)
+		}
+		checkKV(t, db, before)
+		db.Close()
+
+		disk.restart()
+		name := fmt.Sprintf("failed %s", fail)
+		if !checkRecovered(t, name, open(), before) && !checkRecovered(t, name, open(), after) {
+			t.Fatalf("%s: neither the last commit nor the failed one", name)
+		}
+	}
+}
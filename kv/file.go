@@ -0,0 +1,725 @@
+package kv
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// first bytes of the file
+const DB_MAGIC = "BYODB\x00kv"
+
+// version of the file format
+const DB_VERSION = 5
+
+// bytes of a copy of the meta page
+const META_SIZE = 124
+
+// flag of the meta page set while a writer has the file open, see `markOpen`
+const META_FLAG_OPEN = 1
+
+// default `KV.Extent`
+const FILE_EXTENT = 1 << 20
+
+// offsets of the 2 copies of the meta page, in different disk sectors
+var META_OFFSETS = [2]int64{0, PAGE_SIZE / 2}
+
+/*
+The database is a single file of pages. Page 0 is the meta page, the tree
+and free list pages follow it. An update writes its new pages into free pages
+or at the end of the file, and then the meta page, the replaced ones are added
+to the free list.
+
+# Meta page:
+
+Page 0 holds 2 copies of the meta page, at `META_OFFSETS`:
+
+	| magic | version | page size | flags | root | used | free | seq | commit | keys  | crc32 |
+	|  8B   |   2B    |    4B     |  2B   |  8B  |  8B  |  8B  | 8B  |   8B   | 2*32B |  4B   |
+
+The first 16B are the file header: `magic` is `DB_MAGIC`, `version` is
+`DB_VERSION` and `page size` is `PAGE_SIZE` for the file to be opened. In
+`flags`, `META_FLAG_OPEN` marks a file open for writing,
+`META_FLAG_COMPRESSED` one whose pages are packed, `META_FLAG_ENCRYPTED`
+one whose pages are sealed and `META_FLAG_VLOG` one whose values are tagged,
+the other bits are reserved, always 0. `root` is the page of the tree root, 0 for an empty tree,
+`used` the number of pages in use, the meta page included, and `free` the
+head of the free list, 0 for an empty one. `seq` counts the meta pages
+written, `commit` the updates committed, the number stamped in the pages
+they write, see `KV.Backup`, and `keys` are the checks of the keys of an
+encrypted file, 0s otherwise. The checksum covers the rest of the copy.
+
+`used` is the high-water mark of the file, which is grown past it in whole
+extents, see `KV.Extent`, the pages after it are preallocated.
+
+An update is committed by the meta page alone: the new pages are written and
+synced first, so a crash at any point leaves the meta page pointing to either
+the old tree or the new one, both whole. That takes one of the sync modes that
+sync every update, see `SyncMode`.
+
+Commits write the 2 copies in turn, the one with the older `seq`, and the
+newest one with a matching checksum is read on open. A crash in the middle of
+writing one leaves the other, the last commit before it, whole. A meta page
+that was never written, all zeros, holds an empty tree.
+*/
+
+// The `PageStore` of a database file, mapped into memory to read the pages,
+// or read into a buffer pool.
+type fileStore struct {
+	sync         SyncMode
+	syncInterval time.Duration
+	readOnly     bool
+	failed       error // a commit failed once its meta page was written, see `syncPages`
+	direct       bool  // the file is opened for direct I/O
+	extent       int   // pages the file grows by, see `KV.Extent`
+	memLimit     int   // see `KV.MemoryLimit`
+	retry        RetryPolicy
+
+	path string // of the database file
+	fp   dbFile
+	wrap func(*os.File) dbFile // see `KV.wrapFile`
+	wal  *walLog               // nil without a WAL
+	seq  uint64                // of the last meta page written
+	// of the last update, the next one stamps its pages with the number after
+	commit uint64
+	synced uint64 // the last commit synced by `syncAll`, or found on open
+	meta   struct {
+		flags  uint16      // written with the meta page
+		keys   [2]keyCheck // written with the meta page, see `META_FLAG_ENCRYPTED`
+		marked bool        // `META_FLAG_OPEN` was set by this store, cleared on Close
+	}
+	cipher *pageCipher // nil unless the file is encrypted
+	rekey  struct {
+		since uint64 // the pages of the commits up to it are sealed with the old key
+	}
+	root  uint64
+	free  FreeList
+	alloc Allocator   // picks the pages of the tree, see `KV.Allocator`
+	pool  *bufferPool // nil when the file is mapped
+	mmap  struct {
+		file   int      // file size, can be larger than the database size
+		total  int      // mmap size, can be larger than the file size
+		chunks [][]byte // multiple mmaps, can be non-continuous
+	}
+	page struct {
+		flushed uint64            // database size in number of pages
+		nfree   int               // number of pages taken from the free list
+		nappend int               // number of pages to be appended
+		updates map[uint64][]byte // new or reused pages, nil for freed ones
+		limit   uint64            // free pages from there on aren't handed out, see `LimitPages`
+
+		// pages freed by an update written in place, see `WriteInPlace`
+		inPlace    bool
+		freed      []uint64 // since the last `ReusePages`
+		reuse      []uint64 // handed out again by `AllocPage`
+		overwrites bool     // a page of the last commit was reused
+	}
+	vlog  *valueLog   // nil without one, see `META_FLAG_VLOG`
+	hold  pageHold    // pages freed while backups and snapshots read them
+	dirty atomic.Bool // updates not synced yet, for `SyncPeriodic`
+	io    struct {
+		pages atomic.Uint64 // written into the file, see `IOStats`
+		bytes atomic.Uint64 // written into the file and the WAL
+		syncs atomic.Uint64
+	}
+	syncer struct {
+		stop chan struct{}
+		done chan struct{}
+	}
+	flusher struct {
+		interval time.Duration
+		stop     chan struct{}
+		done     chan struct{}
+	}
+	// held by the background goroutines, and by commits and checkpoints
+	// writing the file
+	mu sync.Mutex
+}
+
+// Opens the file of the database with its options, creating it unless it's
+// read-only.
+func openFileStore(db *KV, readOnly bool) (*fileStore, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+
+	fp, direct, err := openFile(db.Path, flag, db.DirectIO)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	fs := &fileStore{sync: db.Sync, syncInterval: db.SyncInterval, readOnly: readOnly, path: db.Path, fp: fp, direct: direct}
+	fs.flusher.interval = db.FlushInterval
+	fs.extent = max(cmp.Or(db.Extent, FILE_EXTENT)/PAGE_SIZE, 1)
+	fs.memLimit = db.MemoryLimit
+	fs.retry = db.retry()
+	fs.wrap = db.wrapFile
+
+	if err := lockFile(fp, readOnly, db.LockTimeout); err != nil {
+		fs.Close()
+		return nil, err
+	}
+	fs.fp = fs.wrapFile(fp)
+
+	if db.CacheSize > 0 || db.DirectIO || db.Key != nil || fs.wrap != nil {
+		fi, err := fs.fp.Stat()
+		if err != nil {
+			fs.Close()
+			return nil, fmt.Errorf("stat: %w", err)
+		}
+		fs.mmap.file = int(fi.Size())
+		fs.pool = newBufferPool(cacheSize(cmp.Or(db.CacheSize, CACHE_SIZE), db.MemoryLimit), fs.loadPage, fs.storePage)
+	} else {
+		size, chunk, err := mmapInit(fp, readOnly)
+		if err != nil {
+			fs.Close()
+			return nil, err
+		}
+		fs.mmap.file = size
+		fs.mmap.total = len(chunk)
+		fs.mmap.chunks = [][]byte{chunk}
+	}
+
+	fs.page.updates = map[uint64][]byte{}
+	fs.free.get = fs.ReadPage
+	fs.free.new = fs.appendPage
+	fs.free.use = fs.usePage
+	fs.free.commit = fs.NextCommit
+	fs.alloc = FreeListAllocator(fileSpace{fs})
+	if db.Allocator != nil {
+		fs.alloc = db.Allocator(fileSpace{fs})
+	}
+
+	if err := fs.loadMeta(); err != nil {
+		fs.Close()
+		return nil, err
+	}
+	if err := fs.openKeys(db.Key, db.OldKey); err != nil {
+		fs.Close()
+		return nil, err
+	}
+	if err := openWAL(fs, db.Path+WAL_SUFFIX, db.WAL); err != nil {
+		fs.Close()
+		return nil, err
+	}
+	if err := fs.setUp(db); err != nil {
+		fs.Close()
+		return nil, err
+	}
+	fs.synced = fs.commit
+	if fs.meta.flags&META_FLAG_VLOG != 0 {
+		if fs.vlog, err = openValueLog(db.Path, db.ValueLog, readOnly, fs.retry); err != nil {
+			fs.Close()
+			return nil, err
+		}
+	}
+
+	if !readOnly {
+		if err := fs.markOpen(); err != nil {
+			fs.Close()
+			return nil, err
+		}
+		fs.startSyncer()
+		fs.startFlusher()
+	}
+	return fs, nil
+}
+
+// Packs and seals the pages of a new file from the first update on, as asked,
+// and writes its first meta page: a crash writing the next one leaves this
+// one, even with a WAL that isn't checkpointed yet. Fails with `ErrBadKey`
+// for a key given for a file that isn't encrypted.
+func (fs *fileStore) setUp(db *KV) error {
+	if !fs.readOnly && fs.seq == 0 && fs.commit == 0 {
+		if db.Compress {
+			fs.meta.flags |= META_FLAG_COMPRESSED
+		}
+		if db.ValueLog > 0 {
+			if db.Key != nil {
+				return fmt.Errorf("%w: the value log isn't encrypted", ErrBadKey)
+			}
+			fs.meta.flags |= META_FLAG_VLOG
+		}
+		if db.Key != nil {
+			if err := fs.newKey(db.Key); err != nil {
+				return err
+			}
+		}
+		if err := fs.writeMeta(); err != nil {
+			return err
+		}
+	}
+	if db.Key != nil && fs.cipher == nil {
+		return fmt.Errorf("%w: the file isn't encrypted", ErrBadKey)
+	}
+	return nil
+}
+
+// Lists the pages held back for the readers, stops the flusher, checkpoints the
+// WAL and marks the file closed, then unmaps and closes the files.
+func (fs *fileStore) Close() {
+	if len(fs.hold.pages) > 0 {
+		// listed by the next update otherwise, and leaked without one
+		fs.Flush(fs.root)
+	}
+	fs.stopFlusher()
+	if fs.pool != nil {
+		fs.pool.wait()
+	}
+	if fs.wal != nil && !fs.readOnly {
+		// what's left in the WAL is replayed on the next open otherwise
+		fs.checkpoint()
+	}
+	if fs.meta.marked && fs.failed == nil {
+		// left marked after a failure, the next open checks the file
+		fs.markClosed()
+	}
+	fs.stopSyncer()
+
+	if fs.wal != nil && fs.wal.fp != nil {
+		fs.wal.fp.Close()
+	}
+	fs.wal = nil
+	if fs.vlog != nil {
+		fs.vlog.close()
+	}
+
+	for _, chunk := range fs.mmap.chunks {
+		if err := mmapClose(chunk); err != nil {
+			panic(err)
+		}
+	}
+	fs.mmap.chunks = nil
+
+	if fs.fp != nil {
+		fs.fp.Close()
+		fs.fp = nil
+	}
+}
+
+func (fs *fileStore) Root() uint64 {
+	return fs.root
+}
+
+// Reads the meta page. An empty file holds an empty tree.
+func (fs *fileStore) loadMeta() error {
+	if fs.mmap.file == 0 {
+		fs.page.flushed = 1 // reserved for the meta page
+		return nil
+	}
+
+	page := make([]byte, PAGE_SIZE)
+	if err := fs.readAt(0, page); err != nil && err != io.EOF {
+		return fmt.Errorf("read meta page: %w", err)
+	}
+	meta, err := pickMeta(page)
+	if err != nil {
+		return err
+	}
+	if meta == nil {
+		fs.page.flushed = 1
+		return nil
+	}
+
+	if err := checkHeader(meta); err != nil {
+		return err
+	}
+	if fs.mmap.file%PAGE_SIZE != 0 {
+		return fmt.Errorf("%w: size %d is not a multiple of the page size", ErrBadFile, fs.mmap.file)
+	}
+
+	flags := binary.LittleEndian.Uint16(meta[14:])
+	root := binary.LittleEndian.Uint64(meta[16:])
+	used := binary.LittleEndian.Uint64(meta[24:])
+	free := binary.LittleEndian.Uint64(meta[32:])
+
+	if used < 1 || used > uint64(fs.mmap.file/PAGE_SIZE) || filePage(flags, root) >= used || free >= used {
+		return fmt.Errorf("%w: %d pages used out of %d, root %d, free list %d", ErrBadFile, used, fs.mmap.file/PAGE_SIZE, root, free)
+	}
+
+	fs.meta.flags = flags
+	copy(fs.meta.keys[0][:], meta[56:])
+	copy(fs.meta.keys[1][:], meta[56+KEY_CHECK_SIZE:])
+	fs.seq = binary.LittleEndian.Uint64(meta[40:])
+	fs.commit = binary.LittleEndian.Uint64(meta[48:])
+	fs.root = root
+	fs.page.flushed = used
+	fs.free.head = free
+	return nil
+}
+
+// Returns the newest copy of the meta page with a matching checksum, nil if
+// both are all zeros.
+func pickMeta(page []byte) ([]byte, error) {
+	var best []byte
+	zeros, magic := 0, 0
+	for _, off := range META_OFFSETS {
+		meta := page[off : off+META_SIZE]
+		switch {
+		case bytes.Equal(meta, make([]byte, META_SIZE)):
+			zeros++
+			continue
+		case bytes.Equal(meta[:8], []byte(DB_MAGIC)):
+			magic++
+		}
+
+		sum := binary.LittleEndian.Uint32(meta[META_SIZE-4:])
+		if crc32.ChecksumIEEE(meta[:META_SIZE-4]) != sum {
+			continue
+		}
+		if best == nil || binary.LittleEndian.Uint64(meta[40:]) > binary.LittleEndian.Uint64(best[40:]) {
+			best = meta
+		}
+	}
+
+	switch {
+	case best != nil:
+		return best, nil
+	case zeros == len(META_OFFSETS):
+		return nil, nil
+	case magic == 0:
+		return nil, checkHeader(page[:META_SIZE])
+	}
+
+	// a header from another version might not have the same layout
+	for _, off := range META_OFFSETS {
+		meta := page[off : off+META_SIZE]
+		if err := checkHeader(meta); err != nil && !errors.Is(err, ErrNotADatabase) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w: both copies of the meta page are damaged", ErrBadFile)
+}
+
+// Checks the file header at the start of the meta page.
+func checkHeader(meta []byte) error {
+	if !bytes.Equal(meta[:8], []byte(DB_MAGIC)) {
+		return fmt.Errorf("%w: magic %q", ErrNotADatabase, meta[:8])
+	}
+	if version := binary.LittleEndian.Uint16(meta[8:]); version != DB_VERSION {
+		return fmt.Errorf("%w: version %d, want %d", ErrUnsupportedVersion, version, DB_VERSION)
+	}
+	if size := binary.LittleEndian.Uint32(meta[10:]); size != PAGE_SIZE {
+		return fmt.Errorf("%w: %d bytes, want %d", ErrPageSizeMismatch, size, PAGE_SIZE)
+	}
+	if flags := binary.LittleEndian.Uint16(meta[14:]); flags&^(META_FLAG_OPEN|META_FLAG_COMPRESSED|META_FLAG_ENCRYPTED|META_FLAG_VLOG) != 0 {
+		return fmt.Errorf("%w: flags %#x", ErrUnsupportedVersion, flags)
+	}
+	return nil
+}
+
+// Writes the meta page over its older copy.
+func (fs *fileStore) storeMeta() error {
+	seq := fs.seq + 1
+	meta := encodeMeta(fs.meta.flags, fs.root, fs.page.flushed, fs.free.head, seq, fs.commit, fs.meta.keys)
+	if err := fs.writeMetaCopy(meta, META_OFFSETS[seq%2]); err != nil {
+		return fmt.Errorf("write meta page: %w", err)
+	}
+
+	fs.seq = seq
+	return nil
+}
+
+// Returns a copy of the meta page.
+func encodeMeta(flags uint16, root, used, free, seq, commit uint64, keys [2]keyCheck) []byte {
+	meta := make([]byte, META_SIZE)
+	copy(meta[:8], DB_MAGIC)
+	binary.LittleEndian.PutUint16(meta[8:], DB_VERSION)
+	binary.LittleEndian.PutUint32(meta[10:], PAGE_SIZE)
+	binary.LittleEndian.PutUint16(meta[14:], flags)
+	binary.LittleEndian.PutUint64(meta[16:], root)
+	binary.LittleEndian.PutUint64(meta[24:], used)
+	binary.LittleEndian.PutUint64(meta[32:], free)
+	binary.LittleEndian.PutUint64(meta[40:], seq)
+	binary.LittleEndian.PutUint64(meta[48:], commit)
+	copy(meta[56:], keys[0][:])
+	copy(meta[56+KEY_CHECK_SIZE:], keys[1][:])
+	binary.LittleEndian.PutUint32(meta[META_SIZE-4:], crc32.ChecksumIEEE(meta[:META_SIZE-4]))
+	return meta
+}
+
+// Persists the new pages, then points the meta page to the new root, or
+// appends them to the WAL. The update is committed once this returns.
+func (fs *fileStore) Flush(root uint64) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.failed != nil {
+		fs.Abort()
+		return fs.failed
+	}
+	old, flushed, free, commit := fs.root, fs.page.flushed, fs.free.head, fs.commit
+	held := fs.hold.pages
+	err := fs.syncValueLog()
+	if err == nil {
+		err = fs.updateFreeList()
+	}
+	switch {
+	case err != nil:
+	case fs.wal != nil:
+		err = fs.logPages(root)
+	default:
+		err = fs.writePages(fs.page.updates, int(fs.page.flushed)+fs.page.nappend)
+		if err == nil {
+			err = fs.syncPages(root)
+		}
+	}
+	if err != nil && fs.failed == nil && fs.page.overwrites && fs.wal == nil {
+		// the last commit was written over
+		fs.failed = fmt.Errorf("%w: %w", ErrStoreFailed, err)
+	}
+	if err != nil && fs.failed == nil {
+		fs.root = old
+		fs.page.flushed = flushed
+		fs.free.head = free
+		fs.commit = commit
+		fs.hold.pages = held
+		fs.Abort()
+	}
+	return err
+}
+
+// Adds the pages freed by the update to the free list and removes the ones
+// it took. The freed pages are held back while a backup or a snapshot of an
+// older commit reads, see `Hold`. Fails if a node of the list is damaged.
+func (fs *fileStore) updateFreeList() (err error) {
+	defer recoverCorrupt(&err)
+
+	var freed []uint64
+	for ptr, page := range fs.page.updates {
+		if page == nil {
+			freed = append(freed, ptr)
+		}
+	}
+	freed = fs.hold.free(fs.NextCommit(), freed)
+	slices.Sort(freed)
+	fs.free.Update(fs.page.nfree, freed)
+	return nil
+}
+
+// Copies pages into the file, growing it to `npages` first.
+func (fs *fileStore) writePages(pages map[uint64][]byte, npages int) error {
+	if err := extendFile(fs, npages); err != nil {
+		return err
+	}
+	if fs.pool == nil {
+		if err := extendMmap(fs, npages); err != nil {
+			return err
+		}
+	}
+	return fs.copyPages(pages)
+}
+
+// Copies pages into the mapped file, or writes them through the buffer pool.
+func (fs *fileStore) copyPages(pages map[uint64][]byte) error {
+	for ptr, page := range pages {
+		if page == nil {
+			continue
+		}
+		if fs.pool != nil {
+			fs.pool.put(ptr, page)
+		} else {
+			copy(fs.mmapPage(ptr), page)
+			fs.countPage()
+		}
+	}
+	if fs.pool != nil {
+		return fs.pool.writeBack()
+	}
+	return nil
+}
+
+// Commits the pages written by `writePages` with the meta page, which is only
+// written once the pages are on disk. Once it's written, even in part or
+// without the sync, it might reach the disk: the store keeps the new commit
+// rather than going back to the last one, whose free pages the new one might
+// use, and fails every update after it with `ErrStoreFailed`.
+func (fs *fileStore) syncPages(root uint64) error {
+	if err := fs.syncFile(fs.fp); err != nil {
+		return err
+	}
+
+	fs.root = root
+	fs.page.flushed += uint64(fs.page.nappend)
+	fs.commit++
+	fs.Abort()
+
+	err := fs.storeMeta()
+	if err == nil {
+		err = fs.syncFile(fs.fp)
+	}
+	if err != nil {
+		fs.failed = fmt.Errorf("%w: %w", ErrStoreFailed, err)
+		return fs.failed
+	}
+	return nil
+}
+
+// Returns the number of the update being made, stamped in its pages.
+func (fs *fileStore) NextCommit() uint64 {
+	return fs.commit + 1
+}
+
+// Forgets the pages of the update.
+func (fs *fileStore) Abort() {
+	fs.page.nfree = 0
+	fs.page.nappend = 0
+	clear(fs.page.updates)
+	fs.page.inPlace, fs.page.overwrites = false, false
+	fs.page.freed, fs.page.reuse = nil, nil
+}
+
+// Reads a page, either from the ones not written yet, the WAL or the file.
+func (fs *fileStore) ReadPage(ptr uint64) []byte {
+	if page, ok := fs.page.updates[ptr]; ok {
+		if page == nil {
+			panic(fmt.Sprintf("kv: page %d was freed", ptr))
+		}
+		return page
+	}
+	if fs.wal != nil {
+		if page, ok := fs.wal.pages[ptr]; ok {
+			return page
+		}
+	}
+	if fs.pool != nil {
+		return fs.pool.get(ptr)
+	}
+	return fs.mmapPage(ptr)
+}
+
+// Starts reading the pages of the file ahead, into the buffer pool or the
+// mapping.
+func (fs *fileStore) Prefetch(ptrs []uint64) {
+	var file []uint64
+	for _, ptr := range ptrs {
+		if _, ok := fs.page.updates[ptr]; ok {
+			continue
+		}
+		if fs.wal != nil {
+			if _, ok := fs.wal.pages[ptr]; ok {
+				continue
+			}
+		}
+		if ptr < fs.page.flushed {
+			file = append(file, ptr)
+		}
+	}
+
+	if fs.pool != nil {
+		fs.pool.prefetch(file)
+		return
+	}
+	for _, ptr := range file {
+		mmapPrefetch(fs.mmapPage(ptr))
+	}
+}
+
+// Allocates a page through the allocator, see `KV.Allocator`, or a free one
+// under the limit of `LimitPages` while there is one left. It's written with
+// the rest of the update.
+func (fs *fileStore) AllocPage(node []byte) uint64 {
+	if len(node) != PAGE_SIZE {
+		panic(fmt.Sprintf("kv: a page of %d bytes", len(node)))
+	}
+
+	ptr, ok := uint64(0), false
+	if n := len(fs.page.reuse); n > 0 {
+		ptr, ok = fs.page.reuse[n-1], true
+		fs.page.reuse = fs.page.reuse[:n-1]
+		fs.page.overwrites = fs.page.overwrites || ptr < fs.page.flushed
+	} else if fs.page.limit > 0 {
+		ptr, ok = fileSpace{fs}.TakeFree()
+	}
+	if !ok {
+		ptr = fs.alloc.Alloc(1)
+	}
+	fs.page.updates[ptr] = node
+	return ptr
+}
+
+// Frees a page through the allocator, it's added to the free list when the
+// update is written unless it's reused, see `WriteInPlace`.
+func (fs *fileStore) FreePage(ptr uint64) {
+	fs.alloc.Free(ptr)
+	if fs.page.inPlace {
+		fs.page.freed = append(fs.page.freed, ptr)
+	}
+}
+
+// Allocates a page at the end of the file.
+func (fs *fileStore) appendPage(node []byte) uint64 {
+	ptr := fileSpace{fs}.Append(1)
+	fs.page.updates[ptr] = node
+	return ptr
+}
+
+// Writes over a free page.
+func (fs *fileStore) usePage(ptr uint64, node []byte) {
+	fs.page.updates[ptr] = node
+}
+
+// Returns the number of pages of the file that can be written, the ones
+// mapped unless there is a buffer pool.
+func (fs *fileStore) writablePages() uint64 {
+	if fs.pool != nil {
+		return uint64(fs.mmap.file / PAGE_SIZE)
+	}
+	return uint64(min(fs.mmap.file, fs.mmap.total) / PAGE_SIZE)
+}
+
+// Rounds a number of pages up to whole extents.
+func (fs *fileStore) extentPages(npages int) int {
+	return (npages + fs.extent - 1) / fs.extent * fs.extent
+}
+
+// Returns a page of the mapped file.
+func (fs *fileStore) mmapPage(ptr uint64) []byte {
+	start := uint64(0)
+	for _, chunk := range fs.mmap.chunks {
+		end := start + uint64(len(chunk))/PAGE_SIZE
+		if ptr < end {
+			offset := PAGE_SIZE * (ptr - start)
+			return chunk[offset : offset+PAGE_SIZE]
+		}
+		start = end
+	}
+
+	panic(fmt.Sprintf("kv: page %d is past the end of the file", ptr))
+}
+
+// Grows the file to hold `npages`, by an eighth of its size at least and in
+// whole extents, so that it isn't resized on every update and its blocks are
+// allocated together.
+func extendFile(fs *fileStore, npages int) error {
+	filePages := fs.mmap.file / PAGE_SIZE
+	if filePages >= npages {
+		return nil
+	}
+
+	for filePages < npages {
+		inc := max(filePages/8, 1)
+		filePages += inc
+	}
+	filePages = fs.extentPages(filePages)
+
+	fileSize := filePages * PAGE_SIZE
+	err := fs.retry.Do(func() error {
+		return allocateFile(fs.fp, int64(fs.mmap.file), int64(fileSize))
+	})
+	if err != nil {
+		return fmt.Errorf("extend file: %w", err)
+	}
+
+	fs.mmap.file = fileSize
+	return nil
+}
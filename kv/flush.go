@@ -0,0 +1,94 @@
+package kv
+
+import "time"
+
+// default `KV.FlushInterval`
+const FLUSH_INTERVAL = 10 * time.Millisecond
+
+// most pages written by the flusher every `KV.FlushInterval`
+const FLUSH_PAGES = 64
+
+/*
+With a WAL, the flusher writes the committed pages into the database file
+ahead of the checkpoint, a few at a time so that it doesn't compete with the
+commits for the disk, and syncs them. The checkpoint then only has to write
+and sync the pages committed since the last round.
+
+The pages written ahead can go over pages of the tree of the last
+checkpoint, which the meta page still points to. That's safe since the tree
+of the file is only read along with the WAL: every committed record is
+replayed over it on open, before anything reads it. In the process, the
+pages of the WAL are read from memory, so nothing reads the pages being
+written either.
+*/
+
+// Starts writing the pages of the WAL ahead of the checkpoint.
+func (fs *fileStore) startFlusher() {
+	if fs.wal == nil {
+		return
+	}
+
+	interval := fs.flusher.interval
+	if interval <= 0 {
+		interval = FLUSH_INTERVAL
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	fs.flusher.stop, fs.flusher.done = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// the pages of a failed round are left to the checkpoint
+				fs.flushAhead(FLUSH_PAGES)
+			}
+		}
+	}()
+}
+
+// Stops the flusher, the pages it didn't write are left to the checkpoint.
+func (fs *fileStore) stopFlusher() {
+	if fs.flusher.stop == nil {
+		return
+	}
+
+	close(fs.flusher.stop)
+	<-fs.flusher.done
+	fs.flusher.stop, fs.flusher.done = nil, nil
+}
+
+// Writes up to `limit` pages of the WAL into the database file and syncs it.
+// Only pages within the file, and the mapping, are written, the checkpoint
+// grows them.
+// Returns the number of pages written.
+func (fs *fileStore) flushAhead(limit int) (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	mapped := fs.writablePages()
+	pages := map[uint64][]byte{}
+	for ptr := range fs.wal.dirty {
+		if len(pages) == limit {
+			break
+		}
+		if ptr < mapped {
+			pages[ptr] = fs.wal.pages[ptr]
+		}
+	}
+
+	if len(pages) == 0 {
+		return 0, nil
+	}
+	if err := fs.copyPages(pages); err != nil {
+		return 0, err
+	}
+	for ptr := range pages {
+		delete(fs.wal.dirty, ptr)
+	}
+	return len(pages), fs.syncFile(fs.fp)
+}
@@ -0,0 +1,85 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The flusher writes the pages of the WAL into the file ahead of the
+// checkpoint, which still survives a crash, and `Checkpoint` empties the WAL.
+func TestFlusher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, WAL: true, FlushInterval: time.Millisecond}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+
+	// a checkpoint maps the file for the flusher to write into
+	want := map[string]string{}
+	set := func(n int) {
+		t.Helper()
+		for i := range n {
+			key := fmt.Sprintf("key%05d", i)
+			val := fmt.Sprint(len(want), i)
+			if err := db.Set([]byte(key), []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = val
+		}
+	}
+	set(500)
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if size := walSize(t, path); size != 0 {
+		t.Fatalf("WAL of %d bytes after a checkpoint", size)
+	}
+
+	set(500)
+	fs := db.store.(*fileStore)
+	dirty := func() int {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		return len(fs.wal.dirty)
+	}
+	for deadline := time.Now().Add(5 * time.Second); dirty() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d pages of %d left to write", dirty(), len(fs.wal.pages))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if walSize(t, path) == 0 {
+		t.Fatal("the flusher checkpointed the WAL")
+	}
+	checkKV(t, db, want)
+
+	// the pages written ahead over the tree of the last checkpoint are fine
+	// once the WAL is replayed
+	crashKV(db)
+	db = &KV{Path: path, WAL: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	checkKV(t, db, want)
+	if err := db.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = &KV{Path: path}
+	if err := db.OpenReadOnly(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkKV(t, db, want)
+	if err := db.Checkpoint(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("checkpoint read-only: %v", err)
+	}
+}
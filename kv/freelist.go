@@ -0,0 +1,216 @@
+package kv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"db/btree"
+)
+
+/*
+The pages freed by the tree are kept in a linked list of pages, its head is
+in the meta page. New pages are taken from the list before the file grows.
+
+# Free list node:
+
+	| size | total | next | crc32 | commit |  pointers  | unused |
+	|  2B  |  8B   |  8B  |  4B   |   8B   | size * 8B  |        |
+
+`size` is the number of pointers in the node, `total` the number of pointers
+in the whole list, only kept in the head, `next` the next node, 0 for the
+last one, and `commit` the update that wrote it, like the tree pages. The checksum covers the rest of the page, a node that fails it is
+reported with a `*btree.ChecksumError` when it's read. The last
+`ENCRYPT_RESERVED` bytes are always unused, see `META_FLAG_ENCRYPTED`.
+
+The list is copy-on-write like the tree: the nodes of the last commit are
+never written over, the nodes an update takes pointers from are replaced by
+new ones. A page freed by an update is only handed out by the next ones, once
+the tree of the update is committed and no longer points to it.
+*/
+const FREE_LIST_HEADER = 2 + 8 + 8 + 4 + 8
+const FREE_LIST_CAP = (PAGE_SIZE - ENCRYPT_RESERVED - FREE_LIST_HEADER) / 8
+
+func flnSize(node []byte) int {
+	return int(binary.LittleEndian.Uint16(node[0:]))
+}
+
+func flnTotal(node []byte) uint64 {
+	return binary.LittleEndian.Uint64(node[2:])
+}
+
+func flnNext(node []byte) uint64 {
+	return binary.LittleEndian.Uint64(node[10:])
+}
+
+func flnChecksum(node []byte) uint32 {
+	return binary.LittleEndian.Uint32(node[18:])
+}
+
+// Computes the checksum of the node, the header field itself is left out.
+func flnComputeChecksum(node []byte) uint32 {
+	crc := crc32.ChecksumIEEE(node[:18])
+	return crc32.Update(crc, crc32.IEEETable, node[22:])
+}
+
+func flnCommit(node []byte) uint64 {
+	return binary.LittleEndian.Uint64(node[22:])
+}
+
+func flnPtr(node []byte, idx int) uint64 {
+	return binary.LittleEndian.Uint64(node[FREE_LIST_HEADER+8*idx:])
+}
+
+func flnSetHeader(node []byte, size int, total, next, commit uint64) {
+	binary.LittleEndian.PutUint16(node[0:], uint16(size))
+	binary.LittleEndian.PutUint64(node[2:], total)
+	binary.LittleEndian.PutUint64(node[10:], next)
+	binary.LittleEndian.PutUint64(node[22:], commit)
+}
+
+func flnSetPtr(node []byte, idx int, ptr uint64) {
+	binary.LittleEndian.PutUint64(node[FREE_LIST_HEADER+8*idx:], ptr)
+}
+
+// Stores the checksum of the node, must be called after it's complete.
+func flnSetChecksum(node []byte) {
+	binary.LittleEndian.PutUint32(node[18:], flnComputeChecksum(node))
+}
+
+// The free pages of the database.
+type FreeList struct {
+	head uint64
+
+	// callbacks for managing on-disk pages
+	get    func(uint64) []byte  // dereference a pointer
+	new    func([]byte) uint64  // append a new page
+	use    func(uint64, []byte) // reuse a page
+	commit func() uint64        // number of the update, stamped in the new nodes
+}
+
+// Number of free pages.
+func (fl *FreeList) Total() int {
+	if fl.head == 0 {
+		return 0
+	}
+	return int(flnTotal(fl.node(fl.head)))
+}
+
+// Reads a node, panics with a `*btree.ChecksumError` if it's damaged.
+func (fl *FreeList) node(ptr uint64) []byte {
+	node := fl.get(ptr)
+	if sum := flnComputeChecksum(node); sum != flnChecksum(node) {
+		panic(&btree.ChecksumError{Page: ptr, Stored: flnChecksum(node), Computed: sum})
+	}
+	return node
+}
+
+// Returns the `topn`-th free page, counting from the head. Pages are taken in
+// this order, the first `n` taken are removed by `Update(n, ...)`.
+func (fl *FreeList) Get(topn int) uint64 {
+	if topn < 0 || topn >= fl.Total() {
+		panic(fmt.Sprintf("kv: free page %d out of %d", topn, fl.Total()))
+	}
+
+	node := fl.node(fl.head)
+	for flnSize(node) <= topn {
+		topn -= flnSize(node)
+		node = fl.node(flnNext(node))
+	}
+	return flnPtr(node, flnSize(node)-topn-1)
+}
+
+// Removes the first `popn` pages and adds the `freed` ones. The nodes pages
+// were taken from are freed as well, and the pointers left in them written
+// again with the freed ones into new nodes, placed in pages that were free
+// before the update when there are some.
+func (fl *FreeList) Update(popn int, freed []uint64) {
+	if popn > fl.Total() {
+		panic(fmt.Sprintf("kv: %d free pages taken out of %d", popn, fl.Total()))
+	}
+	if popn == 0 && len(freed) == 0 {
+		return
+	}
+
+	// take the nodes holding the popped pages, and the head at least so that
+	// the new nodes have pages to go in
+	total := uint64(fl.Total())
+	var push, reusable []uint64
+	for fl.head != 0 && (popn > 0 || len(push) == 0) {
+		node := fl.node(fl.head)
+		size := flnSize(node)
+		push = append(push, fl.head)
+
+		if popn >= size {
+			popn -= size
+		} else {
+			for i := 0; i < size-popn; i++ {
+				reusable = append(reusable, flnPtr(node, i))
+			}
+			popn = 0
+		}
+
+		total -= uint64(size)
+		fl.head = flnNext(node)
+	}
+	push = append(push, freed...)
+
+	// the new nodes go in pages that were free before, which then aren't
+	// listed, the file grows for the rest
+	var reuse []uint64
+	for len(reusable) > 0 && len(reuse) < flNodes(len(push)+len(reusable)) {
+		reuse = append(reuse, reusable[len(reusable)-1])
+		reusable = reusable[:len(reusable)-1]
+	}
+	if len(reuse) > flNodes(len(push)+len(reusable)) {
+		// one too many after the last one taken
+		reusable = append(reusable, reuse[len(reuse)-1])
+		reuse = reuse[:len(reuse)-1]
+	}
+	push = append(push, reusable...)
+
+	total += uint64(len(push))
+	for len(push) > 0 {
+		node := make([]byte, PAGE_SIZE)
+		size := min(len(push), FREE_LIST_CAP)
+		flnSetHeader(node, size, total, fl.head, fl.commit())
+		for i, ptr := range push[:size] {
+			flnSetPtr(node, i, ptr)
+		}
+		flnSetChecksum(node)
+		push = push[size:]
+
+		if len(reuse) > 0 {
+			fl.head, reuse = reuse[0], reuse[1:]
+			fl.use(fl.head, node)
+		} else {
+			fl.head = fl.new(node)
+		}
+	}
+}
+
+// Replaces the list with one of the `free` pages, written into the `nodes`
+// pages, `flNodes(len(free))` of them.
+func (fl *FreeList) reset(free, nodes []uint64) {
+	if len(nodes) != flNodes(len(free)) {
+		panic(fmt.Sprintf("kv: %d nodes for %d free pages", len(nodes), len(free)))
+	}
+
+	fl.head = 0
+	for i, ptr := range nodes {
+		node := make([]byte, PAGE_SIZE)
+		size := min(len(free)-i*FREE_LIST_CAP, FREE_LIST_CAP)
+		flnSetHeader(node, size, uint64(len(free)), fl.head, fl.commit())
+		for j, ptr := range free[i*FREE_LIST_CAP:][:size] {
+			flnSetPtr(node, j, ptr)
+		}
+		flnSetChecksum(node)
+		fl.use(ptr, node)
+		fl.head = ptr
+	}
+}
+
+// Number of nodes needed to list `n` pages.
+func flNodes(n int) int {
+	return (n + FREE_LIST_CAP - 1) / FREE_LIST_CAP
+}
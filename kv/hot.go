@@ -0,0 +1,149 @@
+package kv
+
+import (
+	"container/list"
+	"sync"
+)
+
+// bytes of the keys and values in the hot-key cache when `KV.HotKeyBytes` is 0
+const HOT_KEY_BYTES = 1 << 20
+
+/*
+With `KV.HotKeys` set, `Get` keeps the values it reads in a cache of that
+many keys, least recently used first out, and looks there before going down
+the tree: a few keys read far more than the others are found without a
+lookup. The cache holds copies, bounded by `KV.HotKeyBytes` of keys and
+values too, a value over it isn't kept.
+
+It's filled by the readers under the shared lock of the database and emptied
+under the lock of the writer, so a reader never finds a value an update
+replaced: `Set`, `Del` and the transactions drop the keys they update, the
+bulk updates and a tree opened again, on a failed flush, drop every key. A
+transaction rolled back has dropped keys for nothing, they're read again.
+The snapshots and transactions read their own trees, not the cache.
+*/
+
+// Stats of the hot-key cache, see `KV.HotKeys`.
+type HotKeyStats struct {
+	Keys   int    // in the cache
+	Bytes  int    // of the keys and values in the cache
+	Hits   uint64 // reads found in the cache
+	Misses uint64 // reads that went down the tree
+}
+
+// Fraction of the reads found in the cache.
+func (hs HotKeyStats) HitRate() float64 {
+	if hs.Hits+hs.Misses == 0 {
+		return 0
+	}
+	return float64(hs.Hits) / float64(hs.Hits+hs.Misses)
+}
+
+// A key in the cache.
+type hotKey struct {
+	key string
+	val []byte
+}
+
+// The values of the keys last read, a nil cache holds none.
+type hotKeys struct {
+	mu       sync.Mutex
+	size     int // keys
+	maxBytes int
+	keys     map[string]*list.Element
+	lru      *list.List // of hot keys, the most recently used in front
+	stats    HotKeyStats
+}
+
+// Returns a cache of `size` keys and `maxBytes` of keys and values, nil if
+// `size` isn't positive.
+func newHotKeys(size, maxBytes int) *hotKeys {
+	if size <= 0 {
+		return nil
+	}
+	if maxBytes <= 0 {
+		maxBytes = HOT_KEY_BYTES
+	}
+	return &hotKeys{size: size, maxBytes: maxBytes, keys: map[string]*list.Element{}, lru: list.New()}
+}
+
+// Returns the value of a key, if it's in the cache.
+func (h *hotKeys) get(key []byte) ([]byte, bool) {
+	if h == nil {
+		return nil, false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	elem := h.keys[string(key)]
+	if elem == nil {
+		h.stats.Misses++
+		return nil, false
+	}
+	h.stats.Hits++
+	h.lru.MoveToFront(elem)
+	return elem.Value.(*hotKey).val, true
+}
+
+// Keeps a copy of the value of a key, dropping the least recently used ones
+// to make room.
+func (h *hotKeys) put(key, val []byte) {
+	if h == nil || len(key)+len(val) > h.maxBytes {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(h.keys[string(key)])
+	hk := &hotKey{key: string(key), val: append([]byte(nil), val...)}
+	h.keys[hk.key] = h.lru.PushFront(hk)
+	h.stats.Keys++
+	h.stats.Bytes += len(key) + len(val)
+	for h.stats.Keys > h.size || h.stats.Bytes > h.maxBytes {
+		h.remove(h.lru.Back())
+	}
+}
+
+// Drops a key, updated by the writer.
+func (h *hotKeys) drop(key []byte) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(h.keys[string(key)])
+}
+
+// Drops every key.
+func (h *hotKeys) clear() {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	clear(h.keys)
+	h.lru.Init()
+	h.stats.Keys, h.stats.Bytes = 0, 0
+}
+
+func (h *hotKeys) remove(elem *list.Element) {
+	if elem == nil {
+		return
+	}
+	hk := h.lru.Remove(elem).(*hotKey)
+	delete(h.keys, hk.key)
+	h.stats.Keys--
+	h.stats.Bytes -= len(hk.key) + len(hk.val)
+}
+
+func (h *hotKeys) hotKeyStats() HotKeyStats {
+	if h == nil {
+		return HotKeyStats{}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats
+}
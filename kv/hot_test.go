@@ -0,0 +1,115 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// `Get` finds the keys it read in the cache until they're updated, by `Set`,
+// `Del`, a transaction or a bulk update, and the cache stays within its
+// bounds.
+func TestHotKeys(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), HotKeys: 4, HotKeyBytes: 100}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := range 10 {
+		db.Set(fmt.Appendf(nil, "key%d", i), fmt.Appendf(nil, "val%d", i))
+	}
+
+	get := func(key, want string, hit bool) {
+		t.Helper()
+		before := db.Stats().HotKeys
+		got, ok := db.Get([]byte(key))
+		if ok != (want != "") || string(got) != want {
+			t.Fatalf("get %q: %q, %v, want %q", key, got, ok, want)
+		}
+		after := db.Stats().HotKeys
+		if hits := after.Hits - before.Hits; hits != map[bool]uint64{false: 0, true: 1}[hit] {
+			t.Fatalf("get %q: %d hits, want a hit %v", key, hits, hit)
+		}
+	}
+	get("key1", "val1", false)
+	get("key1", "val1", true)
+
+	db.Set([]byte("key1"), []byte("new"))
+	get("key1", "new", false)
+	get("key1", "new", true)
+	db.Del([]byte("key1"))
+	get("key1", "", false)
+	get("key1", "", false)
+
+	get("key2", "val2", false)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Set([]byte("key2"), []byte("tx"))
+	if _, err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	get("key2", "tx", false)
+
+	get("key3", "val3", false)
+	if _, err := db.TruncateBefore([]byte("key4")); err != nil {
+		t.Fatal(err)
+	}
+	get("key3", "", false)
+
+	// the least recently used keys make room
+	for _, key := range []string{"key5", "key6", "key7", "key8", "key9"} {
+		get(key, "val"+key[3:], false)
+	}
+	get("key5", "val5", false)
+	get("key9", "val9", true)
+	if stats := db.Stats().HotKeys; stats.Keys != 4 || stats.Bytes != 4*8 {
+		t.Fatalf("%d keys of %d bytes in the cache", stats.Keys, stats.Bytes)
+	}
+	// and so do the large ones, a value over the bound isn't kept
+	db.Set([]byte("large"), bytes.Repeat([]byte("v"), 80))
+	get("large", strings.Repeat("v", 80), false)
+	if stats := db.Stats().HotKeys; stats.Keys != 2 || stats.Bytes != 8+85 {
+		t.Fatalf("%d keys of %d bytes in the cache", stats.Keys, stats.Bytes)
+	}
+	db.Set([]byte("huge"), bytes.Repeat([]byte("v"), 100))
+	get("huge", strings.Repeat("v", 100), false)
+	get("huge", strings.Repeat("v", 100), false)
+}
+
+// Reads of keys picked with a zipfian distribution, a few keys take most of
+// them, with and without the hot-key cache.
+func BenchmarkHotKeys(b *testing.B) {
+	const keys = 100000
+	for _, hot := range []int{0, 1000} {
+		b.Run(fmt.Sprintf("hot=%d", hot), func(b *testing.B) {
+			db := &KV{Path: filepath.Join(b.TempDir(), "test.db"), HotKeys: hot}
+			if err := db.Open(); err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			tx, err := db.Begin()
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := range keys {
+				tx.Set(fmt.Appendf(nil, "key%08d", i), bytes.Repeat([]byte("v"), 100))
+			}
+			if _, err := tx.Commit(); err != nil {
+				b.Fatal(err)
+			}
+
+			zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, keys-1)
+			for b.Loop() {
+				if _, ok := db.Get(fmt.Appendf(nil, "key%08d", zipf.Uint64())); !ok {
+					b.Fatal("key not found")
+				}
+			}
+			b.ReportMetric(db.Stats().HotKeys.HitRate(), "hits/op")
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package kv
+
+import "errors"
+
+var ErrNoInPlace = errors.New("kv: the store can't write in place")
+
+/*
+A transaction begun by `BeginInPlace` writes over the pages it frees rather
+than leaving them for the next commits: every `Set` or `Del` copies the
+path to its key like any update, and the pages of the paths it replaced are
+handed out again by the next ones. A bulk update going through the same
+leaves over and over writes each of them once per commit, not once per key.
+A `Set` of a value of the size the key already holds, such as a counter,
+keeps the layout of its leaf, see `btree.BTree.UpdateInPlace`: its bytes are
+written over the old ones in the copy, and nothing is split or merged.
+
+Nothing reads a page freed by an earlier step of the transaction: not the
+transaction, whose tree no longer points to it, and not anyone else, the
+database is held until it ends, and `BeginInPlace` waits for the snapshots
+and backups to end, which could read the last commit, and keeps new ones
+out, like `Compact`.
+
+The pages written over can be the ones of the last commit. With a WAL that
+costs nothing, the pages reach the file only once the commit is in the log.
+Without it they're written into the file before the meta page: a crash or
+a failed write in between leaves the last commit damaged rather than
+whole, and a failed flush fails the store with `ErrStoreFailed`. A
+compressed file writes its packed pages anew, as usual.
+*/
+
+// A `PageStore` that can write an update over the pages it frees, see
+// `KV.BeginInPlace`.
+type InPlaceStore interface {
+	PageStore
+	// Makes the update being made keep the pages it frees for `ReusePages`,
+	// until it's flushed or aborted.
+	WriteInPlace()
+	// Lets `AllocPage` hand out the pages the update freed so far, which
+	// nothing reads anymore.
+	ReusePages()
+}
+
+// Starts a transaction that writes over the pages it frees, see `Begin`,
+// once the snapshots and backups end, and keeps new ones out until it ends.
+// Without a WAL a crash during its commit can damage the database. Fails
+// with `ErrReadOnly` on a read-only database, or with `ErrNoInPlace` for a
+// store that isn't an `InPlaceStore`.
+func (db *KV) BeginInPlace() (*TX, error) {
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	db.exclusive.Lock()
+	tx, err := db.Begin()
+	if err != nil {
+		db.exclusive.Unlock()
+		return nil, err
+	}
+	tx.inPlace = true
+	store, ok := db.store.(InPlaceStore)
+	if !ok {
+		tx.Rollback()
+		return nil, ErrNoInPlace
+	}
+	store.WriteInPlace()
+	return tx, nil
+}
+
+func (fs *fileStore) WriteInPlace() {
+	fs.page.inPlace = true
+}
+
+func (fs *fileStore) ReusePages() {
+	for _, ptr := range fs.page.freed {
+		// freed, not reused since
+		if page, ok := fs.page.updates[ptr]; ok && page == nil {
+			fs.page.reuse = append(fs.page.reuse, ptr)
+		}
+	}
+	fs.page.freed = fs.page.freed[:0]
+}
+
+// Packed pages aren't written over.
+func (cs *compressStore) WriteInPlace() {}
@@ -0,0 +1,175 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Sets every key of a bulk update in a transaction, in place or not, and
+// returns the pages of the file once it's committed.
+func bulkUpdate(t testing.TB, db *KV, inPlace bool, keys int, gen int) uint64 {
+	t.Helper()
+	begin := db.Begin
+	if inPlace {
+		begin = db.BeginInPlace
+	}
+	tx, err := begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range keys {
+		if err := tx.Set(fmt.Appendf(nil, "key%06d", i), fmt.Appendf(nil, "val%d-%d", i, gen)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return db.store.(*fileStore).page.flushed
+}
+
+// A bulk update in place takes the pages it frees again rather than new
+// ones, commits the same pairs, with or without the WAL, and keeps the
+// snapshots out while it runs.
+func TestInPlace(t *testing.T) {
+	const keys = 5000
+	for _, wal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("wal=%v", wal), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			db := &KV{Path: path, WAL: wal}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { db.Close() }()
+			base := bulkUpdate(t, db, false, keys, 0)
+			copied := bulkUpdate(t, db, false, keys, 1) - base
+			start := db.Stats().IO.PagesWritten
+			inPlace := bulkUpdate(t, db, true, keys, 2) - base - copied
+			if written := db.Stats().IO.PagesWritten - start; !wal && written > base {
+				t.Fatalf("%d pages written in place for %d in the tree", written, base)
+			}
+			if inPlace != 0 {
+				t.Fatalf("%d pages appended in place, %d copied", inPlace, copied)
+			}
+
+			tx, err := db.BeginInPlace()
+			if err != nil {
+				t.Fatal(err)
+			}
+			began := make(chan *ReadTX)
+			go func() {
+				snap, err := db.BeginRead()
+				if err != nil {
+					t.Error(err)
+				}
+				began <- snap
+			}()
+			select {
+			case <-began:
+				t.Fatal("a snapshot began during an update in place")
+			case <-time.After(50 * time.Millisecond):
+			}
+			tx.Set([]byte("key000000"), []byte("rolled back"))
+			tx.Rollback()
+			(<-began).Close()
+
+			db.Close()
+			db = &KV{Path: path, WAL: wal}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{}
+			for i := range keys {
+				want[fmt.Sprintf("key%06d", i)] = fmt.Sprintf("val%d-2", i)
+			}
+			checkKV(t, db, want)
+			if err := db.tree.Verify(); err != nil {
+				t.Fatal(err)
+			}
+			freePages(t, db.store.(*fileStore))
+		})
+	}
+
+	mem := &KV{}
+	if err := mem.OpenMemory(); err != nil {
+		t.Fatal(err)
+	}
+	defer mem.Close()
+	if _, err := mem.BeginInPlace(); !errors.Is(err, ErrNoInPlace) {
+		t.Fatalf("in memory: %v", err)
+	}
+	// the failed one let go
+	snap, err := mem.BeginRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap.Close()
+}
+
+// In place, values of the size their keys hold are written over the old
+// ones, while values of another size and new keys are inserted as usual.
+func TestInPlaceSameSize(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+	const keys = 2000
+	bulkUpdate(t, db, false, keys, 0)
+
+	tx, err := db.BeginInPlace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{}
+	for i := range keys {
+		key := fmt.Sprintf("key%06d", i)
+		val := fmt.Sprintf("val%d-1", i) // the same size
+		switch i % 4 {
+		case 1:
+			val = fmt.Sprintf("longer val%d-1", i)
+		case 2:
+			key = fmt.Sprintf("key%06d-new", i)
+		}
+		if err := tx.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		if i%4 == 2 {
+			want[fmt.Sprintf("key%06d", i)] = fmt.Sprintf("val%d-0", i)
+		}
+		want[key] = val
+	}
+	if _, err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkKV(t, db, want)
+	if err := db.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	freePages(t, db.store.(*fileStore))
+}
+
+// Bulk updates of every key of a database, reporting the pages written by
+// each and the size of the file they leave.
+func BenchmarkInPlace(b *testing.B) {
+	const keys = 10000
+	for _, inPlace := range []bool{false, true} {
+		b.Run(fmt.Sprintf("inplace=%v", inPlace), func(b *testing.B) {
+			db := &KV{Path: filepath.Join(b.TempDir(), "test.db")}
+			if err := db.Open(); err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			bulkUpdate(b, db, inPlace, keys, 0)
+
+			start := db.Stats().IO.PagesWritten
+			gen := 0
+			for b.Loop() {
+				gen++
+				bulkUpdate(b, db, inPlace, keys, gen)
+			}
+			b.ReportMetric(float64(db.Stats().IO.PagesWritten-start)/float64(gen), "pages/op")
+			b.ReportMetric(float64(db.store.(*fileStore).page.flushed), "file-pages")
+		})
+	}
+}
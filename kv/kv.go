@@ -0,0 +1,332 @@
+package kv
+
+import (
+	"errors"
+	"iter"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"db/btree"
+)
+
+// size of every page of the file
+const PAGE_SIZE = btree.BTREE_PAGE_SIZE
+
+var (
+	ErrBadFile            = errors.New("kv: bad database file")
+	ErrNotADatabase       = errors.New("kv: not a database file")
+	ErrUnsupportedVersion = errors.New("kv: unsupported database format")
+	ErrPageSizeMismatch   = errors.New("kv: database page size mismatch")
+	ErrReadOnly           = errors.New("kv: read-only database")
+	ErrStoreFailed        = errors.New("kv: a commit failed after its meta page was written, reopen the database")
+)
+
+// A key-value store persisted to the file at `Path`, which is mapped into
+// memory to read the pages, or kept in any other `PageStore`. It's safe for
+// concurrent use, see `commitUpdate`.
+type KV struct {
+	Path             string
+	Sync             SyncMode
+	SyncInterval     time.Duration             // for `SyncPeriodic`, 0 means SYNC_INTERVAL
+	LockTimeout      time.Duration             // wait for another process to close the file
+	WAL              bool                      // commit updates to a log file, see `WAL_SUFFIX`
+	FlushInterval    time.Duration             // for the WAL, 0 means FLUSH_INTERVAL
+	CacheSize        int                       // bytes of the buffer pool, 0 maps the file unless DirectIO or Key is set
+	DirectIO         bool                      // bypass the OS cache, CacheSize defaults to CACHE_SIZE
+	MemoryLimit      int                       // bytes of pages held in memory, 0 for no limit, see `MEMORY_CACHE_PERCENT`
+	Extent           int                       // bytes the file grows by at least, 0 means FILE_EXTENT
+	Compress         bool                      // pack the pages of a new file compressed, see `META_FLAG_COMPRESSED`
+	Key              []byte                    // AES-256 key of an encrypted file, or to encrypt a new one, see `META_FLAG_ENCRYPTED`
+	OldKey           []byte                    // the key replaced by a `Rekey` cut short, until `Compact` ends it
+	Retry            *RetryPolicy              // for the writes of the files failing with transient errors, nil means DEFAULT_RETRY
+	ValueLog         int                       // keep the values of this many bytes or more of a new file out of the tree, see `META_FLAG_VLOG`
+	RepairOnWrite    bool                      // merge the under-filled nodes the updates go through, see `btree.Config.RepairOnWrite`
+	Scratch          *btree.ScratchPool        // shared with other databases to bound the nodes their updates are built in, see `btree.Config.Scratch`
+	Changes          func(Change)              // passed every key set or removed once it's committed, in commit order, see `Change`
+	CaptureOldValues bool                      // read the value of a key removed into `Change.OldVal`
+	HotKeys          int                       // values kept by `Get` for the keys read the most, 0 for none, see `HotKeyStats`
+	HotKeyBytes      int                       // of the keys and values kept for `HotKeys`, 0 means HOT_KEY_BYTES
+	Allocator        func(PageSpace) Allocator // picks the pages of the updates of a file, nil means FreeListAllocator
+
+	readOnly bool
+	wrapFile func(*os.File) dbFile // wraps the files opened, to inject faults in the tests
+	store    PageStore
+	tree     *btree.BTree
+	vlog     *valueLog    // of the file, nil without one
+	hot      *hotKeys     // see `HotKeys`, nil without one
+	mu       sync.RWMutex // held by readers, and by the writer committing a group
+	commit   struct {
+		mu      sync.Mutex
+		queue   []*pendingUpdate // waiting for the next group
+		leading bool             // a writer is committing the groups
+	}
+	snapshots map[*ReadTX]struct{} // open and not expired, under mu
+	stream    sync.Mutex           // held while the changes of a commit are passed to `Changes`
+	exclusive sync.RWMutex         // held by `Compact`, shared by `Backup` and the snapshots, and taken by `Close` to wait for them
+	logical   atomic.Uint64        // bytes of the keys and values updated, see `IOStats`
+}
+
+// Opens the database, creating the file if it doesn't exist. Fails with
+// `ErrDatabaseLocked` if another process has it open for longer than
+// `LockTimeout`.
+func (db *KV) Open() error {
+	return db.openFile(false)
+}
+
+// Opens an existing database for reading only, sharing the file with other
+// readers but not with a writer. `Set` and `Del` fail with `ErrReadOnly`, and
+// the file is never written to.
+func (db *KV) OpenReadOnly() error {
+	return db.openFile(true)
+}
+
+func (db *KV) openFile(readOnly bool) error {
+	fs, err := openFileStore(db, readOnly)
+	if err != nil {
+		return err
+	}
+	var store PageStore = fs
+	if fs.meta.flags&META_FLAG_COMPRESSED != 0 {
+		if store, err = newCompressStore(fs); err != nil {
+			fs.Close()
+			return err
+		}
+	}
+
+	db.readOnly = readOnly
+	db.vlog = fs.vlog
+	return db.OpenStore(store)
+}
+
+// Opens the database kept in `store`, which is closed along with it.
+func (db *KV) OpenStore(store PageStore) error {
+	db.store = store
+	db.hot = newHotKeys(db.HotKeys, db.HotKeyBytes)
+	if err := db.openTree(store.Root()); err != nil {
+		db.Close()
+		return err
+	}
+	return nil
+}
+
+// Closes the store, once the group of updates being committed is, a
+// transaction is, the snapshots are, and a `Backup` or `Compact` running is. With a WAL, what's left in it is
+// checkpointed first. The values returned by `Get` are no longer valid.
+func (db *KV) Close() {
+	db.exclusive.Lock()
+	defer db.exclusive.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.store != nil {
+		db.store.Close()
+		db.store = nil
+	}
+	db.vlog = nil
+}
+
+// Flushes every committed update to disk, whatever the sync mode. Only
+// needed with `SyncPeriodic` and `SyncNone`, the other modes sync every
+// commit.
+func (db *KV) Flush() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if store, ok := db.store.(SyncStore); ok {
+		return store.Sync()
+	}
+	return nil
+}
+
+// Writes the updates in the WAL into the database file and empties it, which
+// is otherwise done once it holds `WAL_CHECKPOINT_PAGES`.
+func (db *KV) Checkpoint() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if store, ok := db.store.(CheckpointStore); ok {
+		return store.Checkpoint()
+	}
+	return nil
+}
+
+// Returns the stats of the database.
+func (db *KV) Stats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var stats Stats
+	if store, ok := db.store.(StatsStore); ok {
+		stats = store.Stats()
+	}
+	stats.IO.Logical = db.logical.Load()
+	stats.HotKeys = db.hot.hotKeyStats()
+	return stats
+}
+
+// Returns the value of a key and whether it was found. It points into the
+// pages of the store unless it's stored in overflow pages or the value log,
+// it must not be modified and is only valid until the next update, by any
+// goroutine. With `HotKeys` it's looked for in the cache first.
+func (db *KV) Get(key []byte) ([]byte, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if val, ok := db.hot.get(key); ok {
+		return val, true
+	}
+	val, ok := db.tree.Get(key)
+	if !ok {
+		return nil, false
+	}
+	val = db.loadVal(val)
+	db.hot.put(key, val)
+	return val, true
+}
+
+// Yields every key-value pair whose key starts with `prefix` in key order,
+// reading ahead of the scan, see `btree.BTree.Scan`. Updates wait for the
+// scan to end, the loop must not make any.
+func (db *KV) Scan(prefix []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, val []byte) bool) {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+
+		for key, val := range db.tree.Scan(prefix) {
+			if !yield(key, db.loadVal(val)) {
+				return
+			}
+		}
+	}
+}
+
+// Inserts or updates a key and writes the change to the store.
+func (db *KV) Set(key, val []byte) error {
+	var changes []Change
+	err := db.updateStreamed(func() error {
+		stored, err := db.storeVal(val)
+		if err != nil {
+			return err
+		}
+		db.hot.drop(key)
+		if err := db.tree.Insert(key, stored); err != nil {
+			return err
+		}
+		if db.Changes != nil {
+			changes = []Change{{Kind: CHANGE_SET, Key: key, Val: val}}
+		}
+		return nil
+	}, &changes)
+	if err == nil {
+		db.logical.Add(uint64(len(key) + len(val)))
+	}
+	return err
+}
+
+// Removes a key and writes the change to the store, returns whether it was
+// there.
+func (db *KV) Del(key []byte) (bool, error) {
+	var deleted bool
+	var changes []Change
+	err := db.updateStreamed(func() error {
+		var change Change
+		if db.Changes != nil {
+			change = db.removal(db.tree.Get, key)
+		}
+		db.hot.drop(key)
+		var err error
+		if deleted, err = db.tree.Delete(key); deleted && db.Changes != nil {
+			changes = []Change{change}
+		}
+		return err
+	}, &changes)
+	if err == nil && deleted {
+		db.logical.Add(uint64(len(key)))
+	}
+	return deleted, err
+}
+
+// Removes every key smaller than `key`, the oldest ones of time-ordered keys,
+// and writes the change to the store. Returns how many there were. The pages
+// freed are reused by the next updates, `Compact` gives them back. With
+// `Changes` set, each key is streamed as a removal: they're read before the
+// subtrees are dropped, which costs a scan of the keys removed.
+func (db *KV) TruncateBefore(key []byte) (int, error) {
+	var count int
+	var changes []Change
+	err := db.updateStreamed(func() error {
+		db.hot.clear()
+		if db.Changes != nil {
+			changes = db.removalsOfFirst(db.tree.Rank(key))
+		}
+		var err error
+		count, err = db.tree.TruncateBefore(key)
+		return err
+	}, &changes)
+	return count, err
+}
+
+// Applies an update to the tree and flushes its pages, along with the ones of
+// concurrent updates. If either fails the database is left as it was before
+// the update. It drops every key of the hot-key cache, see `HotKeys`.
+func (db *KV) update(op func() error) error {
+	return db.updateStreamed(func() error {
+		db.hot.clear()
+		return op()
+	}, nil)
+}
+
+// Applies an update like `update`, then passes the changes it left in
+// `*changes` to `Changes` once it's committed.
+func (db *KV) updateStreamed(op func() error, changes *[]Change) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	return db.commitUpdate(op, changes)
+}
+
+// Sets up the tree at `root` on the pages of the store.
+func (db *KV) openTree(root uint64) error {
+	tree, err := db.newTree(root)
+	if err != nil {
+		return err
+	}
+
+	db.tree = tree
+	db.hot.clear()
+	return nil
+}
+
+// Returns a tree at `root` on the pages of the store.
+func (db *KV) newTree(root uint64) (*btree.BTree, error) {
+	return btree.New(db.treeConfig(root))
+}
+
+// Returns the config of a tree at `root` on the pages of the store.
+func (db *KV) treeConfig(root uint64) btree.Config {
+	cfg := btree.Config{
+		PageSize:      PAGE_SIZE,
+		RepairOnWrite: db.RepairOnWrite,
+		Scratch:       db.Scratch,
+		Root:          root,
+		Get:           db.store.ReadPage,
+		New:           db.store.AllocPage,
+		Del:           db.store.FreePage,
+	}
+	if store, ok := db.store.(ReserveStore); ok {
+		cfg.Reserved = store.Reserved()
+	}
+	if store, ok := db.store.(PrefetchStore); ok {
+		cfg.Prefetch = store.Prefetch
+	}
+	if store, ok := db.store.(BackupStore); ok {
+		cfg.Commit = store.NextCommit
+	}
+
+	return cfg
+}
@@ -0,0 +1,443 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"db/btree"
+)
+
+func openTestKV(t *testing.T, path string) *KV {
+	t.Helper()
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+// Like `openTestKV`, without syncing the commits, for the tests that load
+// many keys one update at a time and don't check durability.
+func openNoSyncKV(t *testing.T, path string) *KV {
+	t.Helper()
+	db := &KV{Path: path, Sync: SyncNone}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+func checkKV(t *testing.T, db *KV, want map[string]string) {
+	t.Helper()
+	for key, val := range want {
+		got, ok := db.Get([]byte(key))
+		if !ok || string(got) != val {
+			t.Fatalf("get %q: %d bytes, %v, want %d bytes", key, len(got), ok, len(val))
+		}
+	}
+}
+
+// Updates are visible right away and still there once the file is reopened,
+// values longer than a page included.
+func TestKV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+
+	want := map[string]string{}
+	for i := range 2000 {
+		key, val := fmt.Sprintf("key%05d", i), fmt.Sprintf("val%d", i)
+		if i%100 == 0 {
+			val = strings.Repeat("v", 3*PAGE_SIZE+i)
+		}
+		if err := db.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = val
+	}
+	for i := 0; i < 2000; i += 3 {
+		key := fmt.Sprintf("key%05d", i)
+		if deleted, err := db.Del([]byte(key)); err != nil || !deleted {
+			t.Fatalf("del %q: %v, %v", key, deleted, err)
+		}
+		delete(want, key)
+	}
+	if deleted, err := db.Del([]byte("missing")); err != nil || deleted {
+		t.Fatalf("del missing: %v, %v", deleted, err)
+	}
+	checkKV(t, db, want)
+
+	db.Close()
+	db = openTestKV(t, path)
+	checkKV(t, db, want)
+	if _, ok := db.Get([]byte("key00000")); ok {
+		t.Fatal("deleted key found after reopening")
+	}
+	if err := db.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// and it keeps going from there
+	if err := db.Set([]byte("key00000"), []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	want["key00000"] = "again"
+	db.Close()
+	checkKV(t, openTestKV(t, path), want)
+}
+
+// Databases sharing a scratch pool written to at once never have more scratch
+// nodes than it allows.
+func TestSharedScratch(t *testing.T) {
+	pool := btree.NewScratchPool(10)
+	dbs := make([]*KV, 4)
+	for i := range dbs {
+		dbs[i] = &KV{Path: filepath.Join(t.TempDir(), "test.db"), Sync: SyncNone, Scratch: pool}
+		if err := dbs[i].Open(); err != nil {
+			t.Fatal(err)
+		}
+		defer dbs[i].Close()
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4*len(dbs))
+	for _, db := range dbs {
+		for w := range 4 {
+			wg.Go(func() {
+				for i := range 500 {
+					key := fmt.Sprintf("key%d-%05d", w, i)
+					if err := db.Set([]byte(key), []byte(strings.Repeat(key, 20))); err != nil {
+						errs <- err
+						return
+					}
+				}
+			})
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{}
+	for w := range 4 {
+		for i := range 500 {
+			key := fmt.Sprintf("key%d-%05d", w, i)
+			want[key] = strings.Repeat(key, 20)
+		}
+	}
+	for _, db := range dbs {
+		checkKV(t, db, want)
+	}
+	if peak := pool.Peak(); peak > 10 {
+		t.Fatalf("%d scratch nodes at once, at most 10", peak)
+	}
+}
+
+// The file is only taken with the signature in its meta page, or with a meta
+// page that was never written.
+func TestMetaPage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	if err := db.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	// a crash before the first commit leaves the file grown, but not the meta page
+	for _, off := range META_OFFSETS {
+		if _, err := fp.WriteAt(make([]byte, META_SIZE), off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db = openTestKV(t, path)
+	if _, ok := db.Get([]byte("k")); ok {
+		t.Fatal("key found without a meta page")
+	}
+	db.Close()
+
+	for _, off := range META_OFFSETS {
+		if _, err := fp.WriteAt([]byte("not a database!!"), off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db = &KV{Path: path}
+	if err := db.Open(); !errors.Is(err, ErrNotADatabase) {
+		t.Fatalf("open with a bad magic: %v", err)
+	}
+}
+
+// Files of another format, or cut short, are refused with the reason.
+func TestFileHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	if err := db.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	orig, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// damages both copies of the meta page
+	both := func(damage func(meta []byte)) func([]byte) []byte {
+		return func(b []byte) []byte {
+			for _, off := range META_OFFSETS {
+				damage(b[off:])
+			}
+			return b
+		}
+	}
+
+	for _, test := range []struct {
+		name   string
+		damage func([]byte) []byte
+		err    error
+	}{
+		{"magic", both(func(b []byte) { b[0] = 'X' }), ErrNotADatabase},
+		{"text", func([]byte) []byte { return []byte("hello, world\n") }, ErrNotADatabase},
+		{"version", both(func(b []byte) { b[8] = DB_VERSION + 1 }), ErrUnsupportedVersion},
+		{"flags", both(func(b []byte) { b[14] = 16 }), ErrUnsupportedVersion},
+		{"page size", both(func(b []byte) { b[11] ^= 0x20 }), ErrPageSizeMismatch},
+		{"checksum", both(func(b []byte) { b[20] ^= 1 }), ErrBadFile},
+		{"truncated", func(b []byte) []byte { return b[:PAGE_SIZE+100] }, ErrBadFile},
+		{"too short", func(b []byte) []byte { return b[:PAGE_SIZE] }, ErrBadFile},
+	} {
+		if err := os.WriteFile(path, test.damage(bytes.Clone(orig)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		db := &KV{Path: path}
+		if err := db.Open(); !errors.Is(err, test.err) {
+			db.Close()
+			t.Fatalf("%s: open: %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+// Counts the pages of the free list, its nodes included, checking that every
+// page is listed once.
+func freePages(t *testing.T, fs *fileStore) int {
+	t.Helper()
+	seen := map[uint64]bool{}
+	mark := func(ptr uint64) {
+		if ptr == 0 || ptr >= fs.page.flushed || seen[ptr] {
+			t.Fatalf("free page %d of %d used", ptr, fs.page.flushed)
+		}
+		seen[ptr] = true
+	}
+
+	total := 0
+	for ptr := fs.free.head; ptr != 0; {
+		mark(ptr)
+		node := fs.ReadPage(ptr)
+		if flnChecksum(node) != flnComputeChecksum(node) {
+			t.Fatalf("free list node %d fails its checksum", ptr)
+		}
+		for i := range flnSize(node) {
+			mark(flnPtr(node, i))
+		}
+		total += flnSize(node)
+		ptr = flnNext(node)
+	}
+	if total != fs.free.Total() {
+		t.Fatalf("%d free pages listed, total %d", total, fs.free.Total())
+	}
+	return len(seen)
+}
+
+// Replaced pages are reused, so the file stops growing once updates free as
+// many pages as they take, and every page is either in the tree or free.
+func TestFreeList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+
+	checkPages := func() {
+		t.Helper()
+		fs := db.store.(*fileStore)
+		stats := db.tree.Stats()
+		used := 1 + stats.InternalNodes + stats.LeafNodes + stats.OverflowPages + uint64(freePages(t, fs))
+		if used != fs.page.flushed {
+			t.Fatalf("%d pages found, %d used", used, fs.page.flushed)
+		}
+	}
+
+	want := map[string]string{}
+	for i := range 1000 {
+		key := fmt.Sprintf("key%05d", i)
+		if err := db.Set([]byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = key
+	}
+	checkPages()
+
+	size := db.store.(*fileStore).page.flushed
+	for i := range 5000 {
+		key := fmt.Sprintf("key%05d", i%1000)
+		val := fmt.Sprintf("val%d", i)
+		if i%500 == 0 {
+			val = strings.Repeat("v", 2*PAGE_SIZE)
+		}
+		if err := db.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = val
+	}
+	checkPages()
+	if grown := db.store.(*fileStore).page.flushed; grown > size+10 {
+		t.Fatalf("file grew from %d to %d pages", size, grown)
+	}
+
+	// the deleted keys free most of the pages
+	for i := range 900 {
+		key := fmt.Sprintf("key%05d", i)
+		if _, err := db.Del([]byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, key)
+	}
+	checkPages()
+
+	db.Close()
+	db = openTestKV(t, path)
+	checkKV(t, db, want)
+	checkPages()
+	if err := db.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A meta page torn by a crash falls back to the copy of the commit before.
+func TestTornMeta(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	for i := range 10 {
+		if err := db.Set([]byte("k"), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seq := db.store.(*fileStore).seq
+	crashKV(db)
+
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	// half of the last copy written
+	if _, err := fp.WriteAt(make([]byte, META_SIZE/2), META_OFFSETS[seq%2]+META_SIZE/2); err != nil {
+		t.Fatal(err)
+	}
+	db = openTestKV(t, path)
+	checkKV(t, db, map[string]string{"k": "8"})
+	if err := db.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// and it goes on from there
+	if err := db.Set([]byte("k"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	checkKV(t, openTestKV(t, path), map[string]string{"k": "new"})
+}
+
+// A damaged page, of the tree or of the free list, fails the update reading it
+// with the number of the page, and the failed update leaves the file as it was.
+func TestPageChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	for i := range 2000 {
+		key := fmt.Sprintf("key%05d", i%500)
+		if err := db.Set([]byte(key), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs := db.store.(*fileStore)
+	root, free := fs.root, fs.free.head
+	if free == 0 {
+		t.Fatal("no free list")
+	}
+	db.Close()
+
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	flip := func(ptr uint64) {
+		t.Helper()
+		b := make([]byte, 1)
+		off := int64(ptr)*PAGE_SIZE + PAGE_SIZE - 1
+		if _, err := fp.ReadAt(b, off); err != nil {
+			t.Fatal(err)
+		}
+		b[0] ^= 0x40
+		if _, err := fp.WriteAt(b, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, ptr := range []uint64{root, free} {
+		flip(ptr)
+		db := openTestKV(t, path)
+		var cerr *btree.ChecksumError
+		err := db.Set([]byte("new"), []byte("val"))
+		if !errors.As(err, &cerr) || cerr.Page != ptr || !errors.Is(err, btree.ErrCorrupt) {
+			t.Fatalf("page %d damaged: set: %v", ptr, err)
+		}
+		db.Close()
+
+		flip(ptr)
+		db = openTestKV(t, path)
+		if err := db.tree.Verify(); err != nil {
+			t.Fatalf("page %d restored: %v", ptr, err)
+		}
+		freePages(t, db.store.(*fileStore))
+		db.Close()
+	}
+}
+
+// The file grows in whole extents, past the pages in use.
+func TestExtent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	const extent = 64 * PAGE_SIZE
+	db := &KV{Path: path, Extent: extent}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := range 2000 {
+		if i%500 == 0 {
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			used := int64(db.store.(*fileStore).page.flushed) * PAGE_SIZE
+			if fi.Size()%extent != 0 || fi.Size() < used || fi.Size() >= used+used/8+extent {
+				t.Fatalf("file of %d bytes for %d in use", fi.Size(), used)
+			}
+		}
+		if err := db.Set(fmt.Appendf(nil, "key%05d", i), bytes.Repeat([]byte("v"), 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
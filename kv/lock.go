@@ -0,0 +1,45 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var ErrDatabaseLocked = errors.New("kv: database is locked by another process")
+
+// time between the attempts to take a lock held by someone else
+const LOCK_RETRY = 10 * time.Millisecond
+
+/*
+The file is locked for as long as it's open: exclusively by a
+writer, shared by the readers, so that 2 processes never update it at once or
+read it while it's updated. The lock is advisory, it only keeps out the
+processes that take it as well. It's released when the file is closed, or
+when the process dies.
+
+It's taken before anything is read from the file, so the opens of a new file
+take turns too: the first one finds it empty and writes its meta page, with
+the flags it asked for, the next ones wait for it to close and open the
+database it set up. An open that fails before writing the meta page leaves
+the file without one, and the next one sets it up.
+*/
+
+// Locks the file, waiting up to `timeout` for the lock to be released if it's
+// taken.
+func lockFile(fp *os.File, shared bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		locked, err := tryLock(fp, shared)
+		switch {
+		case err != nil:
+			return err
+		case locked:
+			return nil
+		case !time.Now().Before(deadline):
+			return fmt.Errorf("%w: %s", ErrDatabaseLocked, fp.Name())
+		}
+		time.Sleep(min(LOCK_RETRY, time.Until(deadline)))
+	}
+}
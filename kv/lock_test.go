@@ -0,0 +1,109 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A second open fails while the file is open, or waits for it to be closed.
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+
+	other := &KV{Path: path}
+	if err := other.Open(); !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("open while locked: %v", err)
+	}
+
+	start := time.Now()
+	other.LockTimeout = 50 * time.Millisecond
+	if err := other.Open(); !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("open while locked: %v", err)
+	}
+	if time.Since(start) < other.LockTimeout {
+		t.Fatalf("gave up after %v", time.Since(start))
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		time.Sleep(20 * time.Millisecond)
+		db.Close()
+	}()
+	other.LockTimeout = 5 * time.Second
+	err := other.Open()
+	<-closed
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+
+	// readers share the lock, but not with a writer
+	var readers []*os.File
+	for range 2 {
+		fp, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fp.Close()
+		if err := lockFile(fp, true, 0); err != nil {
+			t.Fatal(err)
+		}
+		readers = append(readers, fp)
+	}
+	if err := other.Open(); !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("open while read: %v", err)
+	}
+	for _, fp := range readers {
+		fp.Close()
+	}
+	if err := other.Open(); err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+}
+
+// Opens of a new file at once take turns: the first one writes the meta page,
+// the others find it and open the database it set up, compressed or not
+// whatever they asked for.
+func TestLockNewFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+	for i := range cap(errs) {
+		wg.Go(func() {
+			db := &KV{Path: path, LockTimeout: 10 * time.Second, Compress: i%2 == 1}
+			if err := db.Open(); err != nil {
+				errs <- err
+				return
+			}
+			defer db.Close()
+			errs <- db.Set(fmt.Appendf(nil, "key%d", i), fmt.Appendf(nil, "val%d", i))
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db := openTestKV(t, path)
+	want := map[string]string{}
+	for i := range cap(errs) {
+		want[fmt.Sprintf("key%d", i)] = fmt.Sprintf("val%d", i)
+	}
+	checkKV(t, db, want)
+	if n := db.tree.Len(); n != uint64(len(want)) {
+		t.Fatalf("%d keys, want %d", n, len(want))
+	}
+	if err := db.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package kv
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Takes the lock with flock unless someone else holds it.
+func tryLock(fp *os.File, shared bool) (bool, error) {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+
+	for {
+		err := syscall.Flock(int(fp.Fd()), how|syscall.LOCK_NB)
+		switch err {
+		case nil:
+			return true, nil
+		case syscall.EINTR:
+			continue
+		case syscall.EWOULDBLOCK:
+			return false, nil
+		default:
+			return false, fmt.Errorf("flock: %w", err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+//go:build windows
+
+package kv
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	LOCKFILE_FAIL_IMMEDIATELY = 0x1
+	LOCKFILE_EXCLUSIVE_LOCK   = 0x2
+
+	errLockViolation syscall.Errno = 33 // ERROR_LOCK_VIOLATION
+)
+
+// Takes the lock with LockFileEx unless someone else holds it. The locked
+// byte is the last possible one, far past the data, since the locks of
+// Windows also keep the other processes from reading what they cover.
+func tryLock(fp *os.File, shared bool) (bool, error) {
+	flags := uint32(LOCKFILE_FAIL_IMMEDIATELY)
+	if !shared {
+		flags |= LOCKFILE_EXCLUSIVE_LOCK
+	}
+
+	ol := syscall.Overlapped{Offset: ^uint32(0), OffsetHigh: ^uint32(0)}
+	r, _, err := procLockFileEx.Call(fp.Fd(), uintptr(flags), 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	switch {
+	case r != 0:
+		return true, nil
+	case err == errLockViolation:
+		return false, nil
+	default:
+		return false, fmt.Errorf("LockFileEx: %w", err)
+	}
+}
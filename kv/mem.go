@@ -0,0 +1,90 @@
+package kv
+
+import "fmt"
+
+/*
+A database opened with `OpenMemory` keeps its pages in a map instead of a
+file. It has the same API and the same behavior as one on disk, without
+durability: an update is applied to the map once it succeeds, and its freed
+pages are dropped from it, once no snapshot reads them. Pages aren't reused,
+new ones always get new numbers.
+*/
+
+// Opens an empty database held in memory only. `Path` and the sync and lock
+// options aren't used, it's gone once closed.
+func (db *KV) OpenMemory() error {
+	return db.OpenStore(newMemStore())
+}
+
+// The `PageStore` of a database in memory.
+type memStore struct {
+	root    uint64
+	next    uint64            // number of the next new page
+	pages   map[uint64][]byte // committed pages
+	updates map[uint64][]byte // new pages, nil for freed ones
+	commit  uint64            // updates committed
+	hold    pageHold          // pages freed while snapshots read them
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		next:    1, // page 0 stays unused, a tree root is never 0
+		pages:   map[uint64][]byte{},
+		updates: map[uint64][]byte{},
+	}
+}
+
+func (ms *memStore) ReadPage(ptr uint64) []byte {
+	page, ok := ms.updates[ptr]
+	if !ok {
+		page, ok = ms.pages[ptr]
+	}
+	if page == nil {
+		panic(fmt.Sprintf("kv: page %d is not in use", ptr))
+	}
+	return page
+}
+
+func (ms *memStore) AllocPage(page []byte) uint64 {
+	ptr := ms.next
+	ms.next++
+	ms.updates[ptr] = page
+	return ptr
+}
+
+func (ms *memStore) FreePage(ptr uint64) {
+	ms.updates[ptr] = nil
+}
+
+// Applies the pages of the update to the map.
+func (ms *memStore) Flush(root uint64) error {
+	ms.commit++
+	var freed []uint64
+	for ptr, page := range ms.updates {
+		if page == nil {
+			freed = append(freed, ptr)
+		} else {
+			ms.pages[ptr] = page
+		}
+	}
+	for _, ptr := range ms.hold.free(ms.commit, freed) {
+		delete(ms.pages, ptr)
+	}
+
+	ms.root = root
+	ms.Abort()
+	return nil
+}
+
+func (ms *memStore) Abort() {
+	clear(ms.updates)
+}
+
+func (ms *memStore) Root() uint64 {
+	return ms.root
+}
+
+func (ms *memStore) Close() {
+	ms.pages = nil
+	ms.updates = nil
+}
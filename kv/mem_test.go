@@ -0,0 +1,54 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"db/btree"
+)
+
+// An in-memory database works like one on disk and holds the pages of its
+// tree only.
+func TestMemory(t *testing.T) {
+	db := &KV{}
+	if err := db.OpenMemory(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	want := map[string]string{}
+	for i := range 2000 {
+		key, val := fmt.Sprintf("key%05d", i), fmt.Sprintf("val%d", i)
+		if i%100 == 0 {
+			val = strings.Repeat("v", 3*PAGE_SIZE+i)
+		}
+		if err := db.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = val
+	}
+	for i := 0; i < 2000; i += 3 {
+		key := fmt.Sprintf("key%05d", i)
+		if deleted, err := db.Del([]byte(key)); err != nil || !deleted {
+			t.Fatalf("del %q: %v, %v", key, deleted, err)
+		}
+		delete(want, key)
+	}
+	checkKV(t, db, want)
+
+	// a failed update changes nothing
+	if err := db.Set(make([]byte, PAGE_SIZE), nil); !errors.Is(err, btree.ErrKeyTooLarge) {
+		t.Fatalf("set a large key: %v", err)
+	}
+	checkKV(t, db, want)
+
+	stats := db.tree.Stats()
+	if pages := stats.InternalNodes + stats.LeafNodes + stats.OverflowPages; pages != uint64(len(db.store.(*memStore).pages)) {
+		t.Fatalf("%d pages in the tree, %d in memory", pages, len(db.store.(*memStore).pages))
+	}
+	if err := db.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
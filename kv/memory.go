@@ -0,0 +1,108 @@
+package kv
+
+// part of `KV.MemoryLimit` the buffer pool takes at most, in percent
+const MEMORY_CACHE_PERCENT = 50
+
+/*
+The memory taken by a database is mostly pages: the ones of the buffer pool,
+the nodes written by the updates not flushed yet, and the pages kept for the
+WAL until the checkpoint. Nothing bounds the last two but the checkpoint: a
+burst of writers makes a large group of updates, every one of them writing a
+new node per level of the tree.
+
+With `KV.MemoryLimit` set, the buffer pool is cut to `MEMORY_CACHE_PERCENT`
+of it, the pages kept uncompressed in a compressed file to what the pool
+leaves of that, and the rest is left to the updates and the WAL. A group of
+updates whose pages go over the limit is flushed before the updates left in
+it, and the WAL is checkpointed once it does, so the writers wait for the
+disk instead of piling up pages. An update larger than the limit on its own,
+like a bulk load, still holds all of its pages until it's flushed.
+
+A mapped file is left to the OS, only the pages of the updates and of the
+WAL count. The pages the flusher writes into the buffer pool are counted
+twice until the checkpoint.
+*/
+
+// Memory taken by the pages of a database, in bytes, see `KV.Stats`.
+type MemStats struct {
+	Limit   int // `KV.MemoryLimit`, 0 for none
+	Cache   int // pages of the buffer pool, and the ones kept uncompressed
+	Updates int // nodes written by the updates not flushed yet
+	WAL     int // pages kept for the WAL until the checkpoint
+}
+
+func (ms MemStats) Total() int {
+	return ms.Cache + ms.Updates + ms.WAL
+}
+
+// Returns whether the pages go over the limit.
+func (ms MemStats) full() bool {
+	return ms.Limit > 0 && ms.Total() > ms.Limit
+}
+
+// Returns the bytes of the buffer pool under a memory limit.
+func cacheSize(size, limit int) int {
+	if limit > 0 {
+		return min(size, limit*MEMORY_CACHE_PERCENT/100)
+	}
+	return size
+}
+
+// Returns the pages of a compressed file kept uncompressed, see
+// `UNPACKED_PAGES`.
+func (fs *fileStore) unpackedPages() int {
+	if fs.memLimit == 0 {
+		return UNPACKED_PAGES
+	}
+	room := fs.memLimit * MEMORY_CACHE_PERCENT / 100
+	if fs.pool != nil {
+		room -= fs.pool.size * PAGE_SIZE
+	}
+	return min(max(room/PAGE_SIZE, 0), UNPACKED_PAGES)
+}
+
+func (fs *fileStore) Memory() MemStats {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.memory()
+}
+
+func (fs *fileStore) memory() MemStats {
+	ms := MemStats{Limit: fs.memLimit}
+	if fs.pool != nil {
+		ms.Cache = fs.pool.cacheStats().Pages * PAGE_SIZE
+	}
+	for _, page := range fs.page.updates {
+		if page != nil {
+			ms.Updates += PAGE_SIZE
+		}
+	}
+	if fs.wal != nil {
+		ms.WAL = len(fs.wal.pages) * PAGE_SIZE
+	}
+	return ms
+}
+
+func (fs *fileStore) MemoryFull() bool {
+	return fs.Memory().full()
+}
+
+// Also counts the nodes of the update and the pages kept uncompressed.
+func (cs *compressStore) Memory() MemStats {
+	ms := cs.fileStore.Memory()
+	ms.Updates += len(cs.nodes) * PAGE_SIZE
+	cs.unpacked.mu.Lock()
+	ms.Cache += len(cs.unpacked.pages) * PAGE_SIZE
+	cs.unpacked.mu.Unlock()
+	return ms
+}
+
+func (cs *compressStore) MemoryFull() bool {
+	return cs.Memory().full()
+}
+
+func (cs *compressStore) Stats() Stats {
+	stats := cs.fileStore.Stats()
+	stats.Memory = cs.Memory()
+	return stats
+}
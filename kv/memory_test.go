@@ -0,0 +1,92 @@
+package kv
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A group of updates whose pages go over the memory limit is flushed in
+// parts, and the WAL checkpointed, so that the pages held stay under it but
+// for an update. Without a limit the group is flushed at once.
+func TestMemoryLimit(t *testing.T) {
+	const limit = 64 * PAGE_SIZE
+	for _, opts := range []struct {
+		name      string
+		wal       bool
+		cacheSize int
+		compress  bool
+	}{
+		{"mapped", false, 0, false},
+		{"pool", false, 4 * limit, false},
+		{"wal", true, 4 * limit, false},
+		{"compress", false, 0, true},
+	} {
+		for _, memLimit := range []int{0, limit} {
+			name := fmt.Sprintf("%s, limit %d", opts.name, memLimit)
+			db := &KV{
+				Path:        filepath.Join(t.TempDir(), "test.db"),
+				Sync:        SyncNone,
+				WAL:         opts.wal,
+				CacheSize:   opts.cacheSize,
+				Compress:    opts.compress,
+				MemoryLimit: memLimit,
+			}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			fs, ok := db.store.(*fileStore)
+			if !ok {
+				fs = db.store.(*compressStore).fileStore
+			}
+			memory := db.store.(interface{ Memory() MemStats }).Memory
+
+			want := map[string]string{}
+			peak := 0
+			var group []*pendingUpdate
+			for i := range 500 {
+				key := fmt.Sprintf("key%05d", i*7919%500)
+				val := strings.Repeat(key, PAGE_SIZE/2/len(key))
+				want[key] = val
+				group = append(group, &pendingUpdate{op: func() error {
+					err := db.tree.Insert([]byte(key), []byte(val))
+					peak = max(peak, memory().Total())
+					return err
+				}})
+			}
+			commit := fs.commit
+			db.commitGroup(group)
+			for _, u := range group {
+				if u.err != nil || u.panic != nil {
+					t.Fatalf("%s: %v %v", name, u.err, u.panic)
+				}
+			}
+			checkKV(t, db, want)
+
+			stats := db.Stats()
+			switch {
+			case memLimit == 0 && fs.commit != commit+1:
+				t.Fatalf("%s: %d flushes", name, fs.commit-commit)
+			case memLimit == 0 && peak <= limit:
+				t.Fatalf("%s: %d bytes at most, the test doesn't go over the limit", name, peak)
+			case memLimit == 0:
+			case fs.commit <= commit+1:
+				t.Fatalf("%s: one flush", name)
+			case peak > limit+16*PAGE_SIZE:
+				t.Fatalf("%s: %d bytes held, limit %d", name, peak, limit)
+			case stats.Memory.Limit != limit || stats.Memory.Total() > limit:
+				t.Fatalf("%s: %+v after the group", name, stats.Memory)
+			case stats.Cache.Size*PAGE_SIZE > limit*MEMORY_CACHE_PERCENT/100:
+				t.Fatalf("%s: %d pages in the buffer pool", name, stats.Cache.Size)
+			}
+			db.Close()
+
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			checkKV(t, db, want)
+			db.Close()
+		}
+	}
+}
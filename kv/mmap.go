@@ -0,0 +1,52 @@
+package kv
+
+import (
+	"fmt"
+	"os"
+)
+
+// smallest mapping, so that it only has to grow for large databases
+const MMAP_MIN_SIZE = 64 << 20
+
+// Maps the file into memory, at least `MMAP_MIN_SIZE` bytes and doubled until
+// it covers the whole file. Returns the file size and the mapping, which is
+// only writable for a writable file.
+func mmapInit(fp *os.File, readOnly bool) (int, []byte, error) {
+	fi, err := fp.Stat()
+	if err != nil {
+		return 0, nil, fmt.Errorf("stat: %w", err)
+	}
+
+	mmapSize := MMAP_MIN_SIZE
+	for mmapSize < int(fi.Size()) {
+		mmapSize *= 2
+	}
+
+	chunk, err := mmapFile(fp, 0, mmapSize, readOnly)
+	if err != nil {
+		return 0, nil, fmt.Errorf("mmap: %w", err)
+	}
+
+	// the mapping can grow the file on some systems
+	if fi, err = fp.Stat(); err != nil {
+		mmapClose(chunk)
+		return 0, nil, fmt.Errorf("stat: %w", err)
+	}
+	return int(fi.Size()), chunk, nil
+}
+
+// Maps more of the file so that `npages` are covered. Every new chunk is as
+// large as all the previous ones, doubling the mapped size until it covers
+// them, and the pages already mapped stay where they are.
+func extendMmap(fs *fileStore, npages int) error {
+	for fs.mmap.total < npages*PAGE_SIZE {
+		chunk, err := mmapFile(fs.osFile(), fs.mmap.total, fs.mmap.total, false)
+		if err != nil {
+			return fmt.Errorf("mmap: %w", err)
+		}
+
+		fs.mmap.total += fs.mmap.total
+		fs.mmap.chunks = append(fs.mmap.chunks, chunk)
+	}
+	return nil
+}
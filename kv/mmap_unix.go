@@ -0,0 +1,28 @@
+//go:build unix
+
+package kv
+
+import (
+	"os"
+	"syscall"
+)
+
+// Maps `size` bytes of the file from `offset`, which can go past its end.
+func mmapFile(fp *os.File, offset, size int, readOnly bool) ([]byte, error) {
+	prot := syscall.PROT_READ | syscall.PROT_WRITE
+	if readOnly {
+		prot = syscall.PROT_READ
+	}
+	return syscall.Mmap(int(fp.Fd()), int64(offset), size, prot, syscall.MAP_SHARED)
+}
+
+// The mapped pages are in the page cache like the ones written to the file,
+// syncing the file writes them.
+func flushViews(fs *fileStore) error {
+	return nil
+}
+
+// Unmaps a chunk.
+func mmapClose(chunk []byte) error {
+	return syscall.Munmap(chunk)
+}
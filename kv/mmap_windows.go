@@ -0,0 +1,65 @@
+//go:build windows
+
+package kv
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Maps `size` bytes of the file from `offset`. A writable mapping past the
+// end of the file grows the file to cover it, a read-only one is cut at the
+// end of the file instead.
+func mmapFile(fp *os.File, offset, size int, readOnly bool) ([]byte, error) {
+	prot, access := uint32(syscall.PAGE_READWRITE), uint32(syscall.FILE_MAP_WRITE)
+	if readOnly {
+		fi, err := fp.Stat()
+		if err != nil {
+			return nil, err
+		}
+		size = min(size, int(fi.Size())-offset)
+		if size <= 0 {
+			return nil, nil // an empty file can't be mapped
+		}
+		prot, access = syscall.PAGE_READONLY, syscall.FILE_MAP_READ
+	}
+
+	end := uint64(offset + size)
+	h, err := syscall.CreateFileMapping(syscall.Handle(fp.Fd()), nil, prot, uint32(end>>32), uint32(end), nil)
+	if err != nil {
+		return nil, os.NewSyscallError("CreateFileMapping", err)
+	}
+	// the view keeps the mapping alive
+	defer syscall.CloseHandle(h)
+
+	addr, err := syscall.MapViewOfFile(h, access, uint32(uint64(offset)>>32), uint32(offset), uintptr(size))
+	if err != nil {
+		return nil, os.NewSyscallError("MapViewOfFile", err)
+	}
+	// the view is outside of the Go heap, the address can't move
+	ptr := *(*unsafe.Pointer)(unsafe.Pointer(&addr))
+	return unsafe.Slice((*byte)(ptr), size), nil
+}
+
+// Unmaps a chunk.
+func mmapClose(chunk []byte) error {
+	if len(chunk) == 0 {
+		return nil
+	}
+	return syscall.UnmapViewOfFile(uintptr(unsafe.Pointer(&chunk[0])))
+}
+
+// Writes the dirty pages of the mapped chunks back to the file, which must
+// be done before `FlushFileBuffers` to get them to disk.
+func flushViews(fs *fileStore) error {
+	for _, chunk := range fs.mmap.chunks {
+		if len(chunk) == 0 {
+			continue
+		}
+		if err := syscall.FlushViewOfFile(uintptr(unsafe.Pointer(&chunk[0])), uintptr(len(chunk))); err != nil {
+			return os.NewSyscallError("FlushViewOfFile", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package kv
+
+import (
+	"cmp"
+	"container/list"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// fewest pages kept by the buffer pool, whatever `KV.CacheSize`
+const CACHE_MIN_PAGES = 16
+
+/*
+With `KV.CacheSize` set, the file isn't mapped: its pages are read into a
+buffer pool of that many bytes, and written from it. A page read is kept
+until it's the least recently used one and a new page needs its room, so the
+memory taken by the database doesn't depend on how the OS handles a mapping.
+
+The pages of an update are put into the pool dirty and written to the file
+together before the sync, they can't be evicted until then. A page being
+read from the file is pinned, so that it's read once however many readers
+want it. A pool with every page dirty or pinned grows past its size until
+they're written.
+
+An evicted page is dropped from the pool, not written over: the pages handed
+out by `ReadPage` stay valid while someone holds them.
+*/
+
+// Stats of the buffer pool, see `KV.Stats`.
+type CacheStats struct {
+	Size      int    // pages the pool holds at most, 0 without a pool
+	Pages     int    // pages in the pool
+	Hits      uint64 // reads found in the pool
+	Misses    uint64 // reads from the file
+	Evictions uint64 // pages dropped to make room
+	Prefetch  uint64 // pages read ahead of a cursor, see `btree.Config.Prefetch`
+}
+
+// Fraction of the reads found in the pool.
+func (cs CacheStats) HitRate() float64 {
+	if cs.Hits+cs.Misses == 0 {
+		return 0
+	}
+	return float64(cs.Hits) / float64(cs.Hits+cs.Misses)
+}
+
+// A page in the pool.
+type frame struct {
+	ptr    uint64
+	page   []byte
+	pins   int           // readers waiting for it to be read, can't be evicted
+	dirty  bool          // not written to the file yet
+	loaded chan struct{} // closed once it's read
+	err    error         // of reading it
+	elem   *list.Element // in the LRU list
+}
+
+// The pages of a file cached in memory, least recently used first out.
+type bufferPool struct {
+	mu     sync.Mutex
+	size   int
+	frames map[uint64]*frame
+	lru    *list.List // of frames, the most recently used in front
+	stats  CacheStats
+	loads  sync.WaitGroup // of `prefetch`
+
+	// callbacks for the file
+	read  func(ptr uint64, page []byte) error
+	write func(ptr uint64, page []byte) error
+}
+
+func newBufferPool(size int, read, write func(uint64, []byte) error) *bufferPool {
+	return &bufferPool{
+		size:   max(size/PAGE_SIZE, CACHE_MIN_PAGES),
+		frames: map[uint64]*frame{},
+		lru:    list.New(),
+		read:   read,
+		write:  write,
+	}
+}
+
+// Returns a page, reading it from the file if it's not in the pool. Panics if
+// it can't be read.
+func (bp *bufferPool) get(ptr uint64) []byte {
+	bp.mu.Lock()
+	f := bp.frames[ptr]
+	miss := f == nil
+	if miss {
+		bp.stats.Misses++
+		f = &frame{ptr: ptr, page: make([]byte, PAGE_SIZE), pins: 1, loaded: make(chan struct{})}
+		bp.insert(f)
+	} else {
+		bp.stats.Hits++
+		bp.lru.MoveToFront(f.elem)
+		f.pins++
+	}
+	bp.mu.Unlock()
+
+	if miss {
+		bp.load(f)
+	}
+	<-f.loaded
+	bp.mu.Lock()
+	f.pins--
+	bp.mu.Unlock()
+
+	if f.err != nil {
+		panic(fmt.Errorf("kv: read page %d: %w", ptr, f.err))
+	}
+	return f.page
+}
+
+// Reads a new frame from the file, one that failed is dropped.
+func (bp *bufferPool) load(f *frame) {
+	err := bp.read(f.ptr, f.page)
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	f.err = err
+	if err != nil && bp.frames[f.ptr] == f {
+		bp.remove(f)
+	}
+	close(f.loaded)
+}
+
+// Starts reading the pages that aren't in the pool in the background. They
+// are pinned until they're read.
+func (bp *bufferPool) prefetch(ptrs []uint64) {
+	bp.mu.Lock()
+	var load []*frame
+	for _, ptr := range ptrs {
+		if bp.frames[ptr] != nil {
+			continue
+		}
+		f := &frame{ptr: ptr, page: make([]byte, PAGE_SIZE), pins: 1, loaded: make(chan struct{})}
+		bp.insert(f)
+		load = append(load, f)
+	}
+	bp.stats.Prefetch += uint64(len(load))
+	bp.mu.Unlock()
+
+	if len(load) == 0 {
+		return
+	}
+	bp.loads.Add(1)
+	go func() {
+		defer bp.loads.Done()
+		for _, f := range load {
+			bp.load(f)
+			bp.mu.Lock()
+			f.pins--
+			bp.mu.Unlock()
+		}
+	}()
+}
+
+// Waits for the pages being prefetched, before the file is closed.
+func (bp *bufferPool) wait() {
+	bp.loads.Wait()
+}
+
+// Replaces a page with the one of an update, dirty until `writeBack`.
+func (bp *bufferPool) put(ptr uint64, page []byte) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if f := bp.frames[ptr]; f != nil {
+		// a reader still waiting for it keeps the old frame
+		bp.remove(f)
+	}
+	f := &frame{ptr: ptr, page: page, dirty: true, loaded: make(chan struct{})}
+	close(f.loaded)
+	bp.insert(f)
+}
+
+// Writes the dirty pages to the file, in order. If one fails, the ones left
+// are dropped along with the update they're from.
+func (bp *bufferPool) writeBack() error {
+	bp.mu.Lock()
+	var dirty []*frame
+	for _, f := range bp.frames {
+		if f.dirty {
+			dirty = append(dirty, f)
+		}
+	}
+	bp.mu.Unlock()
+	slices.SortFunc(dirty, func(a, b *frame) int { return cmp.Compare(a.ptr, b.ptr) })
+
+	for _, f := range dirty {
+		if err := bp.write(f.ptr, f.page); err != nil {
+			bp.discard()
+			return err
+		}
+		bp.mu.Lock()
+		f.dirty = false
+		bp.mu.Unlock()
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.evict()
+	return nil
+}
+
+// Drops the dirty pages.
+func (bp *bufferPool) discard() {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	for _, f := range bp.frames {
+		if f.dirty {
+			bp.remove(f)
+		}
+	}
+}
+
+// Drops the pages from `ptr` on, cut from the file.
+func (bp *bufferPool) drop(ptr uint64) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	for p, f := range bp.frames {
+		if p >= ptr {
+			bp.remove(f)
+		}
+	}
+}
+
+func (bp *bufferPool) cacheStats() CacheStats {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	stats := bp.stats
+	stats.Size = bp.size
+	stats.Pages = len(bp.frames)
+	return stats
+}
+
+// Adds a frame as the most recently used, evicting others to make room.
+func (bp *bufferPool) insert(f *frame) {
+	f.elem = bp.lru.PushFront(f)
+	bp.frames[f.ptr] = f
+	bp.evict()
+}
+
+// Drops the least recently used pages that aren't dirty or pinned until the
+// pool fits its size.
+func (bp *bufferPool) evict() {
+	for elem := bp.lru.Back(); elem != nil && len(bp.frames) > bp.size; {
+		f := elem.Value.(*frame)
+		elem = elem.Prev()
+		if f.dirty || f.pins > 0 {
+			continue
+		}
+		bp.remove(f)
+		bp.stats.Evictions++
+	}
+}
+
+func (bp *bufferPool) remove(f *frame) {
+	bp.lru.Remove(f.elem)
+	delete(bp.frames, f.ptr)
+}
@@ -0,0 +1,156 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The least recently used pages are evicted, but not the dirty ones until
+// they're written.
+func TestBufferPool(t *testing.T) {
+	file := map[uint64][]byte{}
+	var writeErr error
+	bp := newBufferPool(0, func(ptr uint64, page []byte) error {
+		copy(page, file[ptr])
+		return nil
+	}, func(ptr uint64, page []byte) error {
+		if writeErr != nil {
+			return writeErr
+		}
+		file[ptr] = page
+		return nil
+	})
+	for ptr := range uint64(100) {
+		file[ptr] = []byte(fmt.Sprint(ptr))
+	}
+
+	get := func(ptr uint64) {
+		t.Helper()
+		if got := strings.TrimRight(string(bp.get(ptr)), "\x00"); got != fmt.Sprint(ptr) {
+			t.Fatalf("page %d: %q", ptr, got)
+		}
+	}
+	for ptr := range uint64(CACHE_MIN_PAGES) {
+		get(ptr)
+	}
+	get(0) // now the most recently used
+	get(CACHE_MIN_PAGES)
+	stats := bp.cacheStats()
+	if stats.Size != CACHE_MIN_PAGES || stats.Pages != CACHE_MIN_PAGES || stats.Hits != 1 || stats.Misses != CACHE_MIN_PAGES+1 || stats.Evictions != 1 {
+		t.Fatalf("stats: %+v", stats)
+	}
+	if bp.frames[0] == nil || bp.frames[1] != nil {
+		t.Fatal("evicted another page than the least recently used one")
+	}
+
+	// dirty pages stay until written, however many there are
+	for ptr := range uint64(2 * CACHE_MIN_PAGES) {
+		bp.put(ptr, []byte(fmt.Sprint("new", ptr)))
+	}
+	if n := len(bp.frames); n < 2*CACHE_MIN_PAGES {
+		t.Fatalf("%d pages left, dirty ones evicted", n)
+	}
+	if err := bp.writeBack(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(bp.frames); n != CACHE_MIN_PAGES {
+		t.Fatalf("%d pages left after writing them", n)
+	}
+	if string(file[CACHE_MIN_PAGES]) != fmt.Sprint("new", CACHE_MIN_PAGES) {
+		t.Fatalf("page written: %q", file[CACHE_MIN_PAGES])
+	}
+
+	// and are dropped if they can't be
+	writeErr = errors.New("disk full")
+	bp.put(99, []byte("lost"))
+	if err := bp.writeBack(); err != writeErr {
+		t.Fatalf("write back: %v", err)
+	}
+	if bp.frames[99] != nil {
+		t.Fatal("a page that failed to be written is still there")
+	}
+	get(99)
+}
+
+// A database read through a pool smaller than it works like a mapped one.
+func TestKVCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	for _, wal := range []bool{false, true} {
+		db := &KV{Path: path, WAL: wal, CacheSize: 32 * PAGE_SIZE}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{}
+		for i := range 3000 {
+			key, val := fmt.Sprintf("key%05d", i%1000), fmt.Sprint(wal, i)
+			if i%300 == 0 {
+				val = strings.Repeat("v", 3*PAGE_SIZE)
+			}
+			if err := db.Set([]byte(key), []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = val
+		}
+		checkKV(t, db, want)
+
+		// with a WAL, most reads are of pages kept by it
+		stats := db.Stats().Cache
+		if stats.Size != 32 || stats.Pages > stats.Size || stats.Evictions == 0 || !wal && stats.HitRate() < 0.5 {
+			t.Fatalf("wal %v: stats %+v, hit rate %.2f", wal, stats, stats.HitRate())
+		}
+		crashKV(db)
+
+		db = &KV{Path: path, CacheSize: 32 * PAGE_SIZE}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		checkKV(t, db, want)
+		if err := db.tree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+}
+
+// A scan reads the leaves ahead into the pool, so that few of them are read
+// when it gets to them.
+func TestReadAhead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, Sync: SyncNone}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 5000 {
+		if err := db.Set(fmt.Appendf(nil, "key%05d", i), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leaves := db.tree.Stats().LeafNodes
+	db.Close()
+
+	for _, cache := range []int{0, 32 * PAGE_SIZE} {
+		db := &KV{Path: path, CacheSize: cache}
+		if err := db.OpenReadOnly(); err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for key := range db.Scan([]byte("key")) {
+			if string(key) != fmt.Sprintf("key%05d", n) {
+				t.Fatalf("cache %d: key %q at %d", cache, key, n)
+			}
+			n++
+		}
+		if n != 5000 {
+			t.Fatalf("cache %d: %d keys scanned", cache, n)
+		}
+
+		stats := db.Stats().Cache
+		if cache > 0 && (stats.Prefetch == 0 || stats.Misses > leaves/2) {
+			t.Fatalf("%d leaves scanned: %+v", leaves, stats)
+		}
+		db.Close()
+	}
+}
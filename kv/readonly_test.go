@@ -0,0 +1,65 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A read-only database reads what was written, refuses updates and leaves the
+// file as it was.
+func TestReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path}
+	if err := db.OpenReadOnly(); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("open a missing file: %v", err)
+	}
+
+	db = openTestKV(t, path)
+	want := map[string]string{"a": "1", "b": "2"}
+	for key, val := range want {
+		if err := db.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	orig, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var readers []*KV
+	for range 2 {
+		db := &KV{Path: path}
+		if err := db.OpenReadOnly(); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		readers = append(readers, db)
+	}
+
+	db = readers[0]
+	checkKV(t, db, want)
+	if err := db.Set([]byte("c"), []byte("3")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("set: %v", err)
+	}
+	if deleted, err := db.Del([]byte("a")); deleted || !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("del: %v, %v", deleted, err)
+	}
+	checkKV(t, db, want)
+
+	// no writer while it's read
+	if err := (&KV{Path: path}).Open(); !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("open for writing: %v", err)
+	}
+
+	for _, db := range readers {
+		db.Close()
+	}
+	if data, err := os.ReadFile(path); err != nil || !bytes.Equal(data, orig) {
+		t.Fatalf("file changed: %v", err)
+	}
+}
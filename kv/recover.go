@@ -0,0 +1,265 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+
+	"db/btree"
+)
+
+/*
+A writer sets `META_FLAG_OPEN` in the meta page when it opens the file, and
+clears it on `Close`. Finding it set on open means the last writer didn't
+close the file: it crashed, maybe in the middle of an update. With a WAL,
+records left in it mean the same.
+
+The last commit is whole either way, the meta page or the WAL only points to
+pages that were synced, but the update that was cut short can leave pages
+appended past the end of the database, and the file isn't cut back by the
+crash. Before taking the file, the recovery pass replays and checkpoints the
+WAL, cuts the file to the pages in use, and walks the tree and the free list:
+the pages in use that neither of them reaches are lost to the database and
+added back to the free list.
+
+A free list that's lost or damaged can't be walked, `KV.RebuildFreeList`
+lists every page of the file that the tree doesn't reach instead, the nodes of
+the old list included. The new nodes go past the end of the file, which the
+meta page of the last commit doesn't reach: a crash before the new meta page
+is written leaves the old list.
+*/
+
+// Recovers the file after an unclean shutdown, then marks it open. Without a
+// WAL the flag is written, with one the records in the WAL tell.
+func (fs *fileStore) markOpen() error {
+	unclean := fs.meta.flags&META_FLAG_OPEN != 0
+	if fs.wal != nil && fs.wal.size > 0 {
+		unclean = true
+	}
+	if unclean {
+		if err := fs.recoverCrash(); err != nil {
+			return fmt.Errorf("recover: %w", err)
+		}
+	}
+
+	flags := fs.meta.flags
+	if fs.wal == nil {
+		fs.meta.flags |= META_FLAG_OPEN
+		fs.meta.marked = true
+	} else {
+		fs.meta.flags &^= META_FLAG_OPEN
+	}
+	if fs.meta.flags == flags {
+		return nil
+	}
+	return fs.writeMeta()
+}
+
+// Clears the flag set by `markOpen`.
+func (fs *fileStore) markClosed() error {
+	fs.meta.flags &^= META_FLAG_OPEN
+	fs.meta.marked = false
+	return fs.writeMeta()
+}
+
+// Writes the meta page of the last commit, with the pages in the WAL.
+func (fs *fileStore) writeMeta() error {
+	if fs.wal != nil && fs.wal.size > 0 {
+		return fs.checkpoint()
+	}
+	if err := extendFile(fs, int(fs.page.flushed)); err != nil {
+		return err
+	}
+	if err := fs.storeMeta(); err != nil {
+		return err
+	}
+	return fs.syncFile(fs.fp)
+}
+
+// The recovery pass after an unclean shutdown.
+func (fs *fileStore) recoverCrash() error {
+	if fs.wal != nil {
+		if err := fs.checkpoint(); err != nil {
+			return err
+		}
+	}
+	if err := fs.truncate(); err != nil {
+		return err
+	}
+	return fs.recoverLeaks()
+}
+
+// Cuts the file after the extent of the last page in use. A mapped file is
+// mapped again, it can't be cut while it's mapped on some systems.
+func (fs *fileStore) truncate() error {
+	size := fs.extentPages(int(fs.page.flushed)) * PAGE_SIZE
+	if fs.mmap.file <= size {
+		return nil
+	}
+	if fs.pool != nil {
+		fs.pool.drop(fs.page.flushed)
+		if err := fs.retry.Do(func() error { return fs.fp.Truncate(int64(size)) }); err != nil {
+			return fmt.Errorf("truncate: %w", err)
+		}
+		fs.mmap.file = size
+		return nil
+	}
+
+	for _, chunk := range fs.mmap.chunks {
+		if err := mmapClose(chunk); err != nil {
+			return fmt.Errorf("munmap: %w", err)
+		}
+	}
+	fs.mmap.chunks = nil
+	if err := fs.retry.Do(func() error { return fs.fp.Truncate(int64(size)) }); err != nil {
+		return fmt.Errorf("truncate: %w", err)
+	}
+
+	file, chunk, err := mmapInit(fs.osFile(), false)
+	if err != nil {
+		return err
+	}
+	fs.mmap.file = file
+	fs.mmap.total = len(chunk)
+	fs.mmap.chunks = [][]byte{chunk}
+	return nil
+}
+
+// Adds the pages in use that the tree and the free list don't reach to the
+// free list, in an update of its own.
+func (fs *fileStore) recoverLeaks() (err error) {
+	defer recoverCorrupt(&err)
+
+	tree, err := btree.New(fs.treeConfig(fs.root, fs.readTree))
+	if err != nil {
+		return err
+	}
+
+	reached := make([]bool, fs.page.flushed)
+	reached[0] = true // the meta page
+	mark := func(ptr uint64) error {
+		if ptr == 0 || ptr >= fs.page.flushed || reached[ptr] {
+			return fmt.Errorf("%w: page %d of %d reached twice or out of the file", ErrBadFile, ptr, fs.page.flushed)
+		}
+		reached[ptr] = true
+		return nil
+	}
+
+	for _, ptr := range fs.filePages(tree.Pages()) {
+		if err := mark(ptr); err != nil {
+			return err
+		}
+	}
+	for ptr := fs.free.head; ptr != 0; {
+		if err := mark(ptr); err != nil {
+			return err
+		}
+		node := fs.free.node(ptr)
+		for i := range flnSize(node) {
+			if err := mark(flnPtr(node, i)); err != nil {
+				return err
+			}
+		}
+		ptr = flnNext(node)
+	}
+
+	leaked := 0
+	for ptr, ok := range reached {
+		if !ok {
+			fs.FreePage(uint64(ptr))
+			leaked++
+		}
+	}
+	if leaked == 0 {
+		return nil
+	}
+	return fs.Flush(fs.root)
+}
+
+// Replaces the free list with one of every page of the file that the tree
+// doesn't reach, for a list that was lost or damaged: the old one isn't read.
+// Committed like an update, a crash leaves the old list. Waits for the
+// backups and snapshots to end, and updates wait for it. Does nothing for a
+// store that isn't a `RepairStore`.
+func (db *KV) RebuildFreeList() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	db.exclusive.Lock()
+	defer db.exclusive.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	store, ok := db.store.(RepairStore)
+	if !ok {
+		return nil
+	}
+	return store.RebuildFreeList(db.tree)
+}
+
+func (fs *fileStore) RebuildFreeList(tree *btree.BTree) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer recoverCorrupt(&err)
+
+	if fs.wal != nil {
+		if err := fs.checkpoint(); err != nil {
+			return err
+		}
+	}
+
+	reached := make([]bool, fs.page.flushed)
+	reached[0] = true // the meta page
+	for _, ptr := range fs.filePages(tree.Pages()) {
+		if ptr == 0 || ptr >= fs.page.flushed || reached[ptr] {
+			return fmt.Errorf("%w: page %d of %d reached twice or out of the file", ErrBadFile, ptr, fs.page.flushed)
+		}
+		reached[ptr] = true
+	}
+	var free, nodes []uint64
+	for ptr, ok := range reached {
+		if !ok {
+			free = append(free, uint64(ptr))
+		}
+	}
+	end := fs.page.flushed
+	for range flNodes(len(free)) {
+		nodes = append(nodes, end)
+		end++
+	}
+
+	head := fs.free.head
+	fs.free.reset(free, nodes)
+	err = fs.writePages(fs.page.updates, int(end))
+	if err == nil {
+		err = fs.syncFile(fs.fp)
+	}
+	if err != nil {
+		fs.free.head = head
+		fs.Abort()
+		return err
+	}
+
+	fs.page.flushed = end
+	fs.commit++
+	fs.Abort()
+	// listed with the other free pages, no one reads them
+	fs.hold.pages = nil
+	if err := fs.storeMeta(); err != nil {
+		return err
+	}
+	return fs.syncFile(fs.fp)
+}
+
+// Turns the panic of a page that fails its checks back into an error.
+func recoverCorrupt(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if e, ok := r.(error); ok && (errors.Is(e, btree.ErrCorrupt) || errors.Is(e, btree.ErrVersion)) {
+		*err = e
+		return
+	}
+	panic(r)
+}
@@ -0,0 +1,166 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Returns the flags of the newest meta page of the file.
+func metaFlags(t *testing.T, path string) uint16 {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := pickMeta(data[:PAGE_SIZE])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return binary.LittleEndian.Uint16(meta[14:])
+}
+
+// The file is marked open while a writer has it, and after a crash the pages
+// appended past the database are cut off and the ones nothing reaches go back
+// to the free list.
+func TestRecover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	want := map[string]string{}
+	for i := range 1000 {
+		key := fmt.Sprintf("key%05d", i%300)
+		if err := db.Set([]byte(key), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = fmt.Sprint(i)
+	}
+	if flags := metaFlags(t, path); flags != META_FLAG_OPEN {
+		t.Fatalf("flags %#x while open", flags)
+	}
+
+	// an update that took 2 pages and committed without listing them, then
+	// one that appended a page and crashed
+	fs := db.store.(*fileStore)
+	fs.page.flushed += 2
+	if err := extendFile(fs, int(fs.page.flushed)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.storeMeta(); err != nil {
+		t.Fatal(err)
+	}
+	used := fs.page.flushed
+	garbage := bytes.Repeat([]byte("x"), PAGE_SIZE)
+	if _, err := fs.fp.WriteAt(garbage, int64(fs.mmap.file)); err != nil {
+		t.Fatal(err)
+	}
+	end := int64(fs.mmap.file)
+	crashKV(db)
+
+	db = openTestKV(t, path)
+	checkKV(t, db, want)
+	if err := db.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	fs = db.store.(*fileStore)
+	stats := db.tree.Stats()
+	reached := 1 + stats.InternalNodes + stats.LeafNodes + uint64(freePages(t, fs))
+	if reached != fs.page.flushed || fs.page.flushed < used {
+		t.Fatalf("%d pages reached, %d used, %d before the crash", reached, fs.page.flushed, used)
+	}
+
+	page := make([]byte, PAGE_SIZE)
+	if n, _ := fs.fp.ReadAt(page, end); n == PAGE_SIZE && bytes.Equal(page, garbage) {
+		t.Fatal("the page appended by the crashed update is still there")
+	}
+
+	db.Close()
+	if flags := metaFlags(t, path); flags != 0 {
+		t.Fatalf("flags %#x once closed", flags)
+	}
+	checkKV(t, openTestKV(t, path), want)
+}
+
+// A free list lost from the meta page is rebuilt from the pages the tree
+// doesn't reach, which are then reused instead of growing the file, and the
+// new list is there once the file is reopened, or after a crash.
+func TestRebuildFreeList(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "test.db")
+		open := func() *KV {
+			t.Helper()
+			db := &KV{Path: path, WAL: wal}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(db.Close)
+			return db
+		}
+		db := open()
+		want := map[string]string{}
+		for i := range 3000 {
+			key := fmt.Sprintf("key%05d", i)
+			db.Set([]byte(key), bytes.Repeat([]byte("v"), 100))
+			want[key] = strings.Repeat("v", 100)
+		}
+		for i := range 2000 {
+			key := fmt.Sprintf("key%05d", i)
+			db.Del([]byte(key))
+			delete(want, key)
+		}
+		fs := db.store.(*fileStore)
+		free := freePages(t, fs)
+		if free < 20 {
+			t.Fatalf("wal %v: %d free pages", wal, free)
+		}
+
+		// lost from the meta page
+		db.Checkpoint()
+		fs.free.head = 0
+		if err := fs.storeMeta(); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		db = open()
+		fs = db.store.(*fileStore)
+		if n := freePages(t, fs); n != 0 {
+			t.Fatalf("wal %v: %d free pages with the list lost", wal, n)
+		}
+
+		if err := db.RebuildFreeList(); err != nil {
+			t.Fatal(err)
+		}
+		checkKV(t, db, want)
+		if err := db.tree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		stats := db.tree.Stats()
+		listed := freePages(t, fs)
+		if used := 1 + stats.InternalNodes + stats.LeafNodes + uint64(listed); used != fs.page.flushed || listed < free {
+			t.Fatalf("wal %v: %d pages found, %d used, %d free before", wal, used, fs.page.flushed, free)
+		}
+
+		// reused
+		pages := fs.page.flushed
+		for i := range 500 {
+			key := fmt.Sprintf("key%05d", i)
+			db.Set([]byte(key), []byte("new"))
+			want[key] = "new"
+		}
+		if fs.page.flushed != pages {
+			t.Fatalf("wal %v: the file grew from %d to %d pages", wal, pages, fs.page.flushed)
+		}
+
+		crashKV(db)
+		db = open()
+		checkKV(t, db, want)
+		fs = db.store.(*fileStore)
+		stats = db.tree.Stats()
+		if used := 1 + stats.InternalNodes + stats.LeafNodes + uint64(freePages(t, fs)); used != fs.page.flushed {
+			t.Fatalf("wal %v: %d pages found after a crash, %d used", wal, used, fs.page.flushed)
+		}
+	}
+}
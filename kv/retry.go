@@ -0,0 +1,100 @@
+package kv
+
+import (
+	"errors"
+	"io"
+	"syscall"
+	"time"
+)
+
+/*
+A write, a cut or a rename on a networked or flaky file system can fail with
+an error that goes away if it's tried again, like EAGAIN, a `RetryPolicy`
+retries those. The database file and the WAL are written and cut with
+`KV.Retry`, and so is the copy `KV.BackupTo` writes and renames. EINTR only means
+that a signal interrupted the call, it's retried right away and without
+counting it as an attempt, up to `RETRY_MAX_EINTR` times so that a call
+interrupted on every try still fails.
+
+A sync is never retried: once an fsync fails the kernel may have dropped the
+pages it didn't write and marked them clean, so a second one that succeeds
+doesn't make them durable. Its error is the caller's to handle.
+*/
+
+// most times an operation is retried for EINTR
+const RETRY_MAX_EINTR = 100
+
+// Bounds how often an operation is retried when it fails with a transient
+// error. The zero value only retries EINTR.
+type RetryPolicy struct {
+	Attempts  int           // total tries including the first one, <= 1 means no retries
+	Backoff   time.Duration // delay before the first retry, doubled after each one
+	Transient []error       // errors worth retrying, besides EINTR
+}
+
+// The policy of a `KV` without `KV.Retry`.
+var DEFAULT_RETRY = RetryPolicy{
+	Attempts:  5,
+	Backoff:   time.Millisecond,
+	Transient: []error{syscall.EAGAIN},
+}
+
+// Returns the policy the files of the database are written with.
+func (db *KV) retry() RetryPolicy {
+	if db.Retry == nil {
+		return DEFAULT_RETRY
+	}
+	return *db.Retry
+}
+
+// Reports whether `err` is worth another try.
+func (p RetryPolicy) transient(err error) bool {
+	for _, t := range p.Transient {
+		if errors.Is(err, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs `op` until it succeeds, fails with a permanent error or runs out of
+// attempts.
+func (p RetryPolicy) Do(op func() error) error {
+	delay := p.Backoff
+	for i, eintr := 1, 0; ; {
+		err := op()
+		if errors.Is(err, syscall.EINTR) && eintr < RETRY_MAX_EINTR {
+			eintr++
+			continue // nothing to wait for
+		}
+		if err == nil || i >= p.Attempts || !p.transient(err) {
+			return err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+		i++
+	}
+}
+
+// Writes all of `data`, resuming after a short write instead of starting over.
+func (p RetryPolicy) Write(w io.Writer, data []byte) (int, error) {
+	written := 0
+	err := p.Do(func() error {
+		n, err := w.Write(data[written:])
+		written += n
+		return err
+	})
+	return written, err
+}
+
+// Writes all of `data` at `off`, resuming after a short write like `Write`.
+func (p RetryPolicy) WriteAt(w io.WriterAt, data []byte, off int64) (int, error) {
+	written := 0
+	err := p.Do(func() error {
+		n, err := w.WriteAt(data[written:], off+int64(written))
+		written += n
+		return err
+	})
+	return written, err
+}
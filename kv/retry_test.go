@@ -0,0 +1,142 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// A writer whose writes fail with the errors queued for them, in order, after
+// writing half of what they're given.
+type fakeWriter struct {
+	errs  []error
+	calls int
+	data  []byte
+}
+
+func (w *fakeWriter) Write(b []byte) (int, error) {
+	w.calls++
+	if len(w.errs) == 0 {
+		w.data = append(w.data, b...)
+		return len(b), nil
+	}
+	err := w.errs[0]
+	w.errs = w.errs[1:]
+	w.data = append(w.data, b[:len(b)/2]...)
+	return len(b) / 2, err
+}
+
+func TestRetryEINTR(t *testing.T) {
+	w := &fakeWriter{errs: []error{syscall.EINTR, syscall.EINTR}}
+
+	// EINTR is retried even by a policy without retries
+	n, err := RetryPolicy{}.Write(w, []byte("abcdefgh"))
+	if err != nil || n != 8 {
+		t.Fatalf("write: %d, %v", n, err)
+	}
+	if string(w.data) != "abcdefgh" {
+		t.Fatalf("wrote %q", w.data)
+	}
+	if w.calls != 3 {
+		t.Fatalf("%d writes, want 3", w.calls)
+	}
+}
+
+func TestRetryTransient(t *testing.T) {
+	policy := RetryPolicy{Attempts: 3, Transient: []error{syscall.EAGAIN}}
+
+	failing := func(errs ...error) (func() error, *int) {
+		calls := 0
+		return func() error {
+			calls++
+			if len(errs) == 0 {
+				return nil
+			}
+			err := errs[0]
+			errs = errs[1:]
+			return err
+		}, &calls
+	}
+
+	op, _ := failing(syscall.EAGAIN, syscall.EAGAIN)
+	if err := policy.Do(op); err != nil {
+		t.Fatalf("2 transient errors: %v", err)
+	}
+
+	op, calls := failing(syscall.EAGAIN, syscall.EAGAIN, syscall.EAGAIN)
+	if err := policy.Do(op); !errors.Is(err, syscall.EAGAIN) || *calls != 3 {
+		t.Fatalf("after %d attempts: %v", *calls, err)
+	}
+
+	op, calls = failing(syscall.EIO)
+	if err := policy.Do(op); !errors.Is(err, syscall.EIO) || *calls != 1 {
+		t.Fatalf("a permanent error was retried: %v, %d calls", err, *calls)
+	}
+}
+
+// An operation that keeps failing with EINTR gives up after
+// `RETRY_MAX_EINTR` retries.
+func TestRetryEINTRLimit(t *testing.T) {
+	calls := 0
+	err := RetryPolicy{}.Do(func() error {
+		calls++
+		return syscall.EINTR
+	})
+	if !errors.Is(err, syscall.EINTR) || calls != RETRY_MAX_EINTR+1 {
+		t.Fatalf("%d calls: %v", calls, err)
+	}
+}
+
+// The writes and cuts of the database file and the WAL that fail with a
+// transient error are retried, so the updates succeed.
+func TestRetryKV(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "test.db")
+		disk := &faultDisk{}
+		retry := &RetryPolicy{Attempts: 3, Transient: []error{errInjected}}
+		open := func() *KV {
+			db := &KV{Path: path, WAL: wal, Retry: retry, wrapFile: disk.wrap}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			return db
+		}
+
+		db := open()
+		want := map[string]string{}
+		for i := range 200 {
+			key := fmt.Sprintf("key%03d", i)
+			want[key] = strings.Repeat(key, 1+i%30)
+			disk.mu.Lock()
+			disk.failAt = disk.writes + 1 + i%3
+			disk.mu.Unlock()
+			if err := db.Set([]byte(key), []byte(want[key])); err != nil {
+				t.Fatalf("wal %v: %v", wal, err)
+			}
+		}
+		if err := db.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		disk.restart()
+		if !checkRecovered(t, fmt.Sprintf("wal %v", wal), open(), want) {
+			t.Fatalf("wal %v: the updates aren't there after the retries", wal)
+		}
+
+		// without retries the first failure fails the update
+		db = &KV{Path: path, WAL: wal, Retry: &RetryPolicy{}, wrapFile: disk.wrap}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		disk.mu.Lock()
+		disk.failAt = disk.writes + 1
+		disk.mu.Unlock()
+		if err := db.Set([]byte("key000"), nil); !errors.Is(err, errInjected) {
+			t.Fatalf("wal %v: set without retries: %v", wal, err)
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,180 @@
+package kv
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// What a step of a simulated workload does.
+const (
+	simSet = iota
+	simDel
+	simCheckpoint // with a WAL
+	simFlushAhead // with a WAL, in place of the flusher
+	simCompact
+	simReopen
+)
+
+// A step of a simulated workload.
+type simOp struct {
+	kind     int
+	key, val string
+}
+
+// Returns a random workload, the same for a seed.
+func simWorkload(seed uint64, wal bool) []simOp {
+	rng := rand.New(rand.NewPCG(seed, 1))
+	var ops []simOp
+	for len(ops) < 60 {
+		key := fmt.Sprintf("key%03d", rng.IntN(100))
+		switch n := rng.IntN(100); {
+		case n < 10:
+			ops = append(ops, simOp{kind: simSet, key: key, val: strings.Repeat(key, PAGE_SIZE/4)})
+		case n < 65:
+			ops = append(ops, simOp{kind: simSet, key: key, val: strings.Repeat(key, 1+rng.IntN(100))})
+		case n < 85:
+			ops = append(ops, simOp{kind: simDel, key: key})
+		case n < 90 && wal:
+			ops = append(ops, simOp{kind: simCheckpoint})
+		case n < 95 && wal:
+			ops = append(ops, simOp{kind: simFlushAhead})
+		case n < 97:
+			ops = append(ops, simOp{kind: simCompact})
+		case n >= 97:
+			ops = append(ops, simOp{kind: simReopen})
+		}
+	}
+	return ops
+}
+
+// Runs a workload on a new database at `path`, on a new disk, up to the end
+// or to a crash at write `crashAt` counted from once it's created, 0 for
+// none. Returns the disk, the pairs of the last step acknowledged, and the
+// ones of the step cut short, the same if it changes nothing. The database is
+// left as the crash leaves it.
+func runSim(t *testing.T, path string, wal bool, ops []simOp, crashAt int, crash func(*faultFile)) (disk *faultDisk, acked, next map[string]string) {
+	t.Helper()
+	disk = &faultDisk{}
+	crashed := func() bool {
+		disk.mu.Lock()
+		defer disk.mu.Unlock()
+		return disk.crashed
+	}
+	var db *KV
+	open := func() error {
+		// no flusher, the workload writes ahead where it says
+		db = &KV{Path: path, WAL: wal, FlushInterval: time.Hour, wrapFile: disk.wrap}
+		if err := db.Open(); err != nil {
+			db = nil
+			return err
+		}
+		return nil
+	}
+	defer func() {
+		if db != nil {
+			crashKV(db)
+		}
+	}()
+
+	acked = map[string]string{}
+	if err := open(); err != nil {
+		t.Fatal(err)
+	}
+	disk.mu.Lock()
+	disk.writes, disk.crashAt, disk.crash = 0, crashAt, crash
+	disk.mu.Unlock()
+	for _, op := range ops {
+		next = acked
+		var err error
+		switch op.kind {
+		case simSet:
+			next = maps.Clone(acked)
+			next[op.key] = op.val
+			err = db.Set([]byte(op.key), []byte(op.val))
+		case simDel:
+			next = maps.Clone(acked)
+			delete(next, op.key)
+			_, err = db.Del([]byte(op.key))
+		case simCheckpoint:
+			err = db.Checkpoint()
+		case simFlushAhead:
+			_, err = db.store.(*fileStore).flushAhead(math.MaxInt)
+		case simCompact:
+			err = db.Compact()
+		case simReopen:
+			db.Close()
+			err = open()
+		}
+		if err == nil {
+			acked = next
+		}
+		if crashed() {
+			return disk, acked, next
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return disk, acked, acked
+}
+
+// Every write and cut of a random workload, with or without a WAL, once the
+// database is created, is a point where the process dies, leaving on disk
+// either only what was synced, or everything with the last write to each
+// file torn. Either way the database opens with a tree that verifies and
+// every page accounted for, holding the pairs of the last step acknowledged
+// or of the one cut short.
+func TestCrashSimulation(t *testing.T) {
+	seeds := uint64(4)
+	if testing.Short() {
+		seeds = 1
+	}
+	crashes := map[string]func(ff *faultFile){
+		"synced only": crashLose,
+		"all torn": func(ff *faultFile) {
+			for i, w := range ff.pending {
+				if i == len(ff.pending)-1 && w.data != nil {
+					w.data = w.data[:len(w.data)/2]
+				}
+				ff.apply(w)
+			}
+		},
+	}
+
+	for _, wal := range []bool{false, true} {
+		for seed := range seeds {
+			ops := simWorkload(seed, wal)
+			disk, _, _ := runSim(t, filepath.Join(t.TempDir(), "test.db"), wal, ops, 0, nil)
+			total := disk.writes
+
+			for at := 1; at <= total; at++ {
+				for mode, crash := range crashes {
+					name := fmt.Sprintf("wal %v, seed %d, crash at %d of %d, %s", wal, seed, at, total, mode)
+					path := filepath.Join(t.TempDir(), "test.db")
+					disk, acked, next := runSim(t, path, wal, ops, at, crash)
+					if !disk.crashed {
+						t.Fatalf("%s: the workload didn't get there", name)
+					}
+
+					disk.restart()
+					open := func() *KV {
+						db := &KV{Path: path, WAL: wal, wrapFile: disk.wrap}
+						if err := db.Open(); err != nil {
+							t.Fatalf("%s: %v", name, err)
+						}
+						return db
+					}
+					if !checkRecovered(t, name, open(), acked) && !checkRecovered(t, name, open(), next) {
+						t.Fatalf("%s: neither the last step acknowledged nor the one cut short", name)
+					}
+				}
+			}
+		}
+	}
+}
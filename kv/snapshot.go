@@ -0,0 +1,347 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"iter"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"db/btree"
+)
+
+var (
+	ErrNoSnapshot      = errors.New("kv: the store can't hold snapshots")
+	ErrSnapshotExpired = errors.New("kv: the snapshot expired, its pages were reclaimed")
+)
+
+/*
+A read-only transaction reads the tree of the commit it began at, a
+snapshot: it finds the same pairs however many updates are committed
+meanwhile. Updates never write over a page but write new ones, so the pages
+of its tree stay as they are as long as the ones the updates free aren't
+handed out again: the store holds them back, see `SnapshotStore`.
+
+A page freed by commit n is in the trees of the commits before n alone, so
+it's held along with n until no snapshot or backup of an older commit is
+left. The readers are counted by the commit they read: once the oldest one
+is closed, the next update frees what no one left needs, while the readers
+of later commits go on. A reader open for long holds back every page freed
+after it began, the file grows meanwhile.
+
+Its reads take the lock of the database for each page, like a backup's, so
+many of them go on along with the writer: they only wait for the group or
+the transaction being committed, not for the ones after it. `Compact` moves
+the pages of the tree and cuts the file, it waits for the snapshots to be
+closed and new ones wait for it.
+
+`SnapshotToFile` writes a snapshot into a database file of its own, to be
+shipped elsewhere: its pairs are bulk loaded into a new file next to `path`,
+packed, which is synced and then renamed over `path`, so that `path` holds
+either the whole copy or what it held before. The copy is compressed and
+encrypted like the database, its values are kept in the tree even if the
+database has a value log.
+
+`ExpireSnapshots` lets go of the pages the open snapshots hold, for a file
+grown by a reader left open: the next updates free them and hand them out
+again. The database keeps its open snapshots, and marks the ones it lets go
+of expired: every page read checks the mark first, under the lock of the
+database, so an expired snapshot stops reading before a page could be
+written over, and its reads find nothing from then on. `ReadTX.Get` copies
+the value out of its page and checks the mark again once it's copied, as the
+page can be written over as soon as the lock is let go. `ReadTX.Err` tells
+those apart from keys that aren't there. A snapshot closed reads nothing
+either.
+*/
+
+// A read-only transaction, see `KV.BeginRead`. It's used by one goroutine.
+type ReadTX struct {
+	db      *KV
+	commit  uint64       // it began at, held in the store until it expires
+	tree    *btree.BTree // of that commit, nil once closed
+	expired atomic.Bool  // by `ExpireSnapshots`, its pages aren't held anymore
+	err     error        // why the reads stopped, see `Err`
+}
+
+// Starts a read-only transaction on the last commit, which must end with
+// `Close`: the pages it reads are held until then. Updates go on meanwhile,
+// it doesn't see them. Fails with `ErrNoSnapshot` for a store that isn't a
+// `SnapshotStore`.
+func (db *KV) BeginRead() (*ReadTX, error) {
+	db.exclusive.RLock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	store, ok := db.store.(SnapshotStore)
+	if !ok {
+		db.exclusive.RUnlock()
+		return nil, ErrNoSnapshot
+	}
+
+	// read-only, the pages are read between the commits
+	tx := &ReadTX{db: db}
+	cfg := db.treeConfig(db.tree.Root())
+	get, prefetch := cfg.Get, cfg.Prefetch
+	cfg.Get = func(ptr uint64) []byte {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		if tx.expired.Load() {
+			panic(ErrSnapshotExpired)
+		}
+		return get(ptr)
+	}
+	if prefetch != nil {
+		cfg.Prefetch = func(ptrs []uint64) {
+			db.mu.RLock()
+			defer db.mu.RUnlock()
+			prefetch(ptrs)
+		}
+	}
+	cfg.New, cfg.Del, cfg.Commit = nil, nil, nil
+	var err error
+	tx.tree, err = btree.New(cfg)
+	if err != nil {
+		db.exclusive.RUnlock()
+		return nil, err
+	}
+
+	tx.commit = store.Hold()
+	if db.snapshots == nil {
+		db.snapshots = map[*ReadTX]struct{}{}
+	}
+	db.snapshots[tx] = struct{}{}
+	return tx, nil
+}
+
+// Returns a copy of the value of a key in the snapshot and whether it was
+// found. Finds nothing once it's closed or expired, see `Err`.
+func (tx *ReadTX) Get(key []byte) (val []byte, ok bool) {
+	if !tx.readable() {
+		return nil, false
+	}
+	defer tx.recoverExpired(&ok)
+	val, ok = tx.tree.Get(key)
+	if !ok {
+		return nil, false
+	}
+	// the page could be handed out again once it expires, so it's checked
+	// again after the copy
+	val = bytes.Clone(tx.db.loadVal(val))
+	if !tx.readable() {
+		return nil, false
+	}
+	return val, true
+}
+
+// Yields every key-value pair of the snapshot whose key starts with `prefix`
+// in key order. Unlike `KV.Scan`, updates go on during the scan, the loop can
+// make them. Stops once the snapshot is closed or expires, see `Err`.
+func (tx *ReadTX) Scan(prefix []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, val []byte) bool) {
+		if !tx.readable() {
+			return
+		}
+		defer tx.recoverExpired(nil)
+		for key, val := range tx.tree.Scan(prefix) {
+			if !tx.readable() || !yield(key, tx.db.loadVal(val)) {
+				return
+			}
+		}
+	}
+}
+
+// Returns `ErrSnapshotExpired` once the snapshot has expired, or has been
+// read after `Close`: its reads found nothing from then on, whatever the
+// snapshot holds. Returns nil otherwise.
+func (tx *ReadTX) Err() error {
+	return tx.err
+}
+
+// Reports whether the snapshot can still be read, and records why not.
+func (tx *ReadTX) readable() bool {
+	if tx.tree == nil || tx.expired.Load() {
+		tx.err = ErrSnapshotExpired
+		return false
+	}
+	return true
+}
+
+// Stops a read that found the snapshot expired on the way, see `BeginRead`.
+// A node read before it expired may have been written over since, so any
+// panic of an expired snapshot is taken for the expiry. Sets `ok` to false,
+// if given.
+func (tx *ReadTX) recoverExpired(ok *bool) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	e, isErr := r.(error)
+	if !tx.expired.Load() && (!isErr || !errors.Is(e, ErrSnapshotExpired)) {
+		panic(r)
+	}
+	tx.err = ErrSnapshotExpired
+	if ok != nil {
+		*ok = false
+	}
+}
+
+// Returns the version the snapshot reads, the number of the commit it began
+// at: the one `TX.Commit` returned for it, or the last one before it.
+func (tx *ReadTX) Version() uint64 {
+	return tx.commit
+}
+
+// Ends the transaction and lets the pages it held be freed. Does nothing if
+// it's already closed.
+func (tx *ReadTX) Close() {
+	if tx.tree == nil {
+		return
+	}
+	db := tx.db
+	db.mu.Lock()
+	if !tx.expired.Load() {
+		db.store.(SnapshotStore).Release(tx.commit)
+		delete(db.snapshots, tx)
+	}
+	db.mu.Unlock()
+	db.exclusive.RUnlock()
+	tx.tree = nil
+}
+
+// Lets go of the pages held by the open snapshots, which the next updates
+// free, and returns how many expired. Their reads find nothing from then on,
+// see `ReadTX.Err`, they must still be closed. Backups go on.
+func (db *KV) ExpireSnapshots() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	n := len(db.snapshots)
+	for tx := range db.snapshots {
+		tx.expired.Store(true)
+		db.store.(SnapshotStore).Release(tx.commit)
+	}
+	clear(db.snapshots)
+	return n
+}
+
+// Holds back the pages freed from now on, see `updateFreeList`.
+func (fs *fileStore) Hold() uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.hold.hold(fs.commit)
+	return fs.commit
+}
+
+func (fs *fileStore) Version() uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.commit
+}
+
+func (fs *fileStore) Release(commit uint64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.hold.release(commit)
+}
+
+func (ms *memStore) Hold() uint64 {
+	ms.hold.hold(ms.commit)
+	return ms.commit
+}
+
+func (ms *memStore) Version() uint64 {
+	return ms.commit
+}
+
+func (ms *memStore) Release(commit uint64) {
+	ms.hold.release(commit)
+}
+
+// The readers of the commits of a store, and the pages freed while they
+// read.
+type pageHold struct {
+	readers map[uint64]int // backups and snapshots by the commit they read
+	pages   []heldPage     // in the order they were freed
+}
+
+// A page freed by a commit, which the readers of older ones might read.
+type heldPage struct {
+	ptr    uint64
+	commit uint64
+}
+
+// Counts a reader of a commit.
+func (h *pageHold) hold(commit uint64) {
+	if h.readers == nil {
+		h.readers = map[uint64]int{}
+	}
+	h.readers[commit]++
+}
+
+// Drops a reader of a commit, the pages it held are freed by the next update.
+func (h *pageHold) release(commit uint64) {
+	if h.readers[commit]--; h.readers[commit] <= 0 {
+		delete(h.readers, commit)
+	}
+}
+
+// Holds back the pages freed by `commit` while a reader of an older one is
+// left, and returns the ones to free: those and the ones held that no reader
+// left needs.
+func (h *pageHold) free(commit uint64, freed []uint64) []uint64 {
+	oldest := commit
+	for c := range h.readers {
+		oldest = min(oldest, c)
+	}
+	if oldest < commit {
+		for _, ptr := range freed {
+			h.pages = append(h.pages, heldPage{ptr, commit})
+		}
+		freed = nil
+	}
+
+	n := 0
+	for ; n < len(h.pages) && h.pages[n].commit <= oldest; n++ {
+		freed = append(freed, h.pages[n].ptr)
+	}
+	h.pages = h.pages[n:]
+	return freed
+}
+
+// Writes the database as of the last commit into a new compacted database
+// file at `path`, replacing it atomically, see `ReadTX`. Updates go on
+// meanwhile, the copy doesn't see them. Fails like `BeginRead`, and leaves
+// `path` as it was on an error.
+func (db *KV) SnapshotToFile(path string) error {
+	tx, err := db.BeginRead()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	_, compressed := db.store.(*compressStore)
+	tmp := fmt.Sprintf("%s.tmp.%d", path, rand.Int())
+	copied := &KV{Path: tmp, Compress: compressed, Key: db.Key, Retry: db.Retry}
+	if err := copied.Open(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = copied.update(func() error {
+		return copied.tree.BulkLoad(tx.Scan(nil), 1)
+	})
+	copied.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	retry := db.retry()
+	if err := retry.Do(func() error { return os.Rename(tmp, path) }); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("rename: %w", err)
+	}
+	return SyncDir(filepath.Dir(path))
+}
@@ -0,0 +1,614 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A snapshot reads the pairs of the commit it began at while updates are
+// committed, none of its pages is handed out again until it's closed, and
+// the pages it held are freed afterwards.
+func TestSnapshot(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		name := fmt.Sprintf("wal %v", wal)
+		db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), WAL: wal}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		fs := db.store.(*fileStore)
+		want := map[string]string{}
+		for i := range 300 {
+			key := fmt.Sprintf("key%03d", i)
+			want[key] = strings.Repeat(key, 1+i%50)
+			if err := db.Set([]byte(key), []byte(want[key])); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tx, err := db.BeginRead()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages := tx.tree.Pages()
+		val, _ := tx.Get([]byte("key001"))
+		n := 0
+		for key, val := range tx.Scan(nil) {
+			// updates made during the scan
+			if n%10 == 0 {
+				if _, err := db.Del(key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if want[string(key)] != string(val) {
+				t.Fatalf("%s: scan %q during the updates: %q", name, key, val)
+			}
+			n++
+		}
+		for i := range 300 {
+			key := fmt.Sprintf("key%03d", i)
+			if err := db.Set([]byte(key), []byte(strings.Repeat("new", PAGE_SIZE/4+i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := db.Del([]byte("key000")); err != nil {
+			t.Fatal(err)
+		}
+
+		free := map[uint64]bool{}
+		for i := range fs.free.Total() {
+			free[fs.free.Get(i)] = true
+		}
+		for _, ptr := range pages {
+			if free[ptr] {
+				t.Fatalf("%s: page %d of the snapshot is free", name, ptr)
+			}
+		}
+		for key, val := range want {
+			if got, ok := tx.Get([]byte(key)); !ok || string(got) != val {
+				t.Fatalf("%s: get %q from the snapshot: %d bytes, %v", name, key, len(got), ok)
+			}
+		}
+		if _, ok := db.Get([]byte("key000")); ok {
+			t.Fatalf("%s: a key deleted after the snapshot is still there", name)
+		}
+		if string(val) != want["key001"] {
+			t.Fatalf("%s: a value got from the snapshot changed", name)
+		}
+
+		// the pages held are freed by the next update
+		held := len(fs.hold.pages)
+		tx.Close()
+		tx.Close()
+		if _, ok := tx.Get([]byte("key001")); ok {
+			t.Fatalf("%s: found a key in a closed snapshot", name)
+		}
+		if err := db.Set([]byte("key000"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if held == 0 || len(fs.hold.pages) != 0 {
+			t.Fatalf("%s: %d pages held, %d after the snapshot", name, held, len(fs.hold.pages))
+		}
+		if used := 1 + len(db.tree.Pages()) + freePages(t, fs); uint64(used) != fs.page.flushed {
+			t.Fatalf("%s: %d pages reached, %d used", name, used, fs.page.flushed)
+		}
+		db.Close()
+	}
+}
+
+// Many snapshots read while a writer commits transactions that update every
+// key: each one finds every key at the same version.
+func TestSnapshotConcurrent(t *testing.T) {
+	configs := map[string]func(db *KV) error{
+		"file":       func(db *KV) error { return db.Open() },
+		"wal":        func(db *KV) error { db.WAL = true; return db.Open() },
+		"compressed": func(db *KV) error { db.Compress = true; return db.Open() },
+		"pool":       func(db *KV) error { db.CacheSize = 32 * PAGE_SIZE; return db.Open() },
+		"memory":     func(db *KV) error { return db.OpenMemory() },
+	}
+	for name, open := range configs {
+		db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+		if err := open(db); err != nil {
+			t.Fatal(err)
+		}
+
+		const keys = 200
+		write := func(version int) error {
+			tx, err := db.Begin()
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			for i := range keys {
+				key := fmt.Sprintf("key%03d", i)
+				if err := tx.Set([]byte(key), []byte(fmt.Sprintf("%s-%06d", key, version))); err != nil {
+					return err
+				}
+			}
+			_, err = tx.Commit()
+			return err
+		}
+		if err := write(0); err != nil {
+			t.Fatal(err)
+		}
+
+		// returns the first error of a snapshot
+		read := func() error {
+			tx, err := db.BeginRead()
+			if err != nil {
+				return err
+			}
+			defer tx.Close()
+			var version []byte
+			n := 0
+			for key, val := range tx.Scan([]byte("key")) {
+				if !bytes.HasPrefix(val, key) {
+					return fmt.Errorf("%s: %q holds %q", name, key, val)
+				}
+				v := val[len(key):]
+				if version == nil {
+					version = slices.Clone(v)
+				} else if !bytes.Equal(v, version) {
+					return fmt.Errorf("%s: %q at version %s, the first key at %s", name, key, v, version)
+				}
+				n++
+			}
+			if n != keys {
+				return fmt.Errorf("%s: %d keys in the snapshot", name, n)
+			}
+			return nil
+		}
+
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		errs := make(chan error, 4)
+		for range 4 {
+			wg.Go(func() {
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if err := read(); err != nil {
+						errs <- err
+						return
+					}
+				}
+			})
+		}
+		for version := 1; version <= 50; version++ {
+			if err := write(version); err != nil {
+				t.Fatal(err)
+			}
+		}
+		close(stop)
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+		if err := db.tree.Verify(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		db.Close()
+	}
+}
+
+// `Compact` waits for the snapshots to be closed, since it cuts the file, and
+// lists the pages they held.
+func TestSnapshotCompact(t *testing.T) {
+	db := openTestKV(t, filepath.Join(t.TempDir(), "test.db"))
+	for i := range 500 {
+		key := fmt.Sprintf("key%03d", i)
+		if err := db.Set([]byte(key), []byte(strings.Repeat(key, 100))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx, err := db.BeginRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 450 {
+		if _, err := db.Del(fmt.Appendf(nil, "key%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan error)
+	go func() { done <- db.Compact() }()
+	select {
+	case err := <-done:
+		t.Fatalf("compacted with a snapshot open: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if val, ok := tx.Get([]byte("key000")); !ok || string(val) != strings.Repeat("key000", 100) {
+		t.Fatalf("get from the snapshot: %d bytes, %v", len(val), ok)
+	}
+	tx.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("key000"), nil); err != nil {
+		t.Fatal(err)
+	}
+	fs := db.store.(*fileStore)
+	if used := 1 + len(db.tree.Pages()) + freePages(t, fs); uint64(used) != fs.page.flushed {
+		t.Fatalf("%d pages reached, %d used", used, fs.page.flushed)
+	}
+}
+
+// Snapshots opened one after the other, a few at a time, only hold the pages
+// freed since the oldest one began, and one open for long holds every page
+// freed after it until it's closed.
+func TestSnapshotVersions(t *testing.T) {
+	for _, store := range []string{"file", "memory"} {
+		db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+		var err error
+		if store == "memory" {
+			err = db.OpenMemory()
+		} else {
+			err = db.Open()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hold *pageHold
+		switch s := db.store.(type) {
+		case *fileStore:
+			hold = &s.hold
+		case *memStore:
+			hold = &s.hold
+		}
+
+		update := func(step int) {
+			t.Helper()
+			for i := range 20 {
+				key := fmt.Sprintf("key%03d", (step*7+i)%300)
+				if err := db.Set([]byte(key), []byte(fmt.Sprintf("%s-%d", key, step))); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		begin := func() *ReadTX {
+			t.Helper()
+			tx, err := db.BeginRead()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return tx
+		}
+		// reads every pair the snapshot held when it began
+		scan := func(tx *ReadTX) map[string]string {
+			got := map[string]string{}
+			for key, val := range tx.Scan(nil) {
+				got[string(key)] = string(val)
+			}
+			return got
+		}
+		update(0)
+
+		// fails for a page held that no snapshot from `oldest` on reads
+		checkHeld := func(oldest uint64) {
+			t.Helper()
+			for _, page := range hold.pages {
+				if page.commit <= oldest {
+					t.Fatalf("%s: page %d freed by commit %d held, the oldest snapshot is at %d", store, page.ptr, page.commit, oldest)
+				}
+			}
+		}
+
+		long := begin()
+		want := scan(long)
+		held := 0
+		var window []*ReadTX
+		for step := 1; step <= 100; step++ {
+			window = append(window, begin())
+			if len(window) > 3 {
+				window[0].Close()
+				window = window[1:]
+			}
+			update(step)
+			checkHeld(min(long.commit, window[0].commit))
+			if long.commit < window[0].commit && len(hold.pages) < held {
+				t.Fatalf("%s: %d pages held, %d before, with the long snapshot the oldest", store, len(hold.pages), held)
+			}
+			held = len(hold.pages)
+
+			if step == 50 {
+				long.Close()
+				update(step)
+				checkHeld(window[0].commit)
+				if len(hold.pages) >= held {
+					t.Fatalf("%s: %d pages held, %d before the long snapshot was closed", store, len(hold.pages), held)
+				}
+				long = begin()
+				want = scan(long)
+				held = len(hold.pages)
+			}
+		}
+		if got := scan(long); !maps.Equal(got, want) {
+			t.Fatalf("%s: the long snapshot reads %d pairs, it began with %d", store, len(got), len(want))
+		}
+
+		if ms, ok := db.store.(*memStore); ok {
+			if len(ms.pages) != len(db.tree.Pages())+len(ms.hold.pages) {
+				t.Fatalf("%s: %d pages, %d in the tree and %d held", store, len(ms.pages), len(db.tree.Pages()), len(ms.hold.pages))
+			}
+		}
+		long.Close()
+		for _, tx := range window {
+			tx.Close()
+		}
+		update(0)
+		if len(hold.pages) != 0 || len(hold.readers) != 0 {
+			t.Fatalf("%s: %d pages held for %d commits once every snapshot is closed", store, len(hold.pages), len(hold.readers))
+		}
+		if fs, ok := db.store.(*fileStore); ok {
+			if used := 1 + len(db.tree.Pages()) + freePages(t, fs); uint64(used) != fs.page.flushed {
+				t.Fatalf("%s: %d pages reached, %d used", store, used, fs.page.flushed)
+			}
+		}
+		db.Close()
+	}
+}
+
+// Every commit gets a version past the last one, kept across a reopen, and a
+// snapshot reads the version of the commit before it.
+func TestVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	for _, memory := range []bool{false, true} {
+		db := &KV{Path: path}
+		open := db.Open
+		if memory {
+			open = db.OpenMemory
+		}
+		if err := open(); err != nil {
+			t.Fatal(err)
+		}
+
+		last := uint64(0)
+		commit := func(key string) uint64 {
+			t.Helper()
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key != "" {
+				tx.Set([]byte(key), []byte("val"))
+			}
+			version, err := tx.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return version
+		}
+		for i := range 20 {
+			version := commit(fmt.Sprint("key", i))
+			if version <= last {
+				t.Fatalf("memory %v: version %d after %d", memory, version, last)
+			}
+			last = version
+
+			snap, err := db.BeginRead()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if snap.Version() != version {
+				t.Fatalf("memory %v: snapshot at %d after commit %d", memory, snap.Version(), version)
+			}
+			// the next commits don't move it
+			db.Set([]byte("other"), []byte(fmt.Sprint(i)))
+			if got := commit(""); got <= version {
+				t.Fatalf("memory %v: version %d after a Set past %d", memory, got, version)
+			}
+			if snap.Version() != version {
+				t.Fatalf("memory %v: snapshot moved to %d", memory, snap.Version())
+			}
+			snap.Close()
+		}
+		db.Close()
+
+		if !memory {
+			db = &KV{Path: path}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			if version := commit("again"); version <= last {
+				t.Fatalf("version %d after reopening at %d", version, last)
+			}
+			db.Close()
+		}
+	}
+}
+
+// A copy written while transactions rewrite every key holds the pairs of a
+// single commit, opens on its own and is packed. The file it replaces is
+// swapped whole, and no temporary file is left.
+func TestSnapshotToFile(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestKV(t, filepath.Join(dir, "test.db"))
+	const keys = 2000
+	// every key of generation g, the last one written
+	write := func(g int) error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		tx.Set([]byte("gen"), fmt.Append(nil, g))
+		for i := range keys {
+			tx.Set(fmt.Appendf(nil, "key%05d", i), fmt.Appendf(nil, "%d/%d", g, i))
+		}
+		tx.Del(fmt.Appendf(nil, "del%d", g-1))
+		tx.Set(fmt.Appendf(nil, "del%d", g), nil)
+		_, err = tx.Commit()
+		return err
+	}
+	if err := write(0); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "copy.db")
+	os.WriteFile(path, []byte("replaced"), 0o644)
+	stop := make(chan struct{})
+	var written atomic.Int64
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for g := 1; ; g++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := write(g); err != nil {
+				t.Error(err)
+				return
+			}
+			written.Store(int64(g))
+		}
+	})
+	// some of them while the generations are written
+	for n := 0; n < 3 || written.Load() < 3; n++ {
+		if err := db.SnapshotToFile(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	copied := openTestKV(t, path)
+	gen, ok := copied.Get([]byte("gen"))
+	if !ok {
+		t.Fatal("no generation in the copy")
+	}
+	g, _ := strconv.Atoi(string(gen))
+	want := map[string]string{"gen": string(gen), fmt.Sprintf("del%d", g): ""}
+	for i := range keys {
+		want[fmt.Sprintf("key%05d", i)] = fmt.Sprintf("%d/%d", g, i)
+	}
+	checkKV(t, copied, want)
+	if n := copied.tree.Len(); n != uint64(len(want)) {
+		t.Fatalf("%d keys in the copy of generation %d, want %d", n, g, len(want))
+	}
+	if err := copied.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if free := freePages(t, copied.store.(*fileStore)); free != 0 {
+		t.Fatalf("%d free pages in the copy", free)
+	}
+	if leaves, packed := copied.tree.Stats().LeafNodes, db.tree.Stats().LeafNodes; leaves >= packed {
+		t.Fatalf("%d leaves in the copy, %d in the database", leaves, packed)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".tmp.") {
+			t.Fatalf("%s left behind", entry.Name())
+		}
+	}
+}
+
+// Once `ExpireSnapshots` lets go of its pages, which the next updates hand
+// out again, a snapshot finds nothing and reports it expired, a scan stops
+// on the way, the values it read before are left as they were, and the
+// snapshots begun afterwards read as usual.
+func TestSnapshotExpired(t *testing.T) {
+	db := openNoSyncKV(t, filepath.Join(t.TempDir(), "test.db"))
+	const keys = 2000
+	set := func(gen int) {
+		t.Helper()
+		for i := range keys {
+			if err := db.Set(fmt.Appendf(nil, "key%05d", i), fmt.Appendf(nil, "val%d-%d", i, gen)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	set(0)
+
+	old, err := db.BeginRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	scanned, scan := 0, old.Scan(nil)
+	stopped := make(chan int)
+	next := make(chan bool)
+	go func() {
+		n := 0
+		for range scan {
+			if n++; n == 10 {
+				next <- true
+				<-next
+			}
+		}
+		stopped <- n
+	}()
+	<-next
+
+	kept, ok := old.Get([]byte("key00002"))
+	if !ok {
+		t.Fatal("key00002 not found")
+	}
+	flushed := db.store.(*fileStore).page.flushed
+	if n := db.ExpireSnapshots(); n != 1 {
+		t.Fatalf("%d snapshots expired", n)
+	}
+	set(1)
+	set(2)
+	// the pages it held were handed out again
+	if grown := db.store.(*fileStore).page.flushed - flushed; grown > flushed/2 {
+		t.Fatalf("the file grew by %d pages from %d", grown, flushed)
+	}
+	// a value read before is a copy, not the page written over
+	if string(kept) != "val2-0" {
+		t.Fatalf("value read before it expired: %q", kept)
+	}
+
+	next <- true
+	if scanned = <-stopped; scanned >= keys {
+		t.Fatalf("an expired scan went on to %d keys", scanned)
+	}
+	if val, ok := old.Get([]byte("key00001")); ok {
+		t.Fatalf("read %q from an expired snapshot", val)
+	}
+	if !errors.Is(old.Err(), ErrSnapshotExpired) {
+		t.Fatalf("err: %v", old.Err())
+	}
+	if n := db.ExpireSnapshots(); n != 0 {
+		t.Fatalf("%d snapshots expired twice", n)
+	}
+
+	snap, err := db.BeginRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := snap.Get([]byte("key00001")); !ok || string(val) != "val1-2" || snap.Err() != nil {
+		t.Fatalf("new snapshot: %q, %v, %v", val, ok, snap.Err())
+	}
+	snap.Close()
+	if _, ok := snap.Get([]byte("key00001")); ok || !errors.Is(snap.Err(), ErrSnapshotExpired) {
+		t.Fatalf("read after close: %v, %v", ok, snap.Err())
+	}
+	old.Close()
+	if err := db.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	freePages(t, db.store.(*fileStore))
+}
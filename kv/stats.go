@@ -0,0 +1,66 @@
+package kv
+
+// Stats of a database, see `KV.Stats`.
+type Stats struct {
+	Pages     uint64      // pages of the file in use, the meta page included
+	FreePages int         // pages in the free list, -1 if a node of it is damaged
+	FileSize  int64       // bytes of the file, pages still in the WAL may be past its end
+	WALSize   int64       // bytes of the records in the WAL
+	IO        IOStats     // since the database was opened
+	Cache     CacheStats  // of the buffer pool, see `KV.CacheSize`
+	Memory    MemStats    // taken by the pages, see `KV.MemoryLimit`
+	HotKeys   HotKeyStats // of the values kept by `KV.Get`, see `KV.HotKeys`
+	DirectIO  bool        // the file is read and written without the OS cache
+}
+
+// Writes made by a database since it was opened, see `KV.Stats`.
+type IOStats struct {
+	PagesWritten uint64 // pages of the tree and the free list written into the file
+	BytesWritten uint64 // into the file, the meta page included, and the WAL
+	Syncs        uint64 // of the file and the WAL
+	Logical      uint64 // bytes of the keys and values set, deleted or imported
+}
+
+// Bytes written per byte of the keys and values updated: every update writes
+// whole pages, a new one for every level of the tree, the free list and the
+// meta page, and twice with a WAL.
+func (ios IOStats) WriteAmplification() float64 {
+	if ios.Logical == 0 {
+		return 0
+	}
+	return float64(ios.BytesWritten) / float64(ios.Logical)
+}
+
+func (fs *fileStore) Stats() Stats {
+	stats := Stats{
+		Pages:    fs.page.flushed,
+		FileSize: int64(fs.mmap.file),
+		IO: IOStats{
+			PagesWritten: fs.io.pages.Load(),
+			BytesWritten: fs.io.bytes.Load(),
+			Syncs:        fs.io.syncs.Load(),
+		},
+		Memory:   fs.Memory(),
+		DirectIO: fs.direct,
+	}
+	if err := func() (err error) {
+		defer recoverCorrupt(&err)
+		stats.FreePages = fs.free.Total()
+		return nil
+	}(); err != nil {
+		stats.FreePages = -1
+	}
+	if fs.wal != nil {
+		stats.WALSize = fs.wal.size
+	}
+	if fs.pool != nil {
+		stats.Cache = fs.pool.cacheStats()
+	}
+	return stats
+}
+
+// Counts a page written into the file.
+func (fs *fileStore) countPage() {
+	fs.io.pages.Add(1)
+	fs.io.bytes.Add(PAGE_SIZE)
+}
@@ -0,0 +1,60 @@
+package kv
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// The stats count the pages of the file and the free list, and the writes
+// and syncs made for the keys and values updated.
+func TestStats(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), WAL: wal}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		fs := db.store.(*fileStore)
+
+		const n = 200
+		logical := 0
+		for i := range n {
+			key, val := fmt.Sprintf("key%04d", i), fmt.Sprintf("val%d", i)
+			if err := db.Set([]byte(key), []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+			logical += len(key) + len(val)
+		}
+		for i := range n / 2 {
+			key := fmt.Sprintf("key%04d", i)
+			if _, err := db.Del([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			logical += len(key)
+		}
+		// not there, nothing updated
+		if _, err := db.Del([]byte("none")); err != nil {
+			t.Fatal(err)
+		}
+
+		stats := db.Stats()
+		ios := stats.IO
+		switch {
+		case stats.Pages != fs.page.flushed || stats.FreePages != fs.free.Total() || stats.FreePages == 0:
+			t.Fatalf("wal %v: %d pages, %d free", wal, stats.Pages, stats.FreePages)
+		case !wal && stats.FileSize < int64(stats.Pages)*PAGE_SIZE:
+			t.Fatalf("wal %v: file of %d bytes for %d pages", wal, stats.FileSize, stats.Pages)
+		case wal != (stats.WALSize > 0):
+			t.Fatalf("wal %v: WAL of %d bytes", wal, stats.WALSize)
+		case ios.Logical != uint64(logical):
+			t.Fatalf("wal %v: %d bytes updated, want %d", wal, ios.Logical, logical)
+		case ios.Syncs < 3*n/2:
+			t.Fatalf("wal %v: %d syncs for %d updates", wal, ios.Syncs, 3*n/2)
+		case !wal && ios.PagesWritten < 3*n/2:
+			t.Fatalf("wal %v: %d pages written for %d updates", wal, ios.PagesWritten, 3*n/2)
+		case ios.BytesWritten < ios.PagesWritten*PAGE_SIZE || ios.WriteAmplification() < PAGE_SIZE/32:
+			t.Fatalf("wal %v: %d bytes written, %d pages, amplification %.1f", wal, ios.BytesWritten, ios.PagesWritten, ios.WriteAmplification())
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,153 @@
+package kv
+
+import (
+	"io"
+	"sync"
+
+	"db/btree"
+)
+
+/*
+A `KV` keeps the pages of its tree in a `PageStore`, which decides where they
+live and how updates are made durable. The tree reads, allocates and frees
+pages through it, then the update is flushed as a whole.
+
+The pages of an update are pending until `Flush`: they can be read back, but
+a page freed by the update must still be readable by anyone holding the last
+committed root, so it can't be handed out again before the flush. A store is
+used by one update at a time.
+*/
+type PageStore interface {
+	// Returns a page, committed or pending. It must not be modified.
+	ReadPage(ptr uint64) []byte
+	// Adds a page, the data isn't modified afterwards. Page 0 is never
+	// returned, it's the root of an empty tree.
+	AllocPage(page []byte) uint64
+	// Frees a page, it stays readable until the update is flushed.
+	FreePage(ptr uint64)
+	// Commits the pending pages with the root of the new tree. On an error
+	// none of them is, the store is left at the last commit, unless the
+	// commit might still reach the disk: then the error wraps
+	// `ErrStoreFailed` and every later flush fails with it.
+	Flush(root uint64) error
+	// Drops the pending pages.
+	Abort()
+	// Root of the tree of the last commit.
+	Root() uint64
+	// Releases the store, the pages it returned are no longer valid.
+	Close()
+}
+
+// A `PageStore` whose commits can be made durable on demand, see `KV.Flush`.
+type SyncStore interface {
+	PageStore
+	Sync() error
+}
+
+// A `PageStore` whose last commit can be read back from the disk, see
+// `KV.VerifyDurable`.
+type DurableStore interface {
+	PageStore
+	VerifyDurable() error
+}
+
+// A `PageStore` that numbers its commits, see `ReadTX.Version`.
+type VersionStore interface {
+	PageStore
+	// Returns the number of the last commit, 0 before the first one.
+	Version() uint64
+}
+
+// A `PageStore` that commits to a log before writing the pages in place, see
+// `KV.Checkpoint`.
+type CheckpointStore interface {
+	PageStore
+	Checkpoint() error
+}
+
+// A `PageStore` with stats to report, see `KV.Stats`.
+type StatsStore interface {
+	PageStore
+	Stats() Stats
+}
+
+// A `PageStore` that bounds the memory its pages take, see `KV.MemoryLimit`.
+type MemoryStore interface {
+	PageStore
+	// Returns whether the pages go over the limit, the update is to be
+	// flushed before the next one is made.
+	MemoryFull() bool
+}
+
+// A `PageStore` that can read pages ahead of a cursor, see
+// `btree.Config.Prefetch`.
+type PrefetchStore interface {
+	PageStore
+	Prefetch(ptrs []uint64)
+}
+
+// A `PageStore` that keeps data of its own at the end of every page, see
+// `btree.Config.Reserved`.
+type ReserveStore interface {
+	PageStore
+	Reserved() int
+}
+
+// A `PageStore` whose commits can be read while the next ones are made, see
+// `KV.BeginRead`.
+type SnapshotStore interface {
+	PageStore
+	// Holds back the pages freed from now on until `Release`, and returns
+	// the last commit: its pages stay readable and aren't handed out again.
+	Hold() uint64
+	// Ends a `Hold` of a commit. The pages held that no reader of an older
+	// commit needs are freed by the next update.
+	Release(commit uint64)
+}
+
+// A `PageStore` whose file can give back its free pages, see `KV.Compact`.
+type CompactStore interface {
+	PageStore
+	// Picks a number of pages to pack the tree into, and makes `AllocPage`
+	// only hand out the pages under it until `Shrink`. Returns whether a
+	// page of the tree is past it.
+	LimitPages() (func(ptr uint64) bool, error)
+	// Commits a free list of the pages before the last one of `tree`, the
+	// tree of the last commit, that it doesn't use, and gives back the rest
+	// of the file. Lifts the limit.
+	Shrink(tree *btree.BTree) error
+}
+
+// A `PageStore` whose free list can be rebuilt from the pages in use, see
+// `KV.RebuildFreeList`.
+type RepairStore interface {
+	PageStore
+	// Commits a free list of the pages of the file that `tree`, the tree of
+	// the last commit, doesn't use, in place of the old one, which isn't
+	// read. No one reads the older commits.
+	RebuildFreeList(tree *btree.BTree) error
+}
+
+// A `PageStore` that numbers its commits, so that a backup can hold only the
+// pages written since one, see `KV.Backup`.
+type BackupStore interface {
+	PageStore
+	// Returns the number of the update being made, stamped in its pages,
+	// see `btree.Config.Commit`.
+	NextCommit() uint64
+	// Writes a backup of the pages of the last commit, of its tree and its
+	// free list, written after commit `since`, and returns its number.
+	// `lock` keeps updates out while it's held: it's taken to read the
+	// commit and each of its pages, which aren't reused until it's done.
+	Backup(w io.Writer, since uint64, lock sync.Locker) (uint64, error)
+}
+
+// A `PageStore` that encrypts its pages, whose key can be replaced, see
+// `KV.Rekey`.
+type RekeyStore interface {
+	CompactStore
+	// Seals the new pages with `key`. The others are opened with the old key
+	// until they're moved: `LimitPages` has every one of them moved, and
+	// `Shrink` drops the old key once none is left.
+	Rekey(key []byte) error
+}
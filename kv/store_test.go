@@ -0,0 +1,55 @@
+package kv
+
+import (
+	"errors"
+	"testing"
+)
+
+// A store failing its flushes.
+type failingStore struct {
+	PageStore
+	fail bool
+}
+
+var errFlush = errors.New("flush failed")
+
+func (fs *failingStore) Flush(root uint64) error {
+	if fs.fail {
+		fs.Abort()
+		return errFlush
+	}
+	return fs.PageStore.Flush(root)
+}
+
+// Any store can hold a database, and a failed flush leaves it at the last
+// commit.
+func TestOpenStore(t *testing.T) {
+	store := &failingStore{PageStore: newMemStore()}
+	db := &KV{}
+	if err := db.OpenStore(store); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	store.fail = true
+	if err := db.Set([]byte("a"), []byte("2")); !errors.Is(err, errFlush) {
+		t.Fatalf("set: %v", err)
+	}
+	if deleted, err := db.Del([]byte("a")); !errors.Is(err, errFlush) || !deleted {
+		t.Fatalf("del: %v, %v", deleted, err)
+	}
+	checkKV(t, db, map[string]string{"a": "1"})
+
+	store.fail = false
+	if err := db.Set([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	checkKV(t, db, map[string]string{"a": "1", "b": "2"})
+	if db.tree.Root() != store.Root() {
+		t.Fatalf("tree root %d, store root %d", db.tree.Root(), store.Root())
+	}
+}
@@ -0,0 +1,264 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// returned by `KV.VerifyDurable` for a commit that isn't on disk
+var ErrNotDurable = errors.New("kv: the last commit isn't durable")
+
+// How updates are made durable, see `KV.Sync`.
+type SyncMode int
+
+const (
+	// fsync before and after writing the meta page of every update, or after
+	// appending it to the WAL
+	SyncFull SyncMode = iota
+	// like `SyncFull` with fdatasync where there is one, which skips the file
+	// metadata that isn't needed to read it back, like the modification time
+	SyncData
+	// no sync on updates, the file is synced every `KV.SyncInterval` and on
+	// `Close`
+	SyncPeriodic
+	// never sync, the OS writes the pages back whenever it wants
+	SyncNone
+)
+
+// default `KV.SyncInterval`
+const SYNC_INTERVAL = 100 * time.Millisecond
+
+/*
+Only `SyncFull` and `SyncData` order the writes of an update, making it
+durable once it returns. The other modes trade that for throughput: the last
+updates before a crash of the OS, or a power loss, can be lost, and the meta
+page can reach the disk before the pages it points to, leaving the database
+damaged. A crash of the process alone loses nothing, the pages are in the OS
+cache already.
+
+`KV.VerifyDurable` checks what a crash would leave: the commits since the
+last sync count as lost for the modes that don't sync every update, and the
+last commit is read back from the disk, through files of its own rather than
+the mapping or the buffer pool. The newest meta page, followed by the records
+of the WAL, must point to the root in memory, and the root page on disk must
+hold what the store reads for it. The OS cache isn't bypassed, a write the
+OS dropped would still be read back.
+*/
+
+// Flushes a file of the database to disk as the sync mode says, on every
+// update.
+func (fs *fileStore) syncFile(fp dbFile) error {
+	var err error
+	switch fs.sync {
+	case SyncFull:
+		err = fs.fsync(fp, false)
+	case SyncData:
+		err = fs.fsync(fp, true)
+	case SyncPeriodic:
+		fs.dirty.Store(true)
+	case SyncNone:
+	default:
+		panic(fmt.Sprintf("kv: sync mode %d", fs.sync))
+	}
+
+	if err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
+
+// Starts syncing the file every `SyncInterval` for `SyncPeriodic`.
+func (fs *fileStore) startSyncer() {
+	if fs.sync != SyncPeriodic {
+		return
+	}
+
+	interval := fs.syncInterval
+	if interval <= 0 {
+		interval = SYNC_INTERVAL
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	fs.syncer.stop, fs.syncer.done = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// a failed sync is tried again on the next tick
+				fs.mu.Lock()
+				if fs.dirty.Swap(false) && fs.syncAll() != nil {
+					fs.dirty.Store(true)
+				}
+				fs.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// Stops the periodic sync and syncs what's left.
+func (fs *fileStore) stopSyncer() {
+	if fs.syncer.stop == nil {
+		return
+	}
+
+	close(fs.syncer.stop)
+	<-fs.syncer.done
+	fs.syncer.stop, fs.syncer.done = nil, nil
+
+	if fs.dirty.Swap(false) {
+		fs.syncAll()
+	}
+}
+
+// Flushes a file of the database to disk, only its data and the metadata
+// needed to read it back for `data`.
+func (fs *fileStore) fsync(fp dbFile, data bool) error {
+	fs.io.syncs.Add(1)
+	if fp == fs.fp {
+		if err := flushViews(fs); err != nil {
+			return err
+		}
+	}
+	osFile, ok := fp.(*os.File)
+	switch {
+	case !ok:
+		return fp.Sync()
+	case data:
+		return dataSync(osFile)
+	}
+	return fullSync(osFile)
+}
+
+// Flushes every file of the database to disk, making the commits so far
+// durable whatever the sync mode.
+func (fs *fileStore) Sync() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.syncAll(); err != nil {
+		return err
+	}
+	fs.dirty.Store(false)
+	return nil
+}
+
+// Flushes every file of the database to disk.
+func (fs *fileStore) syncAll() error {
+	if fs.vlog != nil {
+		if err := fs.vlog.sync(func(fp dbFile) error { return fs.fsync(fp, false) }); err != nil {
+			return err
+		}
+	}
+	if fs.wal != nil {
+		if err := fs.fsync(fs.wal.fp, false); err != nil {
+			return err
+		}
+	}
+	if err := fs.fsync(fs.fp, false); err != nil {
+		return err
+	}
+	fs.synced = fs.commit
+	return nil
+}
+
+// Checks that the last commit would be found on disk after a crash, see
+// `SyncMode`. Fails with `ErrNotDurable` if it wouldn't. Does nothing for a
+// store that isn't a `DurableStore`.
+func (db *KV) VerifyDurable() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if store, ok := db.store.(DurableStore); ok {
+		return store.VerifyDurable()
+	}
+	return nil
+}
+
+func (fs *fileStore) VerifyDurable() (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	defer recoverCorrupt(&err)
+
+	if fs.sync != SyncFull && fs.sync != SyncData && fs.synced != fs.commit {
+		return fmt.Errorf("%w: commits %d to %d aren't synced", ErrNotDurable, fs.synced+1, fs.commit)
+	}
+
+	fp, err := os.Open(fs.path)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer fp.Close()
+	// a new file might only hold the meta page
+	page0 := make([]byte, PAGE_SIZE)
+	if _, err := fp.ReadAt(page0, 0); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("read meta page: %w", err)
+	}
+	meta, err := pickMeta(page0)
+	if err != nil {
+		return err
+	}
+	var root, commit uint64
+	if meta != nil {
+		root = binary.LittleEndian.Uint64(meta[16:])
+		commit = binary.LittleEndian.Uint64(meta[48:])
+	}
+
+	logged := map[uint64][]byte{} // the pages in the WAL, sealed
+	if fs.wal != nil {
+		data, err := os.ReadFile(fs.path + WAL_SUFFIX)
+		if err != nil {
+			return fmt.Errorf("read WAL: %w", err)
+		}
+		for off := 0; ; {
+			n, ok := walRecordSize(data[off:])
+			if !ok {
+				break
+			}
+			rec := data[off : off+n]
+			root = binary.LittleEndian.Uint64(rec[4:])
+			commit = binary.LittleEndian.Uint64(rec[28:])
+			for i := range int(binary.LittleEndian.Uint32(rec[0:])) {
+				pos := WAL_RECORD_HEADER + i*(8+PAGE_SIZE)
+				logged[binary.LittleEndian.Uint64(rec[pos:])] = rec[pos+8 : pos+8+PAGE_SIZE]
+			}
+			off += n
+		}
+	}
+	if root != fs.root || commit != fs.commit {
+		return fmt.Errorf("%w: commit %d with root %d on disk, commit %d with root %d in memory",
+			ErrNotDurable, commit, root, fs.commit, fs.root)
+	}
+	if root == 0 {
+		return nil
+	}
+
+	ptr := fs.filePage(root)
+	page, ok := logged[ptr]
+	if !ok {
+		page = make([]byte, PAGE_SIZE)
+		if _, err := fp.ReadAt(page, int64(ptr)*PAGE_SIZE); err != nil {
+			return fmt.Errorf("%w: read root page %d: %v", ErrNotDurable, ptr, err)
+		}
+	}
+	if fs.cipher != nil {
+		opened := make([]byte, PAGE_SIZE)
+		if err := fs.cipher.open(ptr, page, opened); err != nil {
+			return fmt.Errorf("%w: root page %d: %v", ErrNotDurable, ptr, err)
+		}
+		page = opened
+	}
+	if !bytes.Equal(page, fs.ReadPage(ptr)) {
+		return fmt.Errorf("%w: root page %d isn't the one in memory", ErrNotDurable, ptr)
+	}
+	return nil
+}
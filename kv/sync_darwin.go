@@ -0,0 +1,21 @@
+package kv
+
+import (
+	"os"
+	"syscall"
+)
+
+// Flushes the file with F_FULLFSYNC, since fsync on macOS leaves the data in
+// the cache of the drive. Falls back to fsync on the file systems without it.
+func fullSync(fp *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fp.Fd(), syscall.F_FULLFSYNC, 0)
+	if errno == 0 {
+		return nil
+	}
+	return fp.Sync()
+}
+
+// There's no fdatasync, it's a full sync.
+func dataSync(fp *os.File) error {
+	return fullSync(fp)
+}
@@ -0,0 +1,16 @@
+package kv
+
+import (
+	"os"
+	"syscall"
+)
+
+// Flushes the file with fsync.
+func fullSync(fp *os.File) error {
+	return fp.Sync()
+}
+
+// Flushes the file with fdatasync.
+func dataSync(fp *os.File) error {
+	return syscall.Fdatasync(int(fp.Fd()))
+}
@@ -0,0 +1,15 @@
+//go:build unix && !linux && !darwin
+
+package kv
+
+import "os"
+
+// Flushes the file with fsync.
+func fullSync(fp *os.File) error {
+	return fp.Sync()
+}
+
+// Not every system has fdatasync, it's a full sync.
+func dataSync(fp *os.File) error {
+	return fullSync(fp)
+}
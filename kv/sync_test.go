@@ -0,0 +1,103 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Every mode keeps the updates across a clean close, the periodic one syncs
+// them in the background.
+func TestSyncModes(t *testing.T) {
+	for _, mode := range []SyncMode{SyncFull, SyncData, SyncPeriodic, SyncNone} {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := &KV{Path: path, Sync: mode, SyncInterval: time.Millisecond}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]string{}
+		for i := range 100 {
+			key := fmt.Sprintf("key%03d", i)
+			if err := db.Set([]byte(key), []byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = key
+		}
+
+		fs := db.store.(*fileStore)
+		if mode == SyncPeriodic {
+			deadline := time.Now().Add(5 * time.Second)
+			for fs.dirty.Load() {
+				if time.Now().After(deadline) {
+					t.Fatal("updates never synced")
+				}
+				time.Sleep(time.Millisecond)
+			}
+		} else if fs.dirty.Load() {
+			t.Fatalf("mode %d: updates left to sync", mode)
+		}
+
+		db.Close()
+		if fs.syncer.stop != nil {
+			t.Fatal("syncer still running")
+		}
+		checkKV(t, openTestKV(t, path), want)
+	}
+}
+
+// The last commit is durable once it's synced, and not before for the modes
+// that don't sync every update. One the disk lost is found missing.
+func TestVerifyDurable(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		for _, mode := range []SyncMode{SyncFull, SyncNone} {
+			path := filepath.Join(t.TempDir(), "test.db")
+			db := &KV{Path: path, Sync: mode, WAL: wal}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if err := db.VerifyDurable(); err != nil {
+				t.Fatalf("wal %v, mode %d: empty: %v", wal, mode, err)
+			}
+
+			for i := range 100 {
+				key := fmt.Sprintf("key%03d", i)
+				if err := db.Set([]byte(key), []byte(key)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := db.VerifyDurable()
+			if mode == SyncFull && err != nil || mode == SyncNone && !errors.Is(err, ErrNotDurable) {
+				t.Fatalf("wal %v, mode %d: not flushed: %v", wal, mode, err)
+			}
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.VerifyDurable(); err != nil {
+				t.Fatalf("wal %v, mode %d: flushed: %v", wal, mode, err)
+			}
+
+			// the disk loses the last commit
+			lost := path
+			if wal {
+				lost += WAL_SUFFIX
+			}
+			before, err := os.ReadFile(lost)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Set([]byte("key000"), []byte("lost"))
+			db.Flush()
+			if err := os.WriteFile(lost, before, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.VerifyDurable(); !errors.Is(err, ErrNotDurable) {
+				t.Fatalf("wal %v, mode %d: lost commit: %v", wal, mode, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,13 @@
+package kv
+
+import "os"
+
+// Flushes the file with FlushFileBuffers.
+func fullSync(fp *os.File) error {
+	return fp.Sync()
+}
+
+// There's no fdatasync, it's a full sync.
+func dataSync(fp *os.File) error {
+	return fullSync(fp)
+}
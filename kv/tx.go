@@ -0,0 +1,217 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"iter"
+
+	"db/btree"
+)
+
+var ErrTxDone = errors.New("kv: transaction already committed or rolled back")
+
+/*
+A transaction stages its updates on a tree of its own, opened at the root of
+the last commit, and `Commit` flushes them all at once like a single update:
+a crash leaves either none of them or every one. Nothing else sees them
+until then, and `Rollback` drops the pages they wrote.
+
+It holds the database from `Begin` until it ends, like a group being
+committed: the store is used by one update at a time, and a reader of the
+last commit could read a page the transaction freed. Other reads and updates
+wait for it, and its pages stay in memory until it commits, whatever
+`KV.MemoryLimit`. One begun by `KV.BeginInPlace` writes over the pages it
+frees, and holds the snapshots off too, see `InPlaceStore`.
+
+The commits of a store are numbered, see `VersionStore`: `Commit` returns
+the number of its own, a version that only grows, and a snapshot begun after
+it reads that version or a later one, see `ReadTX.Version`. Comparing them
+gives read-your-writes and optimistic checks on top of the database.
+*/
+
+// A read-write transaction, see `KV.Begin`. It's used by one goroutine.
+type TX struct {
+	db      *KV
+	tree    *btree.BTree // at the root of the last commit, then the updates staged
+	updated bool         // a pair was set or deleted
+	logical uint64       // bytes of the keys and values updated, see `IOStats`
+	changes []Change     // streamed once it's committed, see `KV.Changes`
+	inPlace bool         // begun by `KV.BeginInPlace`, holds `KV.exclusive`
+	done    bool
+}
+
+// Starts a transaction, which must end with `Commit` or `Rollback`: until
+// then other reads and updates wait for it, a `defer tx.Rollback()` ends it
+// on any path. Fails with `ErrReadOnly` on a read-only database.
+func (db *KV) Begin() (*TX, error) {
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	db.mu.Lock()
+	tree, err := db.newTree(db.tree.Root())
+	if err != nil {
+		db.mu.Unlock()
+		return nil, err
+	}
+	return &TX{db: db, tree: tree}, nil
+}
+
+// Returns the value of a key as the transaction left it, and whether it was
+// found. It's only valid until the next update of the transaction.
+func (tx *TX) Get(key []byte) ([]byte, bool) {
+	if tx.done {
+		return nil, false
+	}
+	val, ok := tx.tree.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return tx.db.loadVal(val), true
+}
+
+// Yields every key-value pair whose key starts with `prefix` in key order,
+// as the transaction left them. The loop must not update the transaction.
+func (tx *TX) Scan(prefix []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func(key, val []byte) bool) {
+		if tx.done {
+			return
+		}
+		for key, val := range tx.tree.Scan(prefix) {
+			if !yield(key, tx.db.loadVal(val)) {
+				return
+			}
+		}
+	}
+}
+
+// Inserts or updates a key in the transaction. An error only fails this
+// update, the transaction goes on without it.
+func (tx *TX) Set(key, val []byte) error {
+	return tx.update(func() error {
+		stored, err := tx.db.storeVal(val)
+		if err != nil {
+			return err
+		}
+		tx.db.hot.drop(key)
+		if err := tx.insert(key, stored); err != nil {
+			return err
+		}
+		tx.updated = true
+		tx.logical += uint64(len(key) + len(val))
+		if tx.db.Changes != nil {
+			// the caller can reuse them before the commit
+			tx.changes = append(tx.changes, Change{Kind: CHANGE_SET, Key: bytes.Clone(key), Val: bytes.Clone(val)})
+		}
+		return nil
+	})
+}
+
+// Inserts a stored value into the tree. In place, a value of the size the key
+// holds is written over the old one, keeping the layout of the leaf.
+func (tx *TX) insert(key, stored []byte) error {
+	if tx.inPlace {
+		err := tx.tree.UpdateInPlace(key, stored)
+		if !errors.Is(err, btree.ErrKeyNotFound) && !errors.Is(err, btree.ErrSizeMismatch) {
+			return err
+		}
+	}
+	return tx.tree.Insert(key, stored)
+}
+
+// Removes a key in the transaction, returns whether it was there.
+func (tx *TX) Del(key []byte) (bool, error) {
+	var deleted bool
+	err := tx.update(func() error {
+		var change Change
+		if tx.db.Changes != nil {
+			change = tx.db.removal(tx.tree.Get, bytes.Clone(key))
+		}
+		tx.db.hot.drop(key)
+		var err error
+		if deleted, err = tx.tree.Delete(key); deleted {
+			tx.updated = true
+			tx.logical += uint64(len(key))
+			if tx.db.Changes != nil {
+				tx.changes = append(tx.changes, change)
+			}
+		}
+		return err
+	})
+	return deleted, err
+}
+
+// Applies an update to the tree of the transaction. A panic rolls it back
+// before it's raised again, so that the database isn't left held.
+func (tx *TX) update(op func() error) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+	err := op()
+	if tx.inPlace {
+		tx.db.store.(InPlaceStore).ReusePages()
+	}
+	return err
+}
+
+// Flushes the updates of the transaction as one and makes them visible,
+// then ends it. Returns the version of the commit, the last one for a
+// transaction without updates, or 0 for a store that isn't a `VersionStore`.
+// On an error none of them is committed. Fails with `ErrTxDone` if it
+// already ended.
+func (tx *TX) Commit() (uint64, error) {
+	if tx.done {
+		return 0, ErrTxDone
+	}
+	db := tx.db
+	defer tx.end()
+
+	if !tx.updated {
+		db.store.Abort()
+		return db.version(), nil
+	}
+	if err := db.store.Flush(tx.tree.Root()); err != nil {
+		tx.changes = nil
+		return 0, err
+	}
+	db.tree = tx.tree
+	db.logical.Add(tx.logical)
+	return db.version(), nil
+}
+
+// Returns the number of the last commit, 0 for a store that doesn't number
+// them.
+func (db *KV) version() uint64 {
+	if store, ok := db.store.(VersionStore); ok {
+		return store.Version()
+	}
+	return 0
+}
+
+// Drops the updates of the transaction and ends it. Does nothing if it
+// already ended.
+func (tx *TX) Rollback() {
+	if tx.done {
+		return
+	}
+	defer tx.end()
+	tx.changes = nil
+	tx.db.store.Abort()
+}
+
+// Lets other reads and updates go on, then streams the changes committed.
+func (tx *TX) end() {
+	tx.done = true
+	changes := tx.changes
+	tx.changes = nil
+	tx.db.streamChanges(changes)
+	if tx.inPlace {
+		tx.db.exclusive.Unlock()
+	}
+}
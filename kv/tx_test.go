@@ -0,0 +1,221 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"db/btree"
+)
+
+// A transaction sees its own updates, nobody else does until it commits, and
+// a rollback leaves the database and its pages as they were.
+func TestTX(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestKV(t, path)
+	fs := db.store.(*fileStore)
+	want := map[string]string{}
+	for i := range 100 {
+		key := fmt.Sprintf("key%03d", i)
+		if err := db.Set([]byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = key
+	}
+
+	// rolled back
+	pages, free := fs.page.flushed, fs.free.Total()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 100 {
+		key := fmt.Sprintf("key%03d", i)
+		if i%2 == 0 {
+			if deleted, err := tx.Del([]byte(key)); err != nil || !deleted {
+				t.Fatalf("del %q: %v, %v", key, deleted, err)
+			}
+		} else if err := tx.Set([]byte(key), []byte(strings.Repeat("x", PAGE_SIZE))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := tx.Get([]byte("key000")); ok {
+		t.Fatal("a key deleted in the transaction is found in it")
+	}
+	tx.Rollback()
+	if _, err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Fatalf("commit after a rollback: %v", err)
+	}
+	tx.Rollback()
+	checkKV(t, db, want)
+	if fs.page.flushed != pages || fs.free.Total() != free {
+		t.Fatalf("%d pages, %d free after a rollback, want %d, %d", fs.page.flushed, fs.free.Total(), pages, free)
+	}
+
+	// committed, a reader waits for it
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan map[string]string)
+	go func() {
+		got := map[string]string{}
+		for key, val := range db.Scan(nil) {
+			got[string(key)] = string(val)
+		}
+		read <- got
+	}()
+	for i := range 100 {
+		key := fmt.Sprintf("key%03d", i)
+		if i%3 == 0 {
+			if _, err := tx.Del([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, key)
+			continue
+		}
+		val := fmt.Sprintf("val%d", i)
+		if err := tx.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = val
+	}
+	// a failed update only fails itself
+	if err := tx.Set(make([]byte, btree.BTREE_MAX_KEY_SIZE+1), nil); !errors.Is(err, btree.ErrKeyTooLarge) {
+		t.Fatalf("set a key too large: %v", err)
+	}
+	n := 0
+	for key, val := range tx.Scan([]byte("key")) {
+		if want[string(key)] != string(val) {
+			t.Fatalf("scan %q: %q, want %q", key, val, want[string(key)])
+		}
+		n++
+	}
+	if n != len(want) {
+		t.Fatalf("scanned %d keys, want %d", n, len(want))
+	}
+	select {
+	case <-read:
+		t.Fatal("read during the transaction")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if _, err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-read; !maps.Equal(got, want) {
+		t.Fatalf("read %d keys after the commit, want %d", len(got), len(want))
+	}
+	if err := tx.Set([]byte("late"), nil); !errors.Is(err, ErrTxDone) {
+		t.Fatalf("set after a commit: %v", err)
+	}
+
+	db.Close()
+	db = openTestKV(t, path)
+	checkKV(t, db, want)
+	if db.tree.Len() != uint64(len(want)) {
+		t.Fatalf("%d keys after reopening, want %d", db.tree.Len(), len(want))
+	}
+
+	// nothing to commit
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := tx.Del([]byte("missing")); err != nil || deleted {
+		t.Fatalf("del missing: %v, %v", deleted, err)
+	}
+	if _, err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = &KV{Path: path}
+	if err := db.OpenReadOnly(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Begin(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("begin on a read-only database: %v", err)
+	}
+}
+
+// A crash at any write of a commit leaves every update of the transaction or
+// none.
+func TestTXCrash(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		before := map[string]string{}
+		for i := range 50 {
+			key := fmt.Sprintf("key%03d", i)
+			before[key] = key
+		}
+		after := map[string]string{}
+		for i := range 100 {
+			key := fmt.Sprintf("key%03d", i)
+			if i%4 != 0 {
+				after[key] = strings.Repeat(key, 1+i)
+			}
+		}
+
+		// returns the writes of the commit
+		run := func(path string, disk *faultDisk, crashAt int) int {
+			db := &KV{Path: path, WAL: wal, FlushInterval: time.Hour, wrapFile: disk.wrap}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer crashKV(db)
+			for key, val := range before {
+				if err := db.Set([]byte(key), []byte(val)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range 100 {
+				key := fmt.Sprintf("key%03d", i)
+				if val, ok := after[key]; ok {
+					err = tx.Set([]byte(key), []byte(val))
+				} else {
+					_, err = tx.Del([]byte(key))
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			disk.mu.Lock()
+			disk.writes, disk.crashAt, disk.crash = 0, crashAt, crashLose
+			disk.mu.Unlock()
+			_, err = tx.Commit()
+			if crashAt == 0 && err != nil {
+				t.Fatal(err)
+			}
+			return disk.writes
+		}
+
+		total := run(filepath.Join(t.TempDir(), "test.db"), &faultDisk{}, 0)
+		for at := 1; at <= total; at++ {
+			name := fmt.Sprintf("wal %v, crash at %d of %d", wal, at, total)
+			path := filepath.Join(t.TempDir(), "test.db")
+			disk := &faultDisk{}
+			run(path, disk, at)
+
+			disk.restart()
+			open := func() *KV {
+				db := &KV{Path: path, WAL: wal, wrapFile: disk.wrap}
+				if err := db.Open(); err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				return db
+			}
+			if !checkRecovered(t, name, open(), before) && !checkRecovered(t, name, open(), after) {
+				t.Fatalf("%s: neither none nor all of the transaction", name)
+			}
+		}
+	}
+}
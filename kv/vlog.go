@@ -0,0 +1,414 @@
+package kv
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"db/btree"
+)
+
+// flag of the meta page of a file whose values are tagged, see `KV.ValueLog`
+const META_FLAG_VLOG = 8
+
+// the segments of the value log are named after the database file, this
+// suffix and their number
+const VLOG_SUFFIX = ".vlog."
+
+// `KV.ValueLog` of a file that has a value log, when it's opened without it
+const VLOG_MIN_VALUE = 1024
+
+// bytes a segment of the value log grows to before the next one is started
+const VLOG_SEGMENT_SIZE = 64 << 20
+
+// fraction of a segment no key points to any more for `CollectValueLog` to
+// reclaim it, when it's given none
+const VLOG_GC_DEAD = 0.5
+
+// tags of the values in the tree of a file with a value log
+const (
+	VLOG_INLINE  = 0 // the value follows
+	VLOG_POINTER = 1 // where the value is in the log follows
+)
+
+const VLOG_POINTER_SIZE = 1 + 4 + 8 + 4
+
+/*
+With `KV.ValueLog`, a new file keeps the values of that many bytes or more
+out of the tree, in a value log next to it: leaves full of keys and small
+pointers hold far more keys than leaves full of values, so lookups and scans
+of the keys read fewer pages. The log is a series of segment files, only ever
+appended to, named after the database with `VLOG_SUFFIX` and their number.
+
+Every value in the tree of such a file starts with a tag, `VLOG_INLINE` for
+one kept in the tree, `VLOG_POINTER` for one in the log:
+
+# Pointer:
+
+	| tag | segment | offset | length |
+	| 1B  |   4B    |   8B   |   4B   |
+
+# Value in a segment:
+
+	| crc32 | value |
+	|  4B   |  ...  |
+
+The values of an update are appended to the last segment as the update is
+applied, and the segment is synced before the pages pointing to them are
+flushed, like the pages of the tree: a commit only points to values that are
+on disk. An update that fails, or a crash, leaves values in the log that no
+key points to, like the values replaced or deleted since.
+
+`CollectValueLog` reclaims them. It counts the bytes of every segment the
+tree still points to, copies what's left of the segments mostly dead to the
+last one in an update that points their keys there, and deletes the segments
+once the update is synced. A crash before the deletes leaves segments no key
+points to, the next collection deletes them. Snapshots could read the
+segments, it waits for them like `Compact` does.
+
+The values in the log aren't sealed or packed, an encrypted file can't have
+one, and a backup holds the pages alone: `Export` moves such a database.
+*/
+
+// The value log of a database, see `META_FLAG_VLOG`.
+type valueLog struct {
+	path     string // of the database
+	minValue int    // see `KV.ValueLog`
+	segSize  int64  // see `VLOG_SEGMENT_SIZE`
+	readOnly bool
+	retry    RetryPolicy
+
+	// held to read the segments, by readers outside of the lock of the
+	// database, and to append to them
+	mu       sync.RWMutex
+	segments map[uint32]*os.File
+	head     uint32          // number of the last segment, 0 for none
+	size     int64           // bytes of the last segment
+	dirty    map[uint32]bool // appended to since the last sync
+	created  bool            // a segment was created since the last sync
+}
+
+// Opens the segments of the value log of the database at `path`.
+func openValueLog(path string, minValue int, readOnly bool, retry RetryPolicy) (*valueLog, error) {
+	vl := &valueLog{
+		path:     path,
+		minValue: cmp.Or(minValue, VLOG_MIN_VALUE),
+		segSize:  VLOG_SEGMENT_SIZE,
+		readOnly: readOnly,
+		retry:    retry,
+		segments: map[uint32]*os.File{},
+		dirty:    map[uint32]bool{},
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("open value log: %w", err)
+	}
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	prefix := filepath.Base(path) + VLOG_SUFFIX
+	for _, entry := range entries {
+		name, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseUint(name, 10, 32)
+		if err != nil || n == 0 {
+			continue // not a segment
+		}
+		fp, err := os.OpenFile(vl.segmentPath(uint32(n)), flag, 0)
+		if err != nil {
+			vl.close()
+			return nil, fmt.Errorf("open value log: %w", err)
+		}
+		vl.segments[uint32(n)] = fp
+		vl.head = max(vl.head, uint32(n))
+	}
+	if vl.head > 0 {
+		fi, err := vl.segments[vl.head].Stat()
+		if err != nil {
+			vl.close()
+			return nil, fmt.Errorf("stat value log: %w", err)
+		}
+		vl.size = fi.Size()
+	}
+	return vl, nil
+}
+
+// Returns the name of a segment.
+func (vl *valueLog) segmentPath(n uint32) string {
+	return vl.path + VLOG_SUFFIX + strconv.FormatUint(uint64(n), 10)
+}
+
+// Closes the segments.
+func (vl *valueLog) close() {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	for _, fp := range vl.segments {
+		fp.Close()
+	}
+	clear(vl.segments)
+}
+
+// Returns a value as it's stored in the tree, tagged, appending it to the log
+// if it's large enough.
+func (vl *valueLog) encode(val []byte) ([]byte, error) {
+	if len(val) < vl.minValue {
+		return append([]byte{VLOG_INLINE}, val...), nil
+	}
+	return vl.append(val)
+}
+
+// Appends a value to the last segment, starting a new one if it's full, and
+// returns a pointer to it.
+func (vl *valueLog) append(val []byte) ([]byte, error) {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	if vl.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	n := int64(4 + len(val))
+	if vl.head == 0 || vl.size > 0 && vl.size+n > vl.segSize {
+		fp, err := os.OpenFile(vl.segmentPath(vl.head+1), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("create value log: %w", err)
+		}
+		vl.head++
+		vl.segments[vl.head] = fp
+		vl.size = 0
+		vl.created = true
+	}
+
+	rec := make([]byte, n)
+	binary.LittleEndian.PutUint32(rec, crc32.ChecksumIEEE(val))
+	copy(rec[4:], val)
+	if _, err := vl.retry.WriteAt(vl.segments[vl.head], rec, vl.size); err != nil {
+		return nil, fmt.Errorf("write value log: %w", err)
+	}
+
+	ptr := make([]byte, VLOG_POINTER_SIZE)
+	ptr[0] = VLOG_POINTER
+	binary.LittleEndian.PutUint32(ptr[1:], vl.head)
+	binary.LittleEndian.PutUint64(ptr[5:], uint64(vl.size))
+	binary.LittleEndian.PutUint32(ptr[13:], uint32(len(val)))
+	vl.size += n
+	vl.dirty[vl.head] = true
+	return ptr, nil
+}
+
+// Returns the value of a tagged one from the tree, read from the log for a
+// pointer. Panics with an error wrapping `btree.ErrCorrupt` if it can't be
+// read back whole.
+func (vl *valueLog) decode(stored []byte) []byte {
+	if len(stored) > 0 && stored[0] == VLOG_INLINE {
+		return stored[1:]
+	}
+	seg, off, n, ok := decodePointer(stored)
+	if !ok {
+		panic(fmt.Errorf("%w: value tagged %v", btree.ErrCorrupt, stored[:min(len(stored), 1)]))
+	}
+
+	vl.mu.RLock()
+	fp := vl.segments[seg]
+	vl.mu.RUnlock()
+	if fp == nil {
+		panic(fmt.Errorf("%w: value log segment %d is missing", btree.ErrCorrupt, seg))
+	}
+	rec := make([]byte, 4+n)
+	if _, err := fp.ReadAt(rec, off); err != nil {
+		panic(fmt.Errorf("%w: value log segment %d at %d: %w", btree.ErrCorrupt, seg, off, err))
+	}
+	if crc32.ChecksumIEEE(rec[4:]) != binary.LittleEndian.Uint32(rec) {
+		panic(fmt.Errorf("%w: value log segment %d at %d: checksum mismatch", btree.ErrCorrupt, seg, off))
+	}
+	return rec[4:]
+}
+
+// Returns the segment, offset and length of the record a pointer points to,
+// and whether it's one.
+func decodePointer(stored []byte) (seg uint32, off int64, n int, ok bool) {
+	if len(stored) != VLOG_POINTER_SIZE || stored[0] != VLOG_POINTER {
+		return 0, 0, 0, false
+	}
+	seg = binary.LittleEndian.Uint32(stored[1:])
+	off = int64(binary.LittleEndian.Uint64(stored[5:]))
+	n = int(binary.LittleEndian.Uint32(stored[13:]))
+	return seg, off, n, true
+}
+
+// Syncs the segments appended to since the last sync with `fsync`, and the
+// directory if a segment was created.
+func (vl *valueLog) sync(fsync func(fp dbFile) error) error {
+	vl.mu.Lock()
+	var fps []dbFile
+	for seg := range vl.dirty {
+		fps = append(fps, vl.segments[seg])
+	}
+	dirty, created := vl.dirty, vl.created
+	vl.dirty, vl.created = map[uint32]bool{}, false
+	vl.mu.Unlock()
+
+	var err error
+	for _, fp := range fps {
+		if err = fsync(fp); err != nil {
+			break
+		}
+	}
+	if err == nil && created {
+		err = SyncDir(filepath.Dir(vl.path))
+	}
+	if err != nil {
+		// synced again by the next update
+		vl.mu.Lock()
+		for seg := range dirty {
+			vl.dirty[seg] = true
+		}
+		vl.created = vl.created || created
+		vl.mu.Unlock()
+	}
+	return err
+}
+
+// Syncs the value log before the pages of an update are flushed, as the sync
+// mode says: only the modes that sync every update order the writes.
+func (fs *fileStore) syncValueLog() error {
+	if fs.vlog == nil || (fs.sync != SyncFull && fs.sync != SyncData) {
+		return nil
+	}
+	return fs.vlog.sync(fs.syncFile)
+}
+
+// Returns the value to store in the tree for `val`.
+func (db *KV) storeVal(val []byte) ([]byte, error) {
+	if db.vlog == nil {
+		return val, nil
+	}
+	return db.vlog.encode(val)
+}
+
+// Returns the value stored in the tree as `stored`.
+func (db *KV) loadVal(stored []byte) []byte {
+	if db.vlog == nil {
+		return stored
+	}
+	return db.vlog.decode(stored)
+}
+
+// Deletes the segments of the value log at least `dead` of whose bytes no key
+// points to any more, after copying the values left in them to the last
+// segment, and returns the bytes of the segments deleted. A ratio outside of
+// (0, 1] is treated as `VLOG_GC_DEAD`. Reads and updates go on meanwhile, but
+// it waits for the snapshots to be closed and new ones wait for it. Does
+// nothing for a database without a value log.
+func (db *KV) CollectValueLog(dead float64) (int64, error) {
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+	if dead <= 0 || dead > 1 {
+		dead = VLOG_GC_DEAD
+	}
+
+	db.exclusive.Lock()
+	defer db.exclusive.Unlock()
+	vl := db.vlog
+	if vl == nil {
+		return 0, nil
+	}
+
+	victims, err := db.deadSegments(dead)
+	if err != nil || len(victims) == 0 {
+		return 0, err
+	}
+	for _, seg := range victims {
+		if err := db.update(func() error { return db.moveSegment(seg) }); err != nil {
+			return 0, err
+		}
+	}
+	// a commit that isn't on disk yet could still point to them
+	if err := db.Flush(); err != nil {
+		return 0, err
+	}
+
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	reclaimed := int64(0)
+	for _, seg := range victims {
+		fp := vl.segments[seg]
+		fi, err := fp.Stat()
+		if err != nil {
+			return reclaimed, fmt.Errorf("stat value log: %w", err)
+		}
+		fp.Close()
+		delete(vl.segments, seg)
+		delete(vl.dirty, seg)
+		if err := os.Remove(vl.segmentPath(seg)); err != nil {
+			return reclaimed, fmt.Errorf("remove value log: %w", err)
+		}
+		reclaimed += fi.Size()
+	}
+	return reclaimed, SyncDir(filepath.Dir(vl.path))
+}
+
+// Returns the segments but the last one at least `dead` of whose bytes no key
+// of the last commit points to.
+func (db *KV) deadSegments(dead float64) (victims []uint32, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	defer recoverCorrupt(&err)
+
+	live := map[uint32]int64{}
+	for _, stored := range db.tree.Scan(nil) {
+		if seg, _, n, ok := decodePointer(stored); ok {
+			live[seg] += int64(4 + n)
+		}
+	}
+
+	vl := db.vlog
+	vl.mu.RLock()
+	defer vl.mu.RUnlock()
+	for seg, fp := range vl.segments {
+		if seg == vl.head {
+			continue // appended to
+		}
+		fi, err := fp.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("stat value log: %w", err)
+		}
+		if size := fi.Size(); size == 0 || float64(size-live[seg]) >= dead*float64(size) {
+			victims = append(victims, seg)
+		}
+	}
+	slices.Sort(victims)
+	return victims, nil
+}
+
+// Copies the values a segment still holds to the last one, pointing their
+// keys there, in an update: none of them is if a value can't be read.
+func (db *KV) moveSegment(seg uint32) (err error) {
+	defer recoverCorrupt(&err)
+
+	var moved []btree.KV
+	for key, stored := range db.tree.Scan(nil) {
+		if s, _, _, ok := decodePointer(stored); ok && s == seg {
+			moved = append(moved, btree.KV{Key: slices.Clone(key), Val: db.vlog.decode(stored)})
+		}
+	}
+	for i := range moved {
+		ptr, err := db.vlog.append(moved[i].Val)
+		if err != nil {
+			return err
+		}
+		moved[i].Val = ptr
+	}
+	return db.tree.PutMany(moved)
+}
@@ -0,0 +1,267 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns the bytes of the segments of the value log of the database at
+// `path`, and how many there are.
+func vlogSize(t *testing.T, path string) (int64, int) {
+	t.Helper()
+	names, err := filepath.Glob(path + VLOG_SUFFIX + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(0)
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += fi.Size()
+	}
+	return size, len(names)
+}
+
+// Values from the threshold on are kept in the log and the tree holds
+// pointers to them, every read reads them back, from a transaction, a
+// snapshot or an export too, and so does the file reopened without the
+// option.
+func TestValueLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, ValueLog: 256}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"empty": ""}
+	logged := 0
+	for i := range 300 {
+		key, val := fmt.Sprintf("key%03d", i), fmt.Sprintf("val%d", i)
+		if i%3 == 0 {
+			val = strings.Repeat(val, 200)
+			logged += len(val)
+		}
+		want[key] = val
+	}
+	for key, val := range want {
+		if err := db.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for key, val := range want {
+		stored, _ := db.tree.Get([]byte(key))
+		_, _, n, ok := decodePointer(stored)
+		switch {
+		case len(val) >= 256 && (!ok || n != len(val)):
+			t.Fatalf("%q of %d bytes stored as % x", key, len(val), stored[:min(len(stored), VLOG_POINTER_SIZE)])
+		case len(val) < 256 && (stored[0] != VLOG_INLINE || string(stored[1:]) != val):
+			t.Fatalf("%q of %d bytes stored as %d", key, len(val), len(stored))
+		}
+	}
+	if size, _ := vlogSize(t, path); size < int64(logged) {
+		t.Fatalf("%d bytes in the value log, %d logged", size, logged)
+	}
+	checkKV(t, db, want)
+	n := 0
+	for key, val := range db.Scan(nil) {
+		if want[string(key)] != string(val) {
+			t.Fatalf("scan %q: %d bytes", key, len(val))
+		}
+		n++
+	}
+	if n != len(want) {
+		t.Fatalf("scanned %d pairs, want %d", n, len(want))
+	}
+
+	snap, err := db.BeginRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := snap.Get([]byte("key000")); !ok || string(val) != want["key000"] {
+		t.Fatalf("get from a snapshot: %d bytes, %v", len(val), ok)
+	}
+	snap.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want["key000"] = strings.Repeat("tx", 500)
+	if err := tx.Set([]byte("key000"), []byte(want["key000"])); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := tx.Get([]byte("key000")); !ok || string(val) != want["key000"] {
+		t.Fatalf("get from a transaction: %d bytes, %v", len(val), ok)
+	}
+	if _, err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var export bytes.Buffer
+	if err := db.Export(&export); err != nil {
+		t.Fatal(err)
+	}
+	mem := &KV{}
+	if err := mem.OpenMemory(); err != nil {
+		t.Fatal(err)
+	}
+	defer mem.Close()
+	if err := mem.Import(&export); err != nil {
+		t.Fatal(err)
+	}
+	checkKV(t, mem, want)
+
+	// the pages alone don't hold the values
+	if _, err := db.Backup(&bytes.Buffer{}, 0); !errors.Is(err, ErrNoBackup) {
+		t.Fatalf("backup: %v", err)
+	}
+	db.Close()
+
+	db = openTestKV(t, path)
+	checkKV(t, db, want)
+	want["new"] = strings.Repeat("n", VLOG_MIN_VALUE)
+	if err := db.Set([]byte("new"), []byte(want["new"])); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := db.tree.Get([]byte("new")); stored[0] != VLOG_POINTER {
+		t.Fatalf("a value of %d bytes kept in the tree", VLOG_MIN_VALUE)
+	}
+	checkKV(t, db, want)
+
+	encrypted := &KV{Path: filepath.Join(t.TempDir(), "encrypted.db"), ValueLog: 256, Key: make([]byte, ENCRYPT_KEY_SIZE)}
+	if err := encrypted.Open(); !errors.Is(err, ErrBadKey) {
+		t.Fatalf("open an encrypted file with a value log: %v", err)
+	}
+}
+
+// Collecting the log deletes the segments mostly overwritten or deleted,
+// after moving what's left of them, once the snapshots that could read them
+// are closed. The values are all there, reopened too.
+func TestCollectValueLog(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		name := fmt.Sprintf("wal %v", wal)
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := &KV{Path: path, WAL: wal, ValueLog: 100}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		db.vlog.segSize = 16 * 1024
+
+		want := map[string]string{}
+		set := func(i int, version string) {
+			t.Helper()
+			key := fmt.Sprintf("key%03d", i)
+			want[key] = strings.Repeat(fmt.Sprintf("%s-%s ", key, version), 100)
+			if err := db.Set([]byte(key), []byte(want[key])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := range 200 {
+			set(i, "old")
+		}
+		snap, err := db.BeginRead()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range 150 {
+			set(i, "new")
+		}
+		for i := 150; i < 180; i++ {
+			if _, err := db.Del(fmt.Appendf(nil, "key%03d", i)); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, fmt.Sprintf("key%03d", i))
+		}
+		before, segments := vlogSize(t, path)
+
+		type result struct {
+			reclaimed int64
+			err       error
+		}
+		done := make(chan result)
+		go func() {
+			n, err := db.CollectValueLog(0.5)
+			done <- result{n, err}
+		}()
+		select {
+		case r := <-done:
+			t.Fatalf("%s: collected with a snapshot open: %v", name, r.err)
+		case <-time.After(20 * time.Millisecond):
+		}
+		if val, ok := snap.Get([]byte("key000")); !ok || !strings.HasPrefix(string(val), "key000-old") {
+			t.Fatalf("%s: get from the snapshot: %.10q, %v", name, val, ok)
+		}
+		snap.Close()
+		r := <-done
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+
+		after, left := vlogSize(t, path)
+		if r.reclaimed == 0 || after > before-r.reclaimed+r.reclaimed/2 || left >= segments {
+			t.Fatalf("%s: %d bytes reclaimed, %d in %d segments, %d in %d before", name, r.reclaimed, after, left, before, segments)
+		}
+		checkKV(t, db, want)
+		if err := db.tree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		// what's left is live enough
+		if n, err := db.CollectValueLog(0.9); err != nil || n != 0 {
+			t.Fatalf("%s: collected %d bytes again: %v", name, n, err)
+		}
+
+		db.Close()
+		db = openTestKV(t, path)
+		checkKV(t, db, want)
+		if n := db.tree.Len(); n != uint64(len(want)) {
+			t.Fatalf("%s: %d keys, want %d", name, n, len(want))
+		}
+	}
+}
+
+// A crash leaves the values appended by the updates cut short in the log,
+// which no key points to: the commits before it read theirs back, and the
+// next updates append after them.
+func TestValueLogCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, WAL: true, ValueLog: 100, FlushInterval: time.Hour}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{}
+	for i := range 50 {
+		key := fmt.Sprintf("key%03d", i)
+		want[key] = strings.Repeat(key, 50)
+		if err := db.Set([]byte(key), []byte(want[key])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// appended, then the update fails
+	if err := db.Set(make([]byte, 2000), []byte(strings.Repeat("lost", 100))); err == nil {
+		t.Fatal("set a key too large")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Set([]byte("key000"), []byte(strings.Repeat("lost", 100))); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	crashKV(db)
+
+	db = openTestKV(t, path)
+	checkKV(t, db, want)
+	want["key000"] = strings.Repeat("after", 100)
+	if err := db.Set([]byte("key000"), []byte(want["key000"])); err != nil {
+		t.Fatal(err)
+	}
+	checkKV(t, db, want)
+}
@@ -0,0 +1,293 @@
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"slices"
+)
+
+// suffix of the WAL file, next to the database file
+const WAL_SUFFIX = "-wal"
+
+// number of pages in the WAL that triggers a checkpoint
+const WAL_CHECKPOINT_PAGES = 1024
+
+/*
+With `KV.WAL` set, an update is committed by appending its pages to the WAL,
+a log file next to the database file, with a single sync. The pages stay in
+memory, they are written into the database file in the background by the
+flusher, and by a checkpoint, once the WAL holds `WAL_CHECKPOINT_PAGES` or
+goes over `KV.MemoryLimit`, when the database is closed or on
+`KV.Checkpoint`. The checkpoint writes the rest of the pages and the meta
+page, then empties the WAL.
+
+# WAL record:
+
+	| npages | root | used | free | commit |      pages      | crc32 |
+	|   4B   |  8B  |  8B  |  8B  |   8B   | npages * (8B+P) |  4B   |
+
+Each page is its number and its `PAGE_SIZE` bytes, sealed in an encrypted
+file, and `root`, `used`, `free` and `commit` are the meta page after the
+update. The checksum covers the rest of
+the record.
+
+On open, the records are replayed over the database file up to the first one
+that is cut short or damaged, which wasn't committed, and the WAL is cut
+there. A WAL left by a session that used one is replayed and checkpointed on
+open even without `KV.WAL`.
+*/
+const WAL_RECORD_HEADER = 4 + 8 + 8 + 8 + 8
+
+// The WAL of a database file.
+type walLog struct {
+	fp    dbFile
+	size  int64             // bytes of the records up to the last commit
+	pages map[uint64][]byte // pages written since the last checkpoint
+	dirty map[uint64]bool   // pages not written into the file yet
+}
+
+// Opens the WAL at `path` and replays it. It's created if `use` is set,
+// otherwise an existing one is checkpointed and removed.
+func openWAL(fs *fileStore, path string, use bool) error {
+	flag := os.O_RDWR
+	switch {
+	case fs.readOnly:
+		flag = os.O_RDONLY
+	case use:
+		flag |= os.O_CREATE
+	}
+
+	fp, err := os.OpenFile(path, flag, 0644)
+	if errors.Is(err, os.ErrNotExist) && !(use && !fs.readOnly) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open WAL: %w", err)
+	}
+
+	fs.wal = &walLog{fp: fs.wrapFile(fp), pages: map[uint64][]byte{}, dirty: map[uint64]bool{}}
+	if err := fs.replayWAL(); err != nil {
+		return err
+	}
+
+	switch {
+	case fs.readOnly:
+		// the replayed pages are all that's needed
+		fp.Close()
+		fs.wal.fp = nil
+	case !use:
+		if err := fs.checkpoint(); err != nil {
+			return err
+		}
+		fp.Close()
+		fs.wal = nil
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("remove WAL: %w", err)
+		}
+	}
+	return nil
+}
+
+// Applies the committed records of the WAL and cuts it after the last one.
+func (fs *fileStore) replayWAL() error {
+	fi, err := fs.wal.fp.Stat()
+	if err != nil {
+		return fmt.Errorf("stat WAL: %w", err)
+	}
+	data := make([]byte, fi.Size())
+	if _, err := fs.wal.fp.ReadAt(data, 0); err != nil {
+		return fmt.Errorf("read WAL: %w", err)
+	}
+
+	off := 0
+	for {
+		n, ok := walRecordSize(data[off:])
+		if !ok {
+			break
+		}
+		if err := fs.applyWALRecord(data[off : off+n]); err != nil {
+			return err
+		}
+		off += n
+	}
+
+	fs.wal.size = int64(off)
+	if off < len(data) && !fs.readOnly {
+		if err := fs.truncateWAL(int64(off)); err != nil {
+			return fmt.Errorf("truncate WAL: %w", err)
+		}
+	}
+	return nil
+}
+
+// Returns the size of the record at the start of `data`, and whether it's
+// whole and its checksum matches.
+func walRecordSize(data []byte) (int, bool) {
+	if len(data) < WAL_RECORD_HEADER {
+		return 0, false
+	}
+
+	npages := int(binary.LittleEndian.Uint32(data[0:]))
+	n := WAL_RECORD_HEADER + npages*(8+PAGE_SIZE) + 4
+	if n > len(data) {
+		return 0, false
+	}
+
+	sum := binary.LittleEndian.Uint32(data[n-4:])
+	return n, crc32.ChecksumIEEE(data[:n-4]) == sum
+}
+
+// Applies a committed record.
+func (fs *fileStore) applyWALRecord(rec []byte) error {
+	npages := int(binary.LittleEndian.Uint32(rec[0:]))
+	root := binary.LittleEndian.Uint64(rec[4:])
+	used := binary.LittleEndian.Uint64(rec[12:])
+	free := binary.LittleEndian.Uint64(rec[20:])
+	commit := binary.LittleEndian.Uint64(rec[28:])
+	if used < 1 || fs.filePage(root) >= used || free >= used {
+		return fmt.Errorf("%w: WAL record with %d pages used, root %d, free list %d", ErrBadFile, used, root, free)
+	}
+
+	for i := range npages {
+		pos := WAL_RECORD_HEADER + i*(8+PAGE_SIZE)
+		ptr := binary.LittleEndian.Uint64(rec[pos:])
+		if ptr == 0 || ptr >= used {
+			return fmt.Errorf("%w: WAL record with page %d of %d", ErrBadFile, ptr, used)
+		}
+		page := rec[pos+8 : pos+8+PAGE_SIZE]
+		if fs.cipher != nil {
+			sealed := page
+			page = make([]byte, PAGE_SIZE)
+			if err := fs.cipher.open(ptr, sealed, page); err != nil {
+				return err
+			}
+		}
+		fs.wal.pages[ptr] = page
+		fs.wal.dirty[ptr] = true
+	}
+
+	fs.root = root
+	fs.page.flushed = used
+	fs.free.head = free
+	fs.commit = commit
+	return nil
+}
+
+// Encodes the pages of the update, sealed by `seal`, and the meta page after
+// it.
+func encodeWALRecord(root, used, free, commit uint64, pages map[uint64][]byte, seal func(uint64, []byte) []byte) []byte {
+	var ptrs []uint64
+	for ptr, page := range pages {
+		if page != nil {
+			ptrs = append(ptrs, ptr)
+		}
+	}
+	slices.Sort(ptrs)
+
+	rec := make([]byte, WAL_RECORD_HEADER, WAL_RECORD_HEADER+len(ptrs)*(8+PAGE_SIZE)+4)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(len(ptrs)))
+	binary.LittleEndian.PutUint64(rec[4:], root)
+	binary.LittleEndian.PutUint64(rec[12:], used)
+	binary.LittleEndian.PutUint64(rec[20:], free)
+	binary.LittleEndian.PutUint64(rec[28:], commit)
+	for _, ptr := range ptrs {
+		rec = binary.LittleEndian.AppendUint64(rec, ptr)
+		rec = append(rec, seal(ptr, pages[ptr])...)
+	}
+	return binary.LittleEndian.AppendUint32(rec, crc32.ChecksumIEEE(rec))
+}
+
+// Commits the update by appending it to the WAL, then checkpoints if the WAL
+// got large enough.
+func (fs *fileStore) logPages(root uint64) error {
+	used := fs.page.flushed + uint64(fs.page.nappend)
+	rec := encodeWALRecord(root, used, fs.free.head, fs.commit+1, fs.page.updates, fs.sealPage)
+
+	err := func() error {
+		fs.io.bytes.Add(uint64(len(rec)))
+		if _, err := fs.retry.WriteAt(fs.wal.fp, rec, fs.wal.size); err != nil {
+			return fmt.Errorf("write WAL: %w", err)
+		}
+		return fs.syncFile(fs.wal.fp)
+	}()
+	if err != nil {
+		fs.truncateWAL(fs.wal.size)
+		return err
+	}
+
+	fs.wal.size += int64(len(rec))
+	for ptr, page := range fs.page.updates {
+		if page != nil {
+			fs.wal.pages[ptr] = page
+			fs.wal.dirty[ptr] = true
+		}
+	}
+	fs.root = root
+	fs.page.flushed = used
+	fs.commit++
+	fs.Abort()
+
+	if len(fs.wal.pages) >= WAL_CHECKPOINT_PAGES || fs.memory().full() {
+		// the update is committed already, a failed checkpoint is tried again
+		// after the next one
+		fs.checkpoint()
+	}
+	return nil
+}
+
+// Checkpoints the WAL, see `KV.Checkpoint`.
+func (fs *fileStore) Checkpoint() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.wal == nil {
+		return nil
+	}
+	return fs.checkpoint()
+}
+
+// Writes the pages of the WAL into the database file with the meta page,
+// then empties the WAL. The pages written ahead by the flusher are only
+// synced.
+func (fs *fileStore) checkpoint() error {
+	if fs.wal.size == 0 {
+		return nil
+	}
+
+	pages := make(map[uint64][]byte, len(fs.wal.dirty))
+	for ptr := range fs.wal.dirty {
+		pages[ptr] = fs.wal.pages[ptr]
+	}
+	if err := fs.writePages(pages, int(fs.page.flushed)); err != nil {
+		return err
+	}
+	if err := fs.syncFile(fs.fp); err != nil {
+		return err
+	}
+	if err := fs.storeMeta(); err != nil {
+		return err
+	}
+	if err := fs.syncFile(fs.fp); err != nil {
+		return err
+	}
+
+	if err := fs.truncateWAL(0); err != nil {
+		return fmt.Errorf("truncate WAL: %w", err)
+	}
+	if err := fs.syncFile(fs.wal.fp); err != nil {
+		return err
+	}
+
+	fs.wal.size = 0
+	clear(fs.wal.pages)
+	clear(fs.wal.dirty)
+	return nil
+}
+
+// Cuts the WAL at `size`.
+func (fs *fileStore) truncateWAL(size int64) error {
+	return fs.retry.Do(func() error { return fs.wal.fp.Truncate(size) })
+}
@@ -0,0 +1,129 @@
+package kv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Closes the files of the database without a checkpoint, or marking the file
+// closed, like a crash after the last commit.
+func crashKV(db *KV) {
+	fs, ok := db.store.(*fileStore)
+	if !ok {
+		fs = db.store.(*compressStore).fileStore
+	}
+	fs.stopFlusher()
+	fs.meta.marked = false
+	if fs.wal != nil {
+		fs.wal.fp.Close()
+		fs.wal = nil
+	}
+	db.Close()
+}
+
+func walSize(t *testing.T, path string) int64 {
+	t.Helper()
+	fi, err := os.Stat(path + WAL_SUFFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+// Updates committed to the WAL survive a crash, a record cut short is
+// dropped, and checkpoints move the pages into the database file.
+func TestWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	open := func() *KV {
+		t.Helper()
+		db := &KV{Path: path, WAL: true}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(db.Close)
+		return db
+	}
+
+	db := open()
+	want := map[string]string{}
+	for i := range 200 {
+		key := fmt.Sprintf("key%05d", i)
+		if err := db.Set([]byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = key
+	}
+	// only the meta page of the empty tree, written on creation
+	if page, err := os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if meta, err := pickMeta(page[:PAGE_SIZE]); err != nil || binary.LittleEndian.Uint64(meta[16:]) != 0 {
+		t.Fatalf("database file committed to before a checkpoint: %v", err)
+	}
+	crashKV(db)
+
+	db = open()
+	checkKV(t, db, want)
+
+	// the last record is cut short, it's dropped on open
+	size := walSize(t, path)
+	if err := db.Set([]byte("lost"), []byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	crashKV(db)
+	if err := os.Truncate(path+WAL_SUFFIX, walSize(t, path)-10); err != nil {
+		t.Fatal(err)
+	}
+
+	db = open()
+	checkKV(t, db, want)
+	if _, ok := db.Get([]byte("lost")); ok {
+		t.Fatal("found a key from a damaged record")
+	}
+	if got := walSize(t, path); got != size {
+		t.Fatalf("WAL of %d bytes after the replay, want %d", got, size)
+	}
+
+	// enough pages for checkpoints
+	for i := range 3000 {
+		key := fmt.Sprintf("key%05d", i%1000)
+		val := fmt.Sprintf("val%d", i)
+		if err := db.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = val
+	}
+	if fs := db.store.(*fileStore); len(fs.wal.pages) >= WAL_CHECKPOINT_PAGES {
+		t.Fatalf("%d pages in the WAL", len(fs.wal.pages))
+	}
+	crashKV(db)
+
+	db = open()
+	checkKV(t, db, want)
+	if err := db.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// closing checkpoints what's left, and a database opened without a WAL
+	// removes it
+	db.Close()
+	if size := walSize(t, path); size != 0 {
+		t.Fatalf("WAL of %d bytes after closing", size)
+	}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("key00000"), []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	want["key00000"] = "again"
+	crashKV(db)
+
+	db = openTestKV(t, path)
+	checkKV(t, db, want)
+	if _, err := os.Stat(path + WAL_SUFFIX); !os.IsNotExist(err) {
+		t.Fatalf("WAL left: %v", err)
+	}
+}
@@ -5,8 +5,14 @@ import (
 	"math/rand/v2"
 	"os"
 	"path/filepath"
+
+	"db/kv"
 )
 
+// The policy the `SaveData` helpers retry their writes and renames with, tests
+// may swap it. Their fsyncs are never retried, see `kv.RetryPolicy`.
+var SaveRetry = kv.DEFAULT_RETRY
+
 func SaveData1(path string, data []byte) error {
 	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
@@ -14,7 +20,7 @@ func SaveData1(path string, data []byte) error {
 	}
 	defer fp.Close()
 
-	if _, err = fp.Write(data); err != nil {
+	if _, err = SaveRetry.Write(fp, data); err != nil {
 		return err
 	}
 
@@ -35,7 +41,7 @@ func SaveData2(path string, data []byte) error {
 		}
 	}()
 
-	if _, err = fp.Write(data); err != nil {
+	if _, err = SaveRetry.Write(fp, data); err != nil {
 		return err
 	}
 
@@ -43,7 +49,8 @@ func SaveData2(path string, data []byte) error {
 		return err
 	}
 
-	return os.Rename(tmp, path)
+	err = SaveRetry.Do(func() error { return os.Rename(tmp, path) })
+	return err
 }
 
 func SaveData3(path string, data []byte) error {
@@ -53,7 +60,7 @@ func SaveData3(path string, data []byte) error {
 		return err
 	}
 
-	if _, err = fp.Write(data); err != nil {
+	if _, err = SaveRetry.Write(fp, data); err != nil {
 		fp.Close()
 		return err
 	}
@@ -64,19 +71,12 @@ func SaveData3(path string, data []byte) error {
 	}
 
 	fp.Close()
-	if err = os.Rename(tmp, path); err != nil {
+	if err = SaveRetry.Do(func() error { return os.Rename(tmp, path) }); err != nil {
 		os.Remove(tmp)
 		return err
 	}
 
-	parentDir := filepath.Dir(path)
-	fp, err = os.Open(parentDir)
-	if err != nil {
-		return err
-	}
-	defer fp.Close()
-
-	return fp.Sync()
+	return kv.SyncDir(filepath.Dir(path))
 }
 
 func main() {}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveData(t *testing.T) {
+	dir := t.TempDir()
+	for i, save := range []func(string, []byte) error{SaveData1, SaveData2, SaveData3} {
+		path := filepath.Join(dir, "data")
+		data := []byte{byte(i), 'x', 'y'}
+		if err := save(path, data); err != nil {
+			t.Fatalf("SaveData%d: %v", i+1, err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil || string(got) != string(data) {
+			t.Fatalf("SaveData%d: read %q, %v", i+1, got, err)
+		}
+	}
+
+	// no temporary file is left behind
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("%d files in the directory", len(entries))
+	}
+}